@@ -0,0 +1,203 @@
+// This file provides blob stores, to keep big documents (like state
+// jsons) outside database items, which are limited in size.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// blobStore stores immutable blobs by key.
+type blobStore interface {
+	// put stores data at key. Does nothing if key is already stored.
+	put(key string, data []byte) error
+
+	// get returns the data stored at key.
+	get(key string) ([]byte, error)
+}
+
+// newBlobStore creates the blob store for the given url, which
+// may be "s3://bucket/optional/prefix" or "file:///local/directory".
+func newBlobStore(sess *session.Session, url string) (blobStore, error) {
+	switch {
+	case strings.HasPrefix(url, "s3://"):
+		path := strings.SplitN(strings.TrimPrefix(url, "s3://"), "/", 2)
+		store := &s3BlobStore{svc: s3.New(sess), bucket: path[0]}
+		if len(path) == 2 {
+			store.prefix = strings.Trim(path[1], "/")
+		}
+		if store.bucket == "" {
+			return nil, fmt.Errorf("no bucket given in '%s'", url)
+		}
+		return store, nil
+
+	case strings.HasPrefix(url, "file://"):
+		dir := strings.TrimPrefix(url, "file://")
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, fmt.Errorf("can't make directory '%s': %v", dir, err)
+		}
+		return &dirBlobStore{dir}, nil
+
+	default:
+		return nil, fmt.Errorf("invalid blob store '%s': must start with s3:// or file://", url)
+	}
+}
+
+// s3BlobStore stores blobs in a s3 bucket.
+type s3BlobStore struct {
+	svc    *s3.S3
+	bucket string
+	prefix string
+}
+
+func (store *s3BlobStore) objectKey(key string) string {
+	if store.prefix == "" {
+		return key
+	}
+	return store.prefix + "/" + key
+}
+
+func (store *s3BlobStore) put(key string, data []byte) error {
+	_, err := store.svc.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(store.bucket),
+		Key:    aws.String(store.objectKey(key)),
+	})
+	if err == nil {
+		return nil // already stored
+	}
+	if errAws, ok := err.(awserr.Error); !ok || errAws.Code() != "NotFound" {
+		return fmt.Errorf("can't get object head data for %s:%s: %v", store.bucket, store.objectKey(key), err)
+	}
+
+	_, err = store.svc.PutObject(&s3.PutObjectInput{
+		Bucket: aws.String(store.bucket),
+		Key:    aws.String(store.objectKey(key)),
+		Body:   bytes.NewReader(data),
+	})
+	if err != nil {
+		return fmt.Errorf("can't put object %s:%s: %v", store.bucket, store.objectKey(key), err)
+	}
+	return nil
+}
+
+func (store *s3BlobStore) get(key string) ([]byte, error) {
+	output, err := store.svc.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(store.bucket),
+		Key:    aws.String(store.objectKey(key)),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("can't get object %s:%s: %v", store.bucket, store.objectKey(key), err)
+	}
+	defer output.Body.Close()
+	return ioutil.ReadAll(output.Body)
+}
+
+// dirBlobStore stores blobs as files in a local directory.
+type dirBlobStore struct {
+	dir string
+}
+
+func (store *dirBlobStore) put(key string, data []byte) error {
+	path := filepath.Join(store.dir, filepath.FromSlash(key))
+	if _, err := os.Stat(path); err == nil {
+		return nil // already stored
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	// Write to a temporary file first, so a blob is never partially written.
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (store *dirBlobStore) get(key string) ([]byte, error) {
+	return ioutil.ReadFile(filepath.Join(store.dir, filepath.FromSlash(key)))
+}
+
+// Documents offloading
+
+// useBlobStore makes the database keep the documents bigger than
+// threshold bytes in the given blob store.
+func (db *database) useBlobStore(store blobStore, threshold int) {
+	db.blobs = store
+	db.blobThreshold = threshold
+}
+
+// offloadDocument stores doc compressed in the blob store if it's too big to
+// keep it inline. Returns the blob reference (or "" if it's not offloaded)
+// and the document to keep inline. Blobs are keyed by content hash, so
+// identical documents are stored once.
+func (db *database) offloadDocument(doc string) (ref string, inline string, err error) {
+	if db.blobs == nil || len(doc) <= db.blobThreshold {
+		return "", doc, nil
+	}
+
+	hash := sha256.Sum256([]byte(doc))
+	ref = "sha256/" + hex.EncodeToString(hash[:]) + ".json.gz"
+
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	if _, err := writer.Write([]byte(doc)); err != nil {
+		return "", "", err
+	}
+	if err := writer.Close(); err != nil {
+		return "", "", err
+	}
+
+	if err := db.blobs.put(ref, compressed.Bytes()); err != nil {
+		return "", "", fmt.Errorf("can't store blob %s: %v", ref, err)
+	}
+	return ref, "", nil
+}
+
+// loadDocument returns the document referenced by ref,
+// or the inline document if there's no reference.
+func (db *database) loadDocument(ref string, inline string) (string, error) {
+	if ref == "" {
+		return inline, nil
+	}
+	if db.blobs == nil {
+		return "", fmt.Errorf("document stored in blob %s, but no blob store configured", ref)
+	}
+
+	compressed, err := db.blobs.get(ref)
+	if err != nil {
+		return "", fmt.Errorf("can't get blob %s: %v", ref, err)
+	}
+
+	reader, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return "", fmt.Errorf("can't decompress blob %s: %v", ref, err)
+	}
+	defer reader.Close()
+	doc, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return "", fmt.Errorf("can't decompress blob %s: %v", ref, err)
+	}
+	return string(doc), nil
+}
@@ -5,27 +5,169 @@
 package main
 
 import (
+	"encoding/xml"
 	"fmt"
 	"github.com/acarl005/stripansi"
 	"io/ioutil"
-	"math/rand"
 	"os"
 	"os/exec"
 	"reflect"
-	"strconv"
+	"regexp"
 	"strings"
+	"time"
 )
 
 // ComplianceResult contains the information extracted from a compliance output.
 type ComplianceResult struct {
-	Initialized      bool                // if this struct was generated parsing something or is uninitialized
-	Error            bool                // if some error occurred during parsing
-	ErrorMessage     string              // if the above is true, the error
-	FeaturesResult   map[string]bool     // for each feature, true if passed or false otherwise.
-	FeaturesFailures map[string][]string // for each failed feature, lists all the error messages.
-	PassCount        int                 // the number of tests passing
-	FailCount        int                 // the number of tests failing
-	TestCount        int                 // the total number of tests
+	Initialized       bool                // if this struct was generated parsing something or is uninitialized
+	Error             bool                // if some error occurred during parsing
+	ErrorMessage      string              // if the above is true, the error
+	FeaturesResult    map[string]bool     // for each feature, true if passed or false otherwise.
+	FeaturesFailures  map[string][]string // for each failed feature, lists all the error messages.
+	PassCount         int                 // the number of tests passing
+	FailCount         int                 // the number of tests failing
+	TestCount         int                 // the total number of tests
+	Findings          []ComplianceFinding // every failure, with the scenario, step and resource it's about
+	SeverityCounts    map[string]int      // for each severity, the number of failing features
+	BlockingFailCount int                 // the number of failing blocking features (see ComplianceFeature.Enforcement)
+	WaivedCount       int                 // the number of waived failures (see Waiver)
+	FeatureRevisions  map[string]int64    // for each evaluated feature, its evaluated revision (see FeatureRevision)
+}
+
+// applyWaivers marks the findings waived by the given waivers (the ones applying to the
+// checked state and active at the given time), which don't fail their features anymore.
+func (co *ComplianceResult) applyWaivers(waivers []*Waiver, state *TFState, now time.Time) {
+	var applying []*Waiver
+	for _, w := range waivers {
+		if w.active(now) && w.appliesTo(state) {
+			applying = append(applying, w)
+		}
+	}
+	if len(applying) == 0 {
+		return
+	}
+
+	failures := make(map[string][]string) // the not waived failures of each feature
+	for i, finding := range co.Findings {
+		for _, w := range applying {
+			if w.waives(finding) {
+				co.Findings[i].WaiverId = w.Id
+				co.WaivedCount++
+				break
+			}
+		}
+		if co.Findings[i].WaiverId == "" {
+			failures[finding.Feature] = append(failures[finding.Feature], finding.Message)
+		}
+	}
+
+	co.PassCount, co.FailCount = 0, 0
+	for feature := range co.FeaturesResult {
+		co.FeaturesResult[feature] = len(failures[feature]) == 0
+		co.FeaturesFailures[feature] = append(make([]string, 0), failures[feature]...)
+		if co.FeaturesResult[feature] {
+			co.PassCount++
+		} else {
+			co.FailCount++
+		}
+	}
+}
+
+// classify fills the severity counts and blocking failures of the result,
+// according to the given features (the evaluated ones).
+func (co *ComplianceResult) classify(features []*ComplianceFeature) {
+	byName := make(map[string]*ComplianceFeature)
+	for _, f := range features {
+		byName[f.Name] = f
+	}
+
+	co.SeverityCounts = make(map[string]int)
+	co.BlockingFailCount = 0
+	for name, passing := range co.FeaturesResult {
+		if passing {
+			continue
+		}
+		f, ok := byName[name]
+		if !ok { // not expected, but consider it with the defaults
+			f = &ComplianceFeature{Name: name}
+		}
+		co.SeverityCounts[featureSeverity(f)]++
+		if featureEnforcement(f) == enforcementBlocking {
+			co.BlockingFailCount++
+		}
+	}
+
+	for i := range co.Findings {
+		if f, ok := byName[co.Findings[i].Feature]; ok {
+			co.Findings[i].Severity = featureSeverity(f)
+		}
+	}
+}
+
+// passed returns true if the result can be parsed and no blocking feature failed.
+func (co ComplianceResult) passed() bool {
+	return !co.Error && co.BlockingFailCount == 0
+}
+
+// failedWithSeverity returns true if any feature with the given severity or higher failed.
+func (co ComplianceResult) failedWithSeverity(minSeverity string) bool {
+	if co.SeverityCounts == nil { // results classified before severities existed
+		return co.FailCount > 0
+	}
+	for severity, count := range co.SeverityCounts {
+		if count > 0 && severityLevel(severity) >= severityLevel(minSeverity) {
+			return true
+		}
+	}
+	return false
+}
+
+// ComplianceFinding is a failure of a feature, as structured as the compliance output allows.
+type ComplianceFinding struct {
+	Feature         string // the feature name
+	Scenario        string // the scenario name, if known
+	Step            string // the failing step (like "Then it must contain tags"), if known
+	ResourceAddress string // the address of the failing resource (like "module.m.aws_instance.i"), if known
+	ResourceType    string // the type of the failing resource, if known
+	Message         string // the failure message
+	Severity        string // the severity of the feature
+	WaiverId        string // the waiver of this failure, if waived
+}
+
+var (
+	// the resources in failure messages, like "aws_instance.example (aws_instance)"
+	findingResourceRegexp = regexp.MustCompile(`((?:module\.[^\s.]+\.)*(?:data\.)?[a-z0-9]+_[a-z0-9_]*\.[^\s.():,]+) \(([^)]+)\)`)
+	// messages starting with the resource address, like "aws_instance.example: no tags"
+	findingAddressRegexp = regexp.MustCompile(`^((?:module\.[^\s.]+\.)*(?:data\.)?[a-z0-9]+_[a-z0-9_]*\.[^\s.():,]+)`)
+	resourceTypeRegexp   = regexp.MustCompile(`^[a-z0-9]+_[a-z0-9_]*$`)
+)
+
+// newComplianceFinding returns the finding for the given failure message,
+// extracting the resource it's about from the message.
+func newComplianceFinding(feature, scenario, step, message string) ComplianceFinding {
+	finding := ComplianceFinding{Feature: feature, Scenario: scenario, Step: step, Message: message}
+	if groups := findingResourceRegexp.FindStringSubmatch(message); groups != nil {
+		finding.ResourceAddress = groups[1]
+		if resourceTypeRegexp.MatchString(groups[2]) { // may be like "resource that supports tags"
+			finding.ResourceType = groups[2]
+		}
+	} else if groups := findingAddressRegexp.FindStringSubmatch(message); groups != nil {
+		finding.ResourceAddress = groups[1]
+	}
+
+	if finding.ResourceAddress != "" && finding.ResourceType == "" {
+		// the type is the address part before the name, ignoring modules.
+		parts := strings.Split(finding.ResourceAddress, ".")
+		for len(parts) > 2 && (parts[0] == "module" || parts[0] == "data") {
+			if parts[0] == "module" {
+				parts = parts[2:]
+			} else {
+				parts = parts[1:]
+			}
+		}
+		finding.ResourceType = parts[0]
+	}
+	return finding
 }
 
 func cmpSlices(a, b []string) bool {
@@ -64,16 +206,51 @@ func (co ComplianceResult) equals(other ComplianceResult) bool {
 		mapOfSlicesEq(co.FeaturesFailures, other.FeaturesFailures)
 }
 
-// parseComplianceOutput takes an output of the tool and extracts the useful
-// information (ie which features passed and which failed) in a structured way.
-func parseComplianceOutput(output string) ComplianceResult {
-	currentFeature := "" // current iterating feature
-
+// newComplianceResult returns the result of evaluating the given features (by name), which
+// failed with the given findings. It's an error if no features were evaluated at all, with
+// the given output in the message.
+func newComplianceResult(features []string, findings []ComplianceFinding, output string) ComplianceResult {
 	result := ComplianceResult{}
 	result.Initialized = true
 	result.FeaturesResult = make(map[string]bool)
 	result.FeaturesFailures = make(map[string][]string)
+	for _, name := range features {
+		result.FeaturesResult[name] = true // until a failure is found
+		result.FeaturesFailures[name] = make([]string, 0)
+	}
+	for _, finding := range findings {
+		result.FeaturesResult[finding.Feature] = false
+		result.FeaturesFailures[finding.Feature] = append(result.FeaturesFailures[finding.Feature], finding.Message)
+	}
+	result.Findings = findings
+
+	for _, passing := range result.FeaturesResult {
+		if passing {
+			result.PassCount++
+		} else {
+			result.FailCount++
+		}
+		result.TestCount++
+	}
+
+	if result.TestCount == 0 {
+		result.Error = true
+		result.ErrorMessage = "No tests parsed.\nOutput:\n" + stripansi.Strip(output)
+	}
+
+	return result
+}
+
+// parseComplianceOutput takes an output of the tool and extracts the useful
+// information (ie which features passed and which failed) in a structured way.
+// It's the fallback when the tool doesn't give its JUnit report (see parseComplianceJUnit).
+func parseComplianceOutput(output string) ComplianceResult {
+	currentFeature := "" // current iterating feature
+	currentScenario := ""
+	currentStep := ""
 
+	var features []string
+	var findings []ComplianceFinding
 	lines := strings.Split(output, "\n")
 	for _, l := range lines {
 		if strings.HasPrefix(l, "Feature:") {
@@ -85,36 +262,101 @@ func parseComplianceOutput(output string) ComplianceResult {
 			currentFeature = strings.TrimSpace(fields[1])
 			currentFeature = extractNameFromPath(currentFeature)
 			currentFeature = strings.TrimSuffix(currentFeature, ".feature")
-			result.FeaturesResult[currentFeature] = true // true. Later may encounter a failure and set to false
-			result.FeaturesFailures[currentFeature] = make([]string, 0)
+			features = append(features, currentFeature)
+			currentScenario, currentStep = "", ""
 		} else {
 			if currentFeature != "" {
 				trimmed := strings.TrimSpace(l)
-				if strings.HasPrefix(trimmed, "Failure:") && len(strings.Split(trimmed, ":")) == 2 {
-					errorMessage := strings.TrimSpace(strings.Split(trimmed, ":")[1])
-
-					result.FeaturesResult[currentFeature] = false
-					result.FeaturesFailures[currentFeature] = append(result.FeaturesFailures[currentFeature], errorMessage)
+				if strings.HasPrefix(trimmed, "Failure:") {
+					errorMessage := strings.TrimSpace(strings.TrimPrefix(trimmed, "Failure:"))
+					findings = append(findings, newComplianceFinding(currentFeature, currentScenario, currentStep, errorMessage))
+				} else if strings.HasPrefix(trimmed, "Scenario:") || strings.HasPrefix(trimmed, "Scenario Outline:") {
+					currentScenario = strings.TrimSpace(trimmed[strings.Index(trimmed, ":")+1:])
+					currentStep = ""
+				} else if isStepLine(trimmed) {
+					currentStep = trimmed
 				}
 			}
 		}
 	}
 
-	for _, passing := range result.FeaturesResult {
-		if passing {
-			result.PassCount++
-		} else {
-			result.FailCount++
+	return newComplianceResult(features, findings, output)
+}
+
+// complianceJUnit is the JUnit XML report of terraform-compliance (written by radish,
+// the BDD tool it runs on, with --junit-xml): a test suite per feature, named as its
+// title, with a test case per scenario. The failures don't tell their step.
+type complianceJUnit struct {
+	Suites []struct {
+		Name  string `xml:"name,attr"`
+		Cases []struct {
+			Name     string `xml:"name,attr"`
+			Failures []struct {
+				Message string `xml:"message,attr"` // the failure messages, a line each
+			} `xml:"failure"`
+		} `xml:"testcase"`
+	} `xml:"testsuite"`
+}
+
+// parseComplianceJUnit returns the failures in the given JUnit report of the tool, which
+// evaluated the given features. Returns false if the report can't be read or doesn't match
+// the features (the suites are matched by title, so they must be unique).
+func parseComplianceJUnit(report []byte, features []*ComplianceFeature) ([]ComplianceFinding, bool) {
+	var junit complianceJUnit
+	if err := xml.Unmarshal(report, &junit); err != nil {
+		return nil, false
+	}
+
+	byTitle := make(map[string]string) // the feature names by title
+	for _, f := range features {
+		title := featureTitle(f.Source)
+		if _, ok := byTitle[title]; ok {
+			return nil, false
 		}
-		result.TestCount++
+		byTitle[title] = f.Name
+	}
+	if len(junit.Suites) != len(byTitle) {
+		return nil, false
 	}
 
-	if result.TestCount == 0 {
-		result.Error = true
-		result.ErrorMessage = "No tests parsed.\nOutput:\n" + stripansi.Strip(output)
+	var findings []ComplianceFinding
+	for _, suite := range junit.Suites {
+		name, ok := byTitle[strings.TrimSpace(stripansi.Strip(suite.Name))]
+		if !ok {
+			return nil, false
+		}
+		for _, c := range suite.Cases {
+			for _, failure := range c.Failures {
+				for _, line := range strings.Split(stripansi.Strip(failure.Message), "\n") {
+					message := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(line), "Failure:"))
+					if message != "" {
+						findings = append(findings, newComplianceFinding(name, c.Name, "", message))
+					}
+				}
+			}
+		}
 	}
+	return findings, true
+}
 
-	return result
+// featureTitle returns the title of the given gherkin source (the text after "Feature:").
+func featureTitle(source string) string {
+	for _, line := range strings.Split(source, "\n") {
+		if l := strings.TrimSpace(line); strings.HasPrefix(l, "Feature:") {
+			return strings.TrimSpace(strings.TrimPrefix(l, "Feature:"))
+		}
+	}
+	return ""
+}
+
+// isStepLine returns true if the given (trimmed) line of the compliance output is a step.
+func isStepLine(line string) bool {
+	for _, keyword := range []string{"Given ", "When ", "Then ", "And ", "But "} {
+		if strings.HasPrefix(line, keyword) {
+			return true
+		}
+	}
+	return false
 }
 
 // getFeaturesForTags returns only the features that
@@ -146,24 +388,48 @@ func getEnabledFeaturesContainingTags(features []*ComplianceFeature, tags []stri
 	return result
 }
 
-// runComplianceToolForTags runs the compliance tool using only
-// the features from db that contains any of the given tags.
-func runComplianceToolForTags(db *database, fileContent []byte, tags []string) (string, string, error) {
+// runComplianceToolForTags runs the compliance tool using only the features from db
+// that contains any of the given tags. Returns the tool input, output and its result,
+// with the failures waived for the checked state (nil for plans) marked as such.
+func runComplianceToolForTags(db *database, fileContent []byte, tags []string, state *TFState) (string, string, ComplianceResult, error) {
 	allFeatures, err := db.loadAllFeaturesFull()
 	if err != nil {
-		return "", "", fmt.Errorf("can't get features from db: %v", err)
+		return "", "", ComplianceResult{}, fmt.Errorf("can't get features from db: %v", err)
+	}
+	waivers, err := db.loadAllWaivers()
+	if err != nil {
+		return "", "", ComplianceResult{}, fmt.Errorf("can't get waivers from db: %v", err)
 	}
 
 	features := getEnabledFeaturesContainingTags(allFeatures, tags)
-	return runComplianceTool(fileContent, features)
+	return evaluateFeatures(fileContent, features, waivers, state)
+}
+
+// evaluateFeatures runs the compliance tool with the given features, and returns the tool
+// input, output and its result, with the failures waived for the checked state marked as such.
+func evaluateFeatures(fileContent []byte, features []*ComplianceFeature, waivers []*Waiver, state *TFState) (string, string, ComplianceResult, error) {
+	input, output, result, err := runComplianceTool(fileContent, features)
+	if err != nil {
+		return "", "", ComplianceResult{}, err
+	}
+
+	result.applyWaivers(waivers, state, time.Now())
+	result.classify(features)
+	result.FeatureRevisions = make(map[string]int64)
+	for _, f := range features {
+		if f.Version > 0 { // previewed features aren't saved
+			result.FeatureRevisions[f.Name] = f.Version
+		}
+	}
+	return input, output, result, nil
 }
 
-// runComplianceTool runs the tfComplianceBin against the given file content.
-// fileContent may be either a json string, or a terraform binary file format.
-// Returns the input and output of the tool if successful.
-func runComplianceTool(fileContent []byte, features []*ComplianceFeature) (string, string, error) {
+// runComplianceTool evaluates the given features against the given file content, with
+// the engine of each feature (see featureEngine), or with OPA for rego features. fileContent may be either a json string,
+// or a terraform binary file format. Returns the input and output of the engines, and their result, if successful.
+func runComplianceTool(fileContent []byte, features []*ComplianceFeature) (string, string, ComplianceResult, error) {
 	if len(fileContent) == 0 {
-		return "", "", fmt.Errorf("empty file content")
+		return "", "", ComplianceResult{}, fmt.Errorf("empty file content")
 	}
 
 	var complianceToolInput []byte
@@ -175,43 +441,117 @@ func runComplianceTool(fileContent []byte, features []*ComplianceFeature) (strin
 	if fileContent[0] != '{' {
 		asJson, err := convertTerraformBinToJSON(fileContent)
 		if err != nil {
-			return "", "", fmt.Errorf("cntent given can't be converted to json: %v", err)
+			return "", "", ComplianceResult{}, fmt.Errorf("cntent given can't be converted to json: %w", err)
 		}
 		complianceToolInput = []byte(asJson)
 	} else {
 		complianceToolInput = fileContent
 	}
 
-	// Everything written to this directory
-	baseDirectory := os.TempDir() + "/" + strconv.FormatUint(rand.Uint64(), 16)
-	if err := os.Mkdir(baseDirectory, os.ModePerm); err != nil {
-		return "", "", fmt.Errorf("can't make tmp dir: %v", err)
+	var toolFeatures, nativeFeatures, regoFeatures []*ComplianceFeature
+	for _, f := range features {
+		if featureLanguage(f) == languageRego {
+			regoFeatures = append(regoFeatures, f)
+		} else if featureEngine(f) == engineNative {
+			nativeFeatures = append(nativeFeatures, f)
+		} else {
+			toolFeatures = append(toolFeatures, f)
+		}
 	}
-	defer os.RemoveAll(baseDirectory)
-	inputJSONPath := baseDirectory + "/compliance_input.json"
-	featuresPath := baseDirectory + "/features"
 
-	// Write input file
-	if err := ioutil.WriteFile(inputJSONPath, complianceToolInput, os.ModePerm); err != nil {
-		return "", "", fmt.Errorf("can't create tmp file: %v", err)
+	output := ""
+	var evaluated []string // the names of the evaluated features
+	var findings []ComplianceFinding
+	// with no features at all, the tool still runs to give its output as usual.
+	if len(toolFeatures) > 0 || len(nativeFeatures)+len(regoFeatures) == 0 {
+		toolOutput, toolFindings, ok, err := execComplianceTool(complianceToolInput, toolFeatures)
+		if err != nil {
+			return "", "", ComplianceResult{}, err
+		}
+		output += toolOutput
+		if ok {
+			for _, f := range toolFeatures {
+				evaluated = append(evaluated, f.Name)
+			}
+			findings = append(findings, toolFindings...)
+		} else {
+			toolResult := parseComplianceOutput(toolOutput)
+			if toolResult.Error {
+				return string(complianceToolInput), output, toolResult, nil
+			}
+			for name := range toolResult.FeaturesResult {
+				evaluated = append(evaluated, name)
+			}
+			findings = append(findings, toolResult.Findings...)
+		}
 	}
-
-	// Write features directory
-	if err := makeAndFillFeaturesDirectory(featuresPath, features); err != nil {
-		return "", "", fmt.Errorf("can't write features to directory %s: %v", baseDirectory, err)
+	if len(nativeFeatures) > 0 {
+		nativeOutput, nativeFindings, err := runNativeEngine(complianceToolInput, nativeFeatures)
+		if err != nil {
+			return "", "", ComplianceResult{}, fmt.Errorf("can't run native engine: %v", err)
+		}
+		output += nativeOutput
+		for _, f := range nativeFeatures {
+			evaluated = append(evaluated, f.Name)
+		}
+		findings = append(findings, nativeFindings...)
 	}
-
-	// run the compliance tool against the created file
-	toolOutputBytes, err := exec.Command("terraform-compliance", "-p", inputJSONPath, "-f", featuresPath).CombinedOutput()
-	toolOutput := stripansi.Strip(string(toolOutputBytes))
-	if err != nil {
-		_, ok := err.(*exec.ExitError)
-		if !ok { // ignore exit code errors, compliance throws them all the time.
-			return "", "", fmt.Errorf("bad tool exit code (%v) output: %v", err, toolOutput)
+	if len(regoFeatures) > 0 {
+		regoOutput, regoFindings, err := runRegoEngine(complianceToolInput, regoFeatures)
+		if err != nil {
+			return "", "", ComplianceResult{}, fmt.Errorf("can't run rego policies: %v", err)
+		}
+		output += regoOutput
+		for _, f := range regoFeatures {
+			evaluated = append(evaluated, f.Name)
 		}
+		findings = append(findings, regoFindings...)
 	}
 
-	return string(complianceToolInput), toolOutput, nil
+	return string(complianceToolInput), output, newComplianceResult(evaluated, findings, output), nil
+}
+
+// execComplianceTool runs terraform-compliance with the given features against the given json.
+// Returns its output, and the failures in its JUnit report, if it could be read (false otherwise,
+// to parse the output instead). Runs in the tool pool, so returns errToolPoolSaturated if it's full.
+func execComplianceTool(complianceToolInput []byte, features []*ComplianceFeature) (string, []ComplianceFinding, bool, error) {
+	var toolOutput string
+	var findings []ComplianceFinding
+	junitRead := false
+	err := toolWorkers.runInWorkspace(func(baseDirectory string) error {
+		// Everything written to this directory
+		inputJSONPath := baseDirectory + "/compliance_input.json"
+		featuresPath := baseDirectory + "/features"
+		junitPath := baseDirectory + "/junit.xml"
+
+		// Write input file
+		if err := ioutil.WriteFile(inputJSONPath, complianceToolInput, os.ModePerm); err != nil {
+			return fmt.Errorf("can't create tmp file: %v", err)
+		}
+
+		// Write features directory
+		if err := makeAndFillFeaturesDirectory(featuresPath, features); err != nil {
+			return fmt.Errorf("can't write features to directory %s: %v", baseDirectory, err)
+		}
+
+		// run the compliance tool against the created file (the unknown arguments go to radish)
+		cmd := exec.Command("terraform-compliance", "-p", inputJSONPath, "-f", featuresPath, "--junit-xml="+junitPath)
+		cmd.Dir = baseDirectory
+		toolOutputBytes, err := cmd.CombinedOutput()
+		toolOutput = stripansi.Strip(string(toolOutputBytes))
+		if err != nil {
+			_, ok := err.(*exec.ExitError)
+			if !ok { // ignore exit code errors, compliance throws them all the time.
+				return fmt.Errorf("bad tool exit code (%v) output: %v", err, toolOutput)
+			}
+		}
+
+		if report, err := ioutil.ReadFile(junitPath); err == nil {
+			findings, junitRead = parseComplianceJUnit(report, features)
+		}
+		return nil
+	})
+	return toolOutput, findings, junitRead, err
 }
 
 // makeAndFillFeaturesDirectory writes all the feature files that terraform-compliance requires.
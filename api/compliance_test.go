@@ -2,6 +2,10 @@ package main
 
 import (
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -90,3 +94,163 @@ terraform-compliance v1.0.37 initiated
         | environment | ^(prod|uat|dev)$ |
           Failure: aws_instance.example2 (resource that supports tags) does not have environment property.
 `
+
+func TestComplianceFindings(t *testing.T) {
+	got := parseComplianceOutput(`Feature: Resources should be tagged  # /tmp/features/tags.feature
+
+    Scenario: Ensure all resources have tags
+        Given I have resource that supports tags defined
+        Then it must contain tags
+          Failure: module.m.aws_instance.example (resource that supports tags) does not have tags property.
+
+Feature: Buckets  # /tmp/features/buckets.feature
+
+    Scenario: deny
+          Failure: data.aws_s3_bucket.b: acl is public-read
+          Failure: something failed
+`)
+
+	assert.Equal(t, []ComplianceFinding{
+		{
+			Feature:         "tags",
+			Scenario:        "Ensure all resources have tags",
+			Step:            "Then it must contain tags",
+			ResourceAddress: "module.m.aws_instance.example",
+			ResourceType:    "aws_instance",
+			Message:         "module.m.aws_instance.example (resource that supports tags) does not have tags property.",
+		},
+		{
+			Feature:         "buckets",
+			Scenario:        "deny",
+			ResourceAddress: "data.aws_s3_bucket.b",
+			ResourceType:    "aws_s3_bucket",
+			Message:         "data.aws_s3_bucket.b: acl is public-read",
+		},
+		{
+			Feature:  "buckets",
+			Scenario: "deny",
+			Message:  "something failed",
+		},
+	}, got.Findings)
+	assert.Equal(t, []string{"data.aws_s3_bucket.b: acl is public-read", "something failed"}, got.FeaturesFailures["buckets"], "messages with colons")
+}
+
+// complianceTestJUnit is a report as radish writes it for the features of complianceTestFeatures.
+const complianceTestJUnit = `<?xml version='1.0' encoding='utf-8'?>
+<testsuites time="0.04">
+  <testsuite name="Resources should be tagged" failures="1" errors="0" skipped="0" tests="2" time="0.03">
+    <testcase classname="Resources should be tagged" name="Ensure all resources have tags" time="0.01">
+      <failure type="Failure" message="aws_instance.example (aws_instance) does not have tags property.&#10;module.m.aws_instance.other (resource that supports tags) does not have tags property."><![CDATA[Given I have resource that supports tags defined
+Then it must contain tags]]></failure>
+    </testcase>
+    <testcase classname="Resources should be tagged" name="Ensure that specific tags are defined" time="0.02"/>
+  </testsuite>
+  <testsuite name="Zones are listed" failures="0" errors="0" skipped="1" tests="1" time="0.01">
+    <testcase classname="Zones are listed" name="Subnet Count" time="0.01">
+      <skipped/>
+    </testcase>
+  </testsuite>
+</testsuites>
+`
+
+func complianceTestFeatures() []*ComplianceFeature {
+	return []*ComplianceFeature{
+		newFeature("tags", "@tagged\nFeature: Resources should be tagged\n  Scenario: Ensure all resources have tags\n", nil),
+		newFeature("zones", "Feature: Zones are listed\n  Scenario: Subnet Count\n", nil),
+	}
+}
+
+func TestParseComplianceJUnit(t *testing.T) {
+	findings, ok := parseComplianceJUnit([]byte(complianceTestJUnit), complianceTestFeatures())
+	require.True(t, ok)
+	assert.Equal(t, []ComplianceFinding{
+		{
+			Feature:         "tags",
+			Scenario:        "Ensure all resources have tags",
+			ResourceAddress: "aws_instance.example",
+			ResourceType:    "aws_instance",
+			Message:         "aws_instance.example (aws_instance) does not have tags property.",
+		},
+		{
+			Feature:         "tags",
+			Scenario:        "Ensure all resources have tags",
+			ResourceAddress: "module.m.aws_instance.other",
+			ResourceType:    "aws_instance",
+			Message:         "module.m.aws_instance.other (resource that supports tags) does not have tags property.",
+		},
+	}, findings)
+
+	_, ok = parseComplianceJUnit([]byte("not xml"), complianceTestFeatures())
+	assert.False(t, ok, "invalid report")
+	_, ok = parseComplianceJUnit([]byte(complianceTestJUnit), complianceTestFeatures()[:1])
+	assert.False(t, ok, "other features")
+	sameTitle := complianceTestFeatures()
+	sameTitle[1].Source = sameTitle[0].Source
+	_, ok = parseComplianceJUnit([]byte(complianceTestJUnit), sameTitle)
+	assert.False(t, ok, "ambiguous titles")
+}
+
+func TestComplianceToolJUnit(t *testing.T) {
+	// a fake terraform-compliance that writes the report given in its --junit-xml argument
+	binDir, err := ioutil.TempDir("", "bin")
+	require.Nil(t, err)
+	defer os.RemoveAll(binDir)
+	reportPath := filepath.Join(binDir, "junit.xml")
+	require.Nil(t, ioutil.WriteFile(reportPath, []byte(complianceTestJUnit), 0644))
+	script := "#!/bin/sh\nfor arg; do case $arg in --junit-xml=*) cp " + reportPath + " ${arg#--junit-xml=};; esac; done\necho 'not the usual output'\n"
+	require.Nil(t, ioutil.WriteFile(filepath.Join(binDir, "terraform-compliance"), []byte(script), 0755))
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	require.Nil(t, os.Setenv("PATH", binDir+string(os.PathListSeparator)+os.Getenv("PATH")))
+
+	features := complianceTestFeatures()
+	for _, f := range features {
+		f.Engine = engineTerraformCompliance
+	}
+	_, output, result, err := runComplianceTool([]byte("{}"), features)
+	require.Nil(t, err)
+	assert.Equal(t, "not the usual output\n", output)
+	assert.False(t, result.Error, result.ErrorMessage)
+	assert.Equal(t, map[string]bool{"tags": false, "zones": true}, result.FeaturesResult)
+	assert.Len(t, result.Findings, 2)
+
+	// without the report, the output is parsed
+	require.Nil(t, os.Remove(reportPath))
+	_, _, result, err = runComplianceTool([]byte("{}"), features)
+	require.Nil(t, err)
+	assert.True(t, result.Error)
+	assert.Contains(t, result.ErrorMessage, "not the usual output")
+}
+
+func TestComplianceResultSeverities(t *testing.T) {
+	critical := newFeature("critical", "", nil)
+	critical.Severity = "critical"
+	critical.Enforcement = enforcementAdvisory
+	low := newFeature("low", "", nil)
+	low.Severity = "low"
+	passing := newFeature("passing", "", nil)
+	passing.Severity = "high"
+
+	result := ComplianceResult{
+		FeaturesResult: map[string]bool{"critical": false, "low": false, "passing": true},
+		FailCount:      2,
+		Findings:       []ComplianceFinding{{Feature: "low", Message: "m"}},
+	}
+	result.classify([]*ComplianceFeature{critical, low, passing})
+
+	assert.Equal(t, map[string]int{"critical": 1, "low": 1}, result.SeverityCounts)
+	assert.Equal(t, 1, result.BlockingFailCount)
+	assert.Equal(t, "low", result.Findings[0].Severity)
+	assert.False(t, result.passed())
+	assert.True(t, result.failedWithSeverity("high"))
+
+	low.Enforcement = enforcementAdvisory
+	result.classify([]*ComplianceFeature{critical, low, passing})
+	assert.True(t, result.passed(), "advisory failures pass")
+
+	critical.Severity = "medium"
+	result.classify([]*ComplianceFeature{critical, low, passing})
+	assert.False(t, result.failedWithSeverity("high"))
+	assert.True(t, result.failedWithSeverity("info"))
+
+	assert.True(t, ComplianceResult{FailCount: 1}.failedWithSeverity("critical"), "unclassified results")
+}
@@ -1,29 +1,131 @@
 // This file provides an easy-to-use interface to store and
-// retrieve some items from a DynamoDB database, without
-// having to worry about DynamoDB-specific code.
+// retrieve some items from a database, without having to
+// worry about backend-specific code (DynamoDB, bolt...).
 
 package main
 
 import (
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/awserr"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/dynamodb"
-	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
-	"github.com/aws/aws-sdk-go/service/dynamodb/expression"
-	"log"
-	"strings"
-	"time"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
 )
 
+// storage is implemented by every persistence backend. Items are
+// structs identified by their "Id" attribute, and versioned by their
+// "Version" attribute. Tables are created on demand by initTable.
+type storage interface {
+	// initTable creates tableName if it does not exists, along with
+	// the given secondary indexes (also created for existing tables).
+	initTable(tableName string, indexes []tableIndex) error
+
+	// put inserts or updates the given item on the table, only if the stored
+	// item Version is prevVersion (items that aren't stored, or were stored
+	// without version, are at version 0). Otherwise returns errConflict.
+	put(tableName string, item interface{}, prevVersion int64) error
+
+	// scan calls onItemLoaded for each item in the table that matches the
+	// filter (all items if filter is nil). Only "Id", "Timestamp", "Version",
+	// "SchemaVersion" and the given attributes are loaded. Items are loaded in pages: scan loads
+	// one page starting at cursor ("" for the first one), with up to limit
+	// items (0 lets the backend choose), and returns the cursor to the next
+	// page, or "" if there are no more items.
+	scan(
+		tableName string,
+		attributes []string,
+		filter *itemFilter,
+		limit int,
+		cursor string,
+		onItemLoaded func(itemDecoder) error,
+	) (nextCursor string, err error)
+
+	// get loads the item in the given table whose Id equals id. Only "Id", "Timestamp",
+	// "Version", "SchemaVersion" and the given attributes are loaded. Returns a nil decoder if there's no such item.
+	get(tableName string, id string, attributes []string) (itemDecoder, error)
+
+	// query is like scan, but loads the items that match the given index query,
+	// ordered by the index range key in descending order.
+	query(
+		tableName string,
+		q indexQuery,
+		attributes []string,
+		limit int,
+		cursor string,
+		onItemLoaded func(itemDecoder) error,
+	) (nextCursor string, err error)
+
+	// remove removes the item in the given table whose Id equals id.
+	remove(tableName string, id string) error
+}
+
+// errConflict is returned when saving an item that was updated since it was loaded.
+var errConflict = errors.New("the item was updated concurrently")
+
+// tableIndex defines a secondary index, to query items by hashKey
+// sorted by rangeKey. Items that lack the hashKey attribute are
+// not indexed.
+type tableIndex struct {
+	name     string
+	hashKey  string // a string attribute
+	rangeKey string // an optional number attribute
+}
+
+// ttlStorage is implemented by backends that can expire items by themselves.
+type ttlStorage interface {
+	// enableTTL makes the backend remove (eventually) the items of
+	// the table whose given attribute, an unix timestamp, is past.
+	enableTTL(tableName string, attribute string) error
+}
+
+// tableIndexes lists the secondary indexes of each table (without prefix).
+var tableIndexes = map[string][]tableIndex{
+	complianceFeatureTable: {featureNameIndex},
+	validationLogTable:     {logKindIndex},
+	tfStateTable:           {tfStateForceValidationIndex},
+	tfStateRevisionTable:   {tfStateRevisionIndex},
+	featureRevisionTable:   {featureRevisionIndex},
+}
+
+// tableTTLAttributes lists the TTL attribute of the tables (without prefix) whose items expire.
+var tableTTLAttributes = map[string]string{
+	validationLogTable: logExpiresAtAttribute,
+}
+
+// indexQuery matches the items whose index hash key equals hashValue.
+// If rangeBefore is not 0, only items whose range key is lower are matched.
+type indexQuery struct {
+	index       tableIndex
+	hashValue   string
+	rangeBefore int64
+}
+
+// itemDecoder unmarshals a loaded item into dst, which must be a pointer to a struct.
+type itemDecoder func(dst interface{}) error
+
+// itemFilter matches items whose attribute equals value.
+type itemFilter struct {
+	attribute string
+	value     interface{}
+}
+
+// attributeEquals returns a filter for items whose attribute equals value.
+func attributeEquals(attribute string, value interface{}) *itemFilter {
+	return &itemFilter{attribute, value}
+}
+
 type database struct {
-	svc         *dynamodb.DynamoDB
-	tablePrefix string
+	storage       storage
+	tablePrefix   string
+	blobs         blobStore // where big documents are offloaded (nil = keep them inline)
+	blobThreshold int       // documents bigger than this (in bytes) are offloaded
+	logRetention  logRetentionPolicy
 }
 
-// newDynamoDB creates a DynamoDB instance using the default aws authentication method.
-func newDynamoDB(sess *session.Session, tablePrefix string) *database {
-	return &database{dynamodb.New(sess), tablePrefix}
+// newDatabase creates a database on top of the given storage backend.
+func newDatabase(storage storage, tablePrefix string) *database {
+	return &database{storage: storage, tablePrefix: tablePrefix}
 }
 
 // tableFor returns the full database table ({prefix}_{name}).
@@ -31,137 +133,304 @@ func (db *database) tableFor(name string) string {
 	return db.tablePrefix + "_" + name
 }
 
-// initTable creates tableName on the given database if it does not exists.
-func (db *database) initTable(tableName string) error {
-	input := &dynamodb.CreateTableInput{
-		AttributeDefinitions: []*dynamodb.AttributeDefinition{
-			{
-				AttributeName: aws.String("Id"),
-				AttributeType: aws.String("S"),
-			},
-		},
-		KeySchema: []*dynamodb.KeySchemaElement{
-			{
-				AttributeName: aws.String("Id"),
-				KeyType:       aws.String("HASH"),
-			},
-		},
-		ProvisionedThroughput: &dynamodb.ProvisionedThroughput{
-			ReadCapacityUnits:  aws.Int64(5),
-			WriteCapacityUnits: aws.Int64(5),
-		},
-		TableName: aws.String(tableName),
-	}
-
-	_, err := db.svc.CreateTable(input)
-	if err != nil {
-		errAws := err.(awserr.Error)
-		if strings.Contains(errAws.Message(), "Table already exists") {
-			// ignore this error.
-		} else {
-			return err
+// insertOrUpdateGeneric inserts or updates the given item on the table. version must
+// point to the item Version, which is increased when saved. If the stored item is at
+// other version (ie. it was updated since loaded), returns errConflict and the item is
+// not saved. In that case, the caller should reload the item and try again.
+func (db *database) insertOrUpdateGeneric(tableName string, item interface{}, version *int64) error {
+	prevVersion := *version
+	*version = prevVersion + 1
+	if err := db.storage.put(tableName, item, prevVersion); err != nil {
+		*version = prevVersion
+		return err
+	}
+	return nil
+}
+
+// loadGeneric loads all items from a table, filtering with the given
+// filter only if it's not nil.
+func (db *database) loadGeneric(
+	tableName string,
+	attributes []string, // list of the item attribute names (apart from the ones always loaded, like "Id")
+	filter *itemFilter, // an optional filter for elements
+	onItemLoaded func(itemDecoder) error, // called for each loaded item
+) error {
+	_, err := db.loadGenericPage(tableName, attributes, filter, 0, "", onItemLoaded)
+	return err
+}
+
+// loadGenericPage is like loadGeneric, but loads up to limit items (or all
+// of them, if limit is 0) starting at the given cursor. Returns the cursor
+// to load the next items from, or "" if all the items were loaded.
+func (db *database) loadGenericPage(
+	tableName string,
+	attributes []string,
+	filter *itemFilter,
+	limit int,
+	cursor string,
+	onItemLoaded func(itemDecoder) error,
+) (string, error) {
+	return loadPages(limit, cursor, onItemLoaded,
+		func(pageLimit int, pageCursor string, onPageItemLoaded func(itemDecoder) error) (string, error) {
+			return db.storage.scan(tableName, attributes, filter, pageLimit, pageCursor, onPageItemLoaded)
+		})
+}
+
+// queryGenericPage is like loadGenericPage, but loads the items matching
+// the given index query, sorted by the index range key (descending).
+func (db *database) queryGenericPage(
+	tableName string,
+	q indexQuery,
+	attributes []string,
+	limit int,
+	cursor string,
+	onItemLoaded func(itemDecoder) error,
+) (string, error) {
+	return loadPages(limit, cursor, onItemLoaded,
+		func(pageLimit int, pageCursor string, onPageItemLoaded func(itemDecoder) error) (string, error) {
+			return db.storage.query(tableName, q, attributes, pageLimit, pageCursor, onPageItemLoaded)
+		})
+}
+
+// getGeneric loads the item whose Id equals id into dst. Returns false if there's no such item.
+func (db *database) getGeneric(tableName string, id string, attributes []string, dst interface{}) (bool, error) {
+	decode, err := db.storage.get(tableName, id, attributes)
+	if err != nil || decode == nil {
+		return false, err
+	}
+	if err := decode(dst); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// loadPages calls loadPage to load up to limit items (all if 0) starting at cursor,
+// and returns the cursor to the next items ("" if there are no more).
+func loadPages(
+	limit int,
+	cursor string,
+	onItemLoaded func(itemDecoder) error,
+	loadPage func(limit int, cursor string, onItemLoaded func(itemDecoder) error) (string, error),
+) (string, error) {
+	loaded := 0
+	for {
+		pageLimit := 0
+		if limit > 0 {
+			pageLimit = limit - loaded
+		}
+
+		nextCursor, err := loadPage(pageLimit, cursor,
+			func(decode itemDecoder) error {
+				loaded++
+				return onItemLoaded(decode)
+			})
+		if err != nil {
+			return "", err
+		}
+
+		// A page may have less items than requested (for example when filtering),
+		// so keep going until the limit is reached or there are no more pages.
+		cursor = nextCursor
+		if cursor == "" || (limit > 0 && loaded >= limit) {
+			return cursor, nil
 		}
-	} else {
-		// The table is being created. If an upcoming query to this table follows this
-		// call immediately, may fail because the table is not yet created. Wait a few seconds.
-		log.Printf("Sleep 5 sec to wait until table '%s' is created in DynamoDB...", tableName)
-		time.Sleep(5 * time.Second)
-		log.Printf("Done!")
 	}
+}
+
+// removeGeneric removes all the items in the given table whose Id equals id.
+func (db *database) removeGeneric(tableName string, id string) error {
+	return db.storage.remove(tableName, id)
+}
 
+// initTables will ensure all the necessary tables exists.
+// tables should omit the prefix.
+func (db *database) initTables(tables ...string) error {
+	for _, table := range tables {
+		if err := db.storage.initTable(db.tableFor(table), tableIndexes[table]); err != nil {
+			return err
+		}
+		if attribute, ok := tableTTLAttributes[table]; ok {
+			if s, ok := db.storage.(ttlStorage); ok {
+				if err := s.enableTTL(db.tableFor(table), attribute); err != nil {
+					return err
+				}
+			}
+		}
+	}
 	return nil
 }
 
-// insertOrUpdateGeneric inserts or updates the given item on the table.
-func (db *database) insertOrUpdateGeneric(tableName string, item interface{}) error {
-	av, err := dynamodbattribute.MarshalMap(item)
+// Helpers for backends that store items as JSON documents.
+
+// encodeCursor encodes the given key as an opaque cursor.
+func encodeCursor(key []byte) string {
+	return base64.RawURLEncoding.EncodeToString(key)
+}
+
+// decodeCursor decodes a cursor generated by encodeCursor.
+func decodeCursor(cursor string) ([]byte, error) {
+	key, err := base64.RawURLEncoding.DecodeString(cursor)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("invalid cursor '%s': %v", cursor, err)
 	}
+	return key, nil
+}
 
-	input := &dynamodb.PutItemInput{
-		Item:      av,
-		TableName: aws.String(tableName),
-	}
-	_, err = db.svc.PutItem(input)
+// encodeJSONItem marshals item as a JSON document, and returns it along with its Id.
+func encodeJSONItem(item interface{}) (id string, encoded []byte, err error) {
+	encoded, err = json.Marshal(item)
 	if err != nil {
-		return err
+		return "", nil, err
 	}
 
-	return nil
+	var fields struct{ Id string }
+	if err := json.Unmarshal(encoded, &fields); err != nil {
+		return "", nil, err
+	}
+	if fields.Id == "" {
+		return "", nil, fmt.Errorf("item has no Id")
+	}
+
+	return fields.Id, encoded, nil
 }
 
-// loadGeneric loads all items from a table, filtering with the given
-// condition only if useCondition flag is true.
-func (db *database) loadGeneric(
-	tableName string,
-	attributes []string, // list of the item attribute names (apart from "Id" and "Timestamp")
-	useCondition bool,
-	condition expression.ConditionBuilder, // an optional filter for elements
-	onItemLoaded func(map[string]*dynamodb.AttributeValue) error, // called for each loaded item
-) error {
-	projection := expression.NamesList(expression.Name("Id"), expression.Name("Timestamp"))
-	for _, attr := range attributes {
-		projection = projection.AddNames(expression.Name(attr))
+// checkJSONItemVersion returns errConflict if the given stored JSON document
+// (nil if not stored) is not at prevVersion, as storage.put requires.
+func checkJSONItemVersion(stored []byte, prevVersion int64) error {
+	var fields struct{ Version int64 }
+	if stored != nil {
+		if err := json.Unmarshal(stored, &fields); err != nil {
+			return err
+		}
 	}
-
-	builder := expression.NewBuilder().WithProjection(projection)
-	if useCondition {
-		builder = builder.WithFilter(condition)
+	if fields.Version != prevVersion {
+		return errConflict
 	}
+	return nil
+}
 
-	expr, err := builder.Build()
-	if err != nil {
-		return err
+// decodeJSONItem returns whether the given JSON document matches the filter,
+// and a decoder that only loads "Id", "Timestamp", "Version", "SchemaVersion" and the given attributes.
+func decodeJSONItem(encoded []byte, attributes []string, filter *itemFilter) (bool, itemDecoder, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(encoded, &fields); err != nil {
+		return false, nil, err
 	}
 
-	params := &dynamodb.ScanInput{
-		ExpressionAttributeNames:  expr.Names(),
-		ExpressionAttributeValues: expr.Values(),
-		FilterExpression:          expr.Filter(),
-		ProjectionExpression:      expr.Projection(),
-		TableName:                 aws.String(tableName),
+	if filter != nil {
+		expected, err := json.Marshal(filter.value)
+		if err != nil {
+			return false, nil, err
+		}
+		if !bytes.Equal(fields[filter.attribute], expected) {
+			return false, nil, nil
+		}
 	}
 
-	result, err := db.svc.Scan(params)
-	if err != nil {
-		return err
+	projected := make(map[string]json.RawMessage)
+	for _, attr := range append([]string{"Id", "Timestamp", "Version", "SchemaVersion"}, attributes...) {
+		if value, ok := fields[attr]; ok {
+			projected[attr] = value
+		}
 	}
 
-	for _, i := range result.Items {
-		if err := onItemLoaded(i); err != nil {
+	decoder := func(dst interface{}) error {
+		asJSON, err := json.Marshal(projected)
+		if err != nil {
 			return err
 		}
+		return json.Unmarshal(asJSON, dst)
 	}
-	return nil
+
+	return true, decoder, nil
 }
 
-// removeGeneric removes all the items in the given table whose Id equals id.
-func (db *database) removeGeneric(tableName string, id string) error {
-	input := &dynamodb.DeleteItemInput{
-		Key: map[string]*dynamodb.AttributeValue{
-			"Id": {
-				S: aws.String(id),
-			},
-		},
-		TableName: aws.String(tableName),
+// jsonQueryItem is a JSON document that matches an index query.
+type jsonQueryItem struct {
+	id         string
+	rangeValue int64
+	encoded    []byte
+}
+
+// matchJSONQuery returns the given JSON document as a jsonQueryItem, if it matches the query.
+func matchJSONQuery(encoded []byte, q indexQuery) (*jsonQueryItem, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(encoded, &fields); err != nil {
+		return nil, err
 	}
 
-	_, err := db.svc.DeleteItem(input)
-	if err != nil {
-		return err
+	var hashValue string
+	if raw, ok := fields[q.index.hashKey]; !ok || json.Unmarshal(raw, &hashValue) != nil || hashValue != q.hashValue {
+		return nil, nil
 	}
 
-	return nil
+	item := &jsonQueryItem{encoded: encoded}
+	if err := json.Unmarshal(fields["Id"], &item.id); err != nil {
+		return nil, err
+	}
+	if q.index.rangeKey != "" {
+		if err := json.Unmarshal(fields[q.index.rangeKey], &item.rangeValue); err != nil {
+			return nil, nil // not indexed
+		}
+		if q.rangeBefore != 0 && item.rangeValue >= q.rangeBefore {
+			return nil, nil
+		}
+	}
+	return item, nil
 }
 
-// initTables will ensure all the necessary DynamoDB tables exists.
-// tables should omit the prefix.
-func (db *database) initTables(tables ...string) error {
-	for _, table := range tables {
-		if err := db.initTable(db.tableFor(table)); err != nil {
-			return err
+// queryJSONItems loads a page of the given query matches, as storage.query does.
+// The cursor is the range value and id of the last loaded item.
+func queryJSONItems(
+	matches []*jsonQueryItem,
+	attributes []string,
+	limit int,
+	cursor string,
+	onItemLoaded func(itemDecoder) error,
+) (string, error) {
+	// descending by range key, and by id when they're equal.
+	after := func(a *jsonQueryItem, rangeValue int64, id string) bool {
+		return a.rangeValue < rangeValue || (a.rangeValue == rangeValue && a.id < id)
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		return after(matches[j], matches[i].rangeValue, matches[i].id)
+	})
+
+	if cursor != "" {
+		key, err := decodeCursor(cursor)
+		if err != nil {
+			return "", err
 		}
+		var last struct {
+			Range int64
+			Id    string
+		}
+		if err := json.Unmarshal(key, &last); err != nil {
+			return "", fmt.Errorf("invalid cursor '%s': %v", cursor, err)
+		}
+		start := sort.Search(len(matches), func(i int) bool { return after(matches[i], last.Range, last.Id) })
+		matches = matches[start:]
 	}
-	return nil
+
+	nextCursor := ""
+	if limit > 0 && len(matches) > limit {
+		last := matches[limit-1]
+		key, err := json.Marshal(map[string]interface{}{"Range": last.rangeValue, "Id": last.id})
+		if err != nil {
+			return "", err
+		}
+		nextCursor = encodeCursor(key)
+		matches = matches[:limit]
+	}
+
+	for _, item := range matches {
+		_, decoder, err := decodeJSONItem(item.encoded, attributes, nil)
+		if err != nil {
+			return "", err
+		}
+		if err := onItemLoaded(decoder); err != nil {
+			return "", err
+		}
+	}
+	return nextCursor, nil
 }
@@ -0,0 +1,185 @@
+// This file implements the storage interface on top of an embedded
+// bolt database, so the validator can run without AWS persistence.
+
+package main
+
+import (
+	"bytes"
+	bolt "go.etcd.io/bbolt"
+	"time"
+)
+
+// boltStorage stores each table as a bolt bucket, and
+// each item as a JSON document keyed by its Id.
+type boltStorage struct {
+	db *bolt.DB
+}
+
+// newBoltDB opens (or creates) the bolt database file at path.
+func newBoltDB(path string, tablePrefix string) (*database, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	return newDatabase(&boltStorage{db}, tablePrefix), nil
+}
+
+// initTable creates the bucket for tableName if it does not exists.
+// Indexes are not stored; queries go through all the bucket items.
+func (s *boltStorage) initTable(tableName string, _ []tableIndex) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(tableName))
+		return err
+	})
+}
+
+// put inserts or updates the given item on the table, if it's at prevVersion.
+func (s *boltStorage) put(tableName string, item interface{}, prevVersion int64) error {
+	id, encoded, err := encodeJSONItem(item)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(tableName))
+		if err != nil {
+			return err
+		}
+		if err := checkJSONItemVersion(bucket.Get([]byte(id)), prevVersion); err != nil {
+			return err
+		}
+		return bucket.Put([]byte(id), encoded)
+	})
+}
+
+// scan loads a page of items from a table, filtering with the given filter if not nil.
+// Items are loaded in Id order, and the cursor is the Id of the last loaded item.
+func (s *boltStorage) scan(
+	tableName string,
+	attributes []string,
+	filter *itemFilter,
+	limit int,
+	cursor string,
+	onItemLoaded func(itemDecoder) error,
+) (string, error) {
+	var lastKey []byte
+	if cursor != "" {
+		var err error
+		if lastKey, err = decodeCursor(cursor); err != nil {
+			return "", err
+		}
+	}
+
+	// Take matching items first, so onItemLoaded can use the storage too
+	// (bolt doesn't allow to write while a read transaction is open).
+	nextCursor := ""
+	var decoders []itemDecoder
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(tableName))
+		if bucket == nil {
+			return nil // nothing stored yet
+		}
+
+		c := bucket.Cursor()
+		k, v := c.First()
+		if lastKey != nil {
+			k, v = c.Seek(lastKey)
+			if k != nil && bytes.Equal(k, lastKey) {
+				k, v = c.Next()
+			}
+		}
+
+		loaded := 0
+		for ; k != nil; k, v = c.Next() {
+			if limit > 0 && loaded >= limit {
+				nextCursor = encodeCursor(lastKey)
+				return nil
+			}
+
+			matches, decoder, err := decodeJSONItem(v, attributes, filter)
+			if err != nil {
+				return err
+			}
+			if matches {
+				decoders = append(decoders, decoder)
+				loaded++
+				lastKey = append([]byte{}, k...)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	for _, decoder := range decoders {
+		if err := onItemLoaded(decoder); err != nil {
+			return "", err
+		}
+	}
+	return nextCursor, nil
+}
+
+// get loads the item in the given table whose Id equals id.
+func (s *boltStorage) get(tableName string, id string, attributes []string) (itemDecoder, error) {
+	var decoder itemDecoder
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(tableName))
+		if bucket == nil {
+			return nil
+		}
+
+		encoded := bucket.Get([]byte(id))
+		if encoded == nil {
+			return nil
+		}
+
+		var err error
+		_, decoder, err = decodeJSONItem(encoded, attributes, nil)
+		return err
+	})
+	return decoder, err
+}
+
+// query loads a page of the items that match the given index query.
+func (s *boltStorage) query(
+	tableName string,
+	q indexQuery,
+	attributes []string,
+	limit int,
+	cursor string,
+	onItemLoaded func(itemDecoder) error,
+) (string, error) {
+	var matches []*jsonQueryItem
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(tableName))
+		if bucket == nil {
+			return nil
+		}
+
+		return bucket.ForEach(func(_, v []byte) error {
+			// values are only valid during the transaction.
+			item, err := matchJSONQuery(append([]byte{}, v...), q)
+			if item != nil {
+				matches = append(matches, item)
+			}
+			return err
+		})
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return queryJSONItems(matches, attributes, limit, cursor, onItemLoaded)
+}
+
+// remove removes the item in the given table whose Id equals id.
+func (s *boltStorage) remove(tableName string, id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(tableName))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.Delete([]byte(id))
+	})
+}
@@ -0,0 +1,448 @@
+// This file implements the storage interface on top of DynamoDB.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/dynamodb/expression"
+	"log"
+	"strings"
+	"time"
+)
+
+type dynamoDBStorage struct {
+	svc *dynamodb.DynamoDB
+}
+
+// newDynamoDB creates a DynamoDB instance using the default aws authentication method.
+func newDynamoDB(sess *session.Session, tablePrefix string) *database {
+	return newDatabase(&dynamoDBStorage{dynamodb.New(sess)}, tablePrefix)
+}
+
+// initTable creates tableName on the given database if it does not exists,
+// along with its secondary indexes.
+func (s *dynamoDBStorage) initTable(tableName string, indexes []tableIndex) error {
+	input := &dynamodb.CreateTableInput{
+		AttributeDefinitions: []*dynamodb.AttributeDefinition{
+			{
+				AttributeName: aws.String("Id"),
+				AttributeType: aws.String("S"),
+			},
+		},
+		KeySchema: []*dynamodb.KeySchemaElement{
+			{
+				AttributeName: aws.String("Id"),
+				KeyType:       aws.String("HASH"),
+			},
+		},
+		ProvisionedThroughput: &dynamodb.ProvisionedThroughput{
+			ReadCapacityUnits:  aws.Int64(5),
+			WriteCapacityUnits: aws.Int64(5),
+		},
+		TableName: aws.String(tableName),
+	}
+	for _, index := range indexes {
+		input.AttributeDefinitions = appendAttributeDefinitions(input.AttributeDefinitions, index)
+		input.GlobalSecondaryIndexes = append(input.GlobalSecondaryIndexes, &dynamodb.GlobalSecondaryIndex{
+			IndexName:             aws.String(index.name),
+			KeySchema:             index.keySchema(),
+			Projection:            &dynamodb.Projection{ProjectionType: aws.String("ALL")},
+			ProvisionedThroughput: input.ProvisionedThroughput,
+		})
+	}
+
+	_, err := s.svc.CreateTable(input)
+	if err != nil {
+		errAws := err.(awserr.Error)
+		if strings.Contains(errAws.Message(), "Table already exists") {
+			// The table may be from a version without some indexes.
+			return s.ensureIndexes(tableName, indexes)
+		} else {
+			return err
+		}
+	} else {
+		// The table is being created. If an upcoming query to this table follows this
+		// call immediately, may fail because the table is not yet created. Wait a few seconds.
+		log.Printf("Sleep 5 sec to wait until table '%s' is created in DynamoDB...", tableName)
+		time.Sleep(5 * time.Second)
+		log.Printf("Done!")
+	}
+
+	return nil
+}
+
+// ensureIndexes creates on the existing table the indexes that are missing.
+// DynamoDB creates one index at a time, so waits until each one is active.
+func (s *dynamoDBStorage) ensureIndexes(tableName string, indexes []tableIndex) error {
+	desc, err := s.svc.DescribeTable(&dynamodb.DescribeTableInput{TableName: aws.String(tableName)})
+	if err != nil {
+		return err
+	}
+
+	existing := make(map[string]bool)
+	for _, index := range desc.Table.GlobalSecondaryIndexes {
+		existing[aws.StringValue(index.IndexName)] = true
+	}
+
+	for _, index := range indexes {
+		if existing[index.name] {
+			continue
+		}
+
+		log.Printf("Creating index '%s' on table '%s'...", index.name, tableName)
+		_, err := s.svc.UpdateTable(&dynamodb.UpdateTableInput{
+			TableName:            aws.String(tableName),
+			AttributeDefinitions: appendAttributeDefinitions(nil, index),
+			GlobalSecondaryIndexUpdates: []*dynamodb.GlobalSecondaryIndexUpdate{
+				{
+					Create: &dynamodb.CreateGlobalSecondaryIndexAction{
+						IndexName:  aws.String(index.name),
+						KeySchema:  index.keySchema(),
+						Projection: &dynamodb.Projection{ProjectionType: aws.String("ALL")},
+						ProvisionedThroughput: &dynamodb.ProvisionedThroughput{
+							ReadCapacityUnits:  aws.Int64(5),
+							WriteCapacityUnits: aws.Int64(5),
+						},
+					},
+				},
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("can't create index '%s': %v", index.name, err)
+		}
+
+		if err := s.waitForIndex(tableName, index.name); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// waitForIndex blocks until the given index is active (ie has
+// all the table items and can be queried).
+func (s *dynamoDBStorage) waitForIndex(tableName string, indexName string) error {
+	for {
+		desc, err := s.svc.DescribeTable(&dynamodb.DescribeTableInput{TableName: aws.String(tableName)})
+		if err != nil {
+			return err
+		}
+
+		for _, index := range desc.Table.GlobalSecondaryIndexes {
+			if aws.StringValue(index.IndexName) == indexName &&
+				aws.StringValue(index.IndexStatus) == dynamodb.IndexStatusActive {
+				log.Printf("Index '%s' is active!", indexName)
+				return nil
+			}
+		}
+
+		log.Printf("Sleep 10 sec to wait until index '%s' is active...", indexName)
+		time.Sleep(10 * time.Second)
+	}
+}
+
+// keySchema returns the DynamoDB key schema of the index.
+func (index tableIndex) keySchema() []*dynamodb.KeySchemaElement {
+	schema := []*dynamodb.KeySchemaElement{
+		{
+			AttributeName: aws.String(index.hashKey),
+			KeyType:       aws.String("HASH"),
+		},
+	}
+	if index.rangeKey != "" {
+		schema = append(schema, &dynamodb.KeySchemaElement{
+			AttributeName: aws.String(index.rangeKey),
+			KeyType:       aws.String("RANGE"),
+		})
+	}
+	return schema
+}
+
+// appendAttributeDefinitions appends to definitions the index key attributes not defined yet.
+func appendAttributeDefinitions(definitions []*dynamodb.AttributeDefinition, index tableIndex) []*dynamodb.AttributeDefinition {
+	define := func(name string, attrType string) {
+		for _, d := range definitions {
+			if aws.StringValue(d.AttributeName) == name {
+				return
+			}
+		}
+		definitions = append(definitions, &dynamodb.AttributeDefinition{
+			AttributeName: aws.String(name),
+			AttributeType: aws.String(attrType),
+		})
+	}
+
+	define(index.hashKey, "S")
+	if index.rangeKey != "" {
+		define(index.rangeKey, "N")
+	}
+	return definitions
+}
+
+// put inserts or updates the given item on the table, if it's at prevVersion.
+func (s *dynamoDBStorage) put(tableName string, item interface{}, prevVersion int64) error {
+	av, err := dynamodbattribute.MarshalMap(item)
+	if err != nil {
+		return err
+	}
+
+	condition := expression.Name("Version").Equal(expression.Value(prevVersion))
+	if prevVersion == 0 {
+		condition = expression.AttributeNotExists(expression.Name("Version")).Or(condition)
+	}
+	expr, err := expression.NewBuilder().WithCondition(condition).Build()
+	if err != nil {
+		return err
+	}
+
+	input := &dynamodb.PutItemInput{
+		Item:                      av,
+		TableName:                 aws.String(tableName),
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	}
+	_, err = s.svc.PutItem(input)
+	if err != nil {
+		if errAws, ok := err.(awserr.Error); ok && errAws.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+			return errConflict
+		}
+		return err
+	}
+
+	return nil
+}
+
+// scan loads a page of items from a table, filtering with the given filter if not nil.
+// The cursor is the page LastEvaluatedKey as json.
+func (s *dynamoDBStorage) scan(
+	tableName string,
+	attributes []string,
+	filter *itemFilter,
+	limit int,
+	cursor string,
+	onItemLoaded func(itemDecoder) error,
+) (string, error) {
+	builder := expression.NewBuilder().WithProjection(projectionFor(attributes))
+	if filter != nil {
+		builder = builder.WithFilter(expression.Name(filter.attribute).Equal(expression.Value(filter.value)))
+	}
+
+	expr, err := builder.Build()
+	if err != nil {
+		return "", err
+	}
+
+	params := &dynamodb.ScanInput{
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		FilterExpression:          expr.Filter(),
+		ProjectionExpression:      expr.Projection(),
+		TableName:                 aws.String(tableName),
+	}
+	if limit > 0 {
+		params.Limit = aws.Int64(int64(limit))
+	}
+	if cursor != "" {
+		startKey, err := decodeDynamoDBCursor(cursor)
+		if err != nil {
+			return "", err
+		}
+		params.ExclusiveStartKey = startKey
+	}
+
+	result, err := s.svc.Scan(params)
+	if err != nil {
+		return "", err
+	}
+
+	for _, i := range result.Items {
+		if err := onItemLoaded(dynamoDBItemDecoder(i)); err != nil {
+			return "", err
+		}
+	}
+
+	return encodeDynamoDBCursor(result.LastEvaluatedKey)
+}
+
+// get loads the item in the given table whose Id equals id.
+func (s *dynamoDBStorage) get(tableName string, id string, attributes []string) (itemDecoder, error) {
+	expr, err := expression.NewBuilder().WithProjection(projectionFor(attributes)).Build()
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := s.svc.GetItem(&dynamodb.GetItemInput{
+		Key: map[string]*dynamodb.AttributeValue{
+			"Id": {
+				S: aws.String(id),
+			},
+		},
+		ExpressionAttributeNames: expr.Names(),
+		ProjectionExpression:     expr.Projection(),
+		TableName:                aws.String(tableName),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(result.Item) == 0 {
+		return nil, nil
+	}
+	return dynamoDBItemDecoder(result.Item), nil
+}
+
+// query loads a page of the items that match the given index query.
+func (s *dynamoDBStorage) query(
+	tableName string,
+	q indexQuery,
+	attributes []string,
+	limit int,
+	cursor string,
+	onItemLoaded func(itemDecoder) error,
+) (string, error) {
+	keyCondition := expression.Key(q.index.hashKey).Equal(expression.Value(q.hashValue))
+	if q.rangeBefore != 0 {
+		keyCondition = keyCondition.And(expression.Key(q.index.rangeKey).LessThan(expression.Value(q.rangeBefore)))
+	}
+
+	expr, err := expression.NewBuilder().
+		WithKeyCondition(keyCondition).
+		WithProjection(projectionFor(attributes)).
+		Build()
+	if err != nil {
+		return "", err
+	}
+
+	params := &dynamodb.QueryInput{
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		KeyConditionExpression:    expr.KeyCondition(),
+		ProjectionExpression:      expr.Projection(),
+		IndexName:                 aws.String(q.index.name),
+		ScanIndexForward:          aws.Bool(false),
+		TableName:                 aws.String(tableName),
+	}
+	if limit > 0 {
+		params.Limit = aws.Int64(int64(limit))
+	}
+	if cursor != "" {
+		startKey, err := decodeDynamoDBCursor(cursor)
+		if err != nil {
+			return "", err
+		}
+		params.ExclusiveStartKey = startKey
+	}
+
+	result, err := s.svc.Query(params)
+	if err != nil {
+		return "", err
+	}
+
+	for _, i := range result.Items {
+		if err := onItemLoaded(dynamoDBItemDecoder(i)); err != nil {
+			return "", err
+		}
+	}
+
+	return encodeDynamoDBCursor(result.LastEvaluatedKey)
+}
+
+// enableTTL enables DynamoDB Time To Live on the table, using the given attribute.
+func (s *dynamoDBStorage) enableTTL(tableName string, attribute string) error {
+	desc, err := s.svc.DescribeTimeToLive(&dynamodb.DescribeTimeToLiveInput{TableName: aws.String(tableName)})
+	if err != nil {
+		return err
+	}
+
+	status := aws.StringValue(desc.TimeToLiveDescription.TimeToLiveStatus)
+	if aws.StringValue(desc.TimeToLiveDescription.AttributeName) == attribute &&
+		(status == dynamodb.TimeToLiveStatusEnabled || status == dynamodb.TimeToLiveStatusEnabling) {
+		return nil // already enabled
+	}
+
+	log.Printf("Enabling TTL on attribute '%s' of table '%s'...", attribute, tableName)
+	_, err = s.svc.UpdateTimeToLive(&dynamodb.UpdateTimeToLiveInput{
+		TableName: aws.String(tableName),
+		TimeToLiveSpecification: &dynamodb.TimeToLiveSpecification{
+			AttributeName: aws.String(attribute),
+			Enabled:       aws.Bool(true),
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("can't enable TTL on table '%s': %v", tableName, err)
+	}
+	return nil
+}
+
+// remove removes all the items in the given table whose Id equals id.
+func (s *dynamoDBStorage) remove(tableName string, id string) error {
+	input := &dynamodb.DeleteItemInput{
+		Key: map[string]*dynamodb.AttributeValue{
+			"Id": {
+				S: aws.String(id),
+			},
+		},
+		TableName: aws.String(tableName),
+	}
+
+	_, err := s.svc.DeleteItem(input)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// dynamoDBItemDecoder returns a decoder for the given DynamoDB item.
+func dynamoDBItemDecoder(item map[string]*dynamodb.AttributeValue) itemDecoder {
+	return func(dst interface{}) error {
+		return dynamodbattribute.UnmarshalMap(item, dst)
+	}
+}
+
+// encodeDynamoDBCursor encodes the given LastEvaluatedKey as a cursor ("" if there's no key).
+func encodeDynamoDBCursor(key map[string]*dynamodb.AttributeValue) (string, error) {
+	if len(key) == 0 {
+		return "", nil
+	}
+
+	asJSON, err := json.Marshal(key)
+	if err != nil {
+		return "", err
+	}
+	return encodeCursor(asJSON), nil
+}
+
+// decodeDynamoDBCursor decodes a cursor from encodeDynamoDBCursor as an ExclusiveStartKey.
+func decodeDynamoDBCursor(cursor string) (map[string]*dynamodb.AttributeValue, error) {
+	asJSON, err := decodeCursor(cursor)
+	if err != nil {
+		return nil, err
+	}
+
+	var key map[string]*dynamodb.AttributeValue
+	if err := json.Unmarshal(asJSON, &key); err != nil {
+		return nil, fmt.Errorf("invalid cursor '%s': %v", cursor, err)
+	}
+	return key, nil
+}
+
+// projectionFor returns the projection for "Id", "Timestamp", "Version", "SchemaVersion" and the given attributes.
+func projectionFor(attributes []string) expression.ProjectionBuilder {
+	projection := expression.NamesList(
+		expression.Name("Id"),
+		expression.Name("Timestamp"),
+		expression.Name("Version"),
+		expression.Name("SchemaVersion"))
+	for _, attr := range attributes {
+		projection = projection.AddNames(expression.Name(attr))
+	}
+	return projection
+}
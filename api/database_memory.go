@@ -0,0 +1,161 @@
+// This file implements the storage interface in memory. Nothing is
+// persisted, so it's meant for tests and local development.
+
+package main
+
+import (
+	"sort"
+	"sync"
+)
+
+// memoryStorage keeps each item as a JSON document, so loading
+// behaves like the other backends (projections, filters and
+// updates don't share memory with the caller's objects).
+type memoryStorage struct {
+	mu     sync.RWMutex
+	tables map[string]map[string][]byte // table -> id -> item
+}
+
+// newMemoryDB creates an empty in-memory database.
+func newMemoryDB(tablePrefix string) *database {
+	return newDatabase(&memoryStorage{tables: make(map[string]map[string][]byte)}, tablePrefix)
+}
+
+// initTable creates tableName if it does not exists.
+// Indexes are not stored; queries go through all the table items.
+func (s *memoryStorage) initTable(tableName string, _ []tableIndex) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.tables[tableName]; !ok {
+		s.tables[tableName] = make(map[string][]byte)
+	}
+	return nil
+}
+
+// put inserts or updates the given item on the table, if it's at prevVersion.
+func (s *memoryStorage) put(tableName string, item interface{}, prevVersion int64) error {
+	id, encoded, err := encodeJSONItem(item)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	table, ok := s.tables[tableName]
+	if !ok {
+		table = make(map[string][]byte)
+		s.tables[tableName] = table
+	}
+	if err := checkJSONItemVersion(table[id], prevVersion); err != nil {
+		return err
+	}
+	table[id] = encoded
+	return nil
+}
+
+// scan loads a page of items from a table, filtering with the given filter if not nil.
+// Items are loaded in Id order, and the cursor is the Id of the last loaded item.
+func (s *memoryStorage) scan(
+	tableName string,
+	attributes []string,
+	filter *itemFilter,
+	limit int,
+	cursor string,
+	onItemLoaded func(itemDecoder) error,
+) (string, error) {
+	lastId := ""
+	if cursor != "" {
+		key, err := decodeCursor(cursor)
+		if err != nil {
+			return "", err
+		}
+		lastId = string(key)
+	}
+
+	// Take matching items first, so onItemLoaded can use the storage too.
+	s.mu.RLock()
+	table := s.tables[tableName]
+	ids := make([]string, 0, len(table))
+	for id := range table {
+		if id > lastId {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	decoders := make([]itemDecoder, 0, len(ids))
+	nextCursor := ""
+	for _, id := range ids {
+		if limit > 0 && len(decoders) >= limit {
+			nextCursor = encodeCursor([]byte(lastId))
+			break
+		}
+
+		matches, decoder, err := decodeJSONItem(table[id], attributes, filter)
+		if err != nil {
+			s.mu.RUnlock()
+			return "", err
+		}
+		if matches {
+			decoders = append(decoders, decoder)
+			lastId = id
+		}
+	}
+	s.mu.RUnlock()
+
+	for _, decoder := range decoders {
+		if err := onItemLoaded(decoder); err != nil {
+			return "", err
+		}
+	}
+	return nextCursor, nil
+}
+
+// get loads the item in the given table whose Id equals id.
+func (s *memoryStorage) get(tableName string, id string, attributes []string) (itemDecoder, error) {
+	s.mu.RLock()
+	encoded, ok := s.tables[tableName][id]
+	s.mu.RUnlock()
+	if !ok {
+		return nil, nil
+	}
+
+	_, decoder, err := decodeJSONItem(encoded, attributes, nil)
+	return decoder, err
+}
+
+// query loads a page of the items that match the given index query.
+func (s *memoryStorage) query(
+	tableName string,
+	q indexQuery,
+	attributes []string,
+	limit int,
+	cursor string,
+	onItemLoaded func(itemDecoder) error,
+) (string, error) {
+	var matches []*jsonQueryItem
+	s.mu.RLock()
+	for _, encoded := range s.tables[tableName] {
+		item, err := matchJSONQuery(encoded, q)
+		if err != nil {
+			s.mu.RUnlock()
+			return "", err
+		}
+		if item != nil {
+			matches = append(matches, item)
+		}
+	}
+	s.mu.RUnlock()
+
+	return queryJSONItems(matches, attributes, limit, cursor, onItemLoaded)
+}
+
+// remove removes the item in the given table whose Id equals id.
+func (s *memoryStorage) remove(tableName string, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.tables[tableName], id)
+	return nil
+}
@@ -4,6 +4,10 @@ import (
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -54,3 +58,154 @@ func TestDynamoDB(t *testing.T) {
 	require.Nil(t, err, "5: updating check")
 	assert.Equal(t, expected, got, "5: updating check")
 }
+
+// TestBlobOffloading checks that big states are moved to the blob
+// store (deduplicated), and transparently loaded back.
+func TestBlobOffloading(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blobs")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	db := newMemoryDB("test")
+	require.Nil(t, db.initTables(validationLogTable, tfStateTable))
+	store, err := newBlobStore(nil, "file://"+dir)
+	require.Nil(t, err)
+	db.useBlobStore(store, 100)
+
+	bigState := "{\"resources\": \"" + strings.Repeat("x", 200) + "\"}"
+	state := newTFState("acc", "bucket", "path", nil)
+	state.State = bigState
+	require.Nil(t, db.saveTFState(state))
+	assert.Equal(t, bigState, state.State, "saved element must be untouched")
+	l := newTFStateLog(bigState, ComplianceResult{}, "{}", ComplianceResult{}, "", "acc", "bucket", "path")
+	require.Nil(t, db.saveLog(l))
+
+	// Only the reference must be stored in the items.
+	decode, err := db.storage.get(db.tableFor(tfStateTable), state.Id, []string{"State", "StateBlob"})
+	require.Nil(t, err)
+	var stored TFState
+	require.Nil(t, decode(&stored))
+	assert.Equal(t, "", stored.State)
+	assert.NotEqual(t, "", stored.StateBlob)
+
+	// The same state must be stored once.
+	files, err := ioutil.ReadDir(filepath.Join(dir, "sha256"))
+	require.Nil(t, err)
+	assert.Len(t, files, 1)
+
+	gotState, err := db.findTFStateById(state.Id)
+	require.Nil(t, err)
+	assert.Equal(t, bigState, gotState.State)
+	gotLog, err := db.findLogById(l.Id)
+	require.Nil(t, err)
+	assert.Equal(t, bigState, gotLog.StateJSON)
+	assert.Equal(t, "{}", gotLog.PrevStateJSON)
+	assert.Equal(t, "", gotLog.PrevStateJSONBlob, "small documents must be kept inline")
+}
+
+// TestOptimisticConcurrency checks that stale items aren't saved,
+// and that updateTFState merges into the latest state.
+func TestOptimisticConcurrency(t *testing.T) {
+	db := newMemoryDB("test")
+	require.Nil(t, db.initTables(tfStateTable, tfStateRevisionTable))
+
+	state := newTFState("acc", "bucket", "path", nil)
+	require.Nil(t, db.saveTFState(state))
+	assert.Equal(t, int64(1), state.Version)
+
+	first, err := db.findTFStateById(state.Id)
+	require.Nil(t, err)
+	second, err := db.findTFStateById(state.Id)
+	require.Nil(t, err)
+
+	first.Tags = []string{"prod"}
+	require.Nil(t, db.saveTFState(first))
+	second.LastUpdate = "now"
+	assert.Equal(t, errConflict, db.saveTFState(second), "second is stale")
+	assert.Equal(t, int64(1), second.Version, "version must be kept on conflicts")
+
+	// Updates are applied to the latest state
+	require.Nil(t, db.updateTFState(second, func(latest *TFState) bool {
+		latest.LastUpdate = "now"
+		return true
+	}))
+	got, err := db.findTFStateById(state.Id)
+	require.Nil(t, err)
+	assert.Equal(t, []string{"prod"}, got.Tags)
+	assert.Equal(t, "now", got.LastUpdate)
+	assert.Equal(t, int64(3), got.Version)
+}
+
+// TestMigrations checks that items saved by older versions are upgraded.
+func TestMigrations(t *testing.T) {
+	db := newMemoryDB("test")
+	require.Nil(t, db.initTables(complianceFeatureTable, tfStateTable, validationLogTable, tableSchemaTable))
+
+	// Items as saved before tags and kinds
+	require.Nil(t, db.storage.put(db.tableFor(complianceFeatureTable), &ComplianceFeature{Id: "f", Name: "legacy", Source: "s"}, 0))
+	require.Nil(t, db.storage.put(db.tableFor(validationLogTable), &ValidationLog{Id: "l"}, 0))
+	current := newFeature("current", "s", []string{"prod"})
+	require.Nil(t, db.saveFeature(current))
+
+	count, err := db.runMigrations(true)
+	require.Nil(t, err)
+	assert.Equal(t, 2, count)
+	legacy, err := db.findFeatureById("f")
+	require.Nil(t, err)
+	assert.Nil(t, legacy.Tags, "dry run must not change anything")
+
+	count, err = db.runMigrations(false)
+	require.Nil(t, err)
+	assert.Equal(t, 2, count)
+	legacy, err = db.findFeatureById("f")
+	require.Nil(t, err)
+	assert.Equal(t, []string{}, legacy.Tags, "untagged features aren't enrolled in validations")
+	assert.Equal(t, latestSchemaVersion(complianceFeatureTable), legacy.SchemaVersion)
+	l, err := db.findLogById("l")
+	require.Nil(t, err)
+	assert.Equal(t, logKindValidation, l.Kind)
+	got, err := db.findFeatureById(current.Id)
+	require.Nil(t, err)
+	assert.Equal(t, current, got, "current items must be untouched")
+
+	// Migrated tables are skipped
+	count, err = db.runMigrations(false)
+	require.Nil(t, err)
+	assert.Equal(t, 0, count)
+}
+
+// TestBoltScanWrites checks that bolt items can be saved while they're scanned,
+// as the migrations do.
+func TestBoltScanWrites(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bolt")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := newBoltDB(filepath.Join(dir, "test.db"), "test")
+	require.Nil(t, err)
+	require.Nil(t, db.initTables(complianceFeatureTable))
+	for _, name := range []string{"a", "b", "c"} {
+		require.Nil(t, db.saveFeature(newFeature(name, "s", nil)))
+	}
+
+	_, err = db.storage.scan(db.tableFor(complianceFeatureTable), nil, nil, 0, "", func(decode itemDecoder) error {
+		var f ComplianceFeature
+		if err := decode(&f); err != nil {
+			return err
+		}
+		stored, err := db.findFeatureById(f.Id)
+		if err != nil {
+			return err
+		}
+		stored.Source = "updated"
+		return db.saveFeature(stored)
+	})
+	require.Nil(t, err)
+
+	features, err := db.loadAllFeaturesFull()
+	require.Nil(t, err)
+	require.Len(t, features, 3)
+	for _, f := range features {
+		assert.Equal(t, "updated", f.Source)
+	}
+}
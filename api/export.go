@@ -0,0 +1,469 @@
+// This file provides export and import of the validator tables, to
+// back them up or move the configuration between environments.
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// exportFormatVersion is the version of the archive format. Increase it
+// when the format changes in a way that older versions can't import.
+const exportFormatVersion = 1
+
+// configArchive is an export of some tables.
+type configArchive struct {
+	FormatVersion int                        `json:"format_version"`
+	ExportedAt    int64                      `json:"exported_at"`
+	Tables        map[string]json.RawMessage `json:"tables"` // table name -> list of items, as json
+}
+
+// exportTable defines how to export and import the items of a table.
+type exportTable struct {
+	name    string
+	newItem func() restObject
+	loadAll func(db *database) ([]restObject, error) // must clear the blob references
+	key     func(obj restObject) string              // identifies the item across environments
+	save    func(db *database, obj restObject) error
+	insert  func(db *database, obj restObject) error // if given, saves the items not stored yet keeping their Version
+	remove  func(db *database, id string) error
+}
+
+// exportTables lists the exported tables, in import order (an item
+// may reference the ones in previous tables).
+var exportTables = []exportTable{
+	{
+		name:    complianceFeatureTable,
+		newItem: func() restObject { return &ComplianceFeature{} },
+		loadAll: func(db *database) ([]restObject, error) {
+			objs, err := db.loadAllFeaturesFull()
+			result := make([]restObject, len(objs))
+			for i, o := range objs {
+				result[i] = o
+			}
+			return result, err
+		},
+		key:  func(obj restObject) string { return obj.(*ComplianceFeature).Name },
+		save: func(db *database, obj restObject) error { return db.saveFeature(obj.(*ComplianceFeature)) },
+		// the revision numbers of the features are kept, as the logs refer to them
+		insert: func(db *database, obj restObject) error { return db.insertFeature(obj.(*ComplianceFeature)) },
+		remove: func(db *database, id string) error { return db.removeFeature(id) },
+	},
+	{
+		name:    featureRevisionTable,
+		newItem: func() restObject { return &FeatureRevision{} },
+		loadAll: func(db *database) ([]restObject, error) {
+			objs, err := db.loadAllFeatureRevisionsFull()
+			result := make([]restObject, len(objs))
+			for i, o := range objs {
+				result[i] = o
+			}
+			return result, err
+		},
+		key: func(obj restObject) string {
+			// so the revision registered when importing a feature matches the one in the archive
+			revision := obj.(*FeatureRevision)
+			return fmt.Sprintf("%s:%d", revision.FeatureId, revision.Revision)
+		},
+		save:   func(db *database, obj restObject) error { return db.saveFeatureRevision(obj.(*FeatureRevision)) },
+		remove: func(db *database, id string) error { return db.removeFeatureRevision(id) },
+	},
+	{
+		name:    tfStateTable,
+		newItem: func() restObject { return &TFState{} },
+		loadAll: func(db *database) ([]restObject, error) {
+			objs, err := db.loadAllTFStatesFull()
+			result := make([]restObject, len(objs))
+			for i, o := range objs {
+				o.StateBlob = ""
+				result[i] = o
+			}
+			return result, err
+		},
+		key: func(obj restObject) string {
+			state := obj.(*TFState)
+			return state.Bucket + ":" + state.Path
+		},
+		save: func(db *database, obj restObject) error { return db.saveTFState(obj.(*TFState)) },
+		remove: func(db *database, id string) error {
+			// revisions are removed on their own table
+			return db.removeGeneric(db.tableFor(tfStateTable), id)
+		},
+	},
+	{
+		name:    foreignResourcesTable,
+		newItem: func() restObject { return &ForeignResource{} },
+		loadAll: func(db *database) ([]restObject, error) {
+			objs, err := db.loadAllForeignResourcesFull()
+			result := make([]restObject, len(objs))
+			for i, o := range objs {
+				result[i] = o
+			}
+			return result, err
+		},
+		key: func(obj restObject) string {
+			resource := obj.(*ForeignResource)
+			return resource.ResourceType + ":" + resource.ResourceId
+		},
+		save:   func(db *database, obj restObject) error { return db.saveForeignResource(obj.(*ForeignResource)) },
+		remove: func(db *database, id string) error { return db.removeForeignResource(id) },
+	},
+	{
+		name:    waiverTable,
+		newItem: func() restObject { return &Waiver{} },
+		loadAll: func(db *database) ([]restObject, error) {
+			objs, err := db.loadAllWaivers()
+			result := make([]restObject, len(objs))
+			for i, o := range objs {
+				result[i] = o
+			}
+			return result, err
+		},
+		key:    func(obj restObject) string { return obj.id() },
+		save:   func(db *database, obj restObject) error { return db.saveWaiver(obj.(*Waiver)) },
+		remove: func(db *database, id string) error { return db.removeWaiver(id) },
+	},
+	{
+		name:    validationLogTable,
+		newItem: func() restObject { return &ValidationLog{} },
+		loadAll: func(db *database) ([]restObject, error) {
+			objs, err := db.loadAllLogsFull()
+			result := make([]restObject, len(objs))
+			for i, o := range objs {
+				o.StateJSONBlob = ""
+				o.PrevStateJSONBlob = ""
+				result[i] = o
+			}
+			return result, err
+		},
+		key:    func(obj restObject) string { return obj.id() },
+		save:   func(db *database, obj restObject) error { return db.saveLog(obj.(*ValidationLog)) },
+		remove: func(db *database, id string) error { return db.removeLog(id) },
+	},
+	{
+		name:    tfStateRevisionTable,
+		newItem: func() restObject { return &TFStateRevision{} },
+		loadAll: func(db *database) ([]restObject, error) {
+			objs, err := db.loadAllTFStateRevisionsFull()
+			result := make([]restObject, len(objs))
+			for i, o := range objs {
+				o.StateBlob = ""
+				result[i] = o
+			}
+			return result, err
+		},
+		key:    func(obj restObject) string { return obj.id() },
+		save:   func(db *database, obj restObject) error { return db.saveTFStateRevision(obj.(*TFStateRevision)) },
+		remove: func(db *database, id string) error { return db.removeTFStateRevision(id) },
+	},
+}
+
+// selectExportTables returns the export tables with the given comma-separated
+// names, or all of them if names is empty.
+func selectExportTables(names string) ([]exportTable, error) {
+	if names == "" {
+		return exportTables, nil
+	}
+
+	var result []exportTable
+	for _, name := range strings.Split(names, ",") {
+		found := false
+		for _, table := range exportTables {
+			if table.name == name {
+				result = append(result, table)
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown table '%s'", name)
+		}
+	}
+	return result, nil
+}
+
+// exportArchive exports all the items of the given tables.
+func (db *database) exportArchive(tables []exportTable) (*configArchive, error) {
+	archive := &configArchive{
+		FormatVersion: exportFormatVersion,
+		ExportedAt:    time.Now().Unix(),
+		Tables:        make(map[string]json.RawMessage),
+	}
+	for _, table := range tables {
+		objs, err := table.loadAll(db)
+		if err != nil {
+			return nil, fmt.Errorf("can't load %s: %v", table.name, err)
+		}
+		if objs == nil {
+			objs = []restObject{}
+		}
+
+		asJSON, err := json.MarshalIndent(objs, "", "\t")
+		if err != nil {
+			return nil, err
+		}
+		archive.Tables[table.name] = asJSON
+	}
+	return archive, nil
+}
+
+// importTableDiff lists the keys of the items changed by an import in a table.
+type importTableDiff struct {
+	Added     []string `json:"added"`
+	Updated   []string `json:"updated"`
+	Removed   []string `json:"removed"`
+	Unchanged int      `json:"unchanged"`
+}
+
+// importArchive imports the given tables of the archive. Items are matched with the stored ones by
+// Id, or by their key (so features are matched by name, for example). The matched items are updated,
+// and the others added. In replace mode, the items not in the archive are removed too. If dryRun is
+// true, nothing is changed. Returns the changes by table.
+func (db *database) importArchive(
+	archive *configArchive,
+	tables []exportTable,
+	replace bool,
+	dryRun bool,
+) (map[string]*importTableDiff, error) {
+	result := make(map[string]*importTableDiff)
+	tfStateIds := make(map[string]string) // archive tfstate id -> stored tfstate id
+	for _, table := range tables {
+		encoded, ok := archive.Tables[table.name]
+		if !ok {
+			continue
+		}
+
+		var encodedItems []json.RawMessage
+		if err := json.Unmarshal(encoded, &encodedItems); err != nil {
+			return nil, fmt.Errorf("invalid %s: %v", table.name, err)
+		}
+
+		existing, err := table.loadAll(db)
+		if err != nil {
+			return nil, fmt.Errorf("can't load %s: %v", table.name, err)
+		}
+		byId := make(map[string]restObject)
+		byKey := make(map[string]restObject)
+		for _, obj := range existing {
+			byId[obj.id()] = obj
+			byKey[table.key(obj)] = obj
+		}
+
+		diff := &importTableDiff{Added: []string{}, Updated: []string{}, Removed: []string{}}
+		matched := make(map[string]bool)
+		for _, encodedItem := range encodedItems {
+			obj := table.newItem()
+			if err := json.Unmarshal(encodedItem, obj); err != nil {
+				return nil, fmt.Errorf("invalid item in %s: %v", table.name, err)
+			}
+			upgradeItem(table.name, obj) // the archive may be from an older version
+			remapTFStateId(obj, tfStateIds)
+
+			stored, ok := byId[obj.id()]
+			if !ok {
+				stored, ok = byKey[table.key(obj)]
+			}
+			if ok {
+				if table.name == tfStateTable {
+					tfStateIds[obj.id()] = stored.id()
+				}
+				matched[stored.id()] = true
+				copyIdentity(obj, stored)
+				if sameContent(obj, stored) {
+					diff.Unchanged++
+					continue
+				}
+				diff.Updated = append(diff.Updated, table.key(obj))
+			} else {
+				if table.insert == nil {
+					copyIdentity(obj, nil)
+				}
+				diff.Added = append(diff.Added, table.key(obj))
+			}
+
+			if !dryRun {
+				save := table.save
+				if !ok && table.insert != nil {
+					save = table.insert
+				}
+				if err := save(db, obj); err != nil {
+					return nil, fmt.Errorf("can't save %s in %s: %v", table.key(obj), table.name, err)
+				}
+			}
+		}
+
+		if replace {
+			for _, obj := range existing {
+				if matched[obj.id()] {
+					continue
+				}
+				diff.Removed = append(diff.Removed, table.key(obj))
+				if !dryRun {
+					if err := table.remove(db, obj.id()); err != nil {
+						return nil, fmt.Errorf("can't remove %s from %s: %v", table.key(obj), table.name, err)
+					}
+				}
+			}
+		}
+
+		result[table.name] = diff
+	}
+	return result, nil
+}
+
+// copyIdentity sets the Id, Timestamp and Version of obj to the ones of the stored
+// object, so saving obj overwrites it. If stored is nil, just resets the Version.
+func copyIdentity(obj restObject, stored restObject) {
+	dst := reflect.ValueOf(obj).Elem()
+	if stored == nil {
+		dst.FieldByName("Version").SetInt(0)
+		return
+	}
+
+	src := reflect.ValueOf(stored).Elem()
+	for _, field := range []string{"Id", "Timestamp", "Version"} {
+		dst.FieldByName(field).Set(src.FieldByName(field))
+	}
+}
+
+// sameContent returns true if both objects have the same fields.
+func sameContent(a restObject, b restObject) bool {
+	aJSON, errA := json.Marshal(a)
+	bJSON, errB := json.Marshal(b)
+	return errA == nil && errB == nil && bytes.Equal(aJSON, bJSON)
+}
+
+// remapTFStateId updates the TFStateId reference of obj (if it has one)
+// according to the given mapping, of archive ids to stored ids.
+func remapTFStateId(obj restObject, tfStateIds map[string]string) {
+	field := reflect.ValueOf(obj).Elem().FieldByName("TFStateId")
+	if !field.IsValid() {
+		return
+	}
+	if storedId, ok := tfStateIds[field.String()]; ok {
+		field.SetString(storedId)
+	}
+}
+
+// Archive encoding. The tar.gz format contains a "manifest.json", with
+// the format version and export time, and a "{table}.json" for each table.
+
+const exportManifestFile = "manifest.json"
+
+type exportManifest struct {
+	FormatVersion int   `json:"format_version"`
+	ExportedAt    int64 `json:"exported_at"`
+}
+
+// encodeArchiveTarGz encodes the given archive as tar.gz.
+func encodeArchiveTarGz(archive *configArchive) ([]byte, error) {
+	manifest, err := json.MarshalIndent(exportManifest{
+		FormatVersion: archive.FormatVersion,
+		ExportedAt:    archive.ExportedAt,
+	}, "", "\t")
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	gzipWriter := gzip.NewWriter(&buf)
+	tarWriter := tar.NewWriter(gzipWriter)
+	writeFile := func(name string, content []byte) error {
+		header := &tar.Header{
+			Name:    name,
+			Mode:    0600,
+			Size:    int64(len(content)),
+			ModTime: time.Unix(archive.ExportedAt, 0),
+		}
+		if err := tarWriter.WriteHeader(header); err != nil {
+			return err
+		}
+		_, err := tarWriter.Write(content)
+		return err
+	}
+
+	if err := writeFile(exportManifestFile, manifest); err != nil {
+		return nil, err
+	}
+	for _, table := range exportTables { // in order, for stable archives
+		if content, ok := archive.Tables[table.name]; ok {
+			if err := writeFile(table.name+".json", content); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := tarWriter.Close(); err != nil {
+		return nil, err
+	}
+	if err := gzipWriter.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeArchive decodes an archive encoded either as json or tar.gz.
+func decodeArchive(data []byte) (*configArchive, error) {
+	var archive *configArchive
+	var err error
+	if len(data) >= 2 && data[0] == 0x1f && data[1] == 0x8b {
+		archive, err = decodeArchiveTarGz(data)
+	} else {
+		archive = &configArchive{}
+		if err = json.Unmarshal(data, archive); err != nil {
+			err = fmt.Errorf("invalid json archive: %v", err)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if archive.FormatVersion < 1 || archive.FormatVersion > exportFormatVersion {
+		return nil, fmt.Errorf("unsupported archive format version %d", archive.FormatVersion)
+	}
+	return archive, nil
+}
+
+// decodeArchiveTarGz decodes an archive encoded by encodeArchiveTarGz.
+func decodeArchiveTarGz(data []byte) (*configArchive, error) {
+	gzipReader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("invalid tar.gz archive: %v", err)
+	}
+	defer gzipReader.Close()
+
+	archive := &configArchive{Tables: make(map[string]json.RawMessage)}
+	tarReader := tar.NewReader(gzipReader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid tar.gz archive: %v", err)
+		}
+
+		content, err := ioutil.ReadAll(tarReader)
+		if err != nil {
+			return nil, fmt.Errorf("can't read '%s': %v", header.Name, err)
+		}
+		if header.Name == exportManifestFile {
+			var manifest exportManifest
+			if err := json.Unmarshal(content, &manifest); err != nil {
+				return nil, fmt.Errorf("invalid manifest: %v", err)
+			}
+			archive.FormatVersion = manifest.FormatVersion
+			archive.ExportedAt = manifest.ExportedAt
+		} else if strings.HasSuffix(header.Name, ".json") {
+			archive.Tables[strings.TrimSuffix(header.Name, ".json")] = content
+		}
+	}
+	return archive, nil
+}
@@ -1,19 +1,58 @@
 package main
 
-import (
-	"github.com/aws/aws-sdk-go/service/dynamodb"
-	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
-	"github.com/aws/aws-sdk-go/service/dynamodb/expression"
-)
+import "fmt"
 
 // ComplianceFeature stores a feature to test terraform code against.
 type ComplianceFeature struct {
-	Id        string
-	Timestamp int64
-	Name      string   // name of the feature
-	Source    string   // gherkin source code of the feature
-	Tags      []string // to specify which states this feature affects
-	Disabled  bool     // whether this feature is applied or not
+	Id            string
+	Timestamp     int64
+	Version       int64             // increased on every save, to detect concurrent updates
+	SchemaVersion int               // the schema version of this item (see migrations.go)
+	Name          string            // name of the feature
+	Source        string            // source code of the feature, in its language
+	Tags          []string          // to specify which states this feature affects
+	Disabled      bool              // whether this feature is applied or not
+	Engine        string            // for gherkin, the engine that evaluates this feature (see policy_engine.go). Empty for the default one
+	Language      string            // the language of the source: gherkin (terraform-compliance, if empty) or rego
+	Severity      string            // info, low, medium, high or critical. Empty for medium
+	Enforcement   string            // blocking (fails validations) or advisory (just reported). Empty for blocking
+	UpdatedBy     string            // who saved this feature the last time (see FeatureRevision)
+	Tests         []FeatureTestCase // fixtures this feature must pass or fail (see feature_testing.go)
+}
+
+// severities lists the feature severities, from the lowest to the highest.
+var severities = []string{"info", "low", "medium", "high", "critical"}
+
+const (
+	defaultSeverity     = "medium"
+	enforcementBlocking = "blocking"
+	enforcementAdvisory = "advisory"
+)
+
+// severityLevel returns the position of the given severity in severities, or -1 if unknown.
+func severityLevel(severity string) int {
+	for i, s := range severities {
+		if s == severity {
+			return i
+		}
+	}
+	return -1
+}
+
+// featureSeverity returns the severity of the given feature.
+func featureSeverity(f *ComplianceFeature) string {
+	if f.Severity == "" {
+		return defaultSeverity
+	}
+	return f.Severity
+}
+
+// featureEnforcement returns the enforcement mode of the given feature.
+func featureEnforcement(f *ComplianceFeature) string {
+	if f.Enforcement == "" {
+		return enforcementBlocking
+	}
+	return f.Enforcement
 }
 
 func newFeature(name string, source string, tags []string) *ComplianceFeature {
@@ -36,50 +75,86 @@ func (f *ComplianceFeature) timestamp() int64 {
 	return f.Timestamp
 }
 
+func (f *ComplianceFeature) version() int64 {
+	return f.Version
+}
+
 func (f *ComplianceFeature) writeBasic(dst map[string]interface{}) {
 	dst["name"] = f.Name
 	dst["source"] = f.Source
 	dst["tags"] = f.Tags
 	dst["disabled"] = f.Disabled
+	dst["engine"] = f.Engine
+	dst["language"] = featureLanguage(f)
+	dst["severity"] = featureSeverity(f)
+	dst["enforcement"] = featureEnforcement(f)
+	dst["revision"] = f.Version
+	dst["updated_by"] = f.UpdatedBy
 }
 
 func (f *ComplianceFeature) writeDetailed(dst map[string]interface{}) {
 	f.writeBasic(dst)
+	dst["tests"] = f.Tests
 }
 
 // Database methods
 
 const complianceFeatureTable = "features"
 
+var featureNameIndex = tableIndex{name: "Name-index", hashKey: "Name"}
+
 func (db *database) loadAllFeaturesFull() ([]*ComplianceFeature, error) {
+	result, _, err := db.loadFeaturesFullPage(0, "")
+	return result, err
+}
+
+// loadFeaturesFullPage loads up to limit items (all if 0) starting from the given cursor.
+func (db *database) loadFeaturesFullPage(limit int, cursor string) ([]*ComplianceFeature, string, error) {
 	var result []*ComplianceFeature
-	err := db.loadGeneric(
+	nextCursor, err := db.loadGenericPage(
 		db.tableFor(complianceFeatureTable),
-		[]string{"Name", "Source", "Tags", "Disabled"},
-		false,
-		expression.ConditionBuilder{},
-		func(i map[string]*dynamodb.AttributeValue) error {
+		[]string{"Name", "Source", "Tags", "Disabled", "Engine", "Language", "Severity", "Enforcement", "UpdatedBy", "Tests"},
+		nil,
+		limit,
+		cursor,
+		func(decode itemDecoder) error {
 			var elem ComplianceFeature
-			err := dynamodbattribute.UnmarshalMap(i, &elem)
+			err := decode(&elem)
 			if err == nil {
 				result = append(result, &elem)
 			}
 			return err
 		})
 
-	return result, err
+	return result, nextCursor, err
 }
 
 func (db *database) findFeatureById(id string) (*ComplianceFeature, error) {
+	var elem ComplianceFeature
+	found, err := db.getGeneric(
+		db.tableFor(complianceFeatureTable),
+		id,
+		[]string{"Name", "Source", "Tags", "Disabled", "Engine", "Language", "Severity", "Enforcement", "UpdatedBy", "Tests"},
+		&elem)
+	if err != nil || !found {
+		return nil, err
+	}
+
+	return &elem, nil
+}
+
+// findFeatureByName returns the feature with the given name, or nil if there's no such feature.
+func (db *database) findFeatureByName(name string) (*ComplianceFeature, error) {
 	var result *ComplianceFeature = nil
-	err := db.loadGeneric(
+	_, err := db.queryGenericPage(
 		db.tableFor(complianceFeatureTable),
-		[]string{"Name", "Source", "Tags", "Disabled"},
-		true,
-		expression.Name("Id").Equal(expression.Value(id)),
-		func(i map[string]*dynamodb.AttributeValue) error {
+		indexQuery{index: featureNameIndex, hashValue: name},
+		[]string{"Name", "Source", "Tags", "Disabled", "Engine", "Language", "Severity", "Enforcement", "UpdatedBy", "Tests"},
+		1,
+		"",
+		func(decode itemDecoder) error {
 			var elem ComplianceFeature
-			err := dynamodbattribute.UnmarshalMap(i, &elem)
+			err := decode(&elem)
 			if err == nil {
 				result = &elem
 			}
@@ -89,10 +164,42 @@ func (db *database) findFeatureById(id string) (*ComplianceFeature, error) {
 	return result, err
 }
 
+// findFeatureByIdOrName returns the feature with the given id, or else with the given name
+// (as the cli references them), or nil if there's no such feature.
+func (db *database) findFeatureByIdOrName(idOrName string) (*ComplianceFeature, error) {
+	feature, err := db.findFeatureById(idOrName)
+	if err == nil && feature == nil {
+		feature, err = db.findFeatureByName(idOrName)
+	}
+	return feature, err
+}
+
+// saveFeature saves the given feature, and registers the saved version as a new revision.
 func (db *database) saveFeature(feature *ComplianceFeature) error {
-	return db.insertOrUpdateGeneric(db.tableFor(complianceFeatureTable), feature)
+	feature.SchemaVersion = latestSchemaVersion(complianceFeatureTable)
+	if err := db.insertOrUpdateGeneric(db.tableFor(complianceFeatureTable), feature, &feature.Version); err != nil {
+		return err
+	}
+	if err := db.saveFeatureRevision(newFeatureRevision(feature)); err != nil {
+		return fmt.Errorf("can't insert revision on DB: %v", err)
+	}
+	return nil
+}
+
+// insertFeature stores the given feature, not stored yet, keeping its Version (as imports do),
+// and registers it as a revision.
+func (db *database) insertFeature(feature *ComplianceFeature) error {
+	feature.SchemaVersion = latestSchemaVersion(complianceFeatureTable)
+	if err := db.storage.put(db.tableFor(complianceFeatureTable), feature, 0); err != nil {
+		return err
+	}
+	if err := db.saveFeatureRevision(newFeatureRevision(feature)); err != nil {
+		return fmt.Errorf("can't insert revision on DB: %v", err)
+	}
+	return nil
 }
 
+// removeFeature removes the given feature. Its revisions are kept, as the logs refer to them.
 func (db *database) removeFeature(id string) error {
 	return db.removeGeneric(db.tableFor(complianceFeatureTable), id)
 }
@@ -0,0 +1,306 @@
+// This file contains the linting of the feature sources, which are checked when
+// saved so a malformed feature doesn't fail the validation of every state later.
+
+package main
+
+import (
+	"fmt"
+	"github.com/open-policy-agent/opa/ast"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// lintLenient makes the steps toolStepRegexps doesn't match warnings instead of errors (see -lint-lenient),
+// in case terraform-compliance supports steps the linter doesn't know yet.
+var lintLenient = false
+
+// featureLintError is a problem in the source of a feature. Line and column start at 1 (0 if unknown).
+// Warnings are possible problems, that don't make the feature invalid.
+type featureLintError struct {
+	Line    int    `json:"line"`
+	Column  int    `json:"column"`
+	Message string `json:"message"`
+	Warning bool   `json:"warning,omitempty"`
+}
+
+func (e featureLintError) String() string {
+	if e.Warning {
+		return fmt.Sprintf("line %d, column %d: warning: %s", e.Line, e.Column, e.Message)
+	}
+	return fmt.Sprintf("line %d, column %d: %s", e.Line, e.Column, e.Message)
+}
+
+// featureLintErrors are the problems of a feature source, as an error.
+type featureLintErrors []featureLintError
+
+func (errs featureLintErrors) Error() string {
+	lines := make([]string, len(errs))
+	for i, e := range errs {
+		lines[i] = e.String()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// errors returns the problems that aren't warnings.
+func (errs featureLintErrors) errors() featureLintErrors {
+	var result featureLintErrors
+	for _, e := range errs {
+		if !e.Warning {
+			result = append(result, e)
+		}
+	}
+	return result
+}
+
+// toolStepRegexps matches the step grammar of terraform-compliance (the patterns of its step
+// definitions), with any keyword (as it does). Outline parameters are replaced before matching.
+var toolStepRegexps = []*regexp.Regexp{
+	// Given I have aws_instance defined, Given I have resource that supports tags defined,
+	// Given I have AWS S3 Bucket resource configured
+	regexp.MustCompile(`^I have .+ (?:defined|configured)$`),
+	// When it contains ingress, When it has tags, When it does not contain lifecycle
+	regexp.MustCompile(`^it (?:contains?|has|does not (?:have|has|contain)|doesn't (?:have|contain)) .+$`),
+	// When its type is aws_instance, When its name is not "x", When its tags metadata has Name
+	regexp.MustCompile(`^its \S+ (?:metadata )?(?:is not|is|has not|has|includes|contains?|does not (?:have|include|contain)) .+$`),
+	// When I count them, When I flatten the value
+	regexp.MustCompile(`^I \S+ (?:it|them|the value|its value)$`),
+	// Then I expect the result is more than 2
+	regexp.MustCompile(`^I expect the result is .+$`),
+	// Then it must only have tcp protocol and port 22 for 0.0.0.0/0
+	regexp.MustCompile(`^it must (?:(?:not|only|never) )?have \S+ protocol and port \S+ for .+$`),
+	// Then it must contain tags, Then it must not have "x" referenced, Then it must be in 10.0.0.0/8
+	// network, Then it must match the "^x$" regex, Then it must be null, Then it must cover x
+	regexp.MustCompile(`^it (?:must|should) (?:(?:not|only|never) )?(?:contain|have|cover|be|match|include|reference) .+$`),
+	// Then its value must not be null, Then its value must be set by a variable, Then its value
+	// must match the "x" regex, Then its value must be greater than 0
+	regexp.MustCompile(`^its \S+ (?:must|should) (?:(?:not|only|never) )?(?:be|have|contain|match|include|cover|reference) .+$`),
+	// Then any of its values must be "x", Then all of its values must match the "x" regex
+	regexp.MustCompile(`^(?:any|all|none) of its values (?:must|should) .+$`),
+	// Then the scenario should fail, Then it fails
+	regexp.MustCompile(`^(?:it|the scenario) (?:must |should )?fails?$`),
+}
+
+// nativeStepSupported returns true if the native engine supports the given step (see runPolicyStep).
+func nativeStepSupported(step policyStep) bool {
+	switch step.keyword {
+	case "Given":
+		return givenDataRegexp.MatchString(step.text) || givenResourceRegexp.MatchString(step.text)
+	case "When":
+		return containsRegexp.MatchString(step.text)
+	default:
+		return mustContainRegexp.MatchString(step.text) ||
+			valueMatchRegexp.MatchString(step.text) ||
+			valueNotNullRegexp.MatchString(step.text)
+	}
+}
+
+// toolStepSupported returns true if terraform-compliance supports the given step.
+func toolStepSupported(step policyStep) bool {
+	for _, re := range toolStepRegexps {
+		if re.MatchString(step.text) {
+			return true
+		}
+	}
+	return false
+}
+
+// lintFeature returns the problems of the source of the given feature: syntax errors,
+// and for gherkin, the steps not supported by the engine of the feature (just warnings
+// for terraform-compliance with lintLenient).
+func lintFeature(f *ComplianceFeature) featureLintErrors {
+	if featureLanguage(f) == languageRego {
+		return lintRegoPolicy(f)
+	}
+
+	if featureEngine(f) == engineNative {
+		return lintGherkinFeature(f.Source, nativeStepSupported, false)
+	}
+	return lintGherkinFeature(f.Source, toolStepSupported, lintLenient)
+}
+
+// lintRegoPolicy returns the parse errors of the given rego feature.
+func lintRegoPolicy(f *ComplianceFeature) featureLintErrors {
+	_, err := parseRegoPolicy(f.Name, f.Source)
+	if err == nil {
+		return nil
+	}
+
+	var result featureLintErrors
+	if astErrors, ok := err.(ast.Errors); ok {
+		for _, e := range astErrors {
+			lintErr := featureLintError{Message: e.Message}
+			if e.Location != nil {
+				lintErr.Line, lintErr.Column = e.Location.Row, e.Location.Col
+			}
+			result = append(result, lintErr)
+		}
+	}
+	if len(result) == 0 {
+		result = append(result, featureLintError{Message: err.Error()})
+	}
+	return result
+}
+
+// lintGherkinFeature returns the syntax errors of the given gherkin source, and its
+// steps not supported according to stepSupported (as warnings if unknownStepWarnings).
+// Unlike parsePolicyFeature, it doesn't stop at the first error.
+func lintGherkinFeature(source string, stepSupported func(policyStep) bool, unknownStepWarnings bool) featureLintErrors {
+	var result featureLintErrors
+	addError := func(line, column int, format string, args ...interface{}) {
+		result = append(result, featureLintError{Line: line, Column: column, Message: fmt.Sprintf(format, args...)})
+	}
+
+	// the scenario being read
+	type outlineParam struct {
+		name         string
+		line, column int
+	}
+	type scenarioState struct {
+		line, column int
+		outline      bool
+		steps        []policyStep
+		params       []outlineParam // the parameters used in its steps
+		header       []string       // the columns of its examples table
+		hasExamples  bool
+	}
+	var current *scenarioState
+	endScenario := func() {
+		if current == nil {
+			return
+		}
+		if len(current.steps) == 0 {
+			addError(current.line, current.column, "scenario without steps")
+		}
+		if current.outline && !current.hasExamples {
+			addError(current.line, current.column, "scenario outline without examples")
+		}
+		for _, param := range current.params {
+			if current.hasExamples && !containsString(current.header, param.name) {
+				addError(param.line, param.column, "outline parameter <%s> not in the examples", param.name)
+			}
+		}
+		current = nil
+	}
+
+	featureLine := 0
+	scenarios := 0
+	inExamples, inDocString := false, false
+	prevKeyword := ""
+	lines := strings.Split(source, "\n")
+	for i, line := range lines {
+		lineNumber := i + 1
+		l := strings.TrimSpace(line)
+		column := strings.Index(line, l) + 1
+
+		if strings.HasPrefix(l, `"""`) {
+			inDocString = !inDocString
+			continue
+		}
+		if inDocString || l == "" || strings.HasPrefix(l, "#") || strings.HasPrefix(l, "@") {
+			continue
+		}
+
+		switch {
+		case strings.HasPrefix(l, "Feature:"):
+			if featureLine != 0 {
+				addError(lineNumber, column, "just one feature per source is allowed (first one at line %d)", featureLine)
+			}
+			featureLine = lineNumber
+		case featureLine == 0:
+			addError(lineNumber, column, "expected 'Feature:', got '%s'", l)
+		case strings.HasPrefix(l, "Background:"):
+			endScenario()
+			current = &scenarioState{line: lineNumber, column: column}
+			inExamples, prevKeyword = false, ""
+		case strings.HasPrefix(l, "Scenario Outline:"), strings.HasPrefix(l, "Scenario:"):
+			endScenario()
+			current = &scenarioState{line: lineNumber, column: column, outline: strings.HasPrefix(l, "Scenario Outline:")}
+			inExamples, prevKeyword = false, ""
+			scenarios++
+		case strings.HasPrefix(l, "Examples:"):
+			if current == nil || !current.outline {
+				addError(lineNumber, column, "examples out of a scenario outline")
+				continue
+			}
+			current.hasExamples, inExamples = true, true
+		case strings.HasPrefix(l, "|"):
+			if !inExamples {
+				addError(lineNumber, column, "table out of examples")
+				continue
+			}
+			cells := splitTableRow(l)
+			if current.header == nil {
+				current.header = cells
+			} else if len(cells) < len(current.header) {
+				addError(lineNumber, column, "expected %d columns, got %d", len(current.header), len(cells))
+			}
+		default:
+			fields := strings.SplitN(l, " ", 2)
+			keyword := fields[0]
+			switch keyword {
+			case "Given", "When", "Then":
+			case "And", "But":
+				keyword = prevKeyword
+			default:
+				// descriptions are allowed before the steps
+				if current != nil && (len(current.steps) > 0 || inExamples) {
+					addError(lineNumber, column, "unexpected '%s'", l)
+				}
+				continue
+			}
+			if current == nil || inExamples {
+				addError(lineNumber, column, "step out of a scenario")
+				continue
+			}
+			if keyword == "" {
+				addError(lineNumber, column, "'%s' must follow another step", fields[0])
+				continue
+			}
+			if len(fields) != 2 || strings.TrimSpace(fields[1]) == "" {
+				addError(lineNumber, column, "empty step")
+				continue
+			}
+
+			step := policyStep{keyword: keyword, text: strings.TrimSpace(fields[1])}
+			for _, match := range outlineParamRegexp.FindAllStringSubmatchIndex(line, -1) {
+				current.params = append(current.params, outlineParam{name: line[match[2]:match[3]], line: lineNumber, column: match[0] + 1})
+			}
+			// parameters are checked as if they were replaced by a plain value
+			check := step
+			check.text = outlineParamRegexp.ReplaceAllString(step.text, "$1")
+			if !stepSupported(check) {
+				addError(lineNumber, column, "unknown step '%s %s'", fields[0], step.text)
+				result[len(result)-1].Warning = unknownStepWarnings
+			} else if groups := valueMatchRegexp.FindStringSubmatch(step.text); groups != nil && !outlineParamRegexp.MatchString(groups[2]) {
+				if _, err := regexp.Compile(groups[2]); err != nil {
+					addError(lineNumber, column+strings.Index(l, groups[2]), "invalid regex '%s': %v", groups[2], err)
+				}
+			}
+			current.steps = append(current.steps, step)
+			prevKeyword = keyword
+		}
+	}
+	endScenario()
+
+	if inDocString {
+		addError(len(lines), 0, "unterminated doc string")
+	}
+	if featureLine == 0 {
+		addError(1, 1, "no 'Feature:' defined")
+	} else if scenarios == 0 {
+		addError(featureLine, 0, "no scenarios defined")
+	}
+	sort.SliceStable(result, func(i, j int) bool { return result[i].Line < result[j].Line })
+	return result
+}
+
+// containsString returns true if list contains s.
+func containsString(list []string, s string) bool {
+	for _, elem := range list {
+		if elem == s {
+			return true
+		}
+	}
+	return false
+}
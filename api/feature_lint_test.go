@@ -0,0 +1,171 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func TestLintFeature(t *testing.T) {
+	valid := `@tagged
+Feature: Resources should be tagged
+	In order to keep track of resource ownership
+
+	Scenario: Ensure all instances have tags
+		Given I have resource that supports tags defined
+		When its type is aws_instance
+		Then it must contain tags
+		And its value must not be null
+
+	Scenario Outline: Ensure that specific tags are defined
+		Given I have aws_instance defined
+		When it has tags
+		Then it must contain <tags>
+		And its value must match the "<value>" regex
+
+	Examples:
+		| tags        | value            |
+		| Name        | .+               |
+		| environment | ^(prod|uat|dev)$ |
+
+	Scenario: Count
+		Given I have aws_instance defined
+		When I count them
+		Then I expect the result is less than 10
+`
+	f := newFeature("tags", valid, nil)
+	assert.Empty(t, lintFeature(f))
+
+	f.Engine = engineNative
+	assert.Equal(t, featureLintErrors{
+		{Line: 6, Column: 3, Message: "unknown step 'Given I have resource that supports tags defined'"},
+		{Line: 7, Column: 3, Message: "unknown step 'When its type is aws_instance'"},
+		{Line: 24, Column: 3, Message: "unknown step 'When I count them'"},
+		{Line: 25, Column: 3, Message: "unknown step 'Then I expect the result is less than 10'"},
+	}, lintFeature(f))
+
+	f.Engine = engineTerraformCompliance
+	f.Source = strings.Replace(valid, "it must contain tags", "it must fly", 1)
+	assert.Equal(t, featureLintErrors{
+		{Line: 8, Column: 3, Message: "unknown step 'Then it must fly'"},
+	}, lintFeature(f))
+	lintLenient = true
+	assert.Equal(t, featureLintErrors{
+		{Line: 8, Column: 3, Message: "unknown step 'Then it must fly'", Warning: true},
+	}, lintFeature(f))
+	assert.Empty(t, lintFeature(f).errors())
+	lintLenient = false
+
+	f = newFeature("bad", `Scenario: Before the feature
+Feature: Bad
+	Scenario Outline: Bad outline
+		And I have aws_instance defined
+		Given I have aws_instance defined
+		Then it must contain <tag>
+		Then its value must not match the "(" regex
+		| a |
+	Scenario: Empty
+	Examples:
+`, nil)
+	assert.Equal(t, featureLintErrors{
+		{Line: 1, Column: 1, Message: "expected 'Feature:', got 'Scenario: Before the feature'"},
+		{Line: 3, Column: 2, Message: "scenario outline without examples"},
+		{Line: 4, Column: 3, Message: "'And' must follow another step"},
+		{Line: 7, Column: 38, Message: "invalid regex '(': error parsing regexp: missing closing ): `(`"},
+		{Line: 8, Column: 3, Message: "table out of examples"},
+		{Line: 9, Column: 2, Message: "scenario without steps"},
+		{Line: 10, Column: 2, Message: "examples out of a scenario outline"},
+	}, lintFeature(f))
+
+	f = newFeature("params", "Feature: Params\n\tScenario Outline: o\n\t\tGiven I have <type> defined\n\tExamples:\n\t\t| kind |\n\t\t| aws_instance |\n", nil)
+	assert.Equal(t, featureLintErrors{
+		{Line: 3, Column: 16, Message: "outline parameter <type> not in the examples"},
+	}, lintFeature(f))
+
+	f = newFeature("empty", "Feature: Empty\n", nil)
+	assert.Equal(t, featureLintErrors{{Line: 1, Message: "no scenarios defined"}}, lintFeature(f))
+
+	f = newFeature("rego", "deny[msg] { true }", nil)
+	f.Language = languageRego
+	lintErrors := lintFeature(f)
+	assert.Len(t, lintErrors, 1)
+	assert.Equal(t, 1, lintErrors[0].Line)
+}
+
+func TestLintToolSteps(t *testing.T) {
+	// steps from the terraform-compliance documentation and examples
+	source := `Feature: Terraform-compliance steps
+
+	Scenario: Security groups
+		Given I have AWS Security Group defined
+		When it contains ingress
+		Then it must not have tcp protocol and port 22 for 0.0.0.0/0
+		And it must only have tcp protocol and port 443 for 0.0.0.0/0
+		And it must never have udp protocol and port 1-65535 for 0.0.0.0/0
+
+	Scenario: Encryption
+		Given I have aws_s3_bucket defined
+		Then it must contain server_side_encryption_configuration
+		And it must have "aws:kms" referenced
+
+	Scenario: Configured
+		Given I have AWS S3 Bucket resource configured
+		When it has versioning
+		Then it must contain enabled
+		And its value must be true
+
+	Scenario: Subnets
+		Given I have aws_subnet defined
+		When it contains cidr_block
+		Then its value must be in network 10.0.0.0/8
+		And its value must not be null
+
+	Scenario: Tags
+		Given I have resource that supports tags defined
+		When its type is aws_instance
+		And its name is not "bastion"
+		And its tags metadata has Name
+		And it does not contain lifecycle
+		Then it must contain tags
+		And its value must match the "^(prod|dev)$" regex
+		And it must not match the "^test" regex
+
+	Scenario: Variables
+		Given I have aws_instance defined
+		When it contains ami
+		Then its value must be set by a variable
+
+	Scenario: Values
+		Given I have aws_db_instance defined
+		When it contains allocated_storage
+		Then its value must be greater than 0
+		And any of its values must be "gp2"
+
+	Scenario: Count
+		Given I have aws_instance defined
+		When I count them
+		Then I expect the result is more than 2
+
+	Scenario: Forbidden
+		Given I have aws_iam_user_policy defined
+		Then the scenario should fail
+`
+	f := newFeature("tool steps", source, nil)
+	f.Engine = engineTerraformCompliance
+	assert.Empty(t, lintFeature(f))
+
+	for _, step := range []string{
+		"Then it must fly",
+		"Then it must",
+		"When its type",
+		"Given I have aws_instance",
+		"When it is aws_instance",
+		"Then its value must exist",
+		"Then its value",
+	} {
+		f.Source = "Feature: f\n\tScenario: s\n\t\t" + step + "\n"
+		assert.Equal(t, featureLintErrors{
+			{Line: 3, Column: 3, Message: "unknown step '" + step + "'"},
+		}, lintFeature(f), step)
+	}
+}
@@ -0,0 +1,108 @@
+// This file contains the declarative sync of the features, to keep
+// them as a directory of feature files (like in a git repo).
+
+package main
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// featureSyncChanges returns the names of the fields that differ between the stored and the synced feature.
+func featureSyncChanges(stored *ComplianceFeature, synced *ComplianceFeature) []string {
+	var changes []string
+	fields := []struct {
+		name         string
+		stored, sync interface{}
+	}{
+		{"source", stored.Source, synced.Source},
+		{"disabled", stored.Disabled, synced.Disabled},
+		{"engine", stored.Engine, synced.Engine},
+		{"language", featureLanguage(stored), featureLanguage(synced)},
+		{"severity", featureSeverity(stored), featureSeverity(synced)},
+		{"enforcement", featureEnforcement(stored), featureEnforcement(synced)},
+	}
+	for _, field := range fields {
+		if !reflect.DeepEqual(field.stored, field.sync) {
+			changes = append(changes, field.name)
+		}
+	}
+	// nil and empty lists are the same
+	if (len(stored.Tags) > 0 || len(synced.Tags) > 0) && !reflect.DeepEqual(stored.Tags, synced.Tags) {
+		changes = append(changes, "tags")
+	}
+	if (len(stored.Tests) > 0 || len(synced.Tests) > 0) && !reflect.DeepEqual(stored.Tests, synced.Tests) {
+		changes = append(changes, "tests")
+	}
+	return changes
+}
+
+// syncFeatures makes the stored features match the given ones (by name): the missing ones are added,
+// and the different ones updated. If prune is true, the stored features not given are removed too.
+// If dryRun is true, nothing is changed. Returns the changes, and the changed fields of each updated feature.
+func (db *database) syncFeatures(
+	features []*ComplianceFeature,
+	prune bool,
+	dryRun bool,
+	user string,
+) (*importTableDiff, map[string][]string, error) {
+	existing, err := db.loadAllFeaturesFull()
+	if err != nil {
+		return nil, nil, fmt.Errorf("can't load features: %v", err)
+	}
+	byName := make(map[string]*ComplianceFeature)
+	for _, f := range existing {
+		byName[f.Name] = f
+	}
+
+	diff := &importTableDiff{Added: []string{}, Updated: []string{}, Removed: []string{}}
+	updates := make(map[string][]string)
+	synced := make(map[string]bool)
+	for _, f := range features {
+		synced[f.Name] = true
+		feature := f
+		if stored, ok := byName[f.Name]; ok {
+			changes := featureSyncChanges(stored, f)
+			if len(changes) == 0 {
+				diff.Unchanged++
+				continue
+			}
+			diff.Updated = append(diff.Updated, f.Name)
+			updates[f.Name] = changes
+
+			feature = stored
+			feature.Source = f.Source
+			feature.Tags = f.Tags
+			feature.Disabled = f.Disabled
+			feature.Engine = f.Engine
+			feature.Language = f.Language
+			feature.Severity = f.Severity
+			feature.Enforcement = f.Enforcement
+			feature.Tests = f.Tests
+		} else {
+			diff.Added = append(diff.Added, f.Name)
+		}
+
+		if !dryRun {
+			feature.UpdatedBy = user
+			if err := db.saveFeature(feature); err != nil {
+				return nil, nil, fmt.Errorf("can't save %s: %w", f.Name, err)
+			}
+		}
+	}
+
+	if prune {
+		for _, f := range existing {
+			if synced[f.Name] {
+				continue
+			}
+			diff.Removed = append(diff.Removed, f.Name)
+			if !dryRun {
+				if err := db.removeFeature(f.Id); err != nil {
+					return nil, nil, fmt.Errorf("can't remove %s: %v", f.Name, err)
+				}
+			}
+		}
+	}
+	return diff, updates, nil
+}
@@ -0,0 +1,160 @@
+// This file contains the unit tests of the features: small plan or state fixtures
+// stored with a feature, along with the outcome the feature must have for them.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	testExpectPass = "pass"
+	testExpectFail = "fail"
+)
+
+// FeatureTestCase is a fixture a feature must pass or fail.
+type FeatureTestCase struct {
+	Name             string   `json:"name"`
+	Fixture          string   `json:"fixture"`           // the plan or state json (as given by "terraform show -json")
+	Expect           string   `json:"expect"`            // pass or fail. Empty for fail if there are ExpectedFailures, pass otherwise
+	ExpectedFailures []string `json:"expected_failures"` // for fail, messages (or parts of them) that must be among the failures
+}
+
+// expected returns the expected outcome of the test case (pass or fail).
+func (c FeatureTestCase) expected() string {
+	if c.Expect == "" && len(c.ExpectedFailures) > 0 {
+		return testExpectFail
+	} else if c.Expect == "" {
+		return testExpectPass
+	}
+	return c.Expect
+}
+
+// validate returns an error if the test case is malformed.
+func (c FeatureTestCase) validate() error {
+	if c.Name == "" {
+		return fmt.Errorf("test case without name")
+	}
+	if c.Expect != "" && c.Expect != testExpectPass && c.Expect != testExpectFail {
+		return fmt.Errorf("test case '%s': invalid expect '%s'. Must be pass or fail", c.Name, c.Expect)
+	}
+	if c.expected() == testExpectPass && len(c.ExpectedFailures) > 0 {
+		return fmt.Errorf("test case '%s': expected failures given for a passing case", c.Name)
+	}
+	var fixture map[string]interface{}
+	if err := json.Unmarshal([]byte(c.Fixture), &fixture); err != nil {
+		return fmt.Errorf("test case '%s': the fixture must be a json object: %v", c.Name, err)
+	}
+	return nil
+}
+
+// parseFeatureTestCases parses the test cases given in a request body. Fixtures may be given as
+// json objects or as strings. Returns a nil slice if raw is empty (so the tests weren't given).
+func parseFeatureTestCases(raw json.RawMessage) ([]FeatureTestCase, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, nil
+	}
+
+	var cases []struct {
+		FeatureTestCase
+		Fixture json.RawMessage `json:"fixture"`
+	}
+	if err := json.Unmarshal(raw, &cases); err != nil {
+		return nil, fmt.Errorf("invalid tests: %v", err)
+	}
+	result := make([]FeatureTestCase, len(cases))
+	for i, c := range cases {
+		result[i] = c.FeatureTestCase
+		result[i].Fixture = string(c.Fixture)
+		var asString string
+		if json.Unmarshal(c.Fixture, &asString) == nil {
+			result[i].Fixture = asString
+		}
+		if err := result[i].validate(); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// FeatureTestResult is the outcome of a test case of a feature.
+type FeatureTestResult struct {
+	Name     string   `json:"name"`
+	Passed   bool     `json:"passed"`
+	Problems []string `json:"problems"` // why it didn't pass
+	Failures []string `json:"failures"` // the failures of the feature for the fixture
+}
+
+// runFeatureTests runs the test cases of the given feature. Returns the result of each
+// one, and true if all of them passed. Fails just if the tool pool is saturated.
+func runFeatureTests(f *ComplianceFeature) ([]FeatureTestResult, bool, error) {
+	results := make([]FeatureTestResult, 0, len(f.Tests))
+	allPassed := true
+	for _, c := range f.Tests {
+		result, err := runFeatureTest(f, c)
+		if err != nil {
+			return nil, false, err
+		}
+		allPassed = allPassed && result.Passed
+		results = append(results, result)
+	}
+	return results, allPassed, nil
+}
+
+// runFeatureTest evaluates the given feature against the fixture of the given test case.
+func runFeatureTest(f *ComplianceFeature, c FeatureTestCase) (FeatureTestResult, error) {
+	result := FeatureTestResult{Name: c.Name, Problems: []string{}, Failures: []string{}}
+	_, _, complianceResult, err := evaluateFeatures([]byte(c.Fixture), []*ComplianceFeature{f}, nil, nil)
+	if errors.Is(err, errToolPoolSaturated) {
+		return result, err
+	}
+	if err == nil && complianceResult.Error {
+		err = errors.New(complianceResult.ErrorMessage)
+	}
+	if err != nil {
+		result.Problems = append(result.Problems, fmt.Sprintf("can't evaluate the feature: %v", err))
+		return result, nil
+	}
+
+	passed, ok := complianceResult.FeaturesResult[f.Name]
+	if !ok {
+		result.Problems = append(result.Problems, "the feature wasn't evaluated")
+		return result, nil
+	}
+	if complianceResult.FeaturesFailures[f.Name] != nil {
+		result.Failures = complianceResult.FeaturesFailures[f.Name]
+	}
+
+	switch {
+	case c.expected() == testExpectPass && !passed:
+		result.Problems = append(result.Problems, "expected to pass, but failed")
+	case c.expected() == testExpectFail && passed:
+		result.Problems = append(result.Problems, "expected to fail, but passed")
+	case c.expected() == testExpectFail:
+		for _, expected := range c.ExpectedFailures {
+			found := false
+			for _, failure := range result.Failures {
+				found = found || strings.Contains(failure, expected)
+			}
+			if !found {
+				result.Problems = append(result.Problems, fmt.Sprintf("expected failure '%s' not found", expected))
+			}
+		}
+	}
+	result.Passed = len(result.Problems) == 0
+	return result, nil
+}
+
+// failedFeatureTestsError returns an error describing the failed tests among the given results.
+func failedFeatureTestsError(results []FeatureTestResult) error {
+	var lines []string
+	for _, r := range results {
+		if !r.Passed {
+			lines = append(lines, fmt.Sprintf("test '%s': %s", r.Name, strings.Join(r.Problems, ", ")))
+		}
+	}
+	return fmt.Errorf("the feature fails its own tests:\n%s", strings.Join(lines, "\n"))
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestParseFeatureTestCases(t *testing.T) {
+	cases, err := parseFeatureTestCases([]byte(`[
+		{"name": "object", "fixture": {"planned_values": {}}},
+		{"name": "string", "fixture": "{\"values\": {}}", "expected_failures": ["no tags"]}
+	]`))
+	require.Nil(t, err)
+	assert.Equal(t, []FeatureTestCase{
+		{Name: "object", Fixture: `{"planned_values": {}}`},
+		{Name: "string", Fixture: `{"values": {}}`, ExpectedFailures: []string{"no tags"}},
+	}, cases)
+	assert.Equal(t, testExpectPass, cases[0].expected())
+	assert.Equal(t, testExpectFail, cases[1].expected())
+
+	cases, err = parseFeatureTestCases(nil)
+	assert.Nil(t, err)
+	assert.Nil(t, cases, "not given")
+
+	for _, invalid := range []string{
+		`{"name": "not a list"}`,
+		`[{"fixture": {}}]`,
+		`[{"name": "bad expect", "fixture": {}, "expect": "maybe"}]`,
+		`[{"name": "pass with failures", "fixture": {}, "expect": "pass", "expected_failures": ["x"]}]`,
+		`[{"name": "bad fixture", "fixture": "plan.out"}]`,
+	} {
+		_, err := parseFeatureTestCases([]byte(invalid))
+		assert.NotNil(t, err, invalid)
+	}
+}
+
+func TestRunFeatureTests(t *testing.T) {
+	feature := newFeature("tags", validateTestFeature, []string{"validation"})
+	feature.Engine = engineNative
+	feature.Tests = []FeatureTestCase{
+		{Name: "untagged", Fixture: policyEngineTestPlan, ExpectedFailures: []string{"aws_instance.example (aws_instance) does not have tags"}},
+		{Name: "no instances", Fixture: `{"planned_values": {"root_module": {}}}`},
+		{Name: "wrong expectation", Fixture: policyEngineTestPlan, Expect: testExpectPass},
+		{Name: "wrong message", Fixture: policyEngineTestPlan, ExpectedFailures: []string{"aws_instance.example2"}},
+	}
+
+	results, passed, err := runFeatureTests(feature)
+	require.Nil(t, err)
+	assert.False(t, passed)
+	require.Len(t, results, 4)
+	assert.True(t, results[0].Passed, results[0].Problems)
+	assert.Equal(t, []string{"aws_instance.example (aws_instance) does not have tags property."}, results[0].Failures)
+	assert.True(t, results[1].Passed, results[1].Problems)
+	assert.Equal(t, []string{"expected to pass, but failed"}, results[2].Problems)
+	assert.Equal(t, []string{"expected failure 'aws_instance.example2' not found"}, results[3].Problems)
+}
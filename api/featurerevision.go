@@ -0,0 +1,220 @@
+package main
+
+import (
+	"github.com/sergi/go-diff/diffmatchpatch"
+	"reflect"
+	"strings"
+)
+
+// FeatureRevision stores a saved version of a ComplianceFeature, to know
+// who changed it and what it said when a validation was logged.
+type FeatureRevision struct {
+	Id            string
+	Timestamp     int64  // when this revision was saved
+	Version       int64  // increased on every save, to detect concurrent updates
+	SchemaVersion int    // the schema version of this item (see migrations.go)
+	FeatureId     string // the ComplianceFeature this revision belongs to
+	Revision      int64  // the feature Version after the save
+	Author        string // who saved the feature
+
+	// The feature fields, as saved
+	Name        string
+	Source      string
+	Tags        []string
+	Disabled    bool
+	Engine      string
+	Language    string
+	Severity    string
+	Enforcement string
+	Tests       []FeatureTestCase
+}
+
+func newFeatureRevision(feature *ComplianceFeature) *FeatureRevision {
+	return &FeatureRevision{
+		Id:          generateId(),
+		Timestamp:   generateTimestamp(),
+		FeatureId:   feature.Id,
+		Revision:    feature.Version,
+		Author:      feature.UpdatedBy,
+		Name:        feature.Name,
+		Source:      feature.Source,
+		Tags:        feature.Tags,
+		Disabled:    feature.Disabled,
+		Engine:      feature.Engine,
+		Language:    feature.Language,
+		Severity:    feature.Severity,
+		Enforcement: feature.Enforcement,
+		Tests:       feature.Tests,
+	}
+}
+
+// applyTo sets the fields of the given feature as they were in this revision.
+func (r *FeatureRevision) applyTo(feature *ComplianceFeature) {
+	feature.Source = r.Source
+	feature.Tags = r.Tags
+	feature.Disabled = r.Disabled
+	feature.Engine = r.Engine
+	feature.Language = r.Language
+	feature.Severity = r.Severity
+	feature.Enforcement = r.Enforcement
+	feature.Tests = r.Tests
+}
+
+// featureRevisionsDiff returns the differences between two revisions of a feature: the
+// source lines added ("+ ") and removed ("- "), and for each other changed field, its
+// values in from and to.
+func featureRevisionsDiff(from, to *FeatureRevision) (string, map[string][2]interface{}) {
+	dmp := diffmatchpatch.New()
+	fromChars, toChars, lines := dmp.DiffLinesToChars(from.Source, to.Source)
+	diffs := dmp.DiffCharsToLines(dmp.DiffMain(fromChars, toChars, false), lines)
+
+	sb := strings.Builder{}
+	for _, diff := range diffs {
+		prefix := "  "
+		switch diff.Type {
+		case diffmatchpatch.DiffInsert:
+			prefix = "+ "
+		case diffmatchpatch.DiffDelete:
+			prefix = "- "
+		}
+		for _, line := range strings.SplitAfter(diff.Text, "\n") {
+			if line != "" {
+				sb.WriteString(prefix + strings.TrimSuffix(line, "\n") + "\n")
+			}
+		}
+	}
+
+	changes := make(map[string][2]interface{})
+	fields := []struct {
+		name     string
+		from, to interface{}
+	}{
+		{"tags", from.Tags, to.Tags},
+		{"disabled", from.Disabled, to.Disabled},
+		{"engine", from.Engine, to.Engine},
+		{"language", from.Language, to.Language},
+		{"severity", from.Severity, to.Severity},
+		{"enforcement", from.Enforcement, to.Enforcement},
+		{"tests", from.Tests, to.Tests},
+	}
+	for _, field := range fields {
+		if !reflect.DeepEqual(field.from, field.to) {
+			changes[field.name] = [2]interface{}{field.from, field.to}
+		}
+	}
+	return sb.String(), changes
+}
+
+// restObject methods
+
+func (r *FeatureRevision) id() string {
+	return r.Id
+}
+
+func (r *FeatureRevision) timestamp() int64 {
+	return r.Timestamp
+}
+
+func (r *FeatureRevision) version() int64 {
+	return r.Version
+}
+
+func (r *FeatureRevision) writeBasic(dst map[string]interface{}) {
+	dst["feature_id"] = r.FeatureId
+	dst["revision"] = r.Revision
+	dst["author"] = r.Author
+	dst["name"] = r.Name
+	dst["tags"] = r.Tags
+	dst["disabled"] = r.Disabled
+	dst["engine"] = r.Engine
+	dst["language"] = r.Language
+	dst["severity"] = r.Severity
+	dst["enforcement"] = r.Enforcement
+}
+
+func (r *FeatureRevision) writeDetailed(dst map[string]interface{}) {
+	r.writeBasic(dst)
+	dst["source"] = r.Source
+	dst["tests"] = r.Tests
+}
+
+// database methods
+
+const featureRevisionTable = "feature_revisions"
+
+var featureRevisionIndex = tableIndex{name: "FeatureId-Revision-index", hashKey: "FeatureId", rangeKey: "Revision"}
+
+var featureRevisionAttributes = []string{
+	"FeatureId", "Revision", "Author", "Name", "Source", "Tags", "Disabled", "Engine", "Language", "Severity", "Enforcement", "Tests",
+}
+
+// loadFeatureRevisionsPage loads up to limit revisions (all if 0) of the
+// given feature starting from the given cursor, newest first.
+func (db *database) loadFeatureRevisionsPage(featureId string, limit int, cursor string) ([]*FeatureRevision, string, error) {
+	var result []*FeatureRevision
+	nextCursor, err := db.queryGenericPage(
+		db.tableFor(featureRevisionTable),
+		indexQuery{index: featureRevisionIndex, hashValue: featureId},
+		featureRevisionAttributes,
+		limit,
+		cursor,
+		func(decode itemDecoder) error {
+			var elem FeatureRevision
+			err := decode(&elem)
+			if err == nil {
+				result = append(result, &elem)
+			}
+			return err
+		})
+
+	return result, nextCursor, err
+}
+
+// findFeatureRevision returns the given revision of the given feature, or nil if there's no such revision.
+func (db *database) findFeatureRevision(featureId string, revision int64) (*FeatureRevision, error) {
+	var result *FeatureRevision
+	_, err := db.queryGenericPage(
+		db.tableFor(featureRevisionTable),
+		indexQuery{index: featureRevisionIndex, hashValue: featureId, rangeBefore: revision + 1},
+		featureRevisionAttributes,
+		1,
+		"",
+		func(decode itemDecoder) error {
+			var elem FeatureRevision
+			err := decode(&elem)
+			if err == nil && elem.Revision == revision {
+				result = &elem
+			}
+			return err
+		})
+
+	return result, err
+}
+
+func (db *database) saveFeatureRevision(element *FeatureRevision) error {
+	element.SchemaVersion = latestSchemaVersion(featureRevisionTable)
+	return db.insertOrUpdateGeneric(db.tableFor(featureRevisionTable), element, &element.Version)
+}
+
+// loadAllFeatureRevisionsFull loads the revisions of all the features.
+func (db *database) loadAllFeatureRevisionsFull() ([]*FeatureRevision, error) {
+	var result []*FeatureRevision
+	err := db.loadGeneric(
+		db.tableFor(featureRevisionTable),
+		featureRevisionAttributes,
+		nil,
+		func(decode itemDecoder) error {
+			var elem FeatureRevision
+			err := decode(&elem)
+			if err == nil {
+				result = append(result, &elem)
+			}
+			return err
+		})
+
+	return result, err
+}
+
+func (db *database) removeFeatureRevision(id string) error {
+	return db.removeGeneric(db.tableFor(featureRevisionTable), id)
+}
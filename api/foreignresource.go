@@ -1,15 +1,11 @@
 package main
 
-import (
-	"github.com/aws/aws-sdk-go/service/dynamodb"
-	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
-	"github.com/aws/aws-sdk-go/service/dynamodb/expression"
-)
-
 // ForeignResource defines an AWS resource that is outside terraform.
 type ForeignResource struct {
 	Id              string
 	Timestamp       int64
+	Version         int64  // increased on every save, to detect concurrent updates
+	SchemaVersion   int    // the schema version of this item (see migrations.go)
 	ResourceType    string // resource type (example ec2-instance, ec2-eip)
 	ResourceId      string // resource id (example i-abc123)
 	ResourceDetails string // type-specific details
@@ -36,6 +32,10 @@ func (r *ForeignResource) timestamp() int64 {
 	return r.Timestamp
 }
 
+func (r *ForeignResource) version() int64 {
+	return r.Version
+}
+
 func (r *ForeignResource) writeBasic(dst map[string]interface{}) {
 	dst["resource_id"] = r.ResourceId
 	dst["resource_type"] = r.ResourceType
@@ -52,36 +52,42 @@ func (r *ForeignResource) writeDetailed(dst map[string]interface{}) {
 const foreignResourcesTable = "foreignresources"
 
 func (db *database) loadAllForeignResourcesMinimal() ([]*ForeignResource, error) {
+	result, _, err := db.loadForeignResourcesMinimalPage(0, "")
+	return result, err
+}
+
+// loadForeignResourcesMinimalPage loads up to limit items (all if 0) starting from the given cursor.
+func (db *database) loadForeignResourcesMinimalPage(limit int, cursor string) ([]*ForeignResource, string, error) {
 	var result []*ForeignResource
-	err := db.loadGeneric(
+	nextCursor, err := db.loadGenericPage(
 		db.tableFor(foreignResourcesTable),
 		[]string{"ResourceType", "ResourceId", "IsException"},
-		false,
-		expression.ConditionBuilder{},
-		func(i map[string]*dynamodb.AttributeValue) error {
+		nil,
+		limit,
+		cursor,
+		func(decode itemDecoder) error {
 			var elem ForeignResource
-			err := dynamodbattribute.UnmarshalMap(i, &elem)
+			err := decode(&elem)
 			if err == nil {
 				result = append(result, &elem)
 			}
 			return err
 		})
 
-	return result, err
+	return result, nextCursor, err
 }
 
-func (db *database) findForeignResourceById(id string) (*ForeignResource, error) {
-	var result *ForeignResource = nil
+func (db *database) loadAllForeignResourcesFull() ([]*ForeignResource, error) {
+	var result []*ForeignResource
 	err := db.loadGeneric(
 		db.tableFor(foreignResourcesTable),
 		[]string{"ResourceType", "ResourceId", "ResourceDetails", "IsException"},
-		true,
-		expression.Name("Id").Equal(expression.Value(id)),
-		func(i map[string]*dynamodb.AttributeValue) error {
+		nil,
+		func(decode itemDecoder) error {
 			var elem ForeignResource
-			err := dynamodbattribute.UnmarshalMap(i, &elem)
+			err := decode(&elem)
 			if err == nil {
-				result = &elem
+				result = append(result, &elem)
 			}
 			return err
 		})
@@ -89,8 +95,23 @@ func (db *database) findForeignResourceById(id string) (*ForeignResource, error)
 	return result, err
 }
 
+func (db *database) findForeignResourceById(id string) (*ForeignResource, error) {
+	var elem ForeignResource
+	found, err := db.getGeneric(
+		db.tableFor(foreignResourcesTable),
+		id,
+		[]string{"ResourceType", "ResourceId", "ResourceDetails", "IsException"},
+		&elem)
+	if err != nil || !found {
+		return nil, err
+	}
+
+	return &elem, nil
+}
+
 func (db *database) saveForeignResource(element *ForeignResource) error {
-	return db.insertOrUpdateGeneric(db.tableFor(foreignResourcesTable), element)
+	element.SchemaVersion = latestSchemaVersion(foreignResourcesTable)
+	return db.insertOrUpdateGeneric(db.tableFor(foreignResourcesTable), element, &element.Version)
 }
 
 func (db *database) removeForeignResource(id string) error {
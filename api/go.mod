@@ -10,14 +10,18 @@ require (
 	github.com/google/uuid v1.1.1
 	github.com/gorilla/handlers v1.4.2
 	github.com/gorilla/mux v1.7.3
+	github.com/hashicorp/hcl/v2 v2.3.0
 	github.com/lestrrat-go/jwx v0.9.0 // indirect
 	github.com/okta/okta-jwt-verifier-golang v0.1.0
 	github.com/okta/samples-golang v0.0.0-20190416174849-73eec523fa19
+	github.com/open-policy-agent/opa v0.16.2
 	github.com/pkg/errors v0.8.1 // indirect
 	github.com/sergi/go-diff v1.0.0
 	github.com/smartystreets/goconvey v1.6.4 // indirect
 	github.com/stretchr/testify v1.4.0
 	github.com/urfave/negroni v1.0.0 // indirect
+	github.com/zclconf/go-cty v1.2.1
+	go.etcd.io/bbolt v1.3.5
 	golang.org/x/net v0.0.0-20191003171128-d98b1b443823 // indirect
 	golang.org/x/oauth2 v0.0.0-20190604053449-0f29369cfe45
 )
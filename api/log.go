@@ -2,11 +2,10 @@ package main
 
 import (
 	"bytes"
-	"github.com/aws/aws-sdk-go/service/dynamodb"
-	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
-	"github.com/aws/aws-sdk-go/service/dynamodb/expression"
+	"fmt"
 	"github.com/sergi/go-diff/diffmatchpatch"
 	"html"
+	"log"
 	"strings"
 )
 
@@ -14,13 +13,19 @@ import (
 type ValidationLog struct {
 	Id                   string
 	Timestamp            int64
-	Kind                 string           // "tfstate" or "validation"
+	Version              int64            // increased on every save, to detect concurrent updates
+	SchemaVersion        int              // the schema version of this item (see migrations.go)
+	Kind                 string           // "tfstate", "validation" or "waiver"
 	StateJSON            string           // current state json
 	ComplianceResult     ComplianceResult // current compliance result
 	PrevStateJSON        string           // for Kind tfstate, the previous state json.
 	PrevComplianceResult ComplianceResult // For Kind tfstate, the previous compliance result
 	Account              string           // For kind tfstate, the account affected.
-	Details              string           // For kind tfstate, is bucket:path
+	Details              string           // For kind tfstate, is bucket:path. For kind waiver, describes the expired waiver
+	TFStateId            string           // For kind tfstate, the TFState checked.
+	StateJSONBlob        string           `dynamodbav:",omitempty" json:",omitempty"` // blob store reference to StateJSON, when it's too big to keep it inline
+	PrevStateJSONBlob    string           `dynamodbav:",omitempty" json:",omitempty"` // blob store reference to PrevStateJSON, same as above
+	ExpiresAt            int64            `dynamodbav:",omitempty" json:",omitempty"` // when this log expires (unix timestamp), according to the retention policy. 0 = never.
 }
 
 const (
@@ -28,6 +33,19 @@ const (
 	logKindTFState    = "tfstate"
 )
 
+// newWaiverExpiredLog returns the log registered when the given waiver expires.
+func newWaiverExpiredLog(waiver *Waiver) *ValidationLog {
+	return &ValidationLog{
+		Id:        generateId(),
+		Timestamp: generateTimestamp(),
+		Kind:      logKindWaiverExpired,
+		Account:   waiver.Account,
+		TFStateId: waiver.TFStateId,
+		Details: fmt.Sprintf("waiver %s of %s for %s expired (approved by %s: %s)",
+			waiver.Id, waiver.FeatureName, waiver.ResourcePattern, waiver.Approver, waiver.Reason),
+	}
+}
+
 func newValidationLog(inputJSON string, complianceResult ComplianceResult) *ValidationLog {
 	return &ValidationLog{
 		Id:               generateId(),
@@ -43,6 +61,7 @@ func newTFStateLog(
 	complianceResult ComplianceResult,
 	prevStateJSON string,
 	prevComplianceResult ComplianceResult,
+	tfStateId string,
 	account string,
 	bucket string,
 	path string,
@@ -55,6 +74,7 @@ func newTFStateLog(
 		ComplianceResult:     complianceResult,
 		PrevStateJSON:        prevStateJSON,
 		PrevComplianceResult: prevComplianceResult,
+		TFStateId:            tfStateId,
 		Account:              account,
 		Details:              bucket + ":" + path,
 	}
@@ -70,12 +90,17 @@ func (l *ValidationLog) timestamp() int64 {
 	return l.Timestamp
 }
 
+func (l *ValidationLog) version() int64 {
+	return l.Version
+}
+
 func (l *ValidationLog) writeBasic(dst map[string]interface{}) {
 	dst["kind"] = l.Kind
 	dst["compliance_result"] = l.ComplianceResult
 	dst["prev_compliance_result"] = l.PrevComplianceResult
 	dst["account"] = l.Account
 	dst["details"] = l.Details
+	dst["tfstate_id"] = l.TFStateId
 }
 
 func (l *ValidationLog) writeDetailed(dst map[string]interface{}) {
@@ -89,6 +114,13 @@ func (l *ValidationLog) writeDetailed(dst map[string]interface{}) {
 	result := diffsToPrettyHtml(diff, diffs)            // as html
 	result = strings.Replace(result, "	", "&emsp;", -1) // Replace regular tabs with html tabs
 	dst["state_diff_html"] = result
+
+	// and which resources changed
+	stateDiff, err := diffTFStates(l.PrevStateJSON, l.StateJSON)
+	if err != nil {
+		log.Printf("Can't diff the states of log %s: %v", l.Id, err)
+	}
+	dst["state_diff"] = stateDiff
 }
 
 // diffsToPrettyHtml converts a []Diff into a pretty HTML report.
@@ -118,37 +150,76 @@ func diffsToPrettyHtml(_ *diffmatchpatch.DiffMatchPatch, diffs []diffmatchpatch.
 
 const validationLogTable = "logs"
 
+var logKindIndex = tableIndex{name: "Kind-Timestamp-index", hashKey: "Kind", rangeKey: "Timestamp"}
+
 func (db *database) loadAllLogsMinimal() ([]*ValidationLog, error) {
+	result, _, err := db.loadLogsMinimalPage(0, "")
+	return result, err
+}
+
+// loadLogsMinimalPage loads up to limit items (all if 0) starting from the given cursor.
+func (db *database) loadLogsMinimalPage(limit int, cursor string) ([]*ValidationLog, string, error) {
 	var result []*ValidationLog
-	err := db.loadGeneric(
+	nextCursor, err := db.loadGenericPage(
 		db.tableFor(validationLogTable),
-		[]string{"Kind", "ComplianceResult", "Account", "Details", "PrevComplianceResult"},
-		false,
-		expression.ConditionBuilder{},
-		func(i map[string]*dynamodb.AttributeValue) error {
+		[]string{"Kind", "ComplianceResult", "Account", "Details", "TFStateId", "PrevComplianceResult"},
+		nil,
+		limit,
+		cursor,
+		func(decode itemDecoder) error {
 			var elem ValidationLog
-			err := dynamodbattribute.UnmarshalMap(i, &elem)
+			err := decode(&elem)
 			if err == nil {
 				result = append(result, &elem)
 			}
 			return err
 		})
 
-	return result, err
+	return result, nextCursor, err
 }
 
-func (db *database) findLogById(id string) (*ValidationLog, error) {
-	var result *ValidationLog = nil
+// loadLogsMinimalByKindPage is like loadLogsMinimalPage, but loads just the logs
+// of the given kind, newest first.
+func (db *database) loadLogsMinimalByKindPage(kind string, limit int, cursor string) ([]*ValidationLog, string, error) {
+	var result []*ValidationLog
+	nextCursor, err := db.queryGenericPage(
+		db.tableFor(validationLogTable),
+		indexQuery{index: logKindIndex, hashValue: kind},
+		[]string{"Kind", "ComplianceResult", "Account", "Details", "TFStateId", "PrevComplianceResult"},
+		limit,
+		cursor,
+		func(decode itemDecoder) error {
+			var elem ValidationLog
+			err := decode(&elem)
+			if err == nil {
+				result = append(result, &elem)
+			}
+			return err
+		})
+
+	return result, nextCursor, err
+}
+
+func (db *database) loadAllLogsFull() ([]*ValidationLog, error) {
+	var result []*ValidationLog
 	err := db.loadGeneric(
 		db.tableFor(validationLogTable),
-		[]string{"Kind", "StateJSON", "ComplianceResult", "Account", "Details", "PrevStateJSON", "PrevComplianceResult"},
-		true,
-		expression.Name("Id").Equal(expression.Value(id)),
-		func(i map[string]*dynamodb.AttributeValue) error {
+		[]string{
+			"Kind", "StateJSON", "StateJSONBlob", "ComplianceResult", "Account", "Details",
+			"TFStateId", "PrevStateJSON", "PrevStateJSONBlob", "PrevComplianceResult",
+		},
+		nil,
+		func(decode itemDecoder) error {
 			var elem ValidationLog
-			err := dynamodbattribute.UnmarshalMap(i, &elem)
+			err := decode(&elem)
 			if err == nil {
-				result = &elem
+				elem.StateJSON, err = db.loadDocument(elem.StateJSONBlob, elem.StateJSON)
+			}
+			if err == nil {
+				elem.PrevStateJSON, err = db.loadDocument(elem.PrevStateJSONBlob, elem.PrevStateJSON)
+			}
+			if err == nil {
+				result = append(result, &elem)
 			}
 			return err
 		})
@@ -156,10 +227,86 @@ func (db *database) findLogById(id string) (*ValidationLog, error) {
 	return result, err
 }
 
+func (db *database) findLogById(id string) (*ValidationLog, error) {
+	var elem ValidationLog
+	found, err := db.getGeneric(
+		db.tableFor(validationLogTable),
+		id,
+		[]string{
+			"Kind", "StateJSON", "StateJSONBlob", "ComplianceResult", "Account", "Details",
+			"TFStateId", "PrevStateJSON", "PrevStateJSONBlob", "PrevComplianceResult",
+		},
+		&elem)
+	if err != nil || !found {
+		return nil, err
+	}
+
+	if elem.StateJSON, err = db.loadDocument(elem.StateJSONBlob, elem.StateJSON); err != nil {
+		return nil, err
+	}
+	if elem.PrevStateJSON, err = db.loadDocument(elem.PrevStateJSONBlob, elem.PrevStateJSON); err != nil {
+		return nil, err
+	}
+	return &elem, nil
+}
+
 func (db *database) saveLog(element *ValidationLog) error {
-	return db.insertOrUpdateGeneric(db.tableFor(validationLogTable), element)
+	element.SchemaVersion = latestSchemaVersion(validationLogTable)
+
+	// the states may be offloaded, so store a copy to keep element untouched.
+	stored := *element
+	stored.ExpiresAt = db.logRetention.expiresAt(element)
+	var err error
+	if stored.StateJSONBlob, stored.StateJSON, err = db.offloadDocument(element.StateJSON); err != nil {
+		return err
+	}
+	if stored.PrevStateJSONBlob, stored.PrevStateJSON, err = db.offloadDocument(element.PrevStateJSON); err != nil {
+		return err
+	}
+	if err := db.insertOrUpdateGeneric(db.tableFor(validationLogTable), &stored, &stored.Version); err != nil {
+		return err
+	}
+	element.Version = stored.Version
+	return nil
 }
 
 func (db *database) removeLog(id string) error {
 	return db.removeGeneric(db.tableFor(validationLogTable), id)
 }
+
+// removeLogsBefore removes the logs older than the given timestamp. If kind
+// is not empty, removes just the logs of that kind. Returns the number of removed logs.
+func (db *database) removeLogsBefore(before int64, kind string) (int, error) {
+	var ids []string
+	onItemLoaded := func(decode itemDecoder) error {
+		var elem ValidationLog
+		err := decode(&elem)
+		if err == nil && elem.Timestamp < before {
+			ids = append(ids, elem.Id)
+		}
+		return err
+	}
+
+	var err error
+	if kind != "" {
+		_, err = db.queryGenericPage(
+			db.tableFor(validationLogTable),
+			indexQuery{index: logKindIndex, hashValue: kind, rangeBefore: before},
+			[]string{},
+			0,
+			"",
+			onItemLoaded)
+	} else {
+		err = db.loadGeneric(db.tableFor(validationLogTable), []string{}, nil, onItemLoaded)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	for i, id := range ids {
+		if err := db.removeLog(id); err != nil {
+			return i, err
+		}
+	}
+	return len(ids), nil
+}
@@ -0,0 +1,112 @@
+// This file contains the log retention logic. Logs are expired through
+// the storage TTL when the backend supports it, and periodically
+// pruned anyway, since TTL deletion may be late (or unsupported).
+package main
+
+import (
+	"log"
+	"sort"
+	"time"
+)
+
+// logRetentionPolicy defines which logs must be kept.
+type logRetentionPolicy struct {
+	MaxAge        time.Duration // logs older than this are removed. 0 = keep forever.
+	MaxPerTFState int           // for kind tfstate, keep just the newest logs of each state. 0 = unlimited.
+	KeepFailing   bool          // keep the logs with failed validations regardless of the above
+}
+
+// useLogRetention makes the database expire logs according to the given policy.
+func (db *database) useLogRetention(policy logRetentionPolicy) {
+	db.logRetention = policy
+}
+
+// logExpiresAtAttribute is the log attribute used as storage TTL.
+const logExpiresAtAttribute = "ExpiresAt"
+
+// isFailingLog returns true if the validation registered in the log failed.
+func isFailingLog(l *ValidationLog) bool {
+	return l.ComplianceResult.FailCount > 0 || l.ComplianceResult.Error
+}
+
+// expiresAt returns when the given log expires (unix timestamp), or 0 if it never does.
+func (policy logRetentionPolicy) expiresAt(l *ValidationLog) int64 {
+	if policy.MaxAge == 0 || (policy.KeepFailing && isFailingLog(l)) {
+		return 0
+	}
+	return time.Unix(l.Timestamp, 0).Add(policy.MaxAge).Unix()
+}
+
+// logsToPrune returns the ids of the given logs that must be
+// removed at the given time, according to the policy.
+func logsToPrune(logs []*ValidationLog, policy logRetentionPolicy, now time.Time) []string {
+	// rank the tfstate logs of each state, newest first.
+	rank := make(map[*ValidationLog]int)
+	if policy.MaxPerTFState > 0 {
+		byState := make(map[string][]*ValidationLog)
+		for _, l := range logs {
+			if l.Kind == logKindTFState {
+				key := l.TFStateId
+				if key == "" { // logs registered before linking them to the state
+					key = l.Account + "/" + l.Details
+				}
+				byState[key] = append(byState[key], l)
+			}
+		}
+		for _, stateLogs := range byState {
+			sort.SliceStable(stateLogs, func(i, j int) bool { return stateLogs[i].Timestamp > stateLogs[j].Timestamp })
+			for i, l := range stateLogs {
+				rank[l] = i
+			}
+		}
+	}
+
+	var result []string
+	for _, l := range logs {
+		if policy.KeepFailing && isFailingLog(l) {
+			continue
+		}
+
+		expired := policy.MaxAge > 0 && now.Sub(time.Unix(l.Timestamp, 0)) > policy.MaxAge
+		exceeding := policy.MaxPerTFState > 0 && l.Kind == logKindTFState && rank[l] >= policy.MaxPerTFState
+		if expired || exceeding {
+			result = append(result, l.Id)
+		}
+	}
+	return result
+}
+
+// pruneLogs removes the logs that must not be kept anymore. Returns the number of removed logs.
+// Note that the documents offloaded to the blob store are not removed, since they may be shared.
+func (db *database) pruneLogs(now time.Time) (int, error) {
+	logs, err := db.loadAllLogsMinimal()
+	if err != nil {
+		return 0, err
+	}
+
+	ids := logsToPrune(logs, db.logRetention, now)
+	for i, id := range ids {
+		if err := db.removeLog(id); err != nil {
+			return i, err
+		}
+	}
+	return len(ids), nil
+}
+
+// initLogPruning starts a goroutine that periodically removes
+// the logs that the retention policy doesn't keep.
+func initLogPruning(db *database, frequency time.Duration) {
+	ticker := time.NewTicker(frequency)
+	go func() {
+		for range ticker.C {
+			count, err := db.pruneLogs(time.Now())
+			if err != nil {
+				log.Printf("can't prune logs: %v", err)
+				continue
+			}
+			if count > 0 {
+				log.Printf("Pruned %d logs.", count)
+			}
+		}
+	}()
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestLogsToPrune(t *testing.T) {
+	now := time.Unix(10000, 0)
+	newLog := func(id string, kind string, details string, age time.Duration, failing bool) *ValidationLog {
+		l := &ValidationLog{Id: id, Kind: kind, Account: "acc", Details: details, Timestamp: now.Add(-age).Unix()}
+		if failing {
+			l.ComplianceResult.FailCount = 1
+		}
+		return l
+	}
+	logs := []*ValidationLog{
+		newLog("a1", logKindTFState, "b:a", 1*time.Hour, false),
+		newLog("a2", logKindTFState, "b:a", 2*time.Hour, false),
+		newLog("a3", logKindTFState, "b:a", 3*time.Hour, true),
+		newLog("a4", logKindTFState, "b:a", 4*time.Hour, false),
+		newLog("b1", logKindTFState, "b:b", 1*time.Hour, false),
+		newLog("v1", logKindValidation, "", 1*time.Hour, false),
+		newLog("v2", logKindValidation, "", 2*time.Hour, true),
+	}
+
+	cases := []struct {
+		policy   logRetentionPolicy
+		expected []string
+	}{
+		{logRetentionPolicy{}, nil},
+		{logRetentionPolicy{MaxAge: 90 * time.Minute}, []string{"a2", "a3", "a4", "v2"}},
+		{logRetentionPolicy{MaxAge: 90 * time.Minute, KeepFailing: true}, []string{"a2", "a4"}},
+		{logRetentionPolicy{MaxPerTFState: 2}, []string{"a3", "a4"}},
+		{logRetentionPolicy{MaxPerTFState: 1, KeepFailing: true}, []string{"a2", "a4"}},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.expected, logsToPrune(logs, c.policy, now), "policy %+v", c.policy)
+	}
+}
+
+func TestLogExpiresAt(t *testing.T) {
+	passing := &ValidationLog{Timestamp: 1000}
+	failing := &ValidationLog{Timestamp: 1000, ComplianceResult: ComplianceResult{Error: true}}
+
+	assert.Equal(t, int64(0), logRetentionPolicy{}.expiresAt(passing))
+	assert.Equal(t, int64(1060), logRetentionPolicy{MaxAge: time.Minute}.expiresAt(passing))
+	assert.Equal(t, int64(1060), logRetentionPolicy{MaxAge: time.Minute}.expiresAt(failing))
+	assert.Equal(t, int64(0), logRetentionPolicy{MaxAge: time.Minute, KeepFailing: true}.expiresAt(failing))
+}
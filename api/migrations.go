@@ -0,0 +1,155 @@
+// This file contains the schema migrations of the stored items. Items are
+// stamped with the schema version of their table when saved, and items
+// saved by older versions are upgraded in place when the server starts.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"reflect"
+)
+
+// migration upgrades the items of a table to the given schema version.
+type migration struct {
+	table       string
+	version     int // the schema version of the upgraded items
+	description string
+	upgrade     func(obj restObject) // upgrades obj in place
+}
+
+// migrations lists all the migrations. To add one, append it with the
+// next version for its table (versions start at 1 for each table).
+var migrations = []migration{
+	{
+		table:       complianceFeatureTable,
+		version:     1,
+		description: "initialize the tags of untagged features (without enrolling them in any check)",
+		upgrade: func(obj restObject) {
+			feature := obj.(*ComplianceFeature)
+			if feature.Tags == nil {
+				feature.Tags = []string{}
+			}
+		},
+	},
+	{
+		table:       tfStateTable,
+		version:     1,
+		description: "initialize the tags and the last update of tfstates",
+		upgrade: func(obj restObject) {
+			state := obj.(*TFState)
+			if state.Tags == nil {
+				state.Tags = []string{}
+			}
+			if state.LastUpdate == "" {
+				state.LastUpdate = "never"
+			}
+		},
+	},
+	{
+		table:       validationLogTable,
+		version:     1,
+		description: "set the kind of logs registered before tfstate monitoring",
+		upgrade: func(obj restObject) {
+			l := obj.(*ValidationLog)
+			if l.Kind == "" {
+				l.Kind = logKindValidation
+			}
+		},
+	},
+}
+
+// latestSchemaVersion returns the schema version of the items of the given table.
+func latestSchemaVersion(table string) int {
+	latest := 0
+	for _, m := range migrations {
+		if m.table == table && m.version > latest {
+			latest = m.version
+		}
+	}
+	return latest
+}
+
+// upgradeItem runs on obj the migrations of the given table that it lacks, and stamps
+// it with the latest schema version. Returns the applied migrations.
+func upgradeItem(table string, obj restObject) []migration {
+	schemaVersion := reflect.ValueOf(obj).Elem().FieldByName("SchemaVersion")
+	var applied []migration
+	for _, m := range migrations { // in order, as versions are increasing
+		if m.table == table && int64(m.version) > schemaVersion.Int() {
+			m.upgrade(obj)
+			applied = append(applied, m)
+		}
+	}
+	schemaVersion.SetInt(int64(latestSchemaVersion(table)))
+	return applied
+}
+
+// tableSchema records the schema version that all the items of a table were migrated to.
+type tableSchema struct {
+	Id            string // the table name (without prefix)
+	Timestamp     int64
+	Version       int64
+	SchemaVersion int
+}
+
+const tableSchemaTable = "schema"
+
+// runMigrations upgrades the items of all the tables to their latest schema version.
+// Tables already migrated are skipped. If dryRun is true, nothing is saved. Returns
+// the number of items upgraded (or to be upgraded, on dry runs).
+func (db *database) runMigrations(dryRun bool) (int, error) {
+	total := 0
+	for _, table := range exportTables {
+		latest := latestSchemaVersion(table.name)
+
+		var schema tableSchema
+		found, err := db.getGeneric(db.tableFor(tableSchemaTable), table.name, []string{"SchemaVersion"}, &schema)
+		if err != nil {
+			return total, fmt.Errorf("can't get schema of %s: %v", table.name, err)
+		}
+		if !found {
+			schema = tableSchema{Id: table.name, Timestamp: generateTimestamp()}
+		}
+		if schema.SchemaVersion >= latest {
+			continue
+		}
+
+		objs, err := table.loadAll(db)
+		if err != nil {
+			return total, fmt.Errorf("can't load %s: %v", table.name, err)
+		}
+
+		counts := make(map[int]int) // migration version -> upgraded items
+		for _, obj := range objs {
+			applied := upgradeItem(table.name, obj)
+			if len(applied) == 0 {
+				continue
+			}
+			for _, m := range applied {
+				counts[m.version]++
+			}
+			total++
+
+			if !dryRun {
+				if err := table.save(db, obj); err != nil {
+					return total, fmt.Errorf("can't save %s in %s: %v", obj.id(), table.name, err)
+				}
+			}
+		}
+
+		for _, m := range migrations {
+			if m.table == table.name && m.version > schema.SchemaVersion {
+				log.Printf("Migration %s v%d (%s): %d items", m.table, m.version, m.description, counts[m.version])
+			}
+		}
+
+		if !dryRun {
+			schema.SchemaVersion = latest
+			if err := db.insertOrUpdateGeneric(db.tableFor(tableSchemaTable), &schema, &schema.Version); err != nil {
+				return total, fmt.Errorf("can't save schema of %s: %v", table.name, err)
+			}
+		}
+	}
+	return total, nil
+}
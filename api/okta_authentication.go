@@ -14,7 +14,7 @@ var (
 )
 
 // InitOktaLoginCredentials sets the credentials used
-// in LoginDetailsHandler and IsAuthenticated.
+// in LoginDetailsHandler and OktaAuthenticatedUser.
 func InitOktaLoginCredentials(clientId, issuerUrl string) {
 	OktaClientId = clientId
 	OktaIssuerUrl = issuerUrl
@@ -30,9 +30,9 @@ func LoginDetailsHandler(_ *database, _ string, _ map[string]string) (string, in
 	return string(result), http.StatusOK, nil
 }
 
-// IsAuthenticated returns true if the given request has
-// an 'Authorization' header with a valid okta access token.
-func IsAuthenticated(r *http.Request) bool {
+// OktaAuthenticatedUser returns the user (the 'sub' claim) of the access token of the given
+// request, and true if the request has an 'Authorization' header with a valid okta access token.
+func OktaAuthenticatedUser(r *http.Request) (string, bool) {
 	if OktaClientId == "" || OktaIssuerUrl == "" {
 		panic("okta credentials not initialized. Init them using InitOktaLoginCredentials")
 	}
@@ -40,9 +40,12 @@ func IsAuthenticated(r *http.Request) bool {
 	authHeader := r.Header.Get("Authorization")
 
 	if authHeader == "" {
-		return false
+		return "", false
 	}
 	tokenParts := strings.Split(authHeader, "Bearer ")
+	if len(tokenParts) != 2 {
+		return "", false
+	}
 	bearerToken := tokenParts[1]
 
 	tv := map[string]string{}
@@ -53,11 +56,12 @@ func IsAuthenticated(r *http.Request) bool {
 		ClaimsToValidate: tv,
 	}
 
-	_, err := jv.New().VerifyAccessToken(bearerToken)
+	token, err := jv.New().VerifyAccessToken(bearerToken)
 
 	if err != nil {
-		return false
+		return "", false
 	}
 
-	return true
+	user, _ := token.Claims["sub"].(string)
+	return user, true
 }
@@ -0,0 +1,465 @@
+// This file contains the native policy engine, which evaluates in-process a
+// subset of the terraform-compliance steps, without running the tool:
+//
+//	Given I have <type> defined (or "resource configured", or "<type> data defined" for data sources)
+//	When it contains <property>
+//	Then it must contain <property>
+//	Then it must not contain <property>
+//	Then its value must match the "<regex>" regex
+//	Then its value must not match the "<regex>" regex
+//	Then its value must not be null
+//
+// Scenario Outlines (with Examples) are supported too. The failures are given as
+// findings, along with an output that mimics the tool's for the logs.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	engineTerraformCompliance = "terraform-compliance"
+	engineNative              = "native"
+)
+
+// defaultPolicyEngine is the engine used by the features that don't specify one.
+var defaultPolicyEngine = engineTerraformCompliance
+
+// validPolicyEngine returns true if engine is a known engine (or empty, for the default one).
+func validPolicyEngine(engine string) bool {
+	return engine == "" || engine == engineTerraformCompliance || engine == engineNative
+}
+
+// featureEngine returns the engine that must evaluate the given feature.
+func featureEngine(f *ComplianceFeature) string {
+	if f.Engine == "" {
+		return defaultPolicyEngine
+	}
+	return f.Engine
+}
+
+// policyResource is a resource of a plan or state, as given by "terraform show -json".
+type policyResource struct {
+	Address string                 `json:"address"`
+	Mode    string                 `json:"mode"` // "managed" or "data"
+	Type    string                 `json:"type"`
+	Values  map[string]interface{} `json:"values"`
+}
+
+// loadPolicyResources returns all the resources (in any module) of the given
+// plan or state, in the format given by "terraform show -json".
+func loadPolicyResources(input []byte) ([]policyResource, error) {
+	type module struct {
+		Resources    []policyResource  `json:"resources"`
+		ChildModules []json.RawMessage `json:"child_modules"`
+	}
+	type values struct {
+		RootModule json.RawMessage `json:"root_module"`
+	}
+	var doc struct {
+		PlannedValues *values `json:"planned_values"` // for plans
+		Values        *values `json:"values"`         // for states
+	}
+	if err := json.Unmarshal(input, &doc); err != nil {
+		return nil, fmt.Errorf("can't parse input json: %v", err)
+	}
+
+	var root json.RawMessage
+	if doc.PlannedValues != nil {
+		root = doc.PlannedValues.RootModule
+	} else if doc.Values != nil {
+		root = doc.Values.RootModule
+	}
+
+	var result []policyResource
+	var walk func(raw json.RawMessage) error
+	walk = func(raw json.RawMessage) error {
+		if len(raw) == 0 {
+			return nil
+		}
+		var m module
+		if err := json.Unmarshal(raw, &m); err != nil {
+			return fmt.Errorf("can't parse module: %v", err)
+		}
+		result = append(result, m.Resources...)
+		for _, child := range m.ChildModules {
+			if err := walk(child); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return result, walk(root)
+}
+
+// policyStep is a step of a scenario, like "Then it must contain tags".
+type policyStep struct {
+	keyword string // Given, When or Then (And and But take the previous keyword)
+	text    string // the step without the keyword
+}
+
+// policyScenario is a scenario, or a scenario outline along with its examples.
+type policyScenario struct {
+	name     string
+	steps    []policyStep
+	examples []map[string]string // for outlines, one map per example row (column -> value)
+}
+
+// policyFeature is a parsed feature.
+type policyFeature struct {
+	title     string
+	scenarios []policyScenario
+}
+
+// parsePolicyFeature parses the gherkin source of a feature.
+func parsePolicyFeature(source string) (*policyFeature, error) {
+	result := &policyFeature{}
+	var current *policyScenario
+	var header []string // the columns of the current examples table
+	inExamples := false
+	prevKeyword := ""
+
+	for i, line := range strings.Split(source, "\n") {
+		l := strings.TrimSpace(line)
+		lineErr := func(format string, args ...interface{}) error {
+			return fmt.Errorf("line %d: %s", i+1, fmt.Sprintf(format, args...))
+		}
+
+		switch {
+		case l == "" || strings.HasPrefix(l, "#") || strings.HasPrefix(l, "@"):
+			continue
+		case strings.HasPrefix(l, "Feature:"):
+			result.title = strings.TrimSpace(strings.TrimPrefix(l, "Feature:"))
+		case strings.HasPrefix(l, "Scenario Outline:"), strings.HasPrefix(l, "Scenario:"):
+			name := strings.TrimSpace(l[strings.Index(l, ":")+1:])
+			result.scenarios = append(result.scenarios, policyScenario{name: name})
+			current = &result.scenarios[len(result.scenarios)-1]
+			inExamples, header, prevKeyword = false, nil, ""
+		case strings.HasPrefix(l, "Examples:"):
+			if current == nil {
+				return nil, lineErr("examples out of a scenario")
+			}
+			inExamples = true
+		case strings.HasPrefix(l, "|"):
+			if !inExamples {
+				return nil, lineErr("table out of examples")
+			}
+			cells := splitTableRow(l)
+			if header == nil {
+				header = cells
+				continue
+			}
+			if len(cells) > len(header) { // unescaped '|' in the last column, like in "^(a|b)$"
+				cells = append(cells[:len(header)-1], strings.Join(cells[len(header)-1:], "|"))
+			}
+			if len(cells) != len(header) {
+				return nil, lineErr("expected %d columns, got %d", len(header), len(cells))
+			}
+			row := make(map[string]string)
+			for j, column := range header {
+				row[column] = cells[j]
+			}
+			current.examples = append(current.examples, row)
+		default:
+			fields := strings.SplitN(l, " ", 2)
+			keyword := fields[0]
+			switch keyword {
+			case "Given", "When", "Then":
+			case "And", "But":
+				keyword = prevKeyword
+			default:
+				if current == nil { // the feature description
+					continue
+				}
+				return nil, lineErr("unexpected '%s'", l)
+			}
+			if current == nil || keyword == "" || len(fields) != 2 {
+				return nil, lineErr("unexpected step '%s'", l)
+			}
+			current.steps = append(current.steps, policyStep{keyword: keyword, text: strings.TrimSpace(fields[1])})
+			prevKeyword = keyword
+		}
+	}
+
+	if len(result.scenarios) == 0 {
+		return nil, fmt.Errorf("no scenarios defined")
+	}
+	return result, nil
+}
+
+// splitTableRow returns the trimmed cells of the given table row. Cells may contain escaped pipes (\|).
+func splitTableRow(row string) []string {
+	row = strings.TrimSuffix(strings.TrimPrefix(row, "|"), "|")
+	cells := strings.Split(strings.Replace(row, `\|`, "\x00", -1), "|")
+	for i := range cells {
+		cells[i] = strings.TrimSpace(strings.Replace(cells[i], "\x00", "|", -1))
+	}
+	return cells
+}
+
+var (
+	givenResourceRegexp = regexp.MustCompile(`^I have (\S+) (?:resources? )?(?:defined|configured)$`)
+	givenDataRegexp     = regexp.MustCompile(`^I have (\S+) data (?:defined|configured)$`)
+	containsRegexp      = regexp.MustCompile(`^it (?:contains|has) (\S+)$`)
+	mustContainRegexp   = regexp.MustCompile(`^it must (not )?(?:contain|have) (\S+)$`)
+	valueMatchRegexp    = regexp.MustCompile(`^its value must (not )?match the "(.*)" regex$`)
+	valueNotNullRegexp  = regexp.MustCompile(`^its value must not be null$`)
+	outlineParamRegexp  = regexp.MustCompile(`<([^>]+)>`)
+)
+
+// policyMatch is a resource being checked by a scenario, and the property
+// of it the steps are currently on (the resource itself initially).
+type policyMatch struct {
+	resource policyResource
+	property string      // the current property name, empty for the resource itself
+	value    interface{} // the current property value
+}
+
+func (m policyMatch) String() string {
+	return fmt.Sprintf("%s (%s)", m.resource.Address, m.resource.Type)
+}
+
+// failure returns a failure of the resource of this match, with the given message.
+func (m policyMatch) failure(message string) policyFailure {
+	return policyFailure{resourceAddress: m.resource.Address, resourceType: m.resource.Type, message: message}
+}
+
+// lookupProperty returns the value of the given property inside value, if any.
+// Blocks are lists of objects in terraform json, so lists are looked into too.
+func lookupProperty(value interface{}, property string) (interface{}, bool) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		found, ok := v[property]
+		return found, ok
+	case []interface{}:
+		var found []interface{}
+		for _, elem := range v {
+			if f, ok := lookupProperty(elem, property); ok {
+				found = append(found, f)
+			}
+		}
+		if len(found) == 1 {
+			return found[0], true
+		}
+		return found, len(found) > 0
+	}
+	return nil, false
+}
+
+// scalarValues returns all the scalar values inside value, as strings.
+func scalarValues(value interface{}) []string {
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		var result []string
+		for _, k := range keys {
+			result = append(result, scalarValues(v[k])...)
+		}
+		return result
+	case []interface{}:
+		var result []string
+		for _, elem := range v {
+			result = append(result, scalarValues(elem)...)
+		}
+		return result
+	default:
+		return []string{fmt.Sprint(v)}
+	}
+}
+
+// runPolicyStep runs the given step against the current matches. Returns the
+// matches for the next step and the failures (without their step), if any.
+func runPolicyStep(step policyStep, resources []policyResource, matches []policyMatch) ([]policyMatch, []policyFailure, error) {
+	if step.keyword == "Given" {
+		var mode, resourceType string
+		if groups := givenDataRegexp.FindStringSubmatch(step.text); groups != nil {
+			mode, resourceType = "data", groups[1]
+		} else if groups := givenResourceRegexp.FindStringSubmatch(step.text); groups != nil {
+			mode, resourceType = "managed", groups[1]
+		} else {
+			return nil, nil, fmt.Errorf("unsupported step 'Given %s'", step.text)
+		}
+
+		var result []policyMatch
+		for _, r := range resources {
+			resourceMode := r.Mode
+			if resourceMode == "" {
+				resourceMode = "managed"
+			}
+			if resourceMode == mode && (r.Type == resourceType || (mode == "managed" && resourceType == "resource")) {
+				result = append(result, policyMatch{resource: r, value: r.Values})
+			}
+		}
+		return result, nil, nil
+	}
+
+	if groups := containsRegexp.FindStringSubmatch(step.text); groups != nil && step.keyword == "When" {
+		// filter, keeping the matches with the property
+		var result []policyMatch
+		for _, m := range matches {
+			if value, ok := lookupProperty(m.value, groups[1]); ok {
+				result = append(result, policyMatch{resource: m.resource, property: groups[1], value: value})
+			}
+		}
+		return result, nil, nil
+	}
+
+	if step.keyword != "Then" {
+		return nil, nil, fmt.Errorf("unsupported step '%s %s'", step.keyword, step.text)
+	}
+
+	var result []policyMatch
+	var failures []policyFailure
+	if groups := mustContainRegexp.FindStringSubmatch(step.text); groups != nil {
+		negated, property := groups[1] != "", groups[2]
+		for _, m := range matches {
+			value, ok := lookupProperty(m.value, property)
+			switch {
+			case !negated && !ok:
+				failures = append(failures, m.failure(fmt.Sprintf("%s does not have %s property.", m, property)))
+			case negated && ok:
+				failures = append(failures, m.failure(fmt.Sprintf("%s property exists in %s.", property, m)))
+			case ok:
+				result = append(result, policyMatch{resource: m.resource, property: property, value: value})
+			default:
+				result = append(result, m)
+			}
+		}
+	} else if groups := valueMatchRegexp.FindStringSubmatch(step.text); groups != nil {
+		negated := groups[1] != ""
+		re, err := regexp.Compile(groups[2])
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid regex '%s': %v", groups[2], err)
+		}
+		for _, m := range matches {
+			result = append(result, m)
+			for _, value := range scalarValues(m.value) {
+				if re.MatchString(value) == negated {
+					verb := "does not match"
+					if negated {
+						verb = "matches"
+					}
+					failures = append(failures, m.failure(fmt.Sprintf("%s property in %s %s the \"%s\" regex. It is set to \"%s\".", m.property, m, verb, re, value)))
+				}
+			}
+		}
+	} else if valueNotNullRegexp.MatchString(step.text) {
+		for _, m := range matches {
+			if len(scalarValues(m.value)) == 0 {
+				failures = append(failures, m.failure(fmt.Sprintf("%s property in %s is null.", m.property, m)))
+			} else {
+				result = append(result, m)
+			}
+		}
+	} else {
+		return nil, nil, fmt.Errorf("unsupported step 'Then %s'", step.text)
+	}
+
+	return result, failures, nil
+}
+
+// policyFailure is a failure of a scenario step.
+type policyFailure struct {
+	step            string // the step that failed, like "Then it must contain tags"
+	resourceAddress string // the failing resource, empty if the step itself failed
+	resourceType    string
+	message         string
+}
+
+// runPolicyScenario runs the steps of the given scenario (with the given outline
+// parameters) against the resources, and returns all the failures. Unsupported
+// steps fail too, stopping the scenario.
+func runPolicyScenario(scenario policyScenario, params map[string]string, resources []policyResource) []policyFailure {
+	var matches []policyMatch
+	var failures []policyFailure
+	for _, step := range scenario.steps {
+		step.text = outlineParamRegexp.ReplaceAllStringFunc(step.text, func(param string) string {
+			if value, ok := params[strings.Trim(param, "<>")]; ok {
+				return value
+			}
+			return param
+		})
+		stepLine := step.keyword + " " + step.text
+
+		var stepFailures []policyFailure
+		var err error
+		matches, stepFailures, err = runPolicyStep(step, resources, matches)
+		if err != nil {
+			return append(failures, policyFailure{step: stepLine, message: err.Error()})
+		}
+		for _, failure := range stepFailures {
+			failure.step = stepLine
+			failures = append(failures, failure)
+		}
+		if len(matches) == 0 { // nothing left to check, skip the rest of the scenario
+			break
+		}
+	}
+	return failures
+}
+
+// runNativeEngine evaluates the given features against the given plan or state json,
+// and returns an output in the terraform-compliance format and the failures found.
+func runNativeEngine(input []byte, features []*ComplianceFeature) (string, []ComplianceFinding, error) {
+	resources, err := loadPolicyResources(input)
+	if err != nil {
+		return "", nil, err
+	}
+
+	sb := strings.Builder{}
+	var findings []ComplianceFinding
+	for _, f := range features {
+		feature, err := parsePolicyFeature(f.Source)
+		title := f.Name
+		if err == nil && feature.title != "" {
+			title = strings.Replace(feature.title, "#", "", -1) // '#' separates the feature file
+		}
+		sb.WriteString(fmt.Sprintf("Feature: %s  # %s.feature\n", title, f.Name))
+		if err != nil {
+			message := fmt.Sprintf("can't parse feature: %v", err)
+			sb.WriteString(fmt.Sprintf("  Failure: %s\n", message))
+			findings = append(findings, ComplianceFinding{Feature: f.Name, Message: message})
+			continue
+		}
+
+		for _, scenario := range feature.scenarios {
+			sb.WriteString(fmt.Sprintf("\n    Scenario: %s\n", scenario.name))
+			examples := scenario.examples
+			if len(examples) == 0 {
+				examples = []map[string]string{nil}
+			}
+			for _, params := range examples {
+				// the failing steps are written before their failures, as the tool does.
+				lastStep := ""
+				for _, failure := range runPolicyScenario(scenario, params, resources) {
+					if failure.step != lastStep {
+						sb.WriteString(fmt.Sprintf("        %s\n", failure.step))
+						lastStep = failure.step
+					}
+					sb.WriteString(fmt.Sprintf("          Failure: %s\n", failure.message))
+					findings = append(findings, ComplianceFinding{
+						Feature:         f.Name,
+						Scenario:        scenario.name,
+						Step:            failure.step,
+						ResourceAddress: failure.resourceAddress,
+						ResourceType:    failure.resourceType,
+						Message:         failure.message,
+					})
+				}
+			}
+		}
+		sb.WriteString("\n")
+	}
+	return sb.String(), findings, nil
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+const policyEngineTestPlan = `{
+	"format_version": "0.1",
+	"planned_values": {
+		"root_module": {
+			"resources": [
+				{
+					"address": "aws_instance.example",
+					"mode": "managed",
+					"type": "aws_instance",
+					"values": {"ami": "ami-123"}
+				},
+				{
+					"address": "aws_instance.example2",
+					"mode": "managed",
+					"type": "aws_instance",
+					"values": {"ami": "ami-456", "tags": {"Name": "web", "environment": "staging"}}
+				},
+				{
+					"address": "data.aws_availability_zones.all",
+					"mode": "data",
+					"type": "aws_availability_zones",
+					"values": {"zone_ids": ["use1-az1"]}
+				}
+			],
+			"child_modules": [
+				{
+					"resources": [
+						{
+							"address": "module.bucket.aws_s3_bucket.b",
+							"mode": "managed",
+							"type": "aws_s3_bucket",
+							"values": {"acl": "public-read", "bucket": "arn:aws:s3:::b"}
+						}
+					]
+				}
+			]
+		}
+	}
+}`
+
+func TestNativeEngine(t *testing.T) {
+	features := []*ComplianceFeature{
+		newFeature("tags", `Feature: Ensure resources have tags
+	In order to keep track of resource ownership
+
+	Scenario: Ensure all instances have tags
+		Given I have aws_instance defined
+		Then it must contain tags
+
+	Scenario Outline: Ensure that specific tags are defined
+		Given I have aws_instance defined
+		When it contains tags
+		Then it must contain <tags>
+		And its value must match the "<value>" regex
+
+	Examples:
+		| tags        | value            |
+		| Name        | .+               |
+		| environment | ^(prod|uat|dev)$ |
+`, []string{"validation"}),
+		newFeature("s3", `Feature: S3 buckets must be private
+	Scenario: No public acls
+		Given I have aws_s3_bucket resource configured
+		When it contains acl
+		Then its value must not match the "public" regex
+
+	Scenario: Not existing resources are skipped
+		Given I have aws_lb defined
+		Then it must contain listener
+`, []string{"validation"}),
+		newFeature("zones", `Feature: Zones
+	Scenario: Zones are listed
+		Given I have aws_availability_zones data defined
+		Then it must contain zone_ids
+		And its value must not be null
+`, []string{"validation"}),
+		newFeature("unsupported", `Feature: Unsupported
+	Scenario: Count
+		Given I have aws_instance defined
+		When I count them
+`, []string{"validation"}),
+	}
+	for _, f := range features {
+		f.Engine = engineNative
+	}
+
+	input, output, result, err := runComplianceTool([]byte(policyEngineTestPlan), features)
+	require.Nil(t, err)
+	assert.Equal(t, policyEngineTestPlan, input)
+	assert.Equal(t, result.FeaturesFailures, parseComplianceOutput(output).FeaturesFailures, "the output mimics the tool's")
+
+	assert.False(t, result.Error, result.ErrorMessage)
+	assert.Equal(t, map[string]bool{"tags": false, "s3": false, "zones": true, "unsupported": false}, result.FeaturesResult)
+	assert.Equal(t, map[string][]string{
+		"tags": {
+			"aws_instance.example (aws_instance) does not have tags property.",
+			"environment property in aws_instance.example2 (aws_instance) does not match the \"^(prod|uat|dev)$\" regex. It is set to \"staging\".",
+		},
+		"s3": {
+			"acl property in module.bucket.aws_s3_bucket.b (aws_s3_bucket) matches the \"public\" regex. It is set to \"public-read\".",
+		},
+		"zones": {},
+		"unsupported": {
+			"unsupported step 'When I count them'",
+		},
+	}, result.FeaturesFailures)
+	assert.Equal(t, 1, result.PassCount)
+	assert.Equal(t, 3, result.FailCount)
+	require.Len(t, result.Findings, 4)
+	assert.Equal(t, ComplianceFinding{
+		Feature:         "s3",
+		Scenario:        result.Findings[2].Scenario,
+		Step:            result.Findings[2].Step,
+		ResourceAddress: "module.bucket.aws_s3_bucket.b",
+		ResourceType:    "aws_s3_bucket",
+		Message:         "acl property in module.bucket.aws_s3_bucket.b (aws_s3_bucket) matches the \"public\" regex. It is set to \"public-read\".",
+	}, result.Findings[2])
+	assert.Equal(t, ComplianceFinding{
+		Feature:  "unsupported",
+		Scenario: "Count",
+		Step:     "When I count them",
+		Message:  "unsupported step 'When I count them'",
+	}, result.Findings[3])
+}
+
+func TestParsePolicyFeature(t *testing.T) {
+	feature, err := parsePolicyFeature(`@tag
+Feature: Outline
+	Some description
+
+	Scenario Outline: With examples
+		Given I have aws_instance defined
+		When it contains <key>
+		But its value must not be null
+
+	Examples:
+		| key  |
+		| ami  |
+		| tags |
+`)
+	require.Nil(t, err)
+	assert.Equal(t, "Outline", feature.title)
+	require.Len(t, feature.scenarios, 1)
+	assert.Equal(t, []policyStep{
+		{keyword: "Given", text: "I have aws_instance defined"},
+		{keyword: "When", text: "it contains <key>"},
+		{keyword: "When", text: "its value must not be null"},
+	}, feature.scenarios[0].steps)
+	assert.Equal(t, []map[string]string{{"key": "ami"}, {"key": "tags"}}, feature.scenarios[0].examples)
+
+	_, err = parsePolicyFeature("Feature: Empty\n")
+	assert.NotNil(t, err)
+
+	_, err = parsePolicyFeature("Feature: Bad table\n\tScenario: s\n\t\t| a |\n")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,140 @@
+// This file contains the evaluation of the features written in Rego, which are
+// evaluated in-process with OPA. The plan or state json (as given by "terraform
+// show -json") is the policy input, and each message of its deny rule is a failure.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/rego"
+	"strings"
+	"time"
+)
+
+const (
+	languageGherkin = "gherkin"
+	languageRego    = "rego"
+)
+
+// regoEvalTimeout limits the evaluation of each rego feature.
+const regoEvalTimeout = 10 * time.Second
+
+// regoUnsafeBuiltins are the builtins features can't use, as they would give access to the
+// server: its environment (with its credentials) and its network.
+var regoUnsafeBuiltins = map[string]struct{}{
+	ast.HTTPSend.Name:   {},
+	ast.OPARuntime.Name: {},
+}
+
+// validPolicyLanguage returns true if language is a known language (or empty, for gherkin).
+func validPolicyLanguage(language string) bool {
+	return language == "" || language == languageGherkin || language == languageRego
+}
+
+// featureLanguage returns the language the source of the given feature is written in.
+func featureLanguage(f *ComplianceFeature) string {
+	if f.Language == "" {
+		return languageGherkin
+	}
+	return f.Language
+}
+
+// parseRegoPolicy parses and compiles the given rego source, and returns the query
+// of its deny rule (like "data.terraform.s3.deny"). It must define the deny rule
+// (it would always pass otherwise), and not use regoUnsafeBuiltins.
+func parseRegoPolicy(name string, source string) (string, error) {
+	module, err := ast.ParseModule(name+".rego", source)
+	if err != nil {
+		return "", err
+	}
+	if module == nil {
+		return "", fmt.Errorf("empty policy")
+	}
+
+	hasDeny := false
+	for _, rule := range module.Rules {
+		hasDeny = hasDeny || rule.Head.Name.Equal(ast.Var("deny"))
+	}
+	if !hasDeny {
+		return "", ast.Errors{ast.NewError(ast.CompileErr, module.Package.Location, "no deny rule defined")}
+	}
+
+	compiler := ast.NewCompiler().WithUnsafeBuiltins(regoUnsafeBuiltins)
+	if compiler.Compile(map[string]*ast.Module{name + ".rego": module}); compiler.Failed() {
+		return "", compiler.Errors
+	}
+	return module.Package.Path.String() + ".deny", nil
+}
+
+// evalRegoPolicy evaluates the given rego feature against the given input,
+// and returns the messages of its deny rule.
+func evalRegoPolicy(f *ComplianceFeature, input interface{}) ([]string, error) {
+	query, err := parseRegoPolicy(f.Name, f.Source)
+	if err != nil {
+		return nil, fmt.Errorf("can't parse policy: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), regoEvalTimeout)
+	defer cancel()
+	resultSet, err := rego.New(
+		rego.Query(query),
+		rego.Module(f.Name+".rego", f.Source),
+		rego.Input(input),
+		rego.UnsafeBuiltins(regoUnsafeBuiltins),
+	).Eval(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("can't evaluate policy: %v", err)
+	}
+
+	var messages []string
+	for _, result := range resultSet {
+		for _, expression := range result.Expressions {
+			denied, ok := expression.Value.([]interface{}) // sets are given as slices
+			if !ok {
+				return nil, fmt.Errorf("deny must be a set of messages, got %T", expression.Value)
+			}
+			for _, msg := range denied {
+				if s, ok := msg.(string); ok {
+					messages = append(messages, s)
+				} else if asJSON, err := json.Marshal(msg); err == nil {
+					messages = append(messages, string(asJSON))
+				} else {
+					messages = append(messages, fmt.Sprint(msg))
+				}
+			}
+		}
+	}
+	return messages, nil
+}
+
+// runRegoEngine evaluates the given rego features against the given plan or state json,
+// and returns an output in the terraform-compliance format and the failures found (the
+// resources are taken from the messages, like "aws_s3_bucket.b: public acl").
+func runRegoEngine(input []byte, features []*ComplianceFeature) (string, []ComplianceFinding, error) {
+	var doc interface{}
+	if err := json.Unmarshal(input, &doc); err != nil {
+		return "", nil, fmt.Errorf("can't parse input json: %v", err)
+	}
+
+	sb := strings.Builder{}
+	var findings []ComplianceFinding
+	for _, f := range features {
+		sb.WriteString(fmt.Sprintf("Feature: %s  # %s.feature\n", f.Name, f.Name))
+		sb.WriteString("\n    Scenario: deny\n")
+		messages, err := evalRegoPolicy(f, doc)
+		if err != nil {
+			messages = []string{err.Error()}
+		}
+		for _, msg := range messages {
+			// a failure per line, as the tool does.
+			msg = strings.Replace(msg, "\n", " ", -1)
+			sb.WriteString(fmt.Sprintf("  Failure: %s\n", msg))
+			findings = append(findings, newComplianceFinding(f.Name, "deny", "", msg))
+		}
+		sb.WriteString("\n")
+	}
+	return sb.String(), findings, nil
+}
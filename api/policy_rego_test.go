@@ -0,0 +1,71 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+const regoTestPolicy = `package terraform.s3
+
+deny[msg] {
+	r := input.planned_values.root_module.child_modules[_].resources[_]
+	r.type == "aws_s3_bucket"
+	r.values.acl == "public-read"
+	msg := sprintf("%s: public acl", [r.address])
+}
+`
+
+func TestRegoEngine(t *testing.T) {
+	public := newFeature("public", regoTestPolicy, []string{"validation"})
+	public.Language = languageRego
+	private := newFeature("private", "package terraform.private\n\ndeny[msg] {\n\tfalse\n\tmsg := \"never\"\n}\n", []string{"validation"})
+	private.Language = languageRego
+
+	_, _, result, err := runComplianceTool([]byte(policyEngineTestPlan), []*ComplianceFeature{public, private})
+	require.Nil(t, err)
+
+	assert.False(t, result.Error, result.ErrorMessage)
+	assert.Equal(t, map[string]bool{"public": false, "private": true}, result.FeaturesResult)
+	assert.Equal(t, []string{"module.bucket.aws_s3_bucket.b: public acl"}, result.FeaturesFailures["public"])
+	assert.Equal(t, []ComplianceFinding{{
+		Feature:         "public",
+		Scenario:        "deny",
+		ResourceAddress: "module.bucket.aws_s3_bucket.b",
+		ResourceType:    "aws_s3_bucket",
+		Message:         "module.bucket.aws_s3_bucket.b: public acl",
+	}}, result.Findings)
+}
+
+func TestEvalRegoPolicyUnsafeBuiltins(t *testing.T) {
+	// saved before the check, or imported
+	env := newFeature("env", "package terraform.env\n\ndeny[msg] {\n\tmsg := sprintf(\"%v\", [opa.runtime().env])\n}\n", nil)
+	env.Language = languageRego
+	_, err := evalRegoPolicy(env, map[string]interface{}{})
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "opa.runtime")
+}
+
+func TestValidateFeatureSource(t *testing.T) {
+	feature := newFeature("f", regoTestPolicy, nil)
+	assert.NotNil(t, validateFeatureSource(feature), "not a gherkin source")
+	assert.Equal(t, languageGherkin, featureLanguage(feature))
+
+	feature.Language = languageRego
+	assert.Nil(t, validateFeatureSource(feature))
+	query, err := parseRegoPolicy(feature.Name, feature.Source)
+	require.Nil(t, err)
+	assert.Equal(t, "data.terraform.s3.deny", query)
+
+	feature.Source = "deny[msg] { true }"
+	assert.NotNil(t, validateFeatureSource(feature), "no package")
+	feature.Source = "package terraform.none\n\nallow { true }\n"
+	assert.NotNil(t, validateFeatureSource(feature), "no deny rule")
+	feature.Source = "package terraform.env\n\ndeny[msg] {\n\tmsg := sprintf(\"%v\", [opa.runtime().env])\n}\n"
+	assert.NotNil(t, validateFeatureSource(feature), "opa.runtime")
+	feature.Source = "package terraform.ssrf\n\ndeny[msg] {\n\tr := http.send({\"method\": \"get\", \"url\": \"http://169.254.169.254/\"})\n\tmsg := r.raw_body\n}\n"
+	assert.NotNil(t, validateFeatureSource(feature), "http.send")
+
+	feature.Language = "python"
+	assert.NotNil(t, validateFeatureSource(feature))
+}
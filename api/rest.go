@@ -5,6 +5,7 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
@@ -13,9 +14,17 @@ import (
 	"net/http"
 	"reflect"
 	"sort"
+	"strconv"
 	"time"
 )
 
+// authenticate returns the user of a request, and whether it's authenticated. Tests may replace it.
+var authenticate = OktaAuthenticatedUser
+
+// requestUserVar is the handler var with the user of authenticated requests.
+// It can't be given as query parameter.
+const requestUserVar = "@user"
+
 func registerAuthenticatedEndpoint(
 	router *mux.Router,
 	db *database,
@@ -36,6 +45,18 @@ func registerPublicEndpoint(
 	registerEndpoint(false, router, db, endpoint, handler, method)
 }
 
+// registerAuthenticatedEndpointWithHeaders is like registerAuthenticatedEndpoint,
+// but the handler also gets the request headers and the response headers to set.
+func registerAuthenticatedEndpointWithHeaders(
+	router *mux.Router,
+	db *database,
+	endpoint string,
+	handler func(*database, string, map[string]string, http.Header, http.Header) (string, int, error),
+	method string,
+) {
+	registerEndpointWithHeaders(true, router, db, endpoint, handler, method)
+}
+
 // registerEndpoint registers in the router an HTTP handler
 // with a clean handler that does proper error handling and
 // implements authentication if specified.
@@ -46,17 +67,47 @@ func registerEndpoint(
 	endpoint string,
 	handler func(*database, string, map[string]string) (string, int, error),
 	method string,
+) {
+	handlerWithHeaders := func(db *database, body string, vars map[string]string, _, _ http.Header) (string, int, error) {
+		return handler(db, body, vars)
+	}
+	registerEndpointWithHeaders(requireAuthentication, router, db, endpoint, handlerWithHeaders, method)
+}
+
+// registerEndpointWithHeaders is like registerEndpoint, but gives the handler
+// the request headers and the response headers to set.
+func registerEndpointWithHeaders(
+	requireAuthentication bool,
+	router *mux.Router,
+	db *database,
+	endpoint string,
+	handler func(*database, string, map[string]string, http.Header, http.Header) (string, int, error),
+	method string,
 ) {
 	handleFunc := func(w http.ResponseWriter, r *http.Request) {
 		defer r.Body.Close()
 
-		if requireAuthentication && !IsAuthenticated(r) {
-			w.WriteHeader(http.StatusUnauthorized)
-			_, _ = w.Write([]byte("401 - Not authorized"))
-			return
+		user := ""
+		if requireAuthentication {
+			var ok bool
+			if user, ok = authenticate(r); !ok {
+				w.WriteHeader(http.StatusUnauthorized)
+				_, _ = w.Write([]byte("401 - Not authorized"))
+				return
+			}
 		}
 
+		// Query parameters are given to the handler along with the url vars.
 		vars := mux.Vars(r)
+		for key, values := range r.URL.Query() {
+			if _, ok := vars[key]; !ok && len(values) > 0 {
+				vars[key] = values[0]
+			}
+		}
+		delete(vars, requestUserVar)
+		if requireAuthentication {
+			vars[requestUserVar] = user
+		}
 		bodyBytes, err := ioutil.ReadAll(r.Body)
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
@@ -64,7 +115,13 @@ func registerEndpoint(
 			return
 		}
 
-		response, code, err := handler(db, string(bodyBytes), vars)
+		response, code, err := handler(db, string(bodyBytes), vars, r.Header, w.Header())
+		if errors.Is(err, errToolPoolSaturated) {
+			w.Header().Set("Retry-After", "5")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = fmt.Fprint(w, err.Error())
+			return
+		}
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			_, _ = fmt.Fprint(w, err.Error())
@@ -86,6 +143,7 @@ func registerEndpoint(
 type restObject interface {
 	id() string                               // The object uuid
 	timestamp() int64                         // When this object was created.
+	version() int64                           // Increased on every save. Used as ETag.
 	writeBasic(dst map[string]interface{})    // Write short object fields (when getting all objects).
 	writeDetailed(dst map[string]interface{}) // Write detailed fields (when getting this specific object).
 }
@@ -104,6 +162,18 @@ func restObjectTime(obj restObject) time.Time {
 	return time.Unix(obj.timestamp(), 0)
 }
 
+// etagFor returns the ETag header value for the current version of obj.
+func etagFor(obj restObject) string {
+	return fmt.Sprintf("\"%d\"", obj.version())
+}
+
+// matchesIfMatch returns false if the request If-Match header
+// is given and doesn't match the current version of obj.
+func matchesIfMatch(header http.Header, obj restObject) bool {
+	ifMatch := header.Get("If-Match")
+	return ifMatch == "" || ifMatch == "*" || ifMatch == etagFor(obj)
+}
+
 // ByRestObject wraps the type to sort by timestamp, since dynamo
 // doesn't keep the insert order of entities.
 type ByRestObject []restObject
@@ -114,13 +184,23 @@ func (a ByRestObject) Less(i, j int) bool {
 	return a[i].timestamp() > a[j].timestamp()
 }
 
+// badRequestError is returned by the POST and PUT handlers when the body is invalid,
+// so its message is responded with 400 Bad Request (instead of 500).
+type badRequestError struct {
+	err error
+}
+
+func (e badRequestError) Error() string {
+	return e.err.Error()
+}
+
 // restObjectHandler contains the handlers that effectively perform the operations.
 type restObjectHandler struct {
-	loadAllFunc   func(db *database) ([]restObject, error)
+	loadAllFunc   func(db *database, vars map[string]string, limit int, cursor string) ([]restObject, string, error)
 	loadOneFunc   func(db *database, id string) (restObject, error)
 	deleteHandler func(db *database, id string) error
-	postHandler   func(db *database, body string) (restObject, error)
-	putHandler    func(db *database, obj restObject, body string) error
+	postHandler   func(db *database, body string, user string) (restObject, error)
+	putHandler    func(db *database, obj restObject, body string, user string) error
 }
 
 // registerAuthenticatedObjEndpoints registers automatically GET/POST/DELETE/PUT methods
@@ -129,14 +209,27 @@ type restObjectHandler struct {
 func registerAuthenticatedObjEndpoints(router *mux.Router, endpoint string, db *database, handlers restObjectHandler) {
 
 	// GET /endpoint
+	// Supports pagination through ?limit=n&cursor=c. In that case, responds
+	// {"items": [...], "next_cursor": "..."} instead of just the list.
 	if handlers.loadAllFunc != nil {
-		handler := func(_ *database, body string, _ map[string]string) (string, int, error) {
-			objs, err := handlers.loadAllFunc(db)
+		handler := func(_ *database, body string, vars map[string]string) (string, int, error) {
+			limitStr, paginated := vars["limit"]
+			cursor, hasCursor := vars["cursor"]
+			paginated = paginated || hasCursor
+			limit := 0
+			if limitStr != "" {
+				var err error
+				if limit, err = strconv.Atoi(limitStr); err != nil || limit < 0 {
+					return "invalid limit: " + limitStr, http.StatusBadRequest, nil
+				}
+			}
+
+			objs, nextCursor, err := handlers.loadAllFunc(db, vars, limit, cursor)
 			if err != nil {
 				return "", 0, fmt.Errorf("GET: can't fetch object: %v", err)
 			}
 
-			// sort the list by timestamp
+			// sort the list by timestamp (just the page items, when paginated)
 			sort.Sort(ByRestObject(objs))
 
 			// Returns a list of json objects.
@@ -150,7 +243,11 @@ func registerAuthenticatedObjEndpoints(router *mux.Router, endpoint string, db *
 			}
 
 			// jsonify and return
-			asJSON, err := json.MarshalIndent(result, "", "\t")
+			var response interface{} = result
+			if paginated {
+				response = map[string]interface{}{"items": result, "next_cursor": nextCursor}
+			}
+			asJSON, err := json.MarshalIndent(response, "", "\t")
 			if err != nil {
 				return "", 0, err
 			}
@@ -163,7 +260,7 @@ func registerAuthenticatedObjEndpoints(router *mux.Router, endpoint string, db *
 
 	// GET /endpoint/{id}
 	if handlers.loadOneFunc != nil {
-		handler := func(_ *database, body string, urlVars map[string]string) (string, int, error) {
+		handler := func(_ *database, body string, urlVars map[string]string, _, respHeader http.Header) (string, int, error) {
 			id := urlVars["id"]
 			obj, err := handlers.loadOneFunc(db, id)
 			if err != nil {
@@ -183,15 +280,17 @@ func registerAuthenticatedObjEndpoints(router *mux.Router, endpoint string, db *
 				return "", 0, err
 			}
 
+			respHeader.Set("ETag", etagFor(obj))
 			return string(asJSON), http.StatusOK, nil
 		}
 
-		registerAuthenticatedEndpoint(router, db, endpoint+"/{id}", handler, "GET")
+		registerAuthenticatedEndpointWithHeaders(router, db, endpoint+"/{id}", handler, "GET")
 	}
 
 	// DELETE /endpoint/{id}
+	// Supports If-Match, to delete the object only if it didn't change.
 	if handlers.deleteHandler != nil {
-		handler := func(_ *database, body string, vars map[string]string) (string, int, error) {
+		handler := func(_ *database, body string, vars map[string]string, header, _ http.Header) (string, int, error) {
 			id := vars["id"]
 			obj, err := handlers.loadOneFunc(db, id)
 			if err != nil {
@@ -202,20 +301,28 @@ func registerAuthenticatedObjEndpoints(router *mux.Router, endpoint string, db *
 				return "can't find obj for id " + id, http.StatusNotFound, nil
 			}
 
-			if err := handlers.deleteHandler(db, id); err != nil {
+			if !matchesIfMatch(header, obj) {
+				return "obj " + id + " was updated (current version " + etagFor(obj) + ")", http.StatusConflict, nil
+			}
+
+			if err := handlers.deleteHandler(db, obj.id()); err != nil {
 				return "", 0, fmt.Errorf("DELETE: can't delete object: %v", err)
 			}
 
 			return "", http.StatusOK, nil
 		}
 
-		registerAuthenticatedEndpoint(router, db, endpoint+"/{id}", handler, "DELETE")
+		registerAuthenticatedEndpointWithHeaders(router, db, endpoint+"/{id}", handler, "DELETE")
 	}
 
 	// POST /endpoint
 	if handlers.postHandler != nil {
-		handler := func(_ *database, body string, _ map[string]string) (string, int, error) {
-			obj, err := handlers.postHandler(db, body)
+		handler := func(_ *database, body string, vars map[string]string, _, respHeader http.Header) (string, int, error) {
+			obj, err := handlers.postHandler(db, body, vars[requestUserVar])
+			var badRequest badRequestError
+			if errors.As(err, &badRequest) {
+				return badRequest.Error(), http.StatusBadRequest, nil
+			}
 			if err != nil {
 				return "", 0, fmt.Errorf("POST: can't insert object: %v", err)
 			}
@@ -225,15 +332,18 @@ func registerAuthenticatedObjEndpoints(router *mux.Router, endpoint string, db *
 				return "", 0, fmt.Errorf("POST: can't marshall object: %v", err)
 			}
 
+			respHeader.Set("ETag", etagFor(obj))
 			return string(marshalled), http.StatusOK, nil
 		}
 
-		registerAuthenticatedEndpoint(router, db, endpoint, handler, "POST")
+		registerAuthenticatedEndpointWithHeaders(router, db, endpoint, handler, "POST")
 	}
 
 	// PUT /endpoint/{id}
+	// Supports If-Match, to update the object only if it didn't change. Responds
+	// 409 Conflict if it changed (or if it's concurrently updated while putting).
 	if handlers.putHandler != nil {
-		handler := func(_ *database, body string, vars map[string]string) (string, int, error) {
+		handler := func(_ *database, body string, vars map[string]string, header, respHeader http.Header) (string, int, error) {
 			id := vars["id"]
 			obj, err := handlers.loadOneFunc(db, id)
 			if err != nil {
@@ -244,13 +354,25 @@ func registerAuthenticatedObjEndpoints(router *mux.Router, endpoint string, db *
 				return "can't find obj for id " + id, http.StatusNotFound, nil
 			}
 
-			if err := handlers.putHandler(db, obj, body); err != nil {
+			if !matchesIfMatch(header, obj) {
+				return "obj " + id + " was updated (current version " + etagFor(obj) + ")", http.StatusConflict, nil
+			}
+
+			if err := handlers.putHandler(db, obj, body, vars[requestUserVar]); err != nil {
+				if errors.Is(err, errConflict) {
+					return "obj " + id + " was updated concurrently, try again", http.StatusConflict, nil
+				}
+				var badRequest badRequestError
+				if errors.As(err, &badRequest) {
+					return badRequest.Error(), http.StatusBadRequest, nil
+				}
 				return "", 0, fmt.Errorf("PUT: can't put object: %v", err)
 			}
 
+			respHeader.Set("ETag", etagFor(obj))
 			return "", http.StatusOK, nil
 		}
 
-		registerAuthenticatedEndpoint(router, db, endpoint+"/{id}", handler, "PUT")
+		registerAuthenticatedEndpointWithHeaders(router, db, endpoint+"/{id}", handler, "PUT")
 	}
 }
@@ -3,6 +3,7 @@ package main
 import (
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
@@ -12,18 +13,37 @@ import (
 	"github.com/gorilla/mux"
 	"log"
 	"net/http"
+	"os"
+	"path"
+	"strconv"
 	"strings"
 	"time"
 )
 
 var (
 	listenFlag             = flag.String("listen", ":8080", "On which address to listen")
+	storageFlag            = flag.String("storage", "dynamodb", "Storage backend to use: 'dynamodb', 'bolt' or 'memory'")
+	boltPathFlag           = flag.String("bolt-path", "terraformvalidator.db", "For -storage bolt, the database file to use")
+	blobStoreFlag          = flag.String("blob-store", "", "Where to offload big state documents: 's3://bucket/prefix' or 'file:///local/dir'. Empty to keep them in the database")
+	blobThresholdFlag      = flag.Int("blob-threshold", 64*1024, "For -blob-store, the size (in bytes) from which documents are offloaded")
+	logMaxAgeFlag          = flag.Duration("log-max-age", 0, "Remove logs older than this (like 720h). 0 to keep them forever")
+	logMaxPerTFStateFlag   = flag.Int("log-max-per-tfstate", 0, "Keep at most this number of logs for each tfstate. 0 for unlimited")
+	logKeepFailingFlag     = flag.Bool("log-keep-failing", false, "Keep the logs of failed validations regardless of -log-max-age and -log-max-per-tfstate")
+	logPruneIntervalFlag   = flag.Duration("log-prune-interval", time.Hour, "How often to remove the logs that exceed the retention policy")
+	terraformDirFlag       = flag.String("terraform-dir", "", "Directory of versioned terraform binaries (terraform_<version> or <version>/terraform), to convert each state or plan with a version that can read it. Empty to use the terraform in the PATH")
+	tfSchemaVersionsFlag   = flag.String("terraform-schema-versions", "", "Json file with the schema versions of the resource types, to convert the plans without terraform: the output of 'terraform providers schema -json', or like {\"aws_instance\": 1}. Adds to the ones of the aws resources bundled")
+	toolWorkersFlag        = flag.Int("tool-workers", 4, "How many terraform and terraform-compliance executions to run at a time")
+	toolQueueFlag          = flag.Int("tool-queue", 16, "How many executions may wait for a free worker. The validations beyond it are rejected with 503")
+	lintLenientFlag        = flag.Bool("lint-lenient", false, "Accept the terraform-compliance steps the feature linter doesn't know (as warnings) instead of rejecting them")
+	policyEngineFlag       = flag.String("policy-engine", engineTerraformCompliance, "The engine that evaluates the features that don't specify one: 'terraform-compliance' or 'native' (in-process, supports a subset of the steps)")
+	migrateDryRunFlag      = flag.Bool("migrate-dry-run", false, "Just log the items that the pending schema migrations would upgrade, and exit")
 	dynamoPrefixFlag       = flag.String("dynamodb-prefix", "terraformvalidator", "The database table prefix to use")
 	awsUseSharedConfig     = flag.Bool("aws-use-sharedconfig", false, "Use shared config files in AWS session")
 	awsRegionFlag          = flag.String("aws-region", "", "AWS region to use for the session")
 	awsAccessKeyIdFlag     = flag.String("aws-access-key-id", "", "credentials aws_access_key_id parameter")
 	awsSecretAccessKeyFlag = flag.String("aws-secret-access-key", "", "credentials aws_secret_access_key")
 	slackUrlFlagFlag       = flag.String("slack-url", "", "url to report failed validations")
+	slackMinSeverityFlag   = flag.String("slack-min-severity", "info", "Report to slack just the validations failing features of this severity or higher (info, low, medium, high or critical)")
 	panelUrlFlag           = flag.String("panel-url", "", "panel url, for references.")
 	oktaClientIdFlag       = flag.String("okta-client-id", "", "okta client id for authentication")
 	oktaIssuerUrlFlag      = flag.String("okta-issuer-url", "", "okta issuer url")
@@ -44,32 +64,76 @@ func main() {
 	// Create AWS session
 	log.Printf("Create AWS session...")
 	sess := createSession()
-	log.Printf("Init DynamoDB tables at prefix '%s_*'...", *dynamoPrefixFlag)
-	db := initDB(sess, *dynamoPrefixFlag)
+	log.Printf("Init %s tables at prefix '%s_*'...", *storageFlag, *dynamoPrefixFlag)
+	db := initDB(sess, *storageFlag, *dynamoPrefixFlag)
+	if *blobStoreFlag != "" {
+		log.Printf("Offload documents bigger than %d bytes to '%s'...", *blobThresholdFlag, *blobStoreFlag)
+		store, err := newBlobStore(sess, *blobStoreFlag)
+		if err != nil {
+			log.Fatalf("Can't init blob store: %v", err)
+		}
+		db.useBlobStore(store, *blobThresholdFlag)
+	}
+
+	// Log retention
+	retention := logRetentionPolicy{
+		MaxAge:        *logMaxAgeFlag,
+		MaxPerTFState: *logMaxPerTFStateFlag,
+		KeepFailing:   *logKeepFailingFlag,
+	}
+	db.useLogRetention(retention)
+	if retention.MaxAge > 0 || retention.MaxPerTFState > 0 {
+		log.Printf("Init log pruning ticker (retention: %+v)...", retention)
+		initLogPruning(db, *logPruneIntervalFlag)
+	}
+
+	if *policyEngineFlag == "" || !validPolicyEngine(*policyEngineFlag) {
+		log.Fatalf("Invalid -policy-engine given: '%s'", *policyEngineFlag)
+	}
+	defaultPolicyEngine = *policyEngineFlag
+	lintLenient = *lintLenientFlag
+
+	if *terraformDirFlag != "" {
+		binaries, err := installedTerraformBinaries(*terraformDirFlag)
+		if err != nil || len(binaries) == 0 {
+			log.Fatalf("No terraform binaries found in -terraform-dir '%s': %v", *terraformDirFlag, err)
+		}
+		log.Printf("Using the %d terraform versions in '%s'...", len(binaries), *terraformDirFlag)
+		terraformDir = *terraformDirFlag
+	}
+	if *tfSchemaVersionsFlag != "" {
+		if err := loadTFSchemaVersions(*tfSchemaVersionsFlag); err != nil {
+			log.Fatalf("Can't load -terraform-schema-versions '%s': %v", *tfSchemaVersionsFlag, err)
+		}
+	}
+	if *toolWorkersFlag < 1 || *toolQueueFlag < 0 {
+		log.Fatalf("Invalid -tool-workers or -tool-queue given: %d, %d", *toolWorkersFlag, *toolQueueFlag)
+	}
+	toolWorkers = newToolPool(*toolWorkersFlag, *toolQueueFlag)
 
 	// Spawn monitoring routines
 	log.Printf("Init state monitoring ticker...")
 	initStateChangeMonitoring(sess, db, time.Second*60)
+	initWaiverExpiryMonitoring(db, time.Second*60)
 	if *slackUrlFlagFlag != "" {
-		enableSlackPosts(*panelUrlFlag, *slackUrlFlagFlag)
+		if severityLevel(*slackMinSeverityFlag) < 0 {
+			log.Fatalf("Invalid -slack-min-severity given: '%s'", *slackMinSeverityFlag)
+		}
+		enableSlackPosts(*panelUrlFlag, *slackUrlFlagFlag, *slackMinSeverityFlag)
 		log.Println("Errors will be reported to slack. Panel url given: " + *panelUrlFlag)
 	}
 
 	// Init REST handlers
 	log.Printf("Listening on '%s'...", *listenFlag)
-	router := mux.NewRouter()
-	registerPublicEndpoint(router, db, "/login-details", LoginDetailsHandler, "GET")
-	registerAuthenticatedEndpoint(router, db, "/validate", validateHandler, "POST")
-	initFeaturesEndpoint(router, db)
-	initLogsEndpoint(router, db)
-	initTFStatesEndpoint(router, db)
+	router := newRouter(db)
 	http.Handle("/", router)
 
 	// Start REST server (and CORS stuff)
-	headersOk := handlers.AllowedHeaders([]string{"X-Requested-With", "Content-Type", "Authorization"})
+	headersOk := handlers.AllowedHeaders([]string{"X-Requested-With", "Content-Type", "Authorization", "If-Match"})
+	exposedOk := handlers.ExposedHeaders([]string{"ETag"})
 	originsOk := handlers.AllowedOrigins([]string{"*"})
 	methodsOk := handlers.AllowedMethods([]string{"GET", "HEAD", "POST", "PUT", "DELETE", "OPTIONS"})
-	corsHandler := handlers.CORS(headersOk, originsOk, methodsOk)(router)
+	corsHandler := handlers.CORS(headersOk, exposedOk, originsOk, methodsOk)(router)
 	loggingHandler := handlers.LoggingHandler(LogWriter{}, corsHandler)
 	log.Fatal(http.ListenAndServe(*listenFlag, loggingHandler))
 }
@@ -112,35 +176,110 @@ func createSession() *session.Session {
 	}
 }
 
-func initDB(sess *session.Session, prefix string) *database {
-	result := newDynamoDB(sess, prefix)
-	if err := result.initTables(complianceFeatureTable, validationLogTable, tfStateTable, foreignResourcesTable); err != nil {
+func initDB(sess *session.Session, storage string, prefix string) *database {
+	var result *database
+	switch storage {
+	case "dynamodb":
+		result = newDynamoDB(sess, prefix)
+	case "bolt":
+		db, err := newBoltDB(*boltPathFlag, prefix)
+		if err != nil {
+			log.Fatalf("Can't open bolt database at '%s': %v", *boltPathFlag, err)
+		}
+		result = db
+	case "memory":
+		log.Printf("Warning: using in-memory storage. Nothing will be persisted.")
+		result = newMemoryDB(prefix)
+	default:
+		log.Fatalf("Invalid -storage given: '%s'", storage)
+	}
+
+	if err := result.initTables(
+		complianceFeatureTable, validationLogTable, tfStateTable, tfStateRevisionTable,
+		foreignResourcesTable, waiverTable, featureRevisionTable, tableSchemaTable,
+	); err != nil {
 		log.Fatalf("Can't make database table: %v", err)
 	}
+
+	// Upgrade the items saved by older versions
+	count, err := result.runMigrations(*migrateDryRunFlag)
+	if err != nil {
+		log.Fatalf("Can't migrate database: %v", err)
+	}
+	if *migrateDryRunFlag {
+		log.Printf("Migrations dry run: %d items would be upgraded.", count)
+		os.Exit(0)
+	}
 	return result
 }
 
+// newRouter creates a router with all the REST endpoints registered.
+func newRouter(db *database) *mux.Router {
+	router := mux.NewRouter()
+	registerPublicEndpoint(router, db, "/login-details", LoginDetailsHandler, "GET")
+	registerAuthenticatedEndpoint(router, db, "/validate", validateHandler, "POST")
+	registerAuthenticatedEndpoint(router, db, "/validate/source", validateSourceHandler, "POST")
+	registerAuthenticatedEndpointWithHeaders(router, db, "/export", exportHandler, "GET")
+	registerAuthenticatedEndpoint(router, db, "/import", importHandler, "POST")
+	initFeaturesEndpoint(router, db)
+	initLogsEndpoint(router, db)
+	initTFStatesEndpoint(router, db)
+	initWaiversEndpoint(router, db)
+	return router
+}
+
 func initFeaturesEndpoint(router *mux.Router, db *database) {
+	registerAuthenticatedEndpoint(router, db, "/features/preview", previewFeatureHandler, "POST")
+	registerAuthenticatedEndpoint(router, db, "/features/lint", lintFeatureHandler, "POST")
+	registerAuthenticatedEndpoint(router, db, "/features/sync", syncFeaturesHandler, "POST")
+
+	// History: GET /features/{id}/revisions (paginated as the other collections)
+	registerAuthenticatedObjEndpoints(router, "/features/{id}/revisions", db, restObjectHandler{
+		loadAllFunc: func(db *database, vars map[string]string, limit int, cursor string) ([]restObject, string, error) {
+			feature, err := db.findFeatureByIdOrName(vars["id"])
+			if err != nil || feature == nil {
+				return nil, "", err
+			}
+			objs, nextCursor, err := db.loadFeatureRevisionsPage(feature.Id, limit, cursor)
+			if err != nil {
+				return nil, "", err
+			}
+			result := make([]restObject, len(objs))
+			for i, o := range objs {
+				result[i] = o
+			}
+			return result, nextCursor, nil
+		},
+	})
+	registerAuthenticatedEndpoint(router, db, "/features/{id}/diff", featureDiffHandler, "GET")
+	registerAuthenticatedEndpoint(router, db, "/features/{id}/rollback", featureRollbackHandler, "POST")
+	registerAuthenticatedEndpoint(router, db, "/features/{id}/test", featureTestHandler, "POST")
+
 	// '/features' supports all methods.
 	registerAuthenticatedObjEndpoints(router, "/features", db, restObjectHandler{
-		loadAllFunc: func(db *database) ([]restObject, error) {
-			objs, err := db.loadAllFeaturesFull()
+		loadAllFunc: func(db *database, _ map[string]string, limit int, cursor string) ([]restObject, string, error) {
+			objs, nextCursor, err := db.loadFeaturesFullPage(limit, cursor)
 			if err != nil {
-				return nil, nil
+				return nil, "", err
 			}
 			result := make([]restObject, len(objs))
 			for i, o := range objs {
 				result[i] = o
 			}
-			return result, nil
+			return result, nextCursor, nil
 		},
-		loadOneFunc:   func(db *database, id string) (restObject, error) { return db.findFeatureById(id) },
+		loadOneFunc:   func(db *database, id string) (restObject, error) { return db.findFeatureByIdOrName(id) },
 		deleteHandler: func(db *database, id string) error { return db.removeFeature(id) },
-		postHandler: func(db *database, body string) (restObject, error) {
+		postHandler: func(db *database, body string, user string) (restObject, error) {
 			type BodyFields struct {
-				Name   string   `json:"name"`
-				Source string   `json:"source"`
-				Tags   []string `json:"tags"`
+				Name        string          `json:"name"`
+				Source      string          `json:"source"`
+				Tags        []string        `json:"tags"`
+				Engine      string          `json:"engine"`
+				Language    string          `json:"language"`
+				Severity    string          `json:"severity"`
+				Enforcement string          `json:"enforcement"`
+				Tests       json.RawMessage `json:"tests"`
 			}
 			var f BodyFields
 			if err := json.Unmarshal([]byte(body), &f); err != nil {
@@ -155,19 +294,42 @@ func initFeaturesEndpoint(router *mux.Router, db *database) {
 				return nil, fmt.Errorf("invalid feature name: '%s'", f.Name)
 			}
 
+			if !validPolicyEngine(f.Engine) {
+				return nil, badRequestError{fmt.Errorf("invalid engine: '%s'", f.Engine)}
+			}
+
 			feature := newFeature(f.Name, f.Source, f.Tags)
-			err := db.saveFeature(feature)
+			feature.Engine = f.Engine
+			feature.Language = f.Language
+			feature.Severity = f.Severity
+			feature.Enforcement = f.Enforcement
+			feature.UpdatedBy = user
+			tests, err := parseFeatureTestCases(f.Tests)
+			if err != nil {
+				return nil, badRequestError{err}
+			}
+			feature.Tests = tests
+			if err := validateFeature(feature); err != nil {
+				return nil, err
+			}
+			err = db.saveFeature(feature)
 			if err != nil {
 				return nil, err
 			}
 
 			return feature, nil
 		},
-		putHandler: func(db *database, obj restObject, body string) error {
+		putHandler: func(db *database, obj restObject, body string, user string) error {
+			// the settings not given (nil) are kept: the web panel just sends the source, tags and disabled
 			type BodyFields struct {
-				Source   string   `json:"source"`
-				Tags     []string `json:"tags"`
-				Disabled bool     `json:"disabled"`
+				Source      string          `json:"source"`
+				Tags        []string        `json:"tags"`
+				Disabled    bool            `json:"disabled"`
+				Engine      *string         `json:"engine"`
+				Language    *string         `json:"language"`
+				Severity    *string         `json:"severity"`
+				Enforcement *string         `json:"enforcement"`
+				Tests       json.RawMessage `json:"tests"` // the current tests are kept if not given
 			}
 			var f BodyFields
 			if err := json.Unmarshal([]byte(body), &f); err != nil {
@@ -175,27 +337,417 @@ func initFeaturesEndpoint(router *mux.Router, db *database) {
 			}
 
 			feature := obj.(*ComplianceFeature)
+			if f.Engine != nil {
+				if !validPolicyEngine(*f.Engine) {
+					return badRequestError{fmt.Errorf("invalid engine: '%s'", *f.Engine)}
+				}
+				feature.Engine = *f.Engine
+			}
 			feature.Source = f.Source
 			feature.Tags = f.Tags
 			feature.Disabled = f.Disabled
+			if f.Language != nil {
+				feature.Language = *f.Language
+			}
+			if f.Severity != nil {
+				feature.Severity = *f.Severity
+			}
+			if f.Enforcement != nil {
+				feature.Enforcement = *f.Enforcement
+			}
+			feature.UpdatedBy = user
+			tests, err := parseFeatureTestCases(f.Tests)
+			if err != nil {
+				return badRequestError{err}
+			}
+			if tests != nil {
+				feature.Tests = tests
+			}
+			if err := validateFeature(feature); err != nil {
+				return err
+			}
 			return db.saveFeature(feature)
 		},
 	})
 }
 
+// findFeatureRevisions returns the revisions of the given feature with the numbers given in the
+// given params (the current one for the params not given). Responds the not found or invalid ones.
+func findFeatureRevisions(db *database, feature *ComplianceFeature, vars map[string]string, params ...string) ([]*FeatureRevision, string, int, error) {
+	var result []*FeatureRevision
+	for _, param := range params {
+		number := feature.Version
+		if vars[param] != "" {
+			var err error
+			if number, err = strconv.ParseInt(vars[param], 10, 64); err != nil {
+				return nil, "'" + param + "' must be a revision number", http.StatusBadRequest, nil
+			}
+		}
+
+		revision, err := db.findFeatureRevision(feature.Id, number)
+		if err != nil {
+			return nil, "", 0, fmt.Errorf("can't find revision: %v", err)
+		}
+		if revision == nil {
+			return nil, fmt.Sprintf("feature %s has no revision %d", feature.Name, number), http.StatusNotFound, nil
+		}
+		result = append(result, revision)
+	}
+	return result, "", http.StatusOK, nil
+}
+
+// featureDiffHandler responds the differences between two revisions of a feature:
+// GET /features/{id}/diff?from=revision[&to=revision]. 'to' is the current revision if not given.
+func featureDiffHandler(db *database, _ string, vars map[string]string) (string, int, error) {
+	feature, err := db.findFeatureByIdOrName(vars["id"])
+	if err != nil {
+		return "", 0, fmt.Errorf("can't find feature: %v", err)
+	}
+	if feature == nil {
+		return "", http.StatusNotFound, nil
+	}
+	if vars["from"] == "" {
+		return "'from' not given", http.StatusBadRequest, nil
+	}
+
+	revisions, message, code, err := findFeatureRevisions(db, feature, vars, "from", "to")
+	if err != nil || code != http.StatusOK {
+		return message, code, err
+	}
+
+	from, to := revisions[0], revisions[1]
+	sourceDiff, changes := featureRevisionsDiff(from, to)
+	asJSON, err := json.MarshalIndent(map[string]interface{}{
+		"from":        from.Revision,
+		"to":          to.Revision,
+		"source_diff": sourceDiff,
+		"changes":     changes,
+	}, "", "\t")
+	if err != nil {
+		return "", 0, err
+	}
+	return string(asJSON), http.StatusOK, nil
+}
+
+// featureRollbackHandler restores the given revision of a feature, saving it as
+// a new revision: POST /features/{id}/rollback?revision=revision.
+func featureRollbackHandler(db *database, _ string, vars map[string]string) (string, int, error) {
+	feature, err := db.findFeatureByIdOrName(vars["id"])
+	if err != nil {
+		return "", 0, fmt.Errorf("can't find feature: %v", err)
+	}
+	if feature == nil {
+		return "", http.StatusNotFound, nil
+	}
+	if vars["revision"] == "" {
+		return "'revision' not given", http.StatusBadRequest, nil
+	}
+
+	revisions, message, code, err := findFeatureRevisions(db, feature, vars, "revision")
+	if err != nil || code != http.StatusOK {
+		return message, code, err
+	}
+
+	revisions[0].applyTo(feature)
+	feature.UpdatedBy = vars[requestUserVar]
+	if err := db.saveFeature(feature); err != nil {
+		return "", 0, fmt.Errorf("can't save in db: %v", err)
+	}
+
+	result := make(map[string]interface{})
+	result["id"] = feature.id()
+	result["timestamp"] = feature.timestamp()
+	feature.writeDetailed(result)
+	asJSON, err := json.MarshalIndent(result, "", "\t")
+	if err != nil {
+		return "", 0, err
+	}
+	return string(asJSON), http.StatusOK, nil
+}
+
+// syncFeaturesHandler makes the stored features match the ones given in the body, as
+// {"features": [...]} (each one as in POST /features): see syncFeatures. Supports
+// ?prune=true, to remove the features not given, and ?dry_run=true, to just respond the plan.
+// Nothing is changed if any of the given features is invalid.
+func syncFeaturesHandler(db *database, body string, vars map[string]string) (string, int, error) {
+	type FeatureFields struct {
+		Name        string          `json:"name"`
+		Source      string          `json:"source"`
+		Tags        []string        `json:"tags"`
+		Disabled    bool            `json:"disabled"`
+		Engine      string          `json:"engine"`
+		Language    string          `json:"language"`
+		Severity    string          `json:"severity"`
+		Enforcement string          `json:"enforcement"`
+		Tests       json.RawMessage `json:"tests"`
+	}
+	var f struct {
+		Features []FeatureFields `json:"features"`
+	}
+	if err := json.Unmarshal([]byte(body), &f); err != nil {
+		return "", 0, fmt.Errorf("can't unmarshal into f: %v", err)
+	}
+	prune := vars["prune"] == "true"
+	dryRun := vars["dry_run"] == "true"
+
+	var problems []string
+	var features []*ComplianceFeature
+	names := make(map[string]bool)
+	for _, ff := range f.Features {
+		if ff.Tags == nil || ff.Name == "" || ff.Source == "" {
+			problems = append(problems, fmt.Sprintf("%s: 'name', 'tags' or 'source' not given", ff.Name))
+			continue
+		}
+		if !validateFeatureName(ff.Name) || names[ff.Name] {
+			problems = append(problems, fmt.Sprintf("%s: invalid or repeated feature name", ff.Name))
+			continue
+		}
+		names[ff.Name] = true
+		if !validPolicyEngine(ff.Engine) {
+			problems = append(problems, fmt.Sprintf("%s: invalid engine: '%s'", ff.Name, ff.Engine))
+			continue
+		}
+
+		feature := newFeature(ff.Name, ff.Source, ff.Tags)
+		feature.Disabled = ff.Disabled
+		feature.Engine = ff.Engine
+		feature.Language = ff.Language
+		feature.Severity = ff.Severity
+		feature.Enforcement = ff.Enforcement
+		tests, err := parseFeatureTestCases(ff.Tests)
+		if err == nil {
+			feature.Tests = tests
+			err = validateFeature(feature)
+		}
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", ff.Name, err))
+			continue
+		}
+		features = append(features, feature)
+	}
+	if len(problems) > 0 {
+		return strings.Join(problems, "\n"), http.StatusBadRequest, nil
+	}
+
+	diff, updates, err := db.syncFeatures(features, prune, dryRun, vars[requestUserVar])
+	if errors.Is(err, errConflict) {
+		return "a feature was updated concurrently, try again", http.StatusConflict, nil
+	}
+	if err != nil {
+		return "", 0, fmt.Errorf("can't sync: %v", err)
+	}
+
+	asJSON, err := json.MarshalIndent(map[string]interface{}{
+		"prune":    prune,
+		"dry_run":  dryRun,
+		"features": diff,
+		"changes":  updates,
+	}, "", "\t")
+	if err != nil {
+		return "", 0, err
+	}
+	return string(asJSON), http.StatusOK, nil
+}
+
+// lintFeatureHandler checks the source of the feature given in the body (as in POST /features, but
+// just the source is required) as when saved, and responds its problems, with their line and column
+// (and "warning": true for the ones that don't prevent saving it).
+func lintFeatureHandler(_ *database, body string, _ map[string]string) (string, int, error) {
+	type BodyFields struct {
+		Name     string `json:"name"`
+		Source   string `json:"source"`
+		Engine   string `json:"engine"`
+		Language string `json:"language"`
+	}
+	var f BodyFields
+	if err := json.Unmarshal([]byte(body), &f); err != nil {
+		return "", 0, fmt.Errorf("can't unmarshal into f: %v", err)
+	}
+	if f.Source == "" {
+		return "'source' not given", http.StatusBadRequest, nil
+	}
+	if f.Name == "" {
+		f.Name = "lint"
+	}
+	if !validPolicyEngine(f.Engine) {
+		return "invalid engine: '" + f.Engine + "'", http.StatusBadRequest, nil
+	}
+	if !validPolicyLanguage(f.Language) {
+		return "invalid language: '" + f.Language + "'", http.StatusBadRequest, nil
+	}
+
+	feature := newFeature(f.Name, f.Source, nil)
+	feature.Engine = f.Engine
+	feature.Language = f.Language
+	lintErrors := lintFeature(feature)
+	if lintErrors == nil {
+		lintErrors = featureLintErrors{}
+	}
+
+	asJSON, err := json.Marshal(map[string]interface{}{
+		"valid":  len(lintErrors.errors()) == 0, // warnings don't make it invalid
+		"errors": lintErrors,
+	})
+	if err != nil {
+		return "", 0, err
+	}
+	return string(asJSON), http.StatusOK, nil
+}
+
+// featureTestHandler runs the test cases of a feature (see FeatureTestCase), and responds
+// the result of each one.
+func featureTestHandler(db *database, _ string, vars map[string]string) (string, int, error) {
+	feature, err := db.findFeatureByIdOrName(vars["id"])
+	if err != nil {
+		return "", 0, fmt.Errorf("can't find feature: %v", err)
+	}
+	if feature == nil {
+		return "", http.StatusNotFound, nil
+	}
+
+	results, passed, err := runFeatureTests(feature)
+	if err != nil {
+		return "", 0, err
+	}
+	asJSON, err := json.MarshalIndent(map[string]interface{}{
+		"passed":  passed,
+		"results": results,
+	}, "", "\t")
+	if err != nil {
+		return "", 0, err
+	}
+	return string(asJSON), http.StatusOK, nil
+}
+
+// previewFeatureHandler runs the feature given in the body (as in POST /features, but the name is
+// optional) against the latest state of every tfstate it would check. Nothing is saved, not even
+// logs. Responds the result for each state.
+func previewFeatureHandler(db *database, body string, _ map[string]string) (string, int, error) {
+	type BodyFields struct {
+		Name     string   `json:"name"`
+		Source   string   `json:"source"`
+		Tags     []string `json:"tags"`
+		Engine   string   `json:"engine"`
+		Language string   `json:"language"`
+	}
+	var f BodyFields
+	if err := json.Unmarshal([]byte(body), &f); err != nil {
+		return "", 0, fmt.Errorf("can't unmarshal into f: %v", err)
+	}
+	if f.Tags == nil || f.Source == "" {
+		return "'tags' or 'source' not given", http.StatusBadRequest, nil
+	}
+	if f.Name == "" {
+		f.Name = "preview"
+	}
+	if !validateFeatureName(f.Name) {
+		return "invalid feature name: '" + f.Name + "'", http.StatusBadRequest, nil
+	}
+	if !validPolicyEngine(f.Engine) {
+		return "invalid engine: '" + f.Engine + "'", http.StatusBadRequest, nil
+	}
+
+	feature := newFeature(f.Name, f.Source, f.Tags)
+	feature.Engine = f.Engine
+	feature.Language = f.Language
+	if err := validateFeatureSource(feature); err != nil {
+		return err.Error(), http.StatusBadRequest, nil
+	}
+
+	states, err := db.loadAllTFStatesFull()
+	if err != nil {
+		return "", 0, fmt.Errorf("can't load tfstates: %v", err)
+	}
+	waivers, err := db.loadAllWaivers()
+	if err != nil {
+		return "", 0, fmt.Errorf("can't load waivers: %v", err)
+	}
+
+	type stateResult struct {
+		TFStateId        string           `json:"tfstate_id"`
+		Account          string           `json:"account"`
+		Bucket           string           `json:"bucket"`
+		Path             string           `json:"path"`
+		ComplianceResult ComplianceResult `json:"compliance_result"`
+	}
+	results := make([]stateResult, 0)
+	failing := 0
+	for _, state := range states {
+		features := getEnabledFeaturesContainingTags([]*ComplianceFeature{feature}, state.Tags)
+		if len(features) == 0 || state.State == "" { // not affected, or not checked yet
+			continue
+		}
+
+		_, _, result, err := evaluateFeatures([]byte(state.State), features, waivers, state)
+		if errors.Is(err, errToolPoolSaturated) {
+			return "", 0, err
+		}
+		if err != nil {
+			result = ComplianceResult{Initialized: true, Error: true, ErrorMessage: err.Error()}
+		}
+		if !result.passed() {
+			failing++
+		}
+		results = append(results, stateResult{
+			TFStateId:        state.Id,
+			Account:          state.Account,
+			Bucket:           state.Bucket,
+			Path:             state.Path,
+			ComplianceResult: result,
+		})
+	}
+
+	asJSON, err := json.Marshal(map[string]interface{}{
+		"states":  len(results),
+		"failing": failing,
+		"results": results,
+	})
+	if err != nil {
+		return "", 0, err
+	}
+	return string(asJSON), http.StatusOK, nil
+}
+
 func initLogsEndpoint(router *mux.Router, db *database) {
+	// Bulk removal: DELETE /logs?before=timestamp[&kind=kind]
+	bulkDeleteHandler := func(db *database, _ string, vars map[string]string) (string, int, error) {
+		before, err := strconv.ParseInt(vars["before"], 10, 64)
+		if err != nil || before <= 0 {
+			return "'before' must be an unix timestamp", http.StatusBadRequest, nil
+		}
+
+		count, err := db.removeLogsBefore(before, vars["kind"])
+		if err != nil {
+			return "", 0, fmt.Errorf("can't remove logs (%d removed): %v", count, err)
+		}
+
+		asJSON, err := json.Marshal(map[string]int{"deleted": count})
+		if err != nil {
+			return "", 0, err
+		}
+		return string(asJSON), http.StatusOK, nil
+	}
+	registerAuthenticatedEndpoint(router, db, "/logs", bulkDeleteHandler, "DELETE")
+
 	// '/logs' supports just GET and DELETE, since they're generated automatically.
 	registerAuthenticatedObjEndpoints(router, "/logs", db, restObjectHandler{
-		loadAllFunc: func(db *database) ([]restObject, error) {
-			objs, err := db.loadAllLogsMinimal()
+		loadAllFunc: func(db *database, vars map[string]string, limit int, cursor string) ([]restObject, string, error) {
+			var objs []*ValidationLog
+			var nextCursor string
+			var err error
+			if kind := vars["kind"]; kind != "" {
+				objs, nextCursor, err = db.loadLogsMinimalByKindPage(kind, limit, cursor)
+			} else {
+				objs, nextCursor, err = db.loadLogsMinimalPage(limit, cursor)
+			}
 			if err != nil {
-				return nil, nil
+				return nil, "", err
 			}
 			result := make([]restObject, len(objs))
 			for i, o := range objs {
 				result[i] = o
 			}
-			return result, nil
+			return result, nextCursor, nil
 		},
 		loadOneFunc:   func(db *database, id string) (restObject, error) { return db.findLogById(id) },
 		deleteHandler: func(db *database, id string) error { return db.removeLog(id) },
@@ -212,30 +764,75 @@ func initTFStatesEndpoint(router *mux.Router, db *database) {
 		if obj == nil {
 			return "", http.StatusNotFound, nil
 		}
-		obj.ForceValidation = true
-		if err := db.saveTFState(obj); err != nil {
+		err = db.updateTFState(obj, func(latest *TFState) bool {
+			latest.ForceValidation = true
+			return true
+		})
+		if err != nil {
 			return "", 0, fmt.Errorf("can't save in db: %v", err)
 		}
 		return "", http.StatusOK, nil
 	}
 	registerAuthenticatedEndpoint(router, db, "/tfstates/{id}/validate", validationHandler, "POST")
 
+	// History: GET /tfstates/{id}/history (paginated as the other collections)
+	registerAuthenticatedObjEndpoints(router, "/tfstates/{id}/history", db, restObjectHandler{
+		loadAllFunc: func(db *database, vars map[string]string, limit int, cursor string) ([]restObject, string, error) {
+			objs, nextCursor, err := db.loadTFStateRevisionsMinimalPage(vars["id"], limit, cursor)
+			if err != nil {
+				return nil, "", err
+			}
+			result := make([]restObject, len(objs))
+			for i, o := range objs {
+				result[i] = o
+			}
+			return result, nextCursor, nil
+		},
+	})
+
+	// Point-in-time lookup: GET /tfstates/{id}/at?time=t
+	atHandler := func(db *database, _ string, vars map[string]string) (string, int, error) {
+		timestamp, err := parseTimeParam(vars["time"])
+		if err != nil {
+			return err.Error(), http.StatusBadRequest, nil
+		}
+
+		revision, err := db.findTFStateRevisionAt(vars["id"], timestamp)
+		if err != nil {
+			return "", 0, fmt.Errorf("can't find revision: %v", err)
+		}
+		if revision == nil {
+			return "no revision for the state at the given time", http.StatusNotFound, nil
+		}
+
+		result := make(map[string]interface{})
+		result["id"] = revision.id()
+		result["timestamp"] = revision.timestamp()
+		revision.writeDetailed(result)
+		asJSON, err := json.MarshalIndent(result, "", "\t")
+		if err != nil {
+			return "", 0, err
+		}
+		return string(asJSON), http.StatusOK, nil
+	}
+	registerAuthenticatedEndpoint(router, db, "/tfstates/{id}/at", atHandler, "GET")
+
 	// '/tfstates' supports all methods.
 	registerAuthenticatedObjEndpoints(router, "/tfstates", db, restObjectHandler{
-		loadAllFunc: func(db *database) ([]restObject, error) {
-			objs, err := db.loadAllTFStatesMinimal()
+		loadAllFunc: func(db *database, _ map[string]string, limit int, cursor string) ([]restObject, string, error) {
+			objs, nextCursor, err := db.loadTFStatesMinimalPage(limit, cursor)
 			if err != nil {
-				return nil, nil
+				return nil, "", err
 			}
 			result := make([]restObject, len(objs))
 			for i, o := range objs {
 				result[i] = o
 			}
-			return result, nil
+			return result, nextCursor, nil
 		},
 		loadOneFunc:   func(db *database, id string) (restObject, error) { return db.findTFStateById(id) },
 		deleteHandler: func(db *database, id string) error { return db.removeTFState(id) },
-		postHandler: func(db *database, body string) (restObject, error) {
+		postHandler: func(db *database, body string, _ string) (restObject, error) {
 			type BodyFields struct {
 				Account string   `json:"account"`
 				Bucket  string   `json:"bucket"`
@@ -257,7 +854,7 @@ func initTFStatesEndpoint(router *mux.Router, db *database) {
 
 			return tfstate, nil
 		},
-		putHandler: func(db *database, obj restObject, body string) error {
+		putHandler: func(db *database, obj restObject, body string, _ string) error {
 			type BodyFields struct {
 				Account string   `json:"account"`
 				Bucket  string   `json:"bucket"`
@@ -285,25 +882,109 @@ func initTFStatesEndpoint(router *mux.Router, db *database) {
 func initForeignResourcesEndpoint(router *mux.Router, db *database) {
 	// /foreignresources supports just GET.
 	registerAuthenticatedObjEndpoints(router, "/foreignresources", db, restObjectHandler{
-		loadAllFunc: func(db *database) ([]restObject, error) {
-			objs, err := db.loadAllForeignResourcesMinimal()
+		loadAllFunc: func(db *database, _ map[string]string, limit int, cursor string) ([]restObject, string, error) {
+			objs, nextCursor, err := db.loadForeignResourcesMinimalPage(limit, cursor)
 			if err != nil {
-				return nil, nil
+				return nil, "", err
 			}
 			result := make([]restObject, len(objs))
 			for i, o := range objs {
 				result[i] = o
 			}
-			return result, nil
+			return result, nextCursor, nil
 		},
 		loadOneFunc: func(db *database, id string) (restObject, error) { return db.findForeignResourceById(id) },
 	})
 }
 
+func initWaiversEndpoint(router *mux.Router, db *database) {
+	// fillWaiver sets the fields of the given waiver from the given POST/PUT body.
+	fillWaiver := func(body string, waiver *Waiver) error {
+		type BodyFields struct {
+			FeatureName     string `json:"feature_name"`
+			ResourcePattern string `json:"resource_pattern"`
+			TFStateId       string `json:"tfstate_id"`
+			Account         string `json:"account"`
+			Reason          string `json:"reason"`
+			Approver        string `json:"approver"`
+			ExpiresAt       string `json:"expires_at"` // unix timestamp, RFC3339 or date. Empty for never
+		}
+		var f BodyFields
+		if err := json.Unmarshal([]byte(body), &f); err != nil {
+			return fmt.Errorf("can't unmarshal into f: %v", err)
+		}
+		if f.FeatureName == "" || f.ResourcePattern == "" || f.Reason == "" || f.Approver == "" {
+			return fmt.Errorf("'feature_name', 'resource_pattern', 'reason' or 'approver' not given")
+		}
+		if _, err := path.Match(f.ResourcePattern, ""); err != nil {
+			return fmt.Errorf("invalid resource_pattern '%s': %v", f.ResourcePattern, err)
+		}
+
+		var expiresAt int64
+		if f.ExpiresAt != "" {
+			var err error
+			if expiresAt, err = parseTimeParam(f.ExpiresAt); err != nil {
+				return err
+			}
+		}
+		if expiresAt != waiver.ExpiresAt {
+			waiver.ExpiryLogged = false // to log it again, when it expires
+		}
+
+		waiver.FeatureName = f.FeatureName
+		waiver.ResourcePattern = f.ResourcePattern
+		waiver.TFStateId = f.TFStateId
+		waiver.Account = f.Account
+		waiver.Reason = f.Reason
+		waiver.Approver = f.Approver
+		waiver.ExpiresAt = expiresAt
+		return nil
+	}
+
+	// '/waivers' supports all methods.
+	registerAuthenticatedObjEndpoints(router, "/waivers", db, restObjectHandler{
+		loadAllFunc: func(db *database, _ map[string]string, limit int, cursor string) ([]restObject, string, error) {
+			objs, nextCursor, err := db.loadWaiversPage(limit, cursor)
+			if err != nil {
+				return nil, "", err
+			}
+			result := make([]restObject, len(objs))
+			for i, o := range objs {
+				result[i] = o
+			}
+			return result, nextCursor, nil
+		},
+		loadOneFunc:   func(db *database, id string) (restObject, error) { return db.findWaiverById(id) },
+		deleteHandler: func(db *database, id string) error { return db.removeWaiver(id) },
+		postHandler: func(db *database, body string, _ string) (restObject, error) {
+			waiver := newWaiver("", "", "", "", 0)
+			if err := fillWaiver(body, waiver); err != nil {
+				return nil, err
+			}
+			if err := db.saveWaiver(waiver); err != nil {
+				return nil, err
+			}
+			return waiver, nil
+		},
+		putHandler: func(db *database, obj restObject, body string, _ string) error {
+			waiver := obj.(*Waiver)
+			if err := fillWaiver(body, waiver); err != nil {
+				return err
+			}
+			return db.saveWaiver(waiver)
+		},
+	})
+}
+
 // validateHandler takes a base64 string in the body with the plan file content
 // or terraform json, run the tfComplianceBin tool against it, and responds
-// the tool output as a response.
-func validateHandler(db *database, body string, _ map[string]string) (string, int, error) {
+// the tool output as a response (or the structured result, with ?format=json).
+func validateHandler(db *database, body string, vars map[string]string) (string, int, error) {
+	format := vars["format"]
+	if format != "" && format != "text" && format != "json" {
+		return "invalid format '" + format + "': must be text or json", http.StatusBadRequest, nil
+	}
+
 	var base64data string
 	if err := json.Unmarshal([]byte(body), &base64data); err != nil {
 		return "", 0, fmt.Errorf("can't decode into json string: %v", err)
@@ -314,20 +995,201 @@ func validateHandler(db *database, body string, _ map[string]string) (string, in
 		return "", 0, err
 	}
 
-	stateJSON, complianceOutput, err := runComplianceToolForTags(db, planFileBytes, []string{"validation"})
+	return validate(db, planFileBytes, format)
+}
+
+// validateSourceHandler takes a tar.gz of a terraform module directory in the body, either
+// raw or as a base64 json string, and validates the resources configured in its .tf files
+// as validateHandler does with plans: all of them are to be created, with the values given
+// literally (or through variables and locals), and the rest unknown. Supports ?format= too.
+func validateSourceHandler(db *database, body string, vars map[string]string) (string, int, error) {
+	format := vars["format"]
+	if format != "" && format != "text" && format != "json" {
+		return "invalid format '" + format + "': must be text or json", http.StatusBadRequest, nil
+	}
+
+	data := []byte(body)
+	var base64data string
+	if err := json.Unmarshal(data, &base64data); err == nil {
+		if data, err = base64.StdEncoding.DecodeString(base64data); err != nil {
+			return "invalid base64 body: " + err.Error(), http.StatusBadRequest, nil
+		}
+	}
+
+	files, err := readSourceArchive(data)
+	if err != nil {
+		return err.Error(), http.StatusBadRequest, nil
+	}
+	planJSON, err := decodeTerraformSource(files)
+	if err != nil {
+		return "invalid terraform source: " + err.Error(), http.StatusBadRequest, nil
+	}
+
+	return validate(db, planJSON, format)
+}
+
+// validate runs the validation features against the given plan file or json, logs the
+// result, and responds it in the given format (the tool output for text).
+func validate(db *database, planFileBytes []byte, format string) (string, int, error) {
+	stateJSON, complianceOutput, complianceResult, err := runComplianceToolForTags(db, planFileBytes, []string{"validation"}, nil)
 	if err != nil {
-		return "", 0, fmt.Errorf("can't run compliance tool: %v", err)
+		return "", 0, fmt.Errorf("can't run compliance tool: %w", err)
 	}
 
-	complianceResult := parseComplianceOutput(complianceOutput)
 	logEntry := newValidationLog(stateJSON, complianceResult)
 	if err := db.saveLog(logEntry); err != nil {
 		return "", 0, fmt.Errorf("can't insert logEntry: %v", err)
 	}
 
+	if format == "json" {
+		verdict := "pass" // only blocking features fail validations
+		if !complianceResult.passed() {
+			verdict = "fail"
+		}
+		asJSON, err := json.Marshal(map[string]interface{}{
+			"log_id":            logEntry.Id,
+			"verdict":           verdict,
+			"compliance_result": complianceResult,
+		})
+		if err != nil {
+			return "", 0, err
+		}
+		return string(asJSON), http.StatusOK, nil
+	}
 	return complianceOutput, http.StatusOK, nil
 }
 
+// parseTimeParam parses a time given as unix timestamp, RFC3339 or
+// date (2006-01-02, meaning the end of that day in UTC).
+func parseTimeParam(value string) (int64, error) {
+	if timestamp, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return timestamp, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t.Unix(), nil
+	}
+	if t, err := time.Parse("2006-01-02", value); err == nil {
+		return t.Add(24*time.Hour).Unix() - 1, nil
+	}
+	return 0, fmt.Errorf("invalid time '%s': must be an unix timestamp, RFC3339 or 2006-01-02", value)
+}
+
+// exportHandler responds an archive with all the items of the tables given
+// in ?tables= (all if not given), as json or tar.gz (?format=tar.gz).
+func exportHandler(db *database, _ string, vars map[string]string, _, respHeader http.Header) (string, int, error) {
+	tables, err := selectExportTables(vars["tables"])
+	if err != nil {
+		return err.Error(), http.StatusBadRequest, nil
+	}
+
+	format := vars["format"]
+	if format != "" && format != "json" && format != "tar.gz" {
+		return "invalid format '" + format + "': must be json or tar.gz", http.StatusBadRequest, nil
+	}
+
+	archive, err := db.exportArchive(tables)
+	if err != nil {
+		return "", 0, fmt.Errorf("can't export: %v", err)
+	}
+
+	if format == "tar.gz" {
+		encoded, err := encodeArchiveTarGz(archive)
+		if err != nil {
+			return "", 0, fmt.Errorf("can't encode archive: %v", err)
+		}
+		respHeader.Set("Content-Type", "application/gzip")
+		return string(encoded), http.StatusOK, nil
+	}
+
+	asJSON, err := json.MarshalIndent(archive, "", "\t")
+	if err != nil {
+		return "", 0, err
+	}
+	respHeader.Set("Content-Type", "application/json")
+	return string(asJSON), http.StatusOK, nil
+}
+
+// importHandler imports the archive (json or tar.gz) given in the body, either raw or as a base64
+// json string. Supports ?mode=merge|replace (merge by default), ?dry_run=true to just get the
+// changes, and ?tables= to import just some of the tables. Responds the changes by table.
+func importHandler(db *database, body string, vars map[string]string) (string, int, error) {
+	tables, err := selectExportTables(vars["tables"])
+	if err != nil {
+		return err.Error(), http.StatusBadRequest, nil
+	}
+
+	mode := vars["mode"]
+	if mode == "" {
+		mode = "merge"
+	}
+	if mode != "merge" && mode != "replace" {
+		return "invalid mode '" + mode + "': must be merge or replace", http.StatusBadRequest, nil
+	}
+	dryRun := vars["dry_run"] == "true"
+
+	data := []byte(body)
+	var base64data string
+	if err := json.Unmarshal(data, &base64data); err == nil {
+		if data, err = base64.StdEncoding.DecodeString(base64data); err != nil {
+			return "invalid base64 body: " + err.Error(), http.StatusBadRequest, nil
+		}
+	}
+
+	archive, err := decodeArchive(data)
+	if err != nil {
+		return err.Error(), http.StatusBadRequest, nil
+	}
+
+	changes, err := db.importArchive(archive, tables, mode == "replace", dryRun)
+	if err != nil {
+		return "", 0, fmt.Errorf("can't import: %v", err)
+	}
+
+	asJSON, err := json.MarshalIndent(map[string]interface{}{
+		"mode":    mode,
+		"dry_run": dryRun,
+		"tables":  changes,
+	}, "", "\t")
+	if err != nil {
+		return "", 0, err
+	}
+	return string(asJSON), http.StatusOK, nil
+}
+
+// validateFeatureSource returns a badRequestError if the language, severity or enforcement of
+// the given feature are unknown, or if its source has problems (see lintFeature).
+func validateFeatureSource(f *ComplianceFeature) error {
+	if !validPolicyLanguage(f.Language) {
+		return badRequestError{fmt.Errorf("invalid language: '%s'", f.Language)}
+	}
+	if f.Severity != "" && severityLevel(f.Severity) < 0 {
+		return badRequestError{fmt.Errorf("invalid severity: '%s'. Must be one of %v", f.Severity, severities)}
+	}
+	if f.Enforcement != "" && f.Enforcement != enforcementBlocking && f.Enforcement != enforcementAdvisory {
+		return badRequestError{fmt.Errorf("invalid enforcement: '%s'. Must be blocking or advisory", f.Enforcement)}
+	}
+	if lintErrors := lintFeature(f).errors(); len(lintErrors) > 0 {
+		return badRequestError{fmt.Errorf("invalid %s source:\n%v", featureLanguage(f), lintErrors)}
+	}
+	return nil
+}
+
+// validateFeature returns a badRequestError if the given feature is invalid (see
+// validateFeatureSource), or if it fails its own tests.
+func validateFeature(f *ComplianceFeature) error {
+	if err := validateFeatureSource(f); err != nil {
+		return err
+	}
+	results, passed, err := runFeatureTests(f)
+	if err != nil {
+		return err
+	}
+	if !passed {
+		return badRequestError{failedFeatureTestsError(results)}
+	}
+	return nil
+}
+
 // validateFeatureName returns true if the given feature name is valid (doesn't contains invalid file characters).
 func validateFeatureName(name string) bool {
 	return len(name) > 0 && len(name) < 30 && !strings.ContainsAny(name, "./* ")
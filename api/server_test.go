@@ -0,0 +1,1084 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestServer starts the REST API on top of an in-memory database.
+// Authentication is skipped. The server must be closed by the caller.
+func newTestServer(t *testing.T) (*httptest.Server, *database) {
+	authenticate = func(*http.Request) (string, bool) { return "", true }
+	db := newMemoryDB("test")
+	require.Nil(t, db.initTables(complianceFeatureTable, validationLogTable, tfStateTable, tfStateRevisionTable, foreignResourcesTable, waiverTable, featureRevisionTable))
+	return httptest.NewServer(newRouter(db)), db
+}
+
+// doRequest sends body (as json, if not nil) to the given endpoint, and returns the response code and body.
+func doRequest(t *testing.T, server *httptest.Server, method string, endpoint string, body interface{}) (int, string) {
+	var bodyJSON []byte
+	if body != nil {
+		var err error
+		bodyJSON, err = json.Marshal(body)
+		require.Nil(t, err, "can't marshal body")
+	}
+
+	req, err := http.NewRequest(method, server.URL+endpoint, strings.NewReader(string(bodyJSON)))
+	require.Nil(t, err, "can't build request")
+	resp, err := http.DefaultClient.Do(req)
+	require.Nil(t, err, "can't do request")
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	require.Nil(t, err, "can't read response")
+	return resp.StatusCode, string(respBody)
+}
+
+// unmarshalResponse unmarshals the given json response into dst.
+func unmarshalResponse(t *testing.T, response string, dst interface{}) {
+	require.Nil(t, json.Unmarshal([]byte(response), dst), "bad json response: %s", response)
+}
+
+func TestAuthentication(t *testing.T) {
+	server, _ := newTestServer(t)
+	defer server.Close()
+
+	authenticate = func(*http.Request) (string, bool) { return "", false }
+	code, _ := doRequest(t, server, "GET", "/features", nil)
+	assert.Equal(t, http.StatusUnauthorized, code)
+}
+
+func TestFeaturesEndpoint(t *testing.T) {
+	server, _ := newTestServer(t)
+	defer server.Close()
+
+	// Add
+	code, res := doRequest(t, server, "POST", "/features", map[string]interface{}{
+		"name":   "tags",
+		"source": validateTestFeature,
+		"tags":   []string{"validation"},
+		"engine": engineNative,
+	})
+	require.Equal(t, http.StatusOK, code, res)
+	var created map[string]string
+	unmarshalResponse(t, res, &created)
+	id := created["id"]
+
+	code, _ = doRequest(t, server, "POST", "/features", map[string]interface{}{"name": "bad name"})
+	assert.Equal(t, http.StatusInternalServerError, code, "missing fields")
+	code, res = doRequest(t, server, "POST", "/features", map[string]interface{}{
+		"name":   "bad",
+		"source": "Feature: bad\n  Scenario: unknown step\n    Given I have aws_instance defined\n    Then it must fly\n",
+		"tags":   []string{"validation"},
+	})
+	assert.Equal(t, http.StatusBadRequest, code, "unknown step")
+	assert.Contains(t, res, "line 4, column 5: unknown step 'Then it must fly'")
+	lintLenient = true
+	code, res = doRequest(t, server, "POST", "/features", map[string]interface{}{
+		"name":   "warning",
+		"source": "Feature: unknown step\n  Scenario: unknown step\n    Given I have aws_instance defined\n    Then it must fly\n",
+		"tags":   []string{},
+	})
+	lintLenient = false
+	require.Equal(t, http.StatusOK, code, "unknown terraform-compliance steps are just warnings with -lint-lenient: %s", res)
+	var warned map[string]string
+	unmarshalResponse(t, res, &warned)
+	code, _ = doRequest(t, server, "DELETE", "/features/"+warned["id"], nil)
+	assert.Equal(t, http.StatusOK, code)
+	code, _ = doRequest(t, server, "POST", "/features", map[string]interface{}{
+		"name":   "bad",
+		"source": validateTestFeature,
+		"tags":   []string{"validation"},
+		"engine": "unknown",
+	})
+	assert.Equal(t, http.StatusBadRequest, code, "unknown engine")
+
+	// List
+	code, res = doRequest(t, server, "GET", "/features", nil)
+	require.Equal(t, http.StatusOK, code, res)
+	var list []map[string]interface{}
+	unmarshalResponse(t, res, &list)
+	require.Len(t, list, 1)
+	assert.Equal(t, id, list[0]["id"])
+	assert.Equal(t, "tags", list[0]["name"])
+
+	// Update
+	code, res = doRequest(t, server, "PUT", "/features/"+id, map[string]interface{}{
+		"source":   strings.Replace(validateTestFeature, "instances", "updated instances", 1),
+		"tags":     []string{"validation", "prod"},
+		"disabled": true,
+	})
+	require.Equal(t, http.StatusOK, code, res)
+	code, res = doRequest(t, server, "GET", "/features/"+id, nil)
+	require.Equal(t, http.StatusOK, code, res)
+	var details map[string]interface{}
+	unmarshalResponse(t, res, &details)
+	assert.Equal(t, strings.Replace(validateTestFeature, "instances", "updated instances", 1), details["source"])
+	assert.Equal(t, true, details["disabled"])
+	assert.Equal(t, []interface{}{"validation", "prod"}, details["tags"])
+	assert.Equal(t, engineNative, details["engine"], "kept if not given")
+
+	// Features can be referenced by name too
+	code, res = doRequest(t, server, "GET", "/features/tags", nil)
+	require.Equal(t, http.StatusOK, code, res)
+	unmarshalResponse(t, res, &details)
+	assert.Equal(t, id, details["id"])
+
+	// Remove
+	code, _ = doRequest(t, server, "DELETE", "/features/"+id, nil)
+	assert.Equal(t, http.StatusOK, code)
+	code, _ = doRequest(t, server, "GET", "/features/"+id, nil)
+	assert.Equal(t, http.StatusNotFound, code)
+	code, _ = doRequest(t, server, "DELETE", "/features/"+id, nil)
+	assert.Equal(t, http.StatusNotFound, code)
+}
+
+// TestFeaturePanelUpdate checks that the settings not given on updates
+// (the web panel sends just the source, tags and disabled) are kept.
+func TestFeaturePanelUpdate(t *testing.T) {
+	server, _ := newTestServer(t)
+	defer server.Close()
+
+	code, res := doRequest(t, server, "POST", "/features", map[string]interface{}{
+		"name":        "public",
+		"source":      regoTestPolicy,
+		"tags":        []string{"validation"},
+		"language":    languageRego,
+		"severity":    "critical",
+		"enforcement": enforcementAdvisory,
+	})
+	require.Equal(t, http.StatusOK, code, res)
+
+	code, res = doRequest(t, server, "PUT", "/features/public", map[string]interface{}{
+		"source":   regoTestPolicy,
+		"tags":     []string{"validation", "prod"},
+		"disabled": false,
+	})
+	require.Equal(t, http.StatusOK, code, res)
+	code, res = doRequest(t, server, "GET", "/features/public", nil)
+	require.Equal(t, http.StatusOK, code, res)
+	var details map[string]interface{}
+	unmarshalResponse(t, res, &details)
+	assert.Equal(t, languageRego, details["language"])
+	assert.Equal(t, "critical", details["severity"])
+	assert.Equal(t, enforcementAdvisory, details["enforcement"])
+	assert.Equal(t, []interface{}{"validation", "prod"}, details["tags"])
+}
+
+func TestLogsEndpoint(t *testing.T) {
+	server, db := newTestServer(t)
+	defer server.Close()
+
+	first := newValidationLog("{}", ComplianceResult{Initialized: true, PassCount: 1, TestCount: 1})
+	first.Timestamp--
+	second := newTFStateLog("{\"b\": 2}", ComplianceResult{}, "{\"a\": 1}", ComplianceResult{}, "", "acc", "bucket", "path")
+	require.Nil(t, db.saveLog(first))
+	require.Nil(t, db.saveLog(second))
+
+	// List, newest first and without the state diff
+	code, res := doRequest(t, server, "GET", "/logs", nil)
+	require.Equal(t, http.StatusOK, code, res)
+	var list []map[string]interface{}
+	unmarshalResponse(t, res, &list)
+	require.Len(t, list, 2)
+	assert.Equal(t, second.Id, list[0]["id"])
+	assert.Equal(t, first.Id, list[1]["id"])
+	assert.Equal(t, "bucket:path", list[0]["details"])
+	assert.NotContains(t, list[0], "state_diff_html")
+
+	// Filter by kind
+	code, res = doRequest(t, server, "GET", "/logs?kind="+logKindValidation, nil)
+	require.Equal(t, http.StatusOK, code, res)
+	unmarshalResponse(t, res, &list)
+	require.Len(t, list, 1)
+	assert.Equal(t, first.Id, list[0]["id"])
+
+	// Details
+	code, res = doRequest(t, server, "GET", "/logs/"+second.Id, nil)
+	require.Equal(t, http.StatusOK, code, res)
+	var details map[string]interface{}
+	unmarshalResponse(t, res, &details)
+	assert.Equal(t, logKindTFState, details["kind"])
+	assert.Contains(t, details, "state_diff_html")
+	assert.Equal(t, map[string]interface{}{"added": []interface{}{}, "removed": []interface{}{}, "modified": []interface{}{}}, details["state_diff"])
+
+	// Remove. POST isn't supported for logs.
+	code, _ = doRequest(t, server, "DELETE", "/logs/"+first.Id, nil)
+	assert.Equal(t, http.StatusOK, code)
+	code, _ = doRequest(t, server, "GET", "/logs/"+first.Id, nil)
+	assert.Equal(t, http.StatusNotFound, code)
+	code, _ = doRequest(t, server, "POST", "/logs", map[string]string{})
+	assert.Equal(t, http.StatusMethodNotAllowed, code)
+}
+
+func TestLogsBulkDelete(t *testing.T) {
+	server, db := newTestServer(t)
+	defer server.Close()
+
+	oldValidation := newValidationLog("{}", ComplianceResult{})
+	oldValidation.Timestamp = 100
+	oldTFState := newTFStateLog("{}", ComplianceResult{}, "{}", ComplianceResult{}, "", "acc", "bucket", "path")
+	oldTFState.Timestamp = 100
+	newValidation := newValidationLog("{}", ComplianceResult{})
+	newValidation.Timestamp = 300
+	for _, l := range []*ValidationLog{oldValidation, oldTFState, newValidation} {
+		require.Nil(t, db.saveLog(l))
+	}
+
+	code, _ := doRequest(t, server, "DELETE", "/logs", nil)
+	assert.Equal(t, http.StatusBadRequest, code, "before is required")
+
+	// Just the old validation logs
+	code, res := doRequest(t, server, "DELETE", "/logs?before=200&kind="+logKindValidation, nil)
+	require.Equal(t, http.StatusOK, code, res)
+	assert.JSONEq(t, `{"deleted": 1}`, res)
+	remaining, err := db.loadAllLogsMinimal()
+	require.Nil(t, err)
+	assert.Len(t, remaining, 2)
+
+	// All the old logs
+	code, res = doRequest(t, server, "DELETE", "/logs?before=200", nil)
+	require.Equal(t, http.StatusOK, code, res)
+	assert.JSONEq(t, `{"deleted": 1}`, res)
+	remaining, err = db.loadAllLogsMinimal()
+	require.Nil(t, err)
+	require.Len(t, remaining, 1)
+	assert.Equal(t, newValidation.Id, remaining[0].Id)
+}
+
+func TestTFStatesEndpoint(t *testing.T) {
+	server, db := newTestServer(t)
+	defer server.Close()
+
+	// Add
+	code, res := doRequest(t, server, "POST", "/tfstates", map[string]interface{}{
+		"account": "acc",
+		"bucket":  "bucket",
+		"path":    "path/terraform.tfstate",
+		"tags":    []string{"prod"},
+	})
+	require.Equal(t, http.StatusOK, code, res)
+	var created map[string]string
+	unmarshalResponse(t, res, &created)
+	id := created["id"]
+
+	// The state itself is only given in details
+	tfstate, err := db.findTFStateById(id)
+	require.Nil(t, err)
+	tfstate.State = "{\"values\": {}}"
+	require.Nil(t, db.saveTFState(tfstate))
+	code, res = doRequest(t, server, "GET", "/tfstates", nil)
+	require.Equal(t, http.StatusOK, code, res)
+	var list []map[string]interface{}
+	unmarshalResponse(t, res, &list)
+	require.Len(t, list, 1)
+	assert.Equal(t, "never", list[0]["last_update"])
+	assert.NotContains(t, list[0], "state")
+	code, res = doRequest(t, server, "GET", "/tfstates/"+id, nil)
+	require.Equal(t, http.StatusOK, code, res)
+	var details map[string]interface{}
+	unmarshalResponse(t, res, &details)
+	assert.Equal(t, tfstate.State, details["state"])
+
+	// Update
+	code, res = doRequest(t, server, "PUT", "/tfstates/"+id, map[string]interface{}{
+		"account": "acc2",
+		"bucket":  "bucket2",
+		"path":    "path2",
+	})
+	require.Equal(t, http.StatusOK, code, res)
+	tfstate, err = db.findTFStateById(id)
+	require.Nil(t, err)
+	assert.Equal(t, "acc2", tfstate.Account)
+	assert.Equal(t, "bucket2", tfstate.Bucket)
+	assert.Equal(t, "path2", tfstate.Path)
+
+	// Force validation
+	code, _ = doRequest(t, server, "POST", "/tfstates/"+id+"/validate", nil)
+	require.Equal(t, http.StatusOK, code)
+	forced, err := db.loadTFStatesWithForceValidation()
+	require.Nil(t, err)
+	require.Len(t, forced, 1)
+	assert.Equal(t, id, forced[0].Id)
+	code, _ = doRequest(t, server, "POST", "/tfstates/unknown/validate", nil)
+	assert.Equal(t, http.StatusNotFound, code)
+}
+
+func TestConditionalUpdates(t *testing.T) {
+	server, db := newTestServer(t)
+	defer server.Close()
+
+	tfstate := newTFState("acc", "bucket", "path", nil)
+	require.Nil(t, db.saveTFState(tfstate))
+	endpoint := server.URL + "/tfstates/" + tfstate.Id
+	do := func(method string, ifMatch string, body string) *http.Response {
+		req, err := http.NewRequest(method, endpoint, strings.NewReader(body))
+		require.Nil(t, err)
+		if ifMatch != "" {
+			req.Header.Set("If-Match", ifMatch)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.Nil(t, err)
+		resp.Body.Close()
+		return resp
+	}
+	update := `{"account": "acc", "bucket": "bucket", "path": "path2"}`
+
+	resp := do("GET", "", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	etag := resp.Header.Get("ETag")
+	assert.Equal(t, `"1"`, etag)
+
+	resp = do("PUT", etag, update)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, `"2"`, resp.Header.Get("ETag"))
+
+	// Stale writes
+	resp = do("PUT", etag, update)
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+	resp = do("DELETE", etag, "")
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+
+	// Without If-Match, writes are unconditional
+	resp = do("PUT", "", update)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	resp = do("DELETE", "", "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestTFStateHistoryEndpoints(t *testing.T) {
+	server, db := newTestServer(t)
+	defer server.Close()
+
+	tfstate := newTFState("acc", "bucket", "path", nil)
+	require.Nil(t, db.saveTFState(tfstate))
+	failing := ComplianceResult{Initialized: true, FailCount: 1, TestCount: 1}
+	passing := ComplianceResult{Initialized: true, PassCount: 1, TestCount: 1}
+	first := newTFStateRevision(tfstate.Id, "mod1", 1, "lin", "{\"a\": 1}", failing, "log1")
+	first.Timestamp = 1000
+	second := newTFStateRevision(tfstate.Id, "mod2", 2, "lin", "{\"a\": 2}", passing, "log2")
+	second.Timestamp = 2000
+	other := newTFStateRevision("other", "mod", 1, "lin2", "{}", passing, "log3")
+	for _, r := range []*TFStateRevision{first, second, other} {
+		require.Nil(t, db.saveTFStateRevision(r))
+	}
+
+	// History, newest first and without the states
+	code, res := doRequest(t, server, "GET", "/tfstates/"+tfstate.Id+"/history", nil)
+	require.Equal(t, http.StatusOK, code, res)
+	var list []map[string]interface{}
+	unmarshalResponse(t, res, &list)
+	require.Len(t, list, 2)
+	assert.Equal(t, second.Id, list[0]["id"])
+	assert.Equal(t, first.Id, list[1]["id"])
+	assert.Equal(t, float64(2), list[0]["serial"])
+	assert.NotContains(t, list[0], "state")
+
+	// Point-in-time
+	at := func(time string) (int, map[string]interface{}) {
+		code, res := doRequest(t, server, "GET", "/tfstates/"+tfstate.Id+"/at?time="+time, nil)
+		var revision map[string]interface{}
+		if code == http.StatusOK {
+			unmarshalResponse(t, res, &revision)
+		}
+		return code, revision
+	}
+	code, _ = at("999")
+	assert.Equal(t, http.StatusNotFound, code, "not checked yet")
+	code, revision := at("1000")
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, first.Id, revision["id"])
+	assert.Equal(t, first.State, revision["state"])
+	code, revision = at("1970-01-01T00:25:00Z")
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, first.Id, revision["id"])
+	code, revision = at("1970-01-01")
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, second.Id, revision["id"])
+	code, _ = at("yesterday")
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	// Revisions are kept when the state is removed, for audits
+	code, _ = doRequest(t, server, "DELETE", "/tfstates/"+tfstate.Id, nil)
+	require.Equal(t, http.StatusOK, code)
+	revisions, _, err := db.loadTFStateRevisionsMinimalPage(tfstate.Id, 0, "")
+	require.Nil(t, err)
+	assert.Len(t, revisions, 2)
+	code, revision = at("1000")
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, first.Id, revision["id"])
+}
+
+func TestExportImport(t *testing.T) {
+	source, sourceDB := newTestServer(t)
+	defer source.Close()
+	target, targetDB := newTestServer(t)
+	defer target.Close()
+
+	require.Nil(t, sourceDB.saveFeature(newFeature("shared", "new source", []string{"validation"})))
+	require.Nil(t, sourceDB.saveTFState(newTFState("acc", "bucket", "path", nil)))
+	require.Nil(t, targetDB.saveFeature(newFeature("shared", "old source", []string{"validation"})))
+	require.Nil(t, targetDB.saveFeature(newFeature("other", "source", nil)))
+
+	for _, format := range []string{"json", "tar.gz"} {
+		code, archive := doRequest(t, source, "GET", "/export?tables=features,tfstates&format="+format, nil)
+		require.Equal(t, http.StatusOK, code, archive)
+		body := base64.StdEncoding.EncodeToString([]byte(archive))
+
+		// Dry run, changes nothing
+		code, res := doRequest(t, target, "POST", "/import?mode=replace&dry_run=true", body)
+		require.Equal(t, http.StatusOK, code, res)
+		var changes struct {
+			Tables map[string]importTableDiff `json:"tables"`
+		}
+		unmarshalResponse(t, res, &changes)
+		assert.Equal(t, []string{"shared"}, changes.Tables["features"].Updated, format)
+		assert.Equal(t, []string{"other"}, changes.Tables["features"].Removed, format)
+		assert.Equal(t, []string{"bucket:path"}, changes.Tables["tfstates"].Added, format)
+		assert.NotContains(t, changes.Tables, "logs", "not exported")
+		features, err := targetDB.loadAllFeaturesFull()
+		require.Nil(t, err)
+		assert.Len(t, features, 2)
+	}
+
+	// Merge keeps the features not in the archive, and updates by name
+	_, archive := doRequest(t, source, "GET", "/export", nil)
+	code, res := doRequest(t, target, "POST", "/import?mode=merge", base64.StdEncoding.EncodeToString([]byte(archive)))
+	require.Equal(t, http.StatusOK, code, res)
+	shared, err := targetDB.findFeatureByName("shared")
+	require.Nil(t, err)
+	assert.Equal(t, "new source", shared.Source)
+	other, err := targetDB.findFeatureByName("other")
+	require.Nil(t, err)
+	assert.NotNil(t, other)
+	tfstates, err := targetDB.loadAllTFStatesFull()
+	require.Nil(t, err)
+	assert.Len(t, tfstates, 1)
+
+	// Importing again changes nothing
+	code, res = doRequest(t, target, "POST", "/import", base64.StdEncoding.EncodeToString([]byte(archive)))
+	require.Equal(t, http.StatusOK, code, res)
+	var changes struct {
+		Tables map[string]importTableDiff `json:"tables"`
+	}
+	unmarshalResponse(t, res, &changes)
+	assert.Equal(t, 1, changes.Tables["features"].Unchanged)
+	assert.Empty(t, changes.Tables["features"].Updated)
+
+	code, _ = doRequest(t, target, "POST", "/import", "bm90IGFuIGFyY2hpdmU=")
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	// Into a new environment, features keep their revisions (as numbered in the logs)
+	sourceShared, err := sourceDB.findFeatureByName("shared")
+	require.Nil(t, err)
+	sourceShared.Source = "newer source"
+	require.Nil(t, sourceDB.saveFeature(sourceShared))
+	_, archive = doRequest(t, source, "GET", "/export", nil)
+	fresh, freshDB := newTestServer(t)
+	defer fresh.Close()
+	code, res = doRequest(t, fresh, "POST", "/import", base64.StdEncoding.EncodeToString([]byte(archive)))
+	require.Equal(t, http.StatusOK, code, res)
+	shared, err = freshDB.findFeatureByName("shared")
+	require.Nil(t, err)
+	assert.Equal(t, int64(2), shared.Version)
+	revisions, _, err := freshDB.loadFeatureRevisionsPage(shared.Id, 0, "")
+	require.Nil(t, err)
+	require.Len(t, revisions, 2)
+	assert.Equal(t, int64(2), revisions[0].Revision)
+	assert.Equal(t, "newer source", revisions[0].Source)
+	assert.Equal(t, int64(1), revisions[1].Revision)
+	assert.Equal(t, "new source", revisions[1].Source)
+}
+
+func TestValidateEndpoint(t *testing.T) {
+	server, db := newTestServer(t)
+	defer server.Close()
+
+	code, _ := doRequest(t, server, "POST", "/validate", "not base64!")
+	assert.Equal(t, http.StatusInternalServerError, code, "bad base64")
+
+	if _, err := exec.LookPath("terraform-compliance"); err != nil {
+		t.Skipf("terraform-compliance not installed")
+		return
+	}
+
+	feature := newFeature("tags", validateTestFeature, []string{"validation"})
+	require.Nil(t, db.saveFeature(feature))
+	plan := base64.StdEncoding.EncodeToString([]byte(convertTFExpectedJson))
+	code, res := doRequest(t, server, "POST", "/validate", plan)
+	require.Equal(t, http.StatusOK, code, res)
+
+	logs, err := db.loadAllLogsMinimal()
+	require.Nil(t, err)
+	require.Len(t, logs, 1)
+	assert.Equal(t, logKindValidation, logs[0].Kind)
+	assert.Equal(t, false, logs[0].ComplianceResult.FeaturesResult["tags"])
+}
+
+func TestValidateJSONFormat(t *testing.T) {
+	server, db := newTestServer(t)
+	defer server.Close()
+
+	feature := newFeature("tags", validateTestFeature, []string{"validation"})
+	feature.Engine = engineNative
+	require.Nil(t, db.saveFeature(feature))
+	plan := base64.StdEncoding.EncodeToString([]byte(policyEngineTestPlan))
+
+	code, _ := doRequest(t, server, "POST", "/validate?format=xml", plan)
+	assert.Equal(t, http.StatusBadRequest, code, "bad format")
+
+	code, res := doRequest(t, server, "POST", "/validate?format=json", plan)
+	require.Equal(t, http.StatusOK, code, res)
+	var validation struct {
+		LogId            string           `json:"log_id"`
+		Verdict          string           `json:"verdict"`
+		ComplianceResult ComplianceResult `json:"compliance_result"`
+	}
+	unmarshalResponse(t, res, &validation)
+	assert.Equal(t, map[string]bool{"tags": false}, validation.ComplianceResult.FeaturesResult)
+	assert.Equal(t, []ComplianceFinding{{
+		Feature:         "tags",
+		Scenario:        "Ensure all instances have tags",
+		Step:            "Then it must contain tags",
+		ResourceAddress: "aws_instance.example",
+		ResourceType:    "aws_instance",
+		Message:         "aws_instance.example (aws_instance) does not have tags property.",
+		Severity:        "medium",
+	}}, validation.ComplianceResult.Findings)
+	assert.Equal(t, "fail", validation.Verdict)
+
+	code, res = doRequest(t, server, "GET", "/logs/"+validation.LogId, nil)
+	require.Equal(t, http.StatusOK, code, res)
+	var logEntry struct {
+		ComplianceResult ComplianceResult `json:"compliance_result"`
+	}
+	unmarshalResponse(t, res, &logEntry)
+	assert.Equal(t, validation.ComplianceResult.Findings, logEntry.ComplianceResult.Findings)
+
+	// advisory features don't fail validations
+	feature.Enforcement = enforcementAdvisory
+	require.Nil(t, db.saveFeature(feature))
+	code, res = doRequest(t, server, "POST", "/validate?format=json", plan)
+	require.Equal(t, http.StatusOK, code, res)
+	unmarshalResponse(t, res, &validation)
+	assert.Equal(t, "pass", validation.Verdict)
+	assert.Equal(t, 1, validation.ComplianceResult.FailCount)
+	assert.Equal(t, map[string]int{"medium": 1}, validation.ComplianceResult.SeverityCounts)
+}
+
+func TestValidateSourceEndpoint(t *testing.T) {
+	server, db := newTestServer(t)
+	defer server.Close()
+
+	feature := newFeature("tags", validateTestFeature, []string{"validation"})
+	feature.Engine = engineNative
+	require.Nil(t, db.saveFeature(feature))
+
+	code, _ := doRequest(t, server, "POST", "/validate/source", "not base64!")
+	assert.Equal(t, http.StatusBadRequest, code, "bad base64")
+	invalid := sourceArchive(t, map[string]string{"main.tf": "resource {"})
+	code, res := doRequest(t, server, "POST", "/validate/source", base64.StdEncoding.EncodeToString(invalid))
+	assert.Equal(t, http.StatusBadRequest, code, res)
+	tooBig := sourceArchive(t, map[string]string{"main.tf": strings.Repeat("#", tfsourceMaxFileSize+1)})
+	code, res = doRequest(t, server, "POST", "/validate/source", base64.StdEncoding.EncodeToString(tooBig))
+	assert.Equal(t, http.StatusBadRequest, code, res)
+
+	source := sourceArchive(t, map[string]string{
+		"main.tf": `
+resource "aws_instance" "example" {
+  ami           = var.ami
+  instance_type = "t2.micro"
+}
+variable "ami" {}`,
+	})
+	code, res = doRequest(t, server, "POST", "/validate/source?format=json", base64.StdEncoding.EncodeToString(source))
+	require.Equal(t, http.StatusOK, code, res)
+	var validation struct {
+		LogId            string           `json:"log_id"`
+		Verdict          string           `json:"verdict"`
+		ComplianceResult ComplianceResult `json:"compliance_result"`
+	}
+	unmarshalResponse(t, res, &validation)
+	assert.Equal(t, "fail", validation.Verdict)
+	require.Len(t, validation.ComplianceResult.Findings, 1)
+	assert.Equal(t, "aws_instance.example", validation.ComplianceResult.Findings[0].ResourceAddress)
+
+	logs, err := db.loadAllLogsMinimal()
+	require.Nil(t, err)
+	require.Len(t, logs, 1)
+	assert.Equal(t, logKindValidation, logs[0].Kind)
+}
+
+func TestValidateSaturated(t *testing.T) {
+	server, db := newTestServer(t)
+	defer server.Close()
+	defer func(pool *toolPool) { toolWorkers = pool }(toolWorkers)
+
+	// the only worker is busy, and nothing can wait for it
+	toolWorkers = newToolPool(1, 0)
+	release, started := make(chan struct{}), make(chan struct{})
+	go func() {
+		_ = toolWorkers.run(func() error {
+			close(started)
+			<-release
+			return nil
+		})
+	}()
+	<-started
+	defer close(release)
+
+	require.Nil(t, db.saveFeature(newFeature("tags", validateTestFeature, []string{"validation"})))
+	plan := base64.StdEncoding.EncodeToString([]byte(policyEngineTestPlan))
+	code, res := doRequest(t, server, "POST", "/validate", plan)
+	assert.Equal(t, http.StatusServiceUnavailable, code, res)
+
+	logs, err := db.loadAllLogsMinimal()
+	require.Nil(t, err)
+	assert.Empty(t, logs, "rejected validations aren't logged")
+}
+
+func TestWaivers(t *testing.T) {
+	server, db := newTestServer(t)
+	defer server.Close()
+
+	feature := newFeature("tags", validateTestFeature, []string{"validation"})
+	feature.Engine = engineNative
+	require.Nil(t, db.saveFeature(feature))
+	plan := base64.StdEncoding.EncodeToString([]byte(policyEngineTestPlan))
+	validate := func() (string, ComplianceResult) {
+		code, res := doRequest(t, server, "POST", "/validate?format=json", plan)
+		require.Equal(t, http.StatusOK, code, res)
+		var validation struct {
+			Verdict          string           `json:"verdict"`
+			ComplianceResult ComplianceResult `json:"compliance_result"`
+		}
+		unmarshalResponse(t, res, &validation)
+		return validation.Verdict, validation.ComplianceResult
+	}
+
+	code, _ := doRequest(t, server, "POST", "/waivers", map[string]string{"feature_name": "tags"})
+	assert.Equal(t, http.StatusInternalServerError, code, "missing fields")
+	code, _ = doRequest(t, server, "POST", "/waivers", map[string]string{
+		"feature_name": "tags", "resource_pattern": "[", "reason": "r", "approver": "a",
+	})
+	assert.Equal(t, http.StatusInternalServerError, code, "bad pattern")
+
+	// scoped waivers don't apply to plans
+	code, res := doRequest(t, server, "POST", "/waivers", map[string]string{
+		"feature_name": "tags", "resource_pattern": "aws_instance.*", "account": "other",
+		"reason": "legacy instances", "approver": "security",
+	})
+	require.Equal(t, http.StatusOK, code, res)
+	verdict, result := validate()
+	assert.Equal(t, "fail", verdict)
+	assert.Equal(t, 0, result.WaivedCount)
+
+	code, res = doRequest(t, server, "POST", "/waivers", map[string]string{
+		"feature_name": "tags", "resource_pattern": "aws_instance.*",
+		"reason": "legacy instances", "approver": "security", "expires_at": "2100-01-01",
+	})
+	require.Equal(t, http.StatusOK, code, res)
+	var created map[string]string
+	unmarshalResponse(t, res, &created)
+	verdict, result = validate()
+	assert.Equal(t, "pass", verdict)
+	assert.Equal(t, 1, result.WaivedCount)
+	assert.Equal(t, map[string]bool{"tags": true}, result.FeaturesResult)
+	assert.Equal(t, map[string][]string{"tags": {}}, result.FeaturesFailures)
+	require.Len(t, result.Findings, 1)
+	assert.Equal(t, created["id"], result.Findings[0].WaiverId)
+
+	// once expired, the failures fail again and the expiration is logged
+	waiver, err := db.findWaiverById(created["id"])
+	require.Nil(t, err)
+	waiver.ExpiresAt = time.Now().Unix() - 1
+	require.Nil(t, db.saveWaiver(waiver))
+	state := newTFState("account", "bucket", "path", []string{"validation"})
+	require.Nil(t, db.saveTFState(state))
+
+	verdict, _ = validate()
+	assert.Equal(t, "fail", verdict)
+
+	count, err := db.expireWaivers(time.Now())
+	require.Nil(t, err)
+	assert.Equal(t, 1, count)
+	count, err = db.expireWaivers(time.Now())
+	require.Nil(t, err)
+	assert.Equal(t, 0, count, "expirations are logged once")
+
+	forced, err := db.loadTFStatesWithForceValidation()
+	require.Nil(t, err)
+	require.Len(t, forced, 1, "the states are revalidated")
+	assert.Equal(t, state.Id, forced[0].Id)
+	logs, err := db.loadAllLogsMinimal()
+	require.Nil(t, err)
+	kinds := make(map[string]int)
+	for _, l := range logs {
+		kinds[l.Kind]++
+	}
+	assert.Equal(t, 1, kinds[logKindWaiverExpired])
+}
+
+func TestFeaturePreview(t *testing.T) {
+	server, db := newTestServer(t)
+	defer server.Close()
+
+	checked := newTFState("account", "bucket", "checked", []string{"prod"})
+	checked.State = policyEngineTestPlan
+	other := newTFState("account", "bucket", "other", []string{"dev"})
+	other.State = policyEngineTestPlan
+	notChecked := newTFState("account", "bucket", "not_checked", []string{"prod"})
+	for _, state := range []*TFState{checked, other, notChecked} {
+		require.Nil(t, db.saveTFState(state))
+	}
+
+	code, _ := doRequest(t, server, "POST", "/features/preview", map[string]interface{}{"source": validateTestFeature})
+	assert.Equal(t, http.StatusBadRequest, code, "no tags")
+	code, _ = doRequest(t, server, "POST", "/features/preview", map[string]interface{}{
+		"source": "bad", "tags": []string{"prod"}, "language": "rego",
+	})
+	assert.Equal(t, http.StatusBadRequest, code, "bad source")
+
+	code, res := doRequest(t, server, "POST", "/features/preview", map[string]interface{}{
+		"source": validateTestFeature, "tags": []string{"prod"}, "engine": engineNative,
+	})
+	require.Equal(t, http.StatusOK, code, res)
+	var preview struct {
+		States  int `json:"states"`
+		Failing int `json:"failing"`
+		Results []struct {
+			TFStateId        string           `json:"tfstate_id"`
+			ComplianceResult ComplianceResult `json:"compliance_result"`
+		} `json:"results"`
+	}
+	unmarshalResponse(t, res, &preview)
+	assert.Equal(t, 1, preview.States)
+	assert.Equal(t, 1, preview.Failing)
+	require.Len(t, preview.Results, 1)
+	assert.Equal(t, checked.Id, preview.Results[0].TFStateId)
+	assert.Equal(t, map[string]bool{"preview": false}, preview.Results[0].ComplianceResult.FeaturesResult)
+
+	// nothing is saved
+	features, err := db.loadAllFeaturesFull()
+	require.Nil(t, err)
+	assert.Empty(t, features)
+	logs, err := db.loadAllLogsMinimal()
+	require.Nil(t, err)
+	assert.Empty(t, logs)
+}
+
+const validateTestFeature = `Feature: Resources should be tagged
+  Scenario: Ensure all instances have tags
+    Given I have aws_instance defined
+    Then it must contain tags
+`
+
+func TestFeatureLint(t *testing.T) {
+	server, _ := newTestServer(t)
+	defer server.Close()
+
+	code, _ := doRequest(t, server, "POST", "/features/lint", map[string]interface{}{"name": "empty"})
+	assert.Equal(t, http.StatusBadRequest, code, "no source")
+
+	var lint struct {
+		Valid  bool               `json:"valid"`
+		Errors []featureLintError `json:"errors"`
+	}
+	code, res := doRequest(t, server, "POST", "/features/lint", map[string]interface{}{"source": validateTestFeature})
+	require.Equal(t, http.StatusOK, code, res)
+	unmarshalResponse(t, res, &lint)
+	assert.True(t, lint.Valid)
+	assert.Empty(t, lint.Errors)
+
+	code, res = doRequest(t, server, "POST", "/features/lint", map[string]interface{}{
+		"source": strings.Replace(validateTestFeature, "it must contain tags", "I count them", 1),
+		"engine": engineNative,
+	})
+	require.Equal(t, http.StatusOK, code, res)
+	unmarshalResponse(t, res, &lint)
+	assert.False(t, lint.Valid)
+	assert.Equal(t, []featureLintError{{Line: 4, Column: 5, Message: "unknown step 'Then I count them'"}}, lint.Errors)
+
+	unknownStep := map[string]interface{}{"source": strings.Replace(validateTestFeature, "it must contain tags", "it must fly", 1)}
+	code, res = doRequest(t, server, "POST", "/features/lint", unknownStep)
+	require.Equal(t, http.StatusOK, code, res)
+	unmarshalResponse(t, res, &lint)
+	assert.False(t, lint.Valid)
+	assert.Equal(t, []featureLintError{{Line: 4, Column: 5, Message: "unknown step 'Then it must fly'"}}, lint.Errors)
+
+	lintLenient = true
+	defer func() { lintLenient = false }()
+	code, res = doRequest(t, server, "POST", "/features/lint", unknownStep)
+	require.Equal(t, http.StatusOK, code, res)
+	unmarshalResponse(t, res, &lint)
+	assert.True(t, lint.Valid)
+	assert.Equal(t, []featureLintError{{Line: 4, Column: 5, Message: "unknown step 'Then it must fly'", Warning: true}}, lint.Errors)
+}
+
+func TestFeatureTests(t *testing.T) {
+	server, _ := newTestServer(t)
+	defer server.Close()
+
+	body := map[string]interface{}{
+		"name":   "tags",
+		"source": validateTestFeature,
+		"tags":   []string{"validation"},
+		"engine": engineNative,
+		"tests": []map[string]interface{}{
+			{"name": "untagged", "fixture": json.RawMessage(policyEngineTestPlan), "expect": "pass"},
+		},
+	}
+	code, res := doRequest(t, server, "POST", "/features", body)
+	assert.Equal(t, http.StatusBadRequest, code, "fails its tests")
+	assert.Contains(t, res, "test 'untagged': expected to pass, but failed")
+
+	body["tests"] = []map[string]interface{}{
+		{"name": "untagged", "fixture": json.RawMessage(policyEngineTestPlan), "expected_failures": []string{"does not have tags"}},
+	}
+	code, res = doRequest(t, server, "POST", "/features", body)
+	require.Equal(t, http.StatusOK, code, res)
+
+	code, res = doRequest(t, server, "POST", "/features/tags/test", nil)
+	require.Equal(t, http.StatusOK, code, res)
+	var testRun struct {
+		Passed  bool                `json:"passed"`
+		Results []FeatureTestResult `json:"results"`
+	}
+	unmarshalResponse(t, res, &testRun)
+	assert.True(t, testRun.Passed)
+	require.Len(t, testRun.Results, 1)
+	assert.Equal(t, "untagged", testRun.Results[0].Name)
+
+	// updates keep the tests if not given, so a change breaking them is rejected
+	code, res = doRequest(t, server, "PUT", "/features/tags", map[string]interface{}{
+		"source": strings.Replace(validateTestFeature, "it must contain tags", "it must contain ami", 1),
+		"tags":   []string{"validation"},
+		"engine": engineNative,
+	})
+	assert.Equal(t, http.StatusBadRequest, code, res)
+	assert.Contains(t, res, "expected to fail, but passed")
+
+	code, _ = doRequest(t, server, "POST", "/features/unknown/test", nil)
+	assert.Equal(t, http.StatusNotFound, code)
+}
+
+func TestFeatureSync(t *testing.T) {
+	server, db := newTestServer(t)
+	defer server.Close()
+
+	unchanged := newFeature("unchanged", validateTestFeature, []string{"validation"})
+	changed := newFeature("changed", validateTestFeature, []string{"validation"})
+	pruned := newFeature("pruned", validateTestFeature, []string{"validation"})
+	for _, f := range []*ComplianceFeature{unchanged, changed, pruned} {
+		require.Nil(t, db.saveFeature(f))
+	}
+
+	body := map[string]interface{}{"features": []map[string]interface{}{
+		{"name": "unchanged", "source": validateTestFeature, "tags": []string{"validation"}},
+		{"name": "changed", "source": validateTestFeature, "tags": []string{"validation", "prod"}, "severity": "high"},
+		{"name": "added", "source": validateTestFeature, "tags": []string{"prod"}},
+	}}
+	var sync struct {
+		DryRun   bool                `json:"dry_run"`
+		Features importTableDiff     `json:"features"`
+		Changes  map[string][]string `json:"changes"`
+	}
+	code, res := doRequest(t, server, "POST", "/features/sync?prune=true&dry_run=true", body)
+	require.Equal(t, http.StatusOK, code, res)
+	unmarshalResponse(t, res, &sync)
+	assert.True(t, sync.DryRun)
+	assert.Equal(t, importTableDiff{Added: []string{"added"}, Updated: []string{"changed"}, Removed: []string{"pruned"}, Unchanged: 1}, sync.Features)
+	assert.Equal(t, map[string][]string{"changed": {"severity", "tags"}}, sync.Changes)
+	features, err := db.loadAllFeaturesFull()
+	require.Nil(t, err)
+	assert.Len(t, features, 3, "dry run")
+
+	// without prune, the features not given are kept
+	code, res = doRequest(t, server, "POST", "/features/sync", body)
+	require.Equal(t, http.StatusOK, code, res)
+	unmarshalResponse(t, res, &sync)
+	assert.Equal(t, importTableDiff{Added: []string{"added"}, Updated: []string{"changed"}, Removed: []string{}, Unchanged: 1}, sync.Features)
+	got, err := db.findFeatureByName("changed")
+	require.Nil(t, err)
+	assert.Equal(t, changed.Id, got.Id)
+	assert.Equal(t, "high", got.Severity)
+	assert.Equal(t, []string{"validation", "prod"}, got.Tags)
+	_, err = db.findFeatureByName("pruned")
+	require.Nil(t, err)
+
+	// invalid features abort the sync
+	code, res = doRequest(t, server, "POST", "/features/sync?prune=true", map[string]interface{}{"features": []map[string]interface{}{
+		{"name": "unchanged", "source": validateTestFeature, "tags": []string{"validation"}},
+		{"name": "bad", "source": "Feature: bad", "tags": []string{"validation"}},
+	}})
+	assert.Equal(t, http.StatusBadRequest, code, res)
+	assert.Contains(t, res, "bad: invalid gherkin source")
+	features, err = db.loadAllFeaturesFull()
+	require.Nil(t, err)
+	assert.Len(t, features, 4)
+}
+
+func TestFeatureRevisions(t *testing.T) {
+	server, db := newTestServer(t)
+	defer server.Close()
+	authenticate = func(r *http.Request) (string, bool) { return r.Header.Get("X-Test-User"), true }
+
+	code, res := doRequest(t, server, "POST", "/features", map[string]interface{}{
+		"name": "tags", "source": validateTestFeature, "tags": []string{"validation"}, "engine": engineNative,
+	})
+	require.Equal(t, http.StatusOK, code, res)
+	code, res = doRequest(t, server, "PUT", "/features/tags", map[string]interface{}{
+		"source":   strings.Replace(validateTestFeature, "tags", "labels", -1),
+		"tags":     []string{"validation"},
+		"engine":   engineNative,
+		"severity": "high",
+	})
+	require.Equal(t, http.StatusOK, code, res)
+
+	// List, newest first
+	code, res = doRequest(t, server, "GET", "/features/tags/revisions", nil)
+	require.Equal(t, http.StatusOK, code, res)
+	var revisions []map[string]interface{}
+	unmarshalResponse(t, res, &revisions)
+	require.Len(t, revisions, 2)
+	assert.Equal(t, 2.0, revisions[0]["revision"])
+	assert.Equal(t, "high", revisions[0]["severity"])
+	assert.Equal(t, 1.0, revisions[1]["revision"])
+	code, res = doRequest(t, server, "GET", "/features/unknown/revisions", nil)
+	require.Equal(t, http.StatusOK, code, res)
+	unmarshalResponse(t, res, &revisions)
+	assert.Empty(t, revisions)
+
+	// Diff
+	code, res = doRequest(t, server, "GET", "/features/tags/diff?from=1", nil)
+	require.Equal(t, http.StatusOK, code, res)
+	var diff struct {
+		From       int64                    `json:"from"`
+		To         int64                    `json:"to"`
+		SourceDiff string                   `json:"source_diff"`
+		Changes    map[string][]interface{} `json:"changes"`
+	}
+	unmarshalResponse(t, res, &diff)
+	assert.Equal(t, int64(1), diff.From)
+	assert.Equal(t, int64(2), diff.To)
+	assert.Contains(t, diff.SourceDiff, "-     Then it must contain tags\n")
+	assert.Contains(t, diff.SourceDiff, "+     Then it must contain labels\n")
+	assert.Contains(t, diff.SourceDiff, "      Given I have aws_instance defined\n")
+	assert.Equal(t, map[string][]interface{}{"severity": {"", "high"}}, diff.Changes)
+	code, _ = doRequest(t, server, "GET", "/features/tags/diff", nil)
+	assert.Equal(t, http.StatusBadRequest, code, "no from")
+	code, _ = doRequest(t, server, "GET", "/features/tags/diff?from=1&to=5", nil)
+	assert.Equal(t, http.StatusNotFound, code)
+
+	// Rollback, as a new revision
+	req, err := http.NewRequest("POST", server.URL+"/features/tags/rollback?revision=1", nil)
+	require.Nil(t, err)
+	req.Header.Set("X-Test-User", "alice")
+	resp, err := http.DefaultClient.Do(req)
+	require.Nil(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	code, res = doRequest(t, server, "GET", "/features/tags", nil)
+	require.Equal(t, http.StatusOK, code, res)
+	var details map[string]interface{}
+	unmarshalResponse(t, res, &details)
+	assert.Equal(t, validateTestFeature, details["source"])
+	assert.Equal(t, "medium", details["severity"])
+	assert.Equal(t, 3.0, details["revision"])
+	assert.Equal(t, "alice", details["updated_by"])
+
+	// Logs record the evaluated revisions
+	plan := base64.StdEncoding.EncodeToString([]byte(policyEngineTestPlan))
+	code, res = doRequest(t, server, "POST", "/validate?format=json", plan)
+	require.Equal(t, http.StatusOK, code, res)
+	var validation struct {
+		ComplianceResult ComplianceResult `json:"compliance_result"`
+	}
+	unmarshalResponse(t, res, &validation)
+	assert.Equal(t, map[string]int64{"tags": 3}, validation.ComplianceResult.FeatureRevisions)
+
+	// Kept when the feature is removed, as the logs refer to them
+	code, _ = doRequest(t, server, "DELETE", "/features/tags", nil)
+	require.Equal(t, http.StatusOK, code)
+	revisionsLeft, _, err := db.loadFeatureRevisionsPage(details["id"].(string), 0, "")
+	require.Nil(t, err)
+	assert.Len(t, revisionsLeft, 3)
+}
+
+func TestPagination(t *testing.T) {
+	server, db := newTestServer(t)
+	defer server.Close()
+
+	for i := 0; i < 5; i++ {
+		require.Nil(t, db.saveLog(newValidationLog("{}", ComplianceResult{})))
+	}
+
+	code, _ := doRequest(t, server, "GET", "/logs?limit=abc", nil)
+	assert.Equal(t, http.StatusBadRequest, code, "bad limit")
+
+	seen := make(map[string]bool)
+	cursor := ""
+	for pages := 1; ; pages++ {
+		require.True(t, pages <= 3, "too many pages")
+		code, res := doRequest(t, server, "GET", "/logs?limit=2&cursor="+cursor, nil)
+		require.Equal(t, http.StatusOK, code, res)
+		var page struct {
+			Items      []map[string]interface{} `json:"items"`
+			NextCursor string                   `json:"next_cursor"`
+		}
+		unmarshalResponse(t, res, &page)
+		for _, item := range page.Items {
+			seen[item["id"].(string)] = true
+		}
+
+		cursor = page.NextCursor
+		if cursor == "" {
+			assert.Equal(t, 3, pages)
+			break
+		}
+		assert.Len(t, page.Items, 2)
+	}
+	assert.Len(t, seen, 5)
+}
+
+func TestPaginationByKind(t *testing.T) {
+	server, db := newTestServer(t)
+	defer server.Close()
+
+	for i := 0; i < 3; i++ {
+		log := newValidationLog("{}", ComplianceResult{})
+		log.Timestamp += int64(i)
+		require.Nil(t, db.saveLog(log))
+	}
+	require.Nil(t, db.saveLog(newTFStateLog("{}", ComplianceResult{}, "{}", ComplianceResult{}, "", "acc", "b", "p")))
+
+	var timestamps []float64
+	cursor := ""
+	for {
+		code, res := doRequest(t, server, "GET", "/logs?kind="+logKindValidation+"&limit=2&cursor="+cursor, nil)
+		require.Equal(t, http.StatusOK, code, res)
+		var page struct {
+			Items      []map[string]interface{} `json:"items"`
+			NextCursor string                   `json:"next_cursor"`
+		}
+		unmarshalResponse(t, res, &page)
+		for _, item := range page.Items {
+			timestamps = append(timestamps, item["timestamp"].(float64))
+		}
+		if cursor = page.NextCursor; cursor == "" {
+			break
+		}
+	}
+
+	require.Len(t, timestamps, 3)
+	assert.True(t, timestamps[0] > timestamps[1] && timestamps[1] > timestamps[2], "newest first")
+}
@@ -0,0 +1,174 @@
+// This file contains the semantic diff between two states (or plans): which resources were
+// added, removed or modified, and how, instead of which lines of their json changed.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+)
+
+// tfStateDiff is the difference between two states, by resource address.
+type tfStateDiff struct {
+	Added    []tfResourceDiff `json:"added"`
+	Removed  []tfResourceDiff `json:"removed"`
+	Modified []tfResourceDiff `json:"modified"`
+}
+
+// tfResourceDiff is a resource added, removed or modified.
+type tfResourceDiff struct {
+	Address    string                     `json:"address"`
+	Type       string                     `json:"type"`
+	Attributes map[string]tfAttributeDiff `json:"attributes,omitempty"` // for modified resources, the changed ones by path (like tags.Name)
+}
+
+// tfAttributeDiff is an attribute of a resource changed. Before or after are null if it was added or removed.
+type tfAttributeDiff struct {
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+}
+
+// diffTFStates returns the resources added, removed and modified in newJSON, relative to oldJSON.
+// Both are states or plans as given by "terraform show -json" (or raw states), empty for none.
+// Lists with the same elements in other order are considered equal.
+func diffTFStates(oldJSON string, newJSON string) (*tfStateDiff, error) {
+	oldResources, err := tfStateResources(oldJSON)
+	if err != nil {
+		return nil, fmt.Errorf("can't read the previous state: %v", err)
+	}
+	newResources, err := tfStateResources(newJSON)
+	if err != nil {
+		return nil, fmt.Errorf("can't read the state: %v", err)
+	}
+
+	diff := &tfStateDiff{Added: []tfResourceDiff{}, Removed: []tfResourceDiff{}, Modified: []tfResourceDiff{}}
+	for address, r := range newResources {
+		old, ok := oldResources[address]
+		if !ok {
+			diff.Added = append(diff.Added, tfResourceDiff{Address: address, Type: r.Type})
+			continue
+		}
+		attributes := make(map[string]tfAttributeDiff)
+		diffTFValues("", old.Values, r.Values, attributes)
+		if len(attributes) > 0 {
+			diff.Modified = append(diff.Modified, tfResourceDiff{Address: address, Type: r.Type, Attributes: attributes})
+		}
+	}
+	for address, r := range oldResources {
+		if _, ok := newResources[address]; !ok {
+			diff.Removed = append(diff.Removed, tfResourceDiff{Address: address, Type: r.Type})
+		}
+	}
+	for _, list := range [][]tfResourceDiff{diff.Added, diff.Removed, diff.Modified} {
+		sort.Slice(list, func(i, j int) bool { return list[i].Address < list[j].Address })
+	}
+	return diff, nil
+}
+
+// diffTFValues adds to dst the attributes that differ between the given objects, by their path
+// from prefix. Nested objects are compared attribute by attribute, the rest as a whole.
+func diffTFValues(prefix string, before map[string]interface{}, after map[string]interface{}, dst map[string]tfAttributeDiff) {
+	names := make(map[string]bool)
+	for name := range before {
+		names[name] = true
+	}
+	for name := range after {
+		names[name] = true
+	}
+	for name := range names {
+		b, a := before[name], after[name]
+		bObject, bIsObject := b.(map[string]interface{})
+		aObject, aIsObject := a.(map[string]interface{})
+		switch {
+		case bIsObject && aIsObject:
+			diffTFValues(prefix+name+".", bObject, aObject, dst)
+		case !reflect.DeepEqual(unorderedTFValue(b), unorderedTFValue(a)):
+			dst[prefix+name] = tfAttributeDiff{Before: b, After: a}
+		}
+	}
+}
+
+// unorderedTFValue returns v with the elements of its lists sorted, so the
+// lists are equal regardless of the order of their elements.
+func unorderedTFValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		result := make(map[string]interface{}, len(v))
+		for k, elem := range v {
+			result[k] = unorderedTFValue(elem)
+		}
+		return result
+	case []interface{}:
+		result := make([]interface{}, len(v))
+		keys := make(map[int]string, len(v))
+		for i, elem := range v {
+			result[i] = unorderedTFValue(elem)
+			key, _ := json.Marshal(result[i])
+			keys[i] = string(key)
+		}
+		indexes := make([]int, len(v))
+		for i := range indexes {
+			indexes[i] = i
+		}
+		sort.Slice(indexes, func(i, j int) bool { return keys[indexes[i]] < keys[indexes[j]] })
+		sorted := make([]interface{}, len(v))
+		for i, index := range indexes {
+			sorted[i] = result[index]
+		}
+		return sorted
+	case json.Number: // as decoded from raw states
+		f, err := v.Float64()
+		if err == nil {
+			return f
+		}
+	}
+	return v
+}
+
+// tfStateResources returns the resources of the given state or plan json by address. For plans,
+// the planned ones. Raw states (as stored by terraform) are supported too.
+func tfStateResources(stateJSON string) (map[string]tfResourceJSON, error) {
+	resources := make(map[string]tfResourceJSON)
+	if stateJSON == "" {
+		return resources, nil
+	}
+
+	var state struct {
+		Values        *tfValuesJSON     `json:"values"`
+		PlannedValues *tfValuesJSON     `json:"planned_values"`
+		Resources     []json.RawMessage `json:"resources"` // of raw states
+	}
+	if err := json.Unmarshal([]byte(stateJSON), &state); err != nil {
+		return nil, err
+	}
+	values := state.Values
+	if values == nil {
+		values = state.PlannedValues
+	}
+	if values == nil && state.Resources != nil {
+		raw, _, err := tfstateValuesJSON([]byte(stateJSON))
+		if err != nil {
+			return nil, err
+		}
+		if raw != nil {
+			values = &raw.Values
+		}
+	}
+	if values == nil {
+		return resources, nil
+	}
+
+	var addModule func(module tfModuleJSON)
+	addModule = func(module tfModuleJSON) {
+		for _, r := range module.Resources {
+			resources[r.Address] = r
+		}
+		for _, child := range module.ChildModules {
+			addModule(child)
+		}
+	}
+	addModule(values.RootModule)
+	return resources, nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestDiffTFStates(t *testing.T) {
+	oldState := `{
+		"format_version": "0.1",
+		"values": {"root_module": {
+			"resources": [
+				{"address": "aws_instance.a", "type": "aws_instance", "values": {"ami": "ami-1", "tags": {"Name": "a", "env": "dev"}, "security_groups": ["x", "y"]}},
+				{"address": "aws_instance.b", "type": "aws_instance", "values": {"ami": "ami-1"}},
+				{"address": "aws_s3_bucket.old", "type": "aws_s3_bucket", "values": {}}
+			],
+			"child_modules": [{"address": "module.m", "resources": [
+				{"address": "module.m.aws_eip.ip", "type": "aws_eip", "values": {"vpc": true}}
+			]}]
+		}}
+	}`
+	newState := `{
+		"format_version": "0.1",
+		"values": {"root_module": {
+			"resources": [
+				{"address": "aws_instance.a", "type": "aws_instance", "values": {"ami": "ami-2", "tags": {"Name": "a", "owner": "me"}, "security_groups": ["y", "x"]}},
+				{"address": "aws_instance.b", "type": "aws_instance", "values": {"ami": "ami-1"}},
+				{"address": "aws_s3_bucket.new", "type": "aws_s3_bucket", "values": {}}
+			],
+			"child_modules": [{"address": "module.m", "resources": [
+				{"address": "module.m.aws_eip.ip", "type": "aws_eip", "values": {"vpc": false}}
+			]}]
+		}}
+	}`
+
+	diff, err := diffTFStates(oldState, newState)
+	require.Nil(t, err)
+	assert.Equal(t, &tfStateDiff{
+		Added:   []tfResourceDiff{{Address: "aws_s3_bucket.new", Type: "aws_s3_bucket"}},
+		Removed: []tfResourceDiff{{Address: "aws_s3_bucket.old", Type: "aws_s3_bucket"}},
+		Modified: []tfResourceDiff{
+			{Address: "aws_instance.a", Type: "aws_instance", Attributes: map[string]tfAttributeDiff{
+				"ami":        {Before: "ami-1", After: "ami-2"},
+				"tags.env":   {Before: "dev", After: nil},
+				"tags.owner": {Before: nil, After: "me"},
+			}},
+			{Address: "module.m.aws_eip.ip", Type: "aws_eip", Attributes: map[string]tfAttributeDiff{
+				"vpc": {Before: true, After: false},
+			}},
+		},
+	}, diff)
+
+	// from nothing, and from a raw state
+	diff, err = diffTFStates("", `{"version": 4, "resources": [
+		{"mode": "managed", "type": "aws_instance", "name": "a", "instances": [{"index_key": 0, "attributes": {"ami": "ami-1"}}]}
+	]}`)
+	require.Nil(t, err)
+	assert.Equal(t, []tfResourceDiff{{Address: "aws_instance.a[0]", Type: "aws_instance"}}, diff.Added)
+	assert.Empty(t, diff.Removed)
+	assert.Empty(t, diff.Modified)
+
+	_, err = diffTFStates("{", newState)
+	assert.NotNil(t, err)
+}
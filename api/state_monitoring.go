@@ -3,6 +3,7 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
@@ -16,13 +17,14 @@ import (
 )
 
 var mLastFullPull = time.Time{}
-var mPanelUrl, mSlackHookUrl = "", ""
+var mPanelUrl, mSlackHookUrl, mSlackMinSeverity = "", "", ""
 
-// enableSlackPosts will enable slack posts to report failed
-// state validations to a slack channel.
-func enableSlackPosts(panelUrl, slackHookUrl string) {
+// enableSlackPosts will enable slack posts to report failed state validations to a
+// slack channel. Just the validations failing features of minSeverity or higher are reported.
+func enableSlackPosts(panelUrl, slackHookUrl, minSeverity string) {
 	mPanelUrl = panelUrl
 	mSlackHookUrl = slackHookUrl
+	mSlackMinSeverity = minSeverity
 }
 
 // initStateChangeMonitoring starts a goroutine that periodically checks if
@@ -53,7 +55,7 @@ func initStateChangeMonitoring(sess *session.Session, db *database, frequency ti
 					continue
 				}
 
-				if mSlackHookUrl != "" && logEntry != nil && logEntry.ComplianceResult.FailCount > 0 {
+				if mSlackHookUrl != "" && logEntry != nil && logEntry.ComplianceResult.failedWithSeverity(mSlackMinSeverity) {
 					err = reportFailedValidationToSlack(mSlackHookUrl, mPanelUrl, obj, logEntry)
 					if err != nil {
 						log.Printf("can't send to slack: %v", err)
@@ -114,14 +116,34 @@ func checkTFState(
 	db *database,
 	tfstate *TFState,
 ) (changed bool, logEntry *ValidationLog, err error) {
-	checked, lastModification, stateJSON, complianceResult, err := checkTFStateIfNecessary(sess, db, tfstate)
+	// Checking takes a while, so the state may be updated meanwhile through the API. In that
+	// case, the result is merged into the latest state (unless it was moved to other bucket/path).
+	bucket, path, forced := tfstate.Bucket, tfstate.Path, tfstate.ForceValidation
+	saveResult := func(apply func(*TFState)) error {
+		return db.updateTFState(tfstate, func(latest *TFState) bool {
+			if latest.Bucket != bucket || latest.Path != path {
+				return false
+			}
+			if forced { // otherwise, may be forced meanwhile. Keep it for the next check.
+				latest.ForceValidation = false
+			}
+			apply(latest)
+			return true
+		})
+	}
+
+	checked, lastModification, serial, lineage, stateJSON, complianceResult, err := checkTFStateIfNecessary(sess, db, tfstate)
+	if errors.Is(err, errToolPoolSaturated) {
+		return // not an error of the state. It will be checked again in a later pull.
+	}
 	if err != nil {
 		log.Printf("Can't check tfstate. Will update error status and move on: %v", err)
-		tfstate.ForceValidation = false
-		tfstate.ComplianceResult.Initialized = true
-		tfstate.ComplianceResult.Error = true
-		tfstate.ComplianceResult.ErrorMessage = "failed: " + err.Error()
-		err = db.saveTFState(tfstate)
+		errorMessage := "failed: " + err.Error()
+		err = saveResult(func(latest *TFState) {
+			latest.ComplianceResult.Initialized = true
+			latest.ComplianceResult.Error = true
+			latest.ComplianceResult.ErrorMessage = errorMessage
+		})
 		return
 	}
 
@@ -133,19 +155,27 @@ func checkTFState(
 
 	// Register log entry
 	now := time.Now().Format(timestampFormat)
-	logEntry = newTFStateLog(stateJSON, complianceResult, tfstate.State, tfstate.ComplianceResult, tfstate.Account, tfstate.Bucket, tfstate.Path)
+	logEntry = newTFStateLog(stateJSON, complianceResult, tfstate.State, tfstate.ComplianceResult, tfstate.Id, tfstate.Account, tfstate.Bucket, tfstate.Path)
 	if err = db.saveLog(logEntry); err != nil {
 		err = fmt.Errorf("can't insert logEntry on DB: %v", err)
 		return
 	}
 
+	// Register the revision, to keep the state history
+	revision := newTFStateRevision(tfstate.Id, lastModification, serial, lineage, stateJSON, complianceResult, logEntry.Id)
+	if err = db.saveTFStateRevision(revision); err != nil {
+		err = fmt.Errorf("can't insert revision on DB: %v", err)
+		return
+	}
+
 	// Update the state with timestamps and result. Unmark the force check flag as well.
-	tfstate.ForceValidation = false
-	tfstate.LastUpdate = now
-	tfstate.State = stateJSON
-	tfstate.ComplianceResult = complianceResult
-	tfstate.S3LastModification = lastModification
-	if err = db.saveTFState(tfstate); err != nil {
+	err = saveResult(func(latest *TFState) {
+		latest.LastUpdate = now
+		latest.State = stateJSON
+		latest.ComplianceResult = complianceResult
+		latest.S3LastModification = lastModification
+	})
+	if err != nil {
 		err = fmt.Errorf("can't update tfstate on DB: %v", err)
 		return
 	}
@@ -160,7 +190,7 @@ func checkTFStateIfNecessary(
 	sess *session.Session,
 	db *database,
 	state *TFState,
-) (checked bool, lastModification string, stateJSON string, complianceResult ComplianceResult, err error) {
+) (checked bool, lastModification string, serial int64, lineage string, stateJSON string, complianceResult ComplianceResult, err error) {
 
 	bucket := state.Bucket
 	path := state.Path
@@ -183,19 +213,23 @@ func checkTFStateIfNecessary(
 	}
 	checked = true
 
+	// Not critical, it's just to identify the revision.
+	serial, lineage, err = parseTFStateVersion(itemBytes)
+	if err != nil {
+		log.Printf("Can't get serial and lineage of %s:%s: %v", bucket, path, err)
+	}
+
 	stateJSON, err = convertTerraformBinToJSON(itemBytes)
 	if err != nil {
-		err = fmt.Errorf("can't convert to json: %v", err)
+		err = fmt.Errorf("can't convert to json: %w", err)
 		return
 	}
 
-	_, output, err := runComplianceToolForTags(db, []byte(stateJSON), state.Tags)
+	_, _, complianceResult, err = runComplianceToolForTags(db, []byte(stateJSON), state.Tags, state)
 	if err != nil {
-		err = fmt.Errorf("can't run compliance tool: %v", err)
+		err = fmt.Errorf("can't run compliance tool: %w", err)
 		return
 	}
-
-	complianceResult = parseComplianceOutput(output)
 	return
 }
 
@@ -7,8 +7,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"log"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 )
 
@@ -18,21 +22,27 @@ const (
 	failedMsg = "[31mFAILED[0m"
 )
 
-// convertTerraformBinToJSON converts a TF file state (like plan.out) to a
-// pretty json string by invoking internally "terraform show -json".
-// Doesn't supports concurrent access, as uses a hardcoded temporary file.
+// terraformDir is the directory of the versioned terraform binaries (see -terraform-dir).
+// If empty, the terraform binary in the PATH is used for every version.
+var terraformDir = ""
+
+// convertTerraformBinToJSON converts a TF file state (like plan.out) to a pretty json string,
+// the one "terraform show -json" gives. Plans are decoded in go when supported, and by
+// invoking "terraform show -json" otherwise.
+// The tool runs in the tool pool, so returns errToolPoolSaturated if it's full.
 func convertTerraformBinToJSON(fileBytes []byte) (string, error) {
-	// write the bytes to a tmp file
-	path := os.TempDir() + "/" + "convertTfToJson.bin.tmp"
-	if err := ioutil.WriteFile(path, fileBytes, os.ModePerm); err != nil {
-		return "", fmt.Errorf("can't create tmp file '%s': %v", path, err)
+	var outputBytes []byte
+	var err error
+	if len(fileBytes) > 0 && fileBytes[0] != '{' {
+		outputBytes, err = decodeTerraformPlan(fileBytes)
+		if err != nil {
+			log.Printf("Can't decode the plan, using %s instead: %v", tfBin, err)
+		}
 	}
-	defer os.Remove(path)
-
-	// invoke the tool on that file
-	outputBytes, err := exec.Command(tfBin, "show", "-json", path).CombinedOutput()
-	if err != nil || string(outputBytes) == "" {
-		return "", fmt.Errorf("can't exec the tool: %v. out: %s", err, string(outputBytes))
+	if outputBytes == nil {
+		if outputBytes, err = showTerraformBin(fileBytes); err != nil {
+			return "", err
+		}
 	}
 
 	// prettify the json
@@ -44,23 +54,212 @@ func convertTerraformBinToJSON(fileBytes []byte) (string, error) {
 	return string(prettyJSON.Bytes()), nil
 }
 
-// diffBetweenTFStates returns the list of added and removed lines in the newJson, relative to oldJson.
-func diffBetweenTFStates(oldJson, newJson string) (added []string, removed []string) {
-	sliceContains := func(element string, slice []string) bool {
-		for _, e := range slice {
-			if e == element {
-				return true
+// showTerraformBin converts a TF file state (like plan.out) to json by invoking
+// "terraform show -json" in the tool pool, with the terraform version that can read it.
+func showTerraformBin(fileBytes []byte) ([]byte, error) {
+	isPlan := len(fileBytes) > 0 && fileBytes[0] != '{'
+	version := terraformFileVersion(fileBytes)
+	bin, err := terraformBinFor(version, isPlan)
+	if err != nil {
+		return nil, err
+	}
+
+	var outputBytes []byte
+	err = toolWorkers.runInWorkspace(func(dir string) error {
+		// write the bytes to a file of this execution
+		path := filepath.Join(dir, "plan.bin")
+		if err := ioutil.WriteFile(path, fileBytes, 0600); err != nil {
+			return fmt.Errorf("can't create tmp file '%s': %v", path, err)
+		}
+
+		// invoke the tool on that file
+		cmd := exec.Command(bin, "show", "-json", path)
+		cmd.Dir = dir
+		var err error
+		outputBytes, err = cmd.CombinedOutput()
+		if err != nil || string(outputBytes) == "" {
+			return fmt.Errorf("can't exec %s (for version '%s'): %v. out: %s", bin, version, err, string(outputBytes))
+		}
+		return nil
+	})
+	return outputBytes, err
+}
+
+// terraformFileVersion returns the version of terraform that wrote the given
+// state or plan file, empty if unknown.
+func terraformFileVersion(fileBytes []byte) string {
+	if len(fileBytes) > 0 && fileBytes[0] == '{' {
+		var state struct {
+			TerraformVersion string `json:"terraform_version"`
+		}
+		_ = json.Unmarshal(fileBytes, &state)
+		return state.TerraformVersion
+	}
+	return tfplanTerraformVersion(fileBytes)
+}
+
+// noTerraformVersionError is returned when no terraform binary installed can read a file.
+type noTerraformVersionError struct {
+	version   string   // of the file
+	installed []string // the versions installed
+}
+
+func (e noTerraformVersionError) Error() string {
+	version, installed := e.version, strings.Join(e.installed, ", ")
+	if version == "" {
+		version = "unknown"
+	}
+	if installed == "" {
+		installed = "none"
+	}
+	return fmt.Sprintf("no terraform binary compatible with version %s in %s (installed: %s)", version, terraformDir, installed)
+}
+
+// terraformBinFor returns the terraform binary to read a file written by the given version
+// (empty if unknown). Plans can be read just by the same version, and states by the same
+// or newer ones, so the oldest of them is used. With an unknown version, the newest one.
+func terraformBinFor(version string, isPlan bool) (string, error) {
+	if terraformDir == "" {
+		return tfBin, nil
+	}
+	binaries, err := installedTerraformBinaries(terraformDir)
+	if err != nil {
+		return "", fmt.Errorf("can't list terraform binaries: %v", err)
+	}
+	var versions []string
+	for v := range binaries {
+		versions = append(versions, v)
+	}
+	sort.Slice(versions, func(i, j int) bool { return compareTerraformVersions(versions[i], versions[j]) < 0 })
+
+	switch {
+	case version == "" && len(versions) > 0:
+		return binaries[versions[len(versions)-1]], nil
+	case isPlan && binaries[version] != "":
+		return binaries[version], nil
+	case !isPlan:
+		for _, v := range versions {
+			if compareTerraformVersions(v, version) >= 0 {
+				return binaries[v], nil
 			}
 		}
-		return false
 	}
+	return "", noTerraformVersionError{version: version, installed: versions}
+}
+
+// installedTerraformBinaries returns the terraform binaries in the given directory by version:
+// the files named terraform_<version>, and the <version>/terraform ones.
+func installedTerraformBinaries(dir string) (map[string]string, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	binaries := make(map[string]string)
+	for _, entry := range entries {
+		name := entry.Name()
+		switch {
+		case !entry.IsDir() && strings.HasPrefix(name, tfBin+"_"):
+			binaries[strings.TrimPrefix(name, tfBin+"_")] = filepath.Join(dir, name)
+		case entry.IsDir():
+			path := filepath.Join(dir, name, tfBin)
+			if info, err := os.Stat(path); err == nil && !info.IsDir() {
+				binaries[name] = path
+			}
+		}
+	}
+	return binaries, nil
+}
+
+// compareTerraformVersions returns -1, 0 or 1 if the version a is older, the same or newer
+// than b. Versions are like 0.12.6, or 0.13.0-beta1 for pre-releases.
+func compareTerraformVersions(a string, b string) int {
+	parse := func(version string) ([3]int, string) {
+		var numbers [3]int
+		parts := strings.SplitN(strings.TrimPrefix(version, "v"), "-", 2)
+		for i, n := range strings.SplitN(parts[0], ".", 3) {
+			numbers[i], _ = strconv.Atoi(n)
+		}
+		if len(parts) == 2 {
+			return numbers, parts[1]
+		}
+		return numbers, ""
+	}
+	numbersA, preA := parse(a)
+	numbersB, preB := parse(b)
+	for i := range numbersA {
+		if numbersA[i] != numbersB[i] {
+			if numbersA[i] < numbersB[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	switch {
+	case preA == preB:
+		return 0
+	case preA == "": // releases are newer than their pre-releases
+		return 1
+	case preB == "":
+		return -1
+	}
+	return comparePreReleases(preA, preB)
+}
+
+// comparePreReleases compares pre-release tags like beta2, comparing their
+// trailing numbers numerically (so beta10 is newer than beta2).
+func comparePreReleases(a string, b string) int {
+	split := func(pre string) (string, int, bool) {
+		prefix := strings.TrimRight(pre, "0123456789")
+		n, err := strconv.Atoi(pre[len(prefix):])
+		return prefix, n, err == nil
+	}
+	prefixA, numberA, okA := split(a)
+	prefixB, numberB, okB := split(b)
+	switch {
+	case prefixA == prefixB && okA && okB && numberA != numberB:
+		if numberA < numberB {
+			return -1
+		}
+		return 1
+	case a == b:
+		return 0
+	case a < b:
+		return -1
+	}
+	return 1
+}
+
+// parseTFStateVersion returns the serial and lineage of the given
+// tfstate file, which identify the state version.
+func parseTFStateVersion(fileBytes []byte) (serial int64, lineage string, err error) {
+	var version struct {
+		Serial  int64  `json:"serial"`
+		Lineage string `json:"lineage"`
+	}
+	if err := json.Unmarshal(fileBytes, &version); err != nil {
+		return 0, "", fmt.Errorf("can't parse tfstate: %v", err)
+	}
+	return version.Serial, version.Lineage, nil
+}
+
+// diffBetweenTFStates returns the list of added and removed lines in the newJson, relative to oldJson.
+// See diffTFStates for the resources changed instead.
+func diffBetweenTFStates(oldJson, newJson string) (added []string, removed []string) {
 	oldLines := strings.Split(oldJson, "\n")
 	newLines := strings.Split(newJson, "\n")
+	linesSet := func(lines []string) map[string]bool {
+		set := make(map[string]bool, len(lines))
+		for _, line := range lines {
+			set[line] = true
+		}
+		return set
+	}
+	oldSet, newSet := linesSet(oldLines), linesSet(newLines)
 
 	// lines in new, but not in old
 	added = make([]string, 0)
 	for _, line := range newLines {
-		if !sliceContains(line, oldLines) {
+		if !oldSet[line] {
 			added = append(added, line)
 		}
 	}
@@ -68,7 +267,7 @@ func diffBetweenTFStates(oldJson, newJson string) (added []string, removed []str
 	// lines in old, but not in new
 	removed = make([]string, 0)
 	for _, line := range oldLines {
-		if !sliceContains(line, newLines) {
+		if !newSet[line] {
 			removed = append(removed, line)
 		}
 	}
@@ -0,0 +1,435 @@
+// This file contains the reading of the configuration snapshot of terraform plan files,
+// to give the "configuration" json of "terraform show -json". Without provider schemas,
+// every attribute given is an expression, and every nested block a list of them.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	ctyjson "github.com/zclconf/go-cty/cty/json"
+	"sort"
+	"strings"
+)
+
+// the meta-arguments and blocks that aren't expressions of the resources and module calls
+var tfconfigMetaArguments = []string{"count", "for_each", "provider", "providers", "depends_on", "source", "version", "lifecycle", "connection", "provisioner"}
+
+type tfConfigJSON struct {
+	ProviderConfig map[string]tfProviderConfigJSON `json:"provider_config,omitempty"`
+	RootModule     tfConfigModuleJSON              `json:"root_module,omitempty"`
+}
+
+type tfProviderConfigJSON struct {
+	Name              string                 `json:"name,omitempty"`
+	Alias             string                 `json:"alias,omitempty"`
+	VersionConstraint string                 `json:"version_constraint,omitempty"`
+	ModuleAddress     string                 `json:"module_address,omitempty"`
+	Expressions       map[string]interface{} `json:"expressions,omitempty"`
+}
+
+type tfConfigModuleJSON struct {
+	Outputs     map[string]tfConfigOutputJSON   `json:"outputs,omitempty"`
+	Resources   []tfConfigResourceJSON          `json:"resources,omitempty"`
+	ModuleCalls map[string]tfModuleCallJSON     `json:"module_calls,omitempty"`
+	Variables   map[string]tfConfigVariableJSON `json:"variables,omitempty"`
+}
+
+type tfConfigOutputJSON struct {
+	Sensitive   bool             `json:"sensitive,omitempty"`
+	Expression  tfExpressionJSON `json:"expression,omitempty"`
+	DependsOn   []string         `json:"depends_on,omitempty"`
+	Description string           `json:"description,omitempty"`
+}
+
+type tfConfigResourceJSON struct {
+	Address           string                 `json:"address,omitempty"`
+	Mode              string                 `json:"mode,omitempty"`
+	Type              string                 `json:"type,omitempty"`
+	Name              string                 `json:"name,omitempty"`
+	ProviderConfigKey string                 `json:"provider_config_key,omitempty"`
+	Provisioners      []tfProvisionerJSON    `json:"provisioners,omitempty"`
+	Expressions       map[string]interface{} `json:"expressions,omitempty"`
+	SchemaVersion     uint64                 `json:"schema_version"`
+	CountExpression   *tfExpressionJSON      `json:"count_expression,omitempty"`
+	ForEachExpression *tfExpressionJSON      `json:"for_each_expression,omitempty"`
+	DependsOn         []string               `json:"depends_on,omitempty"`
+}
+
+type tfProvisionerJSON struct {
+	Type        string                 `json:"type"`
+	Expressions map[string]interface{} `json:"expressions,omitempty"`
+}
+
+type tfModuleCallJSON struct {
+	Source            string                 `json:"source,omitempty"`
+	Expressions       map[string]interface{} `json:"expressions,omitempty"`
+	CountExpression   *tfExpressionJSON      `json:"count_expression,omitempty"`
+	ForEachExpression *tfExpressionJSON      `json:"for_each_expression,omitempty"`
+	Module            tfConfigModuleJSON     `json:"module,omitempty"`
+	VersionConstraint string                 `json:"version_constraint,omitempty"`
+	DependsOn         []string               `json:"depends_on,omitempty"`
+}
+
+type tfConfigVariableJSON struct {
+	Default     json.RawMessage `json:"default,omitempty"`
+	Description string          `json:"description,omitempty"`
+}
+
+type tfExpressionJSON struct {
+	ConstantValue json.RawMessage `json:"constant_value,omitempty"`
+	References    []string        `json:"references,omitempty"`
+}
+
+// tfconfigJSON returns the configuration json of the snapshot in the given plan file entries,
+// with the given schema versions by resource type. Returns nil if there's no snapshot.
+func tfconfigJSON(files map[string][]byte, schemaVersions map[string]uint64) (*tfConfigJSON, error) {
+	manifest, ok := files[tfplanConfigEntry+"modules.json"]
+	if !ok {
+		return nil, nil
+	}
+	var modules []struct {
+		Key string `json:"Key"`
+	}
+	if err := json.Unmarshal(manifest, &modules); err != nil {
+		return nil, fmt.Errorf("bad modules.json: %v", err)
+	}
+
+	// the files of each module, by module key ("" for the root, "a.b" for module.a.module.b)
+	moduleFiles := make(map[string]map[string][]byte)
+	for _, m := range modules {
+		moduleFiles[m.Key] = make(map[string][]byte)
+	}
+	for name, content := range files {
+		if !strings.HasPrefix(name, tfplanConfigEntry+"m-") {
+			continue
+		}
+		parts := strings.SplitN(strings.TrimPrefix(name, tfplanConfigEntry+"m-"), "/", 2)
+		if len(parts) != 2 || moduleFiles[parts[0]] == nil || strings.Contains(parts[1], "/") {
+			continue
+		}
+		switch {
+		case strings.HasSuffix(parts[1], ".tf.json"), strings.HasSuffix(parts[1], "_override.tf"), parts[1] == "override.tf":
+			return nil, fmt.Errorf("%w: %s not supported", errUnsupportedPlan, name)
+		case strings.HasSuffix(parts[1], ".tf"):
+			moduleFiles[parts[0]][parts[1]] = content
+		}
+	}
+
+	result := &tfConfigJSON{ProviderConfig: make(map[string]tfProviderConfigJSON)}
+	reader := tfconfigReader{files: moduleFiles, schemaVersions: schemaVersions, providers: result.ProviderConfig}
+	var err error
+	if result.RootModule, err = reader.module(""); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// tfconfigSchemaVersionKeys returns the tfSchemaVersionKey of the resources of the given
+// configuration (with repetitions).
+func tfconfigSchemaVersionKeys(config *tfConfigJSON) []string {
+	if config == nil {
+		return nil
+	}
+	var result []string
+	var addModule func(module tfConfigModuleJSON)
+	addModule = func(module tfConfigModuleJSON) {
+		for _, r := range module.Resources {
+			result = append(result, tfSchemaVersionKey(r.Mode, r.Type))
+		}
+		for _, call := range module.ModuleCalls {
+			addModule(call.Module)
+		}
+	}
+	addModule(config.RootModule)
+	return result
+}
+
+// tfconfigReader reads the modules of a configuration snapshot.
+type tfconfigReader struct {
+	files          map[string]map[string][]byte    // the files of each module, by module key
+	schemaVersions map[string]uint64               // by tfSchemaVersionKey
+	providers      map[string]tfProviderConfigJSON // where the provider configurations are added
+}
+
+// module returns the configuration json of the module of the given key.
+func (r tfconfigReader) module(key string) (tfConfigModuleJSON, error) {
+	var result tfConfigModuleJSON
+
+	// parse the files in order, as terraform does
+	var names []string
+	for name := range r.files[key] {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var blocks hclsyntax.Blocks
+	for _, name := range names {
+		file, diags := hclsyntax.ParseConfig(r.files[key][name], name, hcl.Pos{Line: 1, Column: 1})
+		if diags.HasErrors() {
+			return result, fmt.Errorf("can't parse %s: %v", name, diags)
+		}
+		blocks = append(blocks, file.Body.(*hclsyntax.Body).Blocks...)
+	}
+
+	moduleAddress := ""
+	if key != "" {
+		moduleAddress = "module." + strings.Replace(key, ".", ".module.", -1)
+	}
+	for _, block := range blocks {
+		switch {
+		case block.Type == "provider" && len(block.Labels) == 1:
+			config := tfProviderConfigJSON{
+				Name:              block.Labels[0],
+				Alias:             tfconfigConstantString(block.Body, "alias"),
+				VersionConstraint: tfconfigConstantString(block.Body, "version"),
+				ModuleAddress:     moduleAddress,
+				Expressions:       tfconfigExpressions(block.Body, "alias", "version"),
+			}
+			providerKey := config.Name
+			if config.Alias != "" {
+				providerKey += "." + config.Alias
+			}
+			r.providers[tfconfigProviderKey(key, providerKey)] = config
+
+		case (block.Type == "resource" || block.Type == "data") && len(block.Labels) == 2:
+			resource := tfConfigResourceJSON{
+				Mode:              "managed",
+				Type:              block.Labels[0],
+				Name:              block.Labels[1],
+				Expressions:       tfconfigExpressions(block.Body, tfconfigMetaArguments...),
+				CountExpression:   tfconfigAttributeExpression(block.Body, "count"),
+				ForEachExpression: tfconfigAttributeExpression(block.Body, "for_each"),
+				DependsOn:         tfconfigDependsOn(block.Body),
+			}
+			if block.Type == "data" {
+				resource.Mode = "data"
+			}
+			resource.SchemaVersion = r.schemaVersions[tfSchemaVersionKey(resource.Mode, resource.Type)]
+			resource.Address = tfResourceAddress("", resource.Mode, resource.Type, resource.Name, nil)
+
+			// the provider is the one given, or the default for the resource type
+			providerKey := strings.SplitN(resource.Type, "_", 2)[0]
+			if attr, ok := block.Body.Attributes["provider"]; ok {
+				if traversal, diags := hcl.AbsTraversalForExpr(attr.Expr); !diags.HasErrors() {
+					providerKey = tfconfigTraversalString(traversal)
+				}
+			}
+			resource.ProviderConfigKey = tfconfigProviderKey(key, providerKey)
+
+			for _, nested := range block.Body.Blocks {
+				if nested.Type == "provisioner" && len(nested.Labels) == 1 {
+					resource.Provisioners = append(resource.Provisioners, tfProvisionerJSON{
+						Type:        nested.Labels[0],
+						Expressions: tfconfigExpressions(nested.Body, "connection", "when", "on_failure"),
+					})
+				}
+			}
+			result.Resources = append(result.Resources, resource)
+
+		case block.Type == "module" && len(block.Labels) == 1:
+			call := tfModuleCallJSON{
+				Source:            tfconfigConstantString(block.Body, "source"),
+				Expressions:       tfconfigExpressions(block.Body, tfconfigMetaArguments...),
+				CountExpression:   tfconfigAttributeExpression(block.Body, "count"),
+				ForEachExpression: tfconfigAttributeExpression(block.Body, "for_each"),
+				VersionConstraint: tfconfigConstantString(block.Body, "version"),
+				DependsOn:         tfconfigDependsOn(block.Body),
+			}
+			childKey := block.Labels[0]
+			if key != "" {
+				childKey = key + "." + childKey
+			}
+			if _, ok := r.files[childKey]; ok {
+				var err error
+				if call.Module, err = r.module(childKey); err != nil {
+					return result, err
+				}
+			}
+			if result.ModuleCalls == nil {
+				result.ModuleCalls = make(map[string]tfModuleCallJSON)
+			}
+			result.ModuleCalls[block.Labels[0]] = call
+
+		case block.Type == "variable" && len(block.Labels) == 1:
+			variable := tfConfigVariableJSON{Description: tfconfigConstantString(block.Body, "description")}
+			if attr, ok := block.Body.Attributes["default"]; ok {
+				variable.Default = tfconfigExpression(attr.Expr).ConstantValue
+			}
+			if result.Variables == nil {
+				result.Variables = make(map[string]tfConfigVariableJSON)
+			}
+			result.Variables[block.Labels[0]] = variable
+
+		case block.Type == "output" && len(block.Labels) == 1:
+			output := tfConfigOutputJSON{
+				Description: tfconfigConstantString(block.Body, "description"),
+				DependsOn:   tfconfigDependsOn(block.Body),
+			}
+			if expr := tfconfigAttributeExpression(block.Body, "value"); expr != nil {
+				output.Expression = *expr
+			}
+			if sensitive := tfconfigAttributeExpression(block.Body, "sensitive"); sensitive != nil {
+				output.Sensitive = string(sensitive.ConstantValue) == "true"
+			}
+			if result.Outputs == nil {
+				result.Outputs = make(map[string]tfConfigOutputJSON)
+			}
+			result.Outputs[block.Labels[0]] = output
+		}
+	}
+	// the managed resources go first, then the data sources
+	sort.Slice(result.Resources, func(i, j int) bool {
+		if result.Resources[i].Mode != result.Resources[j].Mode {
+			return result.Resources[i].Mode == "managed"
+		}
+		return result.Resources[i].Address < result.Resources[j].Address
+	})
+	return result, nil
+}
+
+// tfconfigProviderKey returns the key of the given provider (like aws or aws.alias)
+// in the given module, as in provider_config and provider_config_key.
+func tfconfigProviderKey(moduleKey string, provider string) string {
+	if moduleKey == "" {
+		return provider
+	}
+	return moduleKey + ":" + provider
+}
+
+// tfconfigExpressions returns the json of the attributes and nested blocks of the given
+// body, but the excluded ones. Returns nil if there's none.
+func tfconfigExpressions(body *hclsyntax.Body, excluded ...string) map[string]interface{} {
+	result := make(map[string]interface{})
+	for name, attr := range body.Attributes {
+		if !containsString(excluded, name) {
+			result[name] = tfconfigExpression(attr.Expr)
+		}
+	}
+	for _, block := range body.Blocks {
+		if containsString(excluded, block.Type) {
+			continue
+		}
+		nested, _ := result[block.Type].([]map[string]interface{})
+		expressions := tfconfigExpressions(block.Body)
+		if expressions == nil {
+			expressions = make(map[string]interface{})
+		}
+		result[block.Type] = append(nested, expressions)
+	}
+	if len(result) == 0 {
+		return nil
+	}
+	return result
+}
+
+// tfconfigAttributeExpression returns the json of the given attribute of body, nil if not given.
+func tfconfigAttributeExpression(body *hclsyntax.Body, name string) *tfExpressionJSON {
+	attr, ok := body.Attributes[name]
+	if !ok {
+		return nil
+	}
+	expr := tfconfigExpression(attr.Expr)
+	return &expr
+}
+
+// tfconfigConstantString returns the value of the given attribute of body if it's a constant string.
+func tfconfigConstantString(body *hclsyntax.Body, name string) string {
+	var result string
+	if expr := tfconfigAttributeExpression(body, name); expr != nil {
+		_ = json.Unmarshal(expr.ConstantValue, &result)
+	}
+	return result
+}
+
+// tfconfigExpression returns the json of the given expression: its value if it's constant,
+// and the objects it refers to.
+func tfconfigExpression(expr hcl.Expression) tfExpressionJSON {
+	var result tfExpressionJSON
+	if value, diags := expr.Value(nil); !diags.HasErrors() && value.IsWhollyKnown() {
+		result.ConstantValue, _ = ctyjson.Marshal(value, value.Type())
+	}
+	for _, traversal := range expr.Variables() {
+		result.References = append(result.References, tfconfigReference(traversal))
+	}
+	return result
+}
+
+// tfconfigDependsOn returns the references of the depends_on of the given body.
+func tfconfigDependsOn(body *hclsyntax.Body) []string {
+	attr, ok := body.Attributes["depends_on"]
+	if !ok {
+		return nil
+	}
+	exprs, diags := hcl.ExprList(attr.Expr)
+	if diags.HasErrors() {
+		return nil
+	}
+	var result []string
+	for _, expr := range exprs {
+		if traversal, diags := hcl.AbsTraversalForExpr(expr); !diags.HasErrors() {
+			result = append(result, tfconfigReference(traversal))
+		}
+	}
+	return result
+}
+
+// tfconfigReference returns the object the given traversal refers to, like var.a for
+// var.a.b, or aws_instance.a[0] for aws_instance.a[0].id.
+func tfconfigReference(traversal hcl.Traversal) string {
+	// the number of names that identify the object, by the first one, and
+	// after how many of them an index is part of the reference (0 for never)
+	length, indexAt := 2, 2
+	switch traversal.RootName() {
+	case "self":
+		length, indexAt = 1, 0
+	case "var", "local", "count", "each", "path", "terraform":
+		indexAt = 0
+	case "data":
+		length, indexAt = 3, 3
+	case "module":
+		length = 3
+	}
+
+	var result hcl.Traversal
+	names := 0
+	for _, step := range traversal {
+		if _, isIndex := step.(hcl.TraverseIndex); isIndex {
+			if names == indexAt {
+				result = append(result, step)
+			}
+			continue
+		}
+		if names == length {
+			break
+		}
+		if _, isName := step.(hcl.TraverseRoot); !isName {
+			if _, isName = step.(hcl.TraverseAttr); !isName {
+				break
+			}
+		}
+		result = append(result, step)
+		names++
+	}
+	return tfconfigTraversalString(result)
+}
+
+// tfconfigTraversalString returns the given traversal as written, like aws_instance.a[0].
+func tfconfigTraversalString(traversal hcl.Traversal) string {
+	var result strings.Builder
+	for _, step := range traversal {
+		switch step := step.(type) {
+		case hcl.TraverseRoot:
+			result.WriteString(step.Name)
+		case hcl.TraverseAttr:
+			result.WriteString("." + step.Name)
+		case hcl.TraverseIndex:
+			key, err := ctyjson.Marshal(step.Key, step.Key.Type())
+			if err == nil {
+				result.WriteString("[" + string(key) + "]")
+			}
+		}
+	}
+	return result.String()
+}
@@ -0,0 +1,963 @@
+// This file contains the decoding of terraform plan files (like plan.out) in go, giving the same
+// json as "terraform show -json" without the terraform binary, which must match the version the
+// plan was made with. Just the plans of terraform 0.12 and 0.13 are supported: the binary is used
+// otherwise. Provider schemas aren't available here, so the schema versions of the resource types
+// are looked up (see terraform_schemas.go), and lists, sets and tuples are all decoded as lists.
+
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"sort"
+	"strings"
+)
+
+// errUnsupportedPlan is returned when a plan file can't be decoded in go.
+var errUnsupportedPlan = errors.New("unsupported plan file")
+
+const (
+	tfplanFormatVersion = 3     // the version of the tfplan protobuf of terraform 0.12 and 0.13
+	tfJSONFormatVersion = "0.1" // the format_version of "terraform show -json" for them
+
+	// the plan file entries
+	tfplanEntry       = "tfplan"
+	tfplanStateEntry  = "tfstate"
+	tfplanConfigEntry = "tfconfig/"
+)
+
+// tfplanTerraformVersions are the prefixes of the terraform versions whose plans are decoded:
+// later ones keep the tfplan version, but their json differs.
+var tfplanTerraformVersions = []string{"0.12.", "0.13."}
+
+// the actions of a change, as in the tfplan protobuf
+const (
+	tfplanActionNoop             = 0
+	tfplanActionCreate           = 1
+	tfplanActionRead             = 2
+	tfplanActionUpdate           = 3
+	tfplanActionDelete           = 5
+	tfplanActionDeleteThenCreate = 6
+	tfplanActionCreateThenDelete = 7
+)
+
+// tfplanActionNames are the json actions of each tfplan action.
+var tfplanActionNames = map[uint64][]string{
+	tfplanActionNoop:             {"no-op"},
+	tfplanActionCreate:           {"create"},
+	tfplanActionRead:             {"read"},
+	tfplanActionUpdate:           {"update"},
+	tfplanActionDelete:           {"delete"},
+	tfplanActionDeleteThenCreate: {"delete", "create"},
+	tfplanActionCreateThenDelete: {"create", "delete"},
+}
+
+// decodeTerraformPlan converts the given plan file to the json "terraform show -json" gives.
+// Returns an error wrapping errUnsupportedPlan if the plan isn't supported, or if the schema
+// version of one of its resource types is unknown (not in the prior state nor tfSchemaVersions).
+func decodeTerraformPlan(fileBytes []byte) ([]byte, error) {
+	return decodeTerraformPlanWithSchemas(fileBytes, tfSchemaVersions)
+}
+
+// decodeTerraformPlanWithSchemas is decodeTerraformPlan, knowing the given schema versions by
+// tfSchemaVersionKey besides the ones of the prior state.
+func decodeTerraformPlanWithSchemas(fileBytes []byte, knownSchemaVersions map[string]uint64) ([]byte, error) {
+	files, err := readTerraformPlanFiles(fileBytes)
+	if err != nil {
+		return nil, err
+	}
+	plan, err := parseTFPlan(files[tfplanEntry])
+	if err != nil {
+		return nil, err
+	}
+	if !supportedTerraformVersion(plan.terraformVersion) {
+		return nil, fmt.Errorf("%w: terraform version %s", errUnsupportedPlan, plan.terraformVersion)
+	}
+	priorState, schemaVersions, err := tfstateValuesJSON(files[tfplanStateEntry])
+	if err != nil {
+		return nil, fmt.Errorf("can't read the prior state: %v", err)
+	}
+	for key, version := range knownSchemaVersions {
+		if _, ok := schemaVersions[key]; !ok {
+			schemaVersions[key] = version
+		}
+	}
+	config, err := tfconfigJSON(files, schemaVersions)
+	if err != nil {
+		return nil, fmt.Errorf("can't read the configuration: %v", err)
+	}
+
+	// a wrong schema version would make the json differ from the one of the binary (but the
+	// data sources are at version 0 unless known otherwise)
+	keys := tfconfigSchemaVersionKeys(config)
+	for _, c := range plan.resourceChanges {
+		keys = append(keys, tfSchemaVersionKey(c.mode, c.resourceType))
+	}
+	for _, key := range keys {
+		if _, ok := schemaVersions[key]; !ok && !strings.HasPrefix(key, "data.") {
+			return nil, fmt.Errorf("%w: unknown schema version of %s", errUnsupportedPlan, key)
+		}
+	}
+
+	result := tfPlanJSON{
+		FormatVersion:    tfJSONFormatVersion,
+		TerraformVersion: plan.terraformVersion,
+		PriorState:       priorState,
+		Configuration:    config,
+	}
+	if len(plan.variables) > 0 {
+		result.Variables = make(map[string]tfVariableJSON)
+		for name, value := range plan.variables {
+			result.Variables[name] = tfVariableJSON{Value: value}
+		}
+	}
+
+	plannedResources := make(map[string][]tfResourceJSON)
+	for _, c := range plan.resourceChanges {
+		before, after := c.change.beforeAfter()
+		resource := tfResourceJSON{
+			Address:       c.address(),
+			Mode:          c.mode,
+			Type:          c.resourceType,
+			Name:          c.name,
+			Index:         c.index,
+			ProviderName:  tfProviderName(c.provider),
+			SchemaVersion: schemaVersions[tfSchemaVersionKey(c.mode, c.resourceType)],
+		}
+		result.ResourceChanges = append(result.ResourceChanges, tfResourceChangeJSON{
+			Address:       resource.Address,
+			ModuleAddress: c.modulePath,
+			Mode:          resource.Mode,
+			Type:          resource.Type,
+			Name:          resource.Name,
+			Index:         resource.Index,
+			Deposed:       c.deposed,
+			ProviderName:  resource.ProviderName,
+			Change:        c.change.resourceJSON(before, after),
+		})
+
+		if c.change.action == tfplanActionDelete || c.deposed != "" {
+			continue
+		}
+		if known, ok := knownValues(after); ok {
+			resource.Values, _ = known.(map[string]interface{})
+		}
+		plannedResources[c.modulePath] = append(plannedResources[c.modulePath], resource)
+	}
+	sort.Slice(result.ResourceChanges, func(i, j int) bool {
+		return result.ResourceChanges[i].Address < result.ResourceChanges[j].Address
+	})
+	result.PlannedValues.RootModule = tfModuleTree(plannedResources)
+
+	for _, c := range plan.outputChanges {
+		before, after := c.change.beforeAfter()
+		if result.OutputChanges == nil {
+			result.OutputChanges = make(map[string]tfOutputChangeJSON)
+		}
+		result.OutputChanges[c.name] = c.change.outputJSON(before, after)
+		if c.change.action == tfplanActionDelete {
+			continue
+		}
+		if result.PlannedValues.Outputs == nil {
+			result.PlannedValues.Outputs = make(map[string]tfOutputJSON)
+		}
+		output := tfOutputJSON{Sensitive: c.sensitive}
+		if !containsUnknown(after) {
+			output.Value = after
+		}
+		result.PlannedValues.Outputs[c.name] = output
+	}
+
+	planJSON, err := json.Marshal(result)
+	if err != nil {
+		return nil, err
+	}
+	return append(planJSON, '\n'), nil // as terraform prints it
+}
+
+// readTerraformPlanFiles returns the entries of the given plan file by name.
+func readTerraformPlanFiles(fileBytes []byte) (map[string][]byte, error) {
+	archive, err := zip.NewReader(bytes.NewReader(fileBytes), int64(len(fileBytes)))
+	if err != nil {
+		return nil, fmt.Errorf("%w: not a zip file: %v", errUnsupportedPlan, err)
+	}
+	files := make(map[string][]byte)
+	for _, f := range archive.File {
+		r, err := f.Open()
+		if err != nil {
+			return nil, fmt.Errorf("can't open %s: %v", f.Name, err)
+		}
+		files[f.Name], err = ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			return nil, fmt.Errorf("can't read %s: %v", f.Name, err)
+		}
+	}
+	if _, ok := files[tfplanEntry]; !ok {
+		return nil, fmt.Errorf("%w: no %s in the file", errUnsupportedPlan, tfplanEntry)
+	}
+	return files, nil
+}
+
+// supportedTerraformVersion returns true if the plans of the given terraform version are decoded.
+func supportedTerraformVersion(version string) bool {
+	for _, prefix := range tfplanTerraformVersions {
+		if strings.HasPrefix(version, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// tfplanTerraformVersion returns the version of terraform that made the given plan file,
+// empty if unknown. Unlike parseTFPlan, it supports any version of the tfplan protobuf.
+func tfplanTerraformVersion(fileBytes []byte) string {
+	files, err := readTerraformPlanFiles(fileBytes)
+	if err != nil {
+		return ""
+	}
+	fields, err := readProtoMessage(files[tfplanEntry])
+	if err != nil {
+		return ""
+	}
+	for _, field := range fields {
+		if field.number == 14 {
+			return string(field.bytes)
+		}
+	}
+	return ""
+}
+
+// tfPlanJSON is the json of a plan, as given by "terraform show -json".
+type tfPlanJSON struct {
+	FormatVersion    string                        `json:"format_version,omitempty"`
+	TerraformVersion string                        `json:"terraform_version,omitempty"`
+	Variables        map[string]tfVariableJSON     `json:"variables,omitempty"`
+	PlannedValues    tfValuesJSON                  `json:"planned_values,omitempty"`
+	ResourceChanges  []tfResourceChangeJSON        `json:"resource_changes,omitempty"`
+	OutputChanges    map[string]tfOutputChangeJSON `json:"output_changes,omitempty"`
+	PriorState       *tfStateJSON                  `json:"prior_state,omitempty"`
+	Configuration    *tfConfigJSON                 `json:"configuration,omitempty"`
+}
+
+type tfVariableJSON struct {
+	Value interface{} `json:"value,omitempty"`
+}
+
+type tfStateJSON struct {
+	FormatVersion    string       `json:"format_version,omitempty"`
+	TerraformVersion string       `json:"terraform_version,omitempty"`
+	Values           tfValuesJSON `json:"values,omitempty"`
+}
+
+type tfValuesJSON struct {
+	Outputs    map[string]tfOutputJSON `json:"outputs,omitempty"`
+	RootModule tfModuleJSON            `json:"root_module,omitempty"`
+}
+
+type tfOutputJSON struct {
+	Sensitive bool        `json:"sensitive"`
+	Value     interface{} `json:"value,omitempty"`
+}
+
+type tfModuleJSON struct {
+	Resources    []tfResourceJSON `json:"resources,omitempty"`
+	Address      string           `json:"address,omitempty"`
+	ChildModules []tfModuleJSON   `json:"child_modules,omitempty"`
+}
+
+type tfResourceJSON struct {
+	Address       string                 `json:"address,omitempty"`
+	Mode          string                 `json:"mode,omitempty"`
+	Type          string                 `json:"type,omitempty"`
+	Name          string                 `json:"name,omitempty"`
+	Index         interface{}            `json:"index,omitempty"`
+	ProviderName  string                 `json:"provider_name"`
+	SchemaVersion uint64                 `json:"schema_version"`
+	Values        map[string]interface{} `json:"values,omitempty"`
+	DependsOn     []string               `json:"depends_on,omitempty"`
+	Tainted       bool                   `json:"tainted,omitempty"`
+	DeposedKey    string                 `json:"deposed_key,omitempty"`
+}
+
+type tfResourceChangeJSON struct {
+	Address       string       `json:"address,omitempty"`
+	ModuleAddress string       `json:"module_address,omitempty"`
+	Mode          string       `json:"mode,omitempty"`
+	Type          string       `json:"type,omitempty"`
+	Name          string       `json:"name,omitempty"`
+	Index         interface{}  `json:"index,omitempty"`
+	Deposed       string       `json:"deposed,omitempty"`
+	ProviderName  string       `json:"provider_name,omitempty"`
+	Change        tfChangeJSON `json:"change,omitempty"`
+}
+
+type tfChangeJSON struct {
+	Actions      []string    `json:"actions,omitempty"`
+	Before       interface{} `json:"before"`
+	After        interface{} `json:"after"`
+	AfterUnknown interface{} `json:"after_unknown,omitempty"`
+}
+
+// tfOutputChangeJSON is the change of an output, whose value is omitted if unknown.
+type tfOutputChangeJSON struct {
+	Actions      []string        `json:"actions,omitempty"`
+	Before       interface{}     `json:"before"`
+	After        json.RawMessage `json:"after,omitempty"`
+	AfterUnknown bool            `json:"after_unknown"`
+}
+
+// tfModuleTree returns the root module with the given resources, by module address ("" for the root).
+func tfModuleTree(resources map[string][]tfResourceJSON) tfModuleJSON {
+	children := make(map[string][]string)
+	known := map[string]bool{"": true}
+	var addModule func(address string)
+	addModule = func(address string) {
+		if known[address] {
+			return
+		}
+		known[address] = true
+		parent := ""
+		if i := strings.LastIndex(address, ".module."); i >= 0 {
+			parent = address[:i]
+		}
+		children[parent] = append(children[parent], address)
+		addModule(parent)
+	}
+	for address := range resources {
+		addModule(address)
+	}
+
+	var build func(address string) tfModuleJSON
+	build = func(address string) tfModuleJSON {
+		module := tfModuleJSON{Address: address, Resources: resources[address]}
+		sort.Slice(module.Resources, func(i, j int) bool { return module.Resources[i].Address < module.Resources[j].Address })
+		sort.Strings(children[address])
+		for _, child := range children[address] {
+			module.ChildModules = append(module.ChildModules, build(child))
+		}
+		return module
+	}
+	return build("")
+}
+
+// tfResourceAddress returns the address of a resource instance, like module.a.aws_instance.b[0].
+func tfResourceAddress(modulePath string, mode string, resourceType string, name string, index interface{}) string {
+	address := resourceType + "." + name
+	if mode == "data" {
+		address = "data." + address
+	}
+	if modulePath != "" {
+		address = modulePath + "." + address
+	}
+	switch index := index.(type) {
+	case nil:
+	case string:
+		address += fmt.Sprintf("[%q]", index)
+	default:
+		address += fmt.Sprintf("[%v]", index)
+	}
+	return address
+}
+
+// tfProviderName returns the name of the provider of the given address: like aws for provider.aws
+// (terraform 0.12), and registry.terraform.io/hashicorp/aws for provider["registry.terraform.io/hashicorp/aws"]
+// (terraform 0.13, where the name is the source address, and the alias isn't part of it).
+func tfProviderName(provider string) string {
+	if i := strings.LastIndex(provider, `provider["`); i >= 0 {
+		name := provider[i+len(`provider["`):]
+		if end := strings.Index(name, `"]`); end >= 0 {
+			return name[:end]
+		}
+		return name
+	}
+	if i := strings.LastIndex(provider, "provider."); i >= 0 {
+		return provider[i+len("provider."):]
+	}
+	return provider
+}
+
+// tfstateValuesJSON returns the json of the given state file, with the schema version of each
+// resource type in it (by tfSchemaVersionKey). Returns nil if the state is empty.
+func tfstateValuesJSON(stateBytes []byte) (*tfStateJSON, map[string]uint64, error) {
+	schemaVersions := make(map[string]uint64)
+	if len(stateBytes) == 0 {
+		return nil, schemaVersions, nil
+	}
+
+	var state struct {
+		Version          int    `json:"version"`
+		TerraformVersion string `json:"terraform_version"`
+		Outputs          map[string]struct {
+			Value     interface{} `json:"value"`
+			Sensitive bool        `json:"sensitive"`
+		} `json:"outputs"`
+		Resources []struct {
+			Module    string `json:"module"`
+			Mode      string `json:"mode"`
+			Type      string `json:"type"`
+			Name      string `json:"name"`
+			Provider  string `json:"provider"`
+			Instances []struct {
+				IndexKey      interface{}            `json:"index_key"`
+				Status        string                 `json:"status"`
+				Deposed       string                 `json:"deposed"`
+				SchemaVersion uint64                 `json:"schema_version"`
+				Attributes    map[string]interface{} `json:"attributes"`
+				Dependencies  []string               `json:"dependencies"`
+			} `json:"instances"`
+		} `json:"resources"`
+	}
+	decoder := json.NewDecoder(bytes.NewReader(stateBytes))
+	decoder.UseNumber() // to keep the numbers as they are
+	if err := decoder.Decode(&state); err != nil {
+		return nil, nil, err
+	}
+	if state.Version != 4 {
+		return nil, nil, fmt.Errorf("%w: state version %d", errUnsupportedPlan, state.Version)
+	}
+	if len(state.Resources) == 0 && len(state.Outputs) == 0 {
+		return nil, schemaVersions, nil
+	}
+
+	result := &tfStateJSON{FormatVersion: tfJSONFormatVersion, TerraformVersion: state.TerraformVersion}
+	for name, output := range state.Outputs {
+		if result.Values.Outputs == nil {
+			result.Values.Outputs = make(map[string]tfOutputJSON)
+		}
+		result.Values.Outputs[name] = tfOutputJSON{Sensitive: output.Sensitive, Value: output.Value}
+	}
+	resources := make(map[string][]tfResourceJSON)
+	for _, r := range state.Resources {
+		for _, instance := range r.Instances {
+			index := instance.IndexKey
+			if number, ok := index.(json.Number); ok {
+				index, _ = number.Int64()
+			}
+			schemaVersions[tfSchemaVersionKey(r.Mode, r.Type)] = instance.SchemaVersion
+			resources[r.Module] = append(resources[r.Module], tfResourceJSON{
+				Address:       tfResourceAddress(r.Module, r.Mode, r.Type, r.Name, index),
+				Mode:          r.Mode,
+				Type:          r.Type,
+				Name:          r.Name,
+				Index:         index,
+				ProviderName:  tfProviderName(r.Provider),
+				SchemaVersion: instance.SchemaVersion,
+				Values:        instance.Attributes,
+				DependsOn:     instance.Dependencies,
+				Tainted:       instance.Status == "tainted",
+				DeposedKey:    instance.Deposed,
+			})
+		}
+	}
+	result.Values.RootModule = tfModuleTree(resources)
+	return result, schemaVersions, nil
+}
+
+// tfplan is the content of the tfplan protobuf of a plan file.
+type tfplan struct {
+	terraformVersion string
+	variables        map[string]interface{}
+	resourceChanges  []tfplanResourceChange
+	outputChanges    []tfplanOutputChange
+}
+
+type tfplanResourceChange struct {
+	modulePath   string // like module.a.module.b, empty for the root module
+	mode         string // managed or data
+	resourceType string
+	name         string
+	index        interface{} // string or int64 key, nil if none
+	deposed      string
+	provider     string
+	change       tfplanChange
+}
+
+func (c tfplanResourceChange) address() string {
+	return tfResourceAddress(c.modulePath, c.mode, c.resourceType, c.name, c.index)
+}
+
+type tfplanOutputChange struct {
+	name      string
+	sensitive bool
+	change    tfplanChange
+}
+
+type tfplanChange struct {
+	action uint64
+	values []interface{} // the values before and after the change, decoded from msgpack
+}
+
+// beforeAfter returns the values before and after the change, nil if there's no value.
+func (c tfplanChange) beforeAfter() (interface{}, interface{}) {
+	switch {
+	case c.action == tfplanActionCreate && len(c.values) == 1:
+		return nil, c.values[0]
+	case c.action == tfplanActionDelete && len(c.values) == 1:
+		return c.values[0], nil
+	case len(c.values) == 2:
+		return c.values[0], c.values[1]
+	}
+	return nil, nil
+}
+
+// resourceJSON returns the json of the change of a resource, whose unknown values are given
+// apart (an empty object if none).
+func (c tfplanChange) resourceJSON(before interface{}, after interface{}) tfChangeJSON {
+	result := tfChangeJSON{Actions: tfplanActionNames[c.action], Before: before, After: after, AfterUnknown: map[string]interface{}{}}
+	if containsUnknown(after) {
+		result.After, _ = knownValues(after)
+		result.AfterUnknown = unknownAsBool(after)
+	}
+	return result
+}
+
+// outputJSON returns the json of the change of an output, which is unknown as a whole
+// if any of its values is.
+func (c tfplanChange) outputJSON(before interface{}, after interface{}) tfOutputChangeJSON {
+	result := tfOutputChangeJSON{Actions: tfplanActionNames[c.action], Before: before, AfterUnknown: containsUnknown(after)}
+	if !result.AfterUnknown {
+		result.After, _ = json.Marshal(after)
+	}
+	return result
+}
+
+// parseTFPlan parses the tfplan protobuf of a plan file (see plans/internal/planproto
+// in terraform 0.12 and 0.13 for its definition).
+func parseTFPlan(data []byte) (*tfplan, error) {
+	fields, err := readProtoMessage(data)
+	if err != nil {
+		return nil, err
+	}
+
+	plan := &tfplan{variables: make(map[string]interface{})}
+	version := uint64(0)
+	for _, field := range fields {
+		switch field.number {
+		case 1:
+			version = field.varint
+		case 2: // map entry of the variables
+			entry, err := readProtoMessage(field.bytes)
+			if err != nil {
+				return nil, err
+			}
+			var name string
+			var value interface{}
+			for _, f := range entry {
+				switch f.number {
+				case 1:
+					name = string(f.bytes)
+				case 2:
+					if value, err = decodeDynamicValue(f.bytes); err != nil {
+						return nil, fmt.Errorf("can't decode variable %s: %v", name, err)
+					}
+				}
+			}
+			plan.variables[name] = value
+		case 3:
+			change, err := parseTFPlanResourceChange(field.bytes)
+			if err != nil {
+				return nil, err
+			}
+			plan.resourceChanges = append(plan.resourceChanges, change)
+		case 4:
+			change, err := parseTFPlanOutputChange(field.bytes)
+			if err != nil {
+				return nil, err
+			}
+			plan.outputChanges = append(plan.outputChanges, change)
+		case 14:
+			plan.terraformVersion = string(field.bytes)
+		}
+	}
+	if version != tfplanFormatVersion {
+		return nil, fmt.Errorf("%w: tfplan version %d", errUnsupportedPlan, version)
+	}
+	return plan, nil
+}
+
+func parseTFPlanResourceChange(data []byte) (tfplanResourceChange, error) {
+	change := tfplanResourceChange{mode: "managed"}
+	fields, err := readProtoMessage(data)
+	if err != nil {
+		return change, err
+	}
+	for _, field := range fields {
+		switch field.number {
+		case 1:
+			change.modulePath = string(field.bytes)
+		case 2:
+			if field.varint == 1 {
+				change.mode = "data"
+			}
+		case 3:
+			change.resourceType = string(field.bytes)
+		case 4:
+			change.name = string(field.bytes)
+		case 5:
+			change.index = string(field.bytes)
+		case 6:
+			change.index = int64(field.varint)
+		case 7:
+			change.deposed = string(field.bytes)
+		case 8:
+			change.provider = string(field.bytes)
+		case 9:
+			if change.change, err = parseTFPlanChange(field.bytes); err != nil {
+				return change, fmt.Errorf("can't decode change of %s: %v", change.address(), err)
+			}
+		}
+	}
+	return change, nil
+}
+
+func parseTFPlanOutputChange(data []byte) (tfplanOutputChange, error) {
+	var change tfplanOutputChange
+	fields, err := readProtoMessage(data)
+	if err != nil {
+		return change, err
+	}
+	for _, field := range fields {
+		switch field.number {
+		case 1:
+			change.name = string(field.bytes)
+		case 2:
+			if change.change, err = parseTFPlanChange(field.bytes); err != nil {
+				return change, fmt.Errorf("can't decode change of output %s: %v", change.name, err)
+			}
+		case 3:
+			change.sensitive = field.varint != 0
+		}
+	}
+	return change, nil
+}
+
+func parseTFPlanChange(data []byte) (tfplanChange, error) {
+	var change tfplanChange
+	fields, err := readProtoMessage(data)
+	if err != nil {
+		return change, err
+	}
+	for _, field := range fields {
+		switch field.number {
+		case 1:
+			change.action = field.varint
+		case 2:
+			value, err := decodeDynamicValue(field.bytes)
+			if err != nil {
+				return change, err
+			}
+			change.values = append(change.values, value)
+		}
+	}
+	if _, ok := tfplanActionNames[change.action]; !ok {
+		return change, fmt.Errorf("%w: unknown action %d", errUnsupportedPlan, change.action)
+	}
+	return change, nil
+}
+
+// decodeDynamicValue decodes a DynamicValue message, which holds a value encoded as msgpack.
+func decodeDynamicValue(data []byte) (interface{}, error) {
+	fields, err := readProtoMessage(data)
+	if err != nil {
+		return nil, err
+	}
+	for _, field := range fields {
+		if field.number == 1 {
+			return decodeMsgpack(field.bytes)
+		}
+	}
+	return nil, fmt.Errorf("%w: value not encoded as msgpack", errUnsupportedPlan)
+}
+
+// protoField is a field of a protobuf message.
+type protoField struct {
+	number int
+	varint uint64 // for varint fields
+	bytes  []byte // for length-delimited fields (strings, bytes and embedded messages)
+}
+
+// readProtoMessage returns the fields of the given protobuf message, in order.
+func readProtoMessage(data []byte) ([]protoField, error) {
+	var fields []protoField
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return nil, errors.New("bad protobuf field key")
+		}
+		data = data[n:]
+		field := protoField{number: int(key >> 3)}
+		switch key & 7 {
+		case 0:
+			if field.varint, n = binary.Uvarint(data); n <= 0 {
+				return nil, fmt.Errorf("bad varint in protobuf field %d", field.number)
+			}
+			data = data[n:]
+		case 1, 5: // fixed 64 and 32 bits, not used by the plan
+			size := 8
+			if key&7 == 5 {
+				size = 4
+			}
+			if len(data) < size {
+				return nil, fmt.Errorf("truncated protobuf field %d", field.number)
+			}
+			data = data[size:]
+		case 2:
+			length, n := binary.Uvarint(data)
+			if n <= 0 || length > uint64(len(data)-n) {
+				return nil, fmt.Errorf("truncated protobuf field %d", field.number)
+			}
+			field.bytes = data[n : n+int(length)]
+			data = data[n+int(length):]
+		default:
+			return nil, fmt.Errorf("unsupported wire type %d in protobuf field %d", key&7, field.number)
+		}
+		fields = append(fields, field)
+	}
+	return fields, nil
+}
+
+// unknownValue is a value not known until apply, as decoded from msgpack.
+type unknownValue struct{}
+
+// knownValues returns v without its unknown values: they're removed from the objects,
+// and replaced by null in the lists. Returns false if v is unknown itself.
+func knownValues(v interface{}) (interface{}, bool) {
+	switch v := v.(type) {
+	case unknownValue:
+		return nil, false
+	case map[string]interface{}:
+		known := make(map[string]interface{}, len(v))
+		for k, elem := range v {
+			if elem, ok := knownValues(elem); ok {
+				known[k] = elem
+			}
+		}
+		return known, true
+	case []interface{}:
+		known := make([]interface{}, len(v))
+		for i, elem := range v {
+			known[i], _ = knownValues(elem)
+		}
+		return known, true
+	}
+	return v, true
+}
+
+// containsUnknown returns true if v is or contains unknown values.
+func containsUnknown(v interface{}) bool {
+	switch v := v.(type) {
+	case unknownValue:
+		return true
+	case map[string]interface{}:
+		for _, elem := range v {
+			if containsUnknown(elem) {
+				return true
+			}
+		}
+	case []interface{}:
+		for _, elem := range v {
+			if containsUnknown(elem) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// unknownAsBool returns the after_unknown json of v: true for the unknown values, with
+// the objects and lists holding them as they are. Known values are false, and omitted
+// from the objects.
+func unknownAsBool(v interface{}) interface{} {
+	switch v := v.(type) {
+	case unknownValue:
+		return true
+	case map[string]interface{}:
+		result := make(map[string]interface{})
+		for k, elem := range v {
+			if b := unknownAsBool(elem); b != false {
+				result[k] = b
+			}
+		}
+		return result
+	case []interface{}:
+		result := make([]interface{}, len(v))
+		for i, elem := range v {
+			result[i] = unknownAsBool(elem)
+		}
+		return result
+	}
+	return false
+}
+
+// decodeMsgpack decodes the given value encoded by terraform as msgpack. Unknown
+// values are decoded as unknownValue.
+func decodeMsgpack(data []byte) (interface{}, error) {
+	r := &msgpackReader{data: data}
+	value, err := r.value()
+	if err != nil {
+		return nil, fmt.Errorf("bad msgpack value: %v", err)
+	}
+	if len(r.data) > 0 {
+		return nil, fmt.Errorf("bad msgpack value: %d bytes left", len(r.data))
+	}
+	return value, nil
+}
+
+type msgpackReader struct {
+	data []byte
+}
+
+func (r *msgpackReader) read(n int) ([]byte, error) {
+	if n < 0 || n > len(r.data) {
+		return nil, errors.New("unexpected end of data")
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b, nil
+}
+
+// uint reads a big endian unsigned int of the given size.
+func (r *msgpackReader) uint(size int) (uint64, error) {
+	b, err := r.read(size)
+	if err != nil {
+		return 0, err
+	}
+	var result uint64
+	for _, c := range b {
+		result = result<<8 | uint64(c)
+	}
+	return result, nil
+}
+
+// value reads a value. Objects and maps are read as map[string]interface{}, and lists, sets
+// and tuples as []interface{}.
+func (r *msgpackReader) value() (interface{}, error) {
+	b, err := r.read(1)
+	if err != nil {
+		return nil, err
+	}
+	c := b[0]
+	switch {
+	case c <= 0x7f:
+		return int64(c), nil
+	case c >= 0xe0:
+		return int64(int8(c)), nil
+	case c&0xf0 == 0x80:
+		return r.mapOf(uint64(c & 0x0f))
+	case c&0xf0 == 0x90:
+		return r.arrayOf(uint64(c & 0x0f))
+	case c&0xe0 == 0xa0:
+		return r.str(uint64(c & 0x1f))
+	}
+
+	// the sizes of the lengths, numbers and extension data by type
+	sizes := map[byte]int{
+		0xc4: 1, 0xc5: 2, 0xc6: 4, 0xc7: 1, 0xc8: 2, 0xc9: 4,
+		0xcc: 1, 0xcd: 2, 0xce: 4, 0xcf: 8, 0xd0: 1, 0xd1: 2, 0xd2: 4, 0xd3: 8,
+		0xd4: 1, 0xd5: 2, 0xd6: 4, 0xd7: 8, 0xd8: 16,
+		0xd9: 1, 0xda: 2, 0xdb: 4, 0xdc: 2, 0xdd: 4, 0xde: 2, 0xdf: 4,
+	}
+	switch c {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xca:
+		n, err := r.uint(4)
+		return float64(math.Float32frombits(uint32(n))), err
+	case 0xcb:
+		n, err := r.uint(8)
+		return math.Float64frombits(n), err
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		n, err := r.uint(sizes[c])
+		if n > math.MaxInt64 {
+			return n, err
+		}
+		return int64(n), err
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		n, err := r.uint(sizes[c])
+		shift := uint(64 - 8*sizes[c]) // to extend the sign
+		return int64(n<<shift) >> shift, err
+	case 0xd4, 0xd5, 0xd6, 0xd7, 0xd8:
+		// extensions: terraform encodes the unknown values as such
+		_, err := r.read(1 + sizes[c])
+		return unknownValue{}, err
+	case 0xc7, 0xc8, 0xc9:
+		length, err := r.uint(sizes[c])
+		if err == nil {
+			_, err = r.read(int(length) + 1)
+		}
+		return unknownValue{}, err
+	}
+
+	length, err := r.uint(sizes[c])
+	if err != nil {
+		return nil, err
+	}
+	switch c {
+	case 0xc4, 0xc5, 0xc6:
+		return r.read(int(length))
+	case 0xd9, 0xda, 0xdb:
+		return r.str(length)
+	case 0xdc, 0xdd:
+		return r.arrayOf(length)
+	case 0xde, 0xdf:
+		return r.mapOf(length)
+	}
+	return nil, fmt.Errorf("unsupported type 0x%x", c)
+}
+
+func (r *msgpackReader) str(length uint64) (interface{}, error) {
+	b, err := r.read(int(length))
+	return string(b), err
+}
+
+func (r *msgpackReader) arrayOf(length uint64) (interface{}, error) {
+	if length > uint64(len(r.data)) {
+		return nil, errors.New("unexpected end of data")
+	}
+	result := make([]interface{}, length)
+	for i := range result {
+		var err error
+		if result[i], err = r.value(); err != nil {
+			return nil, err
+		}
+	}
+	// values of dynamic type are encoded along with their type, as [type json, value]
+	if length == 2 {
+		if _, isType := result[0].([]byte); isType {
+			return result[1], nil
+		}
+	}
+	return result, nil
+}
+
+func (r *msgpackReader) mapOf(length uint64) (interface{}, error) {
+	if length > uint64(len(r.data)) {
+		return nil, errors.New("unexpected end of data")
+	}
+	result := make(map[string]interface{}, length)
+	for i := uint64(0); i < length; i++ {
+		key, err := r.value()
+		if err != nil {
+			return nil, err
+		}
+		keyString, ok := key.(string)
+		if !ok {
+			return nil, fmt.Errorf("unsupported key %v", key)
+		}
+		if result[keyString], err = r.value(); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
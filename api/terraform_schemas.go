@@ -0,0 +1,77 @@
+// This file contains the schema versions of the resource types, which the json of a plan
+// gives but the plan file doesn't (they come from the provider). Those of the prior state are
+// used first, then the ones given with -terraform-schema-versions, then the ones bundled here.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+)
+
+// tfSchemaVersions are the schema versions of the resource types, by tfSchemaVersionKey.
+// Data sources not in it are at version 0, as they (almost) always are.
+var tfSchemaVersions = map[string]uint64{
+	"aws_cloudwatch_metric_alarm": 1,
+	"aws_dynamodb_table":          1,
+	"aws_ecs_task_definition":     1,
+	"aws_eip":                     0,
+	"aws_instance":                1,
+	"aws_key_pair":                1,
+	"aws_route53_record":          2,
+	"aws_s3_bucket":               0,
+	"aws_security_group":          1,
+	"aws_security_group_rule":     2,
+	"aws_subnet":                  1,
+	"aws_vpc":                     1,
+}
+
+// tfSchemaVersionKey returns the key of the given resource type in the schema versions:
+// the type for managed resources, and data.<type> for data sources (they're versioned apart).
+func tfSchemaVersionKey(mode string, resourceType string) string {
+	if mode == "data" {
+		return "data." + resourceType
+	}
+	return resourceType
+}
+
+// loadTFSchemaVersions adds the schema versions of the given json file to tfSchemaVersions
+// (replacing the bundled ones). The file is either the output of "terraform providers schema -json",
+// or the versions by tfSchemaVersionKey, like {"aws_instance": 1, "data.aws_ami": 0}.
+func loadTFSchemaVersions(path string) error {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var schemas struct {
+		ProviderSchemas map[string]struct {
+			ResourceSchemas map[string]struct {
+				Version uint64 `json:"version"`
+			} `json:"resource_schemas"`
+			DataSourceSchemas map[string]struct {
+				Version uint64 `json:"version"`
+			} `json:"data_source_schemas"`
+		} `json:"provider_schemas"`
+	}
+	if err := json.Unmarshal(content, &schemas); err == nil && schemas.ProviderSchemas != nil {
+		for _, provider := range schemas.ProviderSchemas {
+			for resourceType, schema := range provider.ResourceSchemas {
+				tfSchemaVersions[tfSchemaVersionKey("managed", resourceType)] = schema.Version
+			}
+			for resourceType, schema := range provider.DataSourceSchemas {
+				tfSchemaVersions[tfSchemaVersionKey("data", resourceType)] = schema.Version
+			}
+		}
+		return nil
+	}
+
+	var versions map[string]uint64
+	if err := json.Unmarshal(content, &versions); err != nil {
+		return fmt.Errorf("bad schema versions in %s: %v", path, err)
+	}
+	for key, version := range versions {
+		tfSchemaVersions[key] = version
+	}
+	return nil
+}
@@ -0,0 +1,436 @@
+// This file contains the validation of terraform source directories without a plan: their
+// .tf files are evaluated in go to a plan-like json, where every resource is to be created
+// with the values given literally (or from variable defaults and locals), and the rest unknown.
+// Local modules in the directory are evaluated too. Remote ones aren't available, so skipped.
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/zclconf/go-cty/cty"
+	"github.com/zclconf/go-cty/cty/function"
+	"github.com/zclconf/go-cty/cty/function/stdlib"
+	"io"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+)
+
+// tfsourceMaxModuleDepth limits the nesting of local modules, to stop on cycles.
+const tfsourceMaxModuleDepth = 10
+
+// tfsourceMaxInstances limits the instances of a resource with count or for_each: beyond it,
+// the resource is evaluated as a single instance, as when the count is unknown.
+const tfsourceMaxInstances = 1000
+
+// the limits of the uncompressed source archives, of each file and of all of them
+const (
+	tfsourceMaxFileSize    = 1 << 20
+	tfsourceMaxArchiveSize = 10 << 20
+)
+
+// tfsourceFunctions are the terraform functions available to evaluate the sources. Calls to
+// other ones give unknown values.
+var tfsourceFunctions = map[string]function.Function{
+	"abs":        stdlib.AbsoluteFunc,
+	"coalesce":   stdlib.CoalesceFunc,
+	"concat":     stdlib.ConcatFunc,
+	"csvdecode":  stdlib.CSVDecodeFunc,
+	"format":     stdlib.FormatFunc,
+	"formatdate": stdlib.FormatDateFunc,
+	"formatlist": stdlib.FormatListFunc,
+	"jsondecode": stdlib.JSONDecodeFunc,
+	"jsonencode": stdlib.JSONEncodeFunc,
+	"length":     stdlib.LengthFunc,
+	"lower":      stdlib.LowerFunc,
+	"max":        stdlib.MaxFunc,
+	"min":        stdlib.MinFunc,
+	"range":      stdlib.RangeFunc,
+	"regex":      stdlib.RegexFunc,
+	"regexall":   stdlib.RegexAllFunc,
+	"substr":     stdlib.SubstrFunc,
+	"upper":      stdlib.UpperFunc,
+}
+
+// readSourceArchive returns the files of the given tar.gz archive by path. If all of
+// them are in a single directory, the paths are relative to it.
+func readSourceArchive(data []byte) (map[string][]byte, error) {
+	gzipReader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("invalid tar.gz archive: %v", err)
+	}
+	defer gzipReader.Close()
+
+	files := make(map[string][]byte)
+	size := 0
+	tarReader := tar.NewReader(gzipReader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid tar.gz archive: %v", err)
+		}
+		name := path.Clean(strings.TrimPrefix(header.Name, "/"))
+		if header.Typeflag != tar.TypeReg || strings.HasPrefix(name, "../") || strings.Contains("/"+name, "/.terraform/") {
+			continue
+		}
+		content, err := ioutil.ReadAll(io.LimitReader(tarReader, tfsourceMaxFileSize+1))
+		if err != nil {
+			return nil, fmt.Errorf("can't read '%s': %v", header.Name, err)
+		}
+		if len(content) > tfsourceMaxFileSize {
+			return nil, fmt.Errorf("'%s' is bigger than %d bytes", header.Name, tfsourceMaxFileSize)
+		}
+		if size += len(content); size > tfsourceMaxArchiveSize {
+			return nil, fmt.Errorf("the archive is bigger than %d bytes uncompressed", tfsourceMaxArchiveSize)
+		}
+		files[name] = content
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("empty archive")
+	}
+
+	// remove the common directory, if any
+	for {
+		prefix := ""
+		for name := range files {
+			dir := strings.SplitN(name, "/", 2)
+			if len(dir) == 1 || (prefix != "" && dir[0] != prefix) {
+				return files, nil
+			}
+			prefix = dir[0]
+		}
+		unprefixed := make(map[string][]byte, len(files))
+		for name, content := range files {
+			unprefixed[strings.TrimPrefix(name, prefix+"/")] = content
+		}
+		files = unprefixed
+	}
+}
+
+// decodeTerraformSource returns the plan-like json of the terraform module in the given files (by path).
+// Errors are due to the source given.
+func decodeTerraformSource(files map[string][]byte) ([]byte, error) {
+	e := &tfsourceEvaluator{
+		files:       files,
+		moduleFiles: make(map[string]map[string][]byte),
+		resources:   make(map[string][]tfResourceJSON),
+	}
+	variables, err := e.module("", ".", "", nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	if len(e.moduleFiles[""]) == 0 {
+		return nil, fmt.Errorf("no .tf files found")
+	}
+
+	result := tfPlanJSON{FormatVersion: tfJSONFormatVersion, ResourceChanges: e.changes}
+	for name, value := range variables {
+		if known, ok := knownValues(ctyToTFValue(value)); ok && known != nil {
+			if result.Variables == nil {
+				result.Variables = make(map[string]tfVariableJSON)
+			}
+			result.Variables[name] = tfVariableJSON{Value: known}
+		}
+	}
+	result.PlannedValues.RootModule = tfModuleTree(e.resources)
+	sort.Slice(result.ResourceChanges, func(i, j int) bool {
+		return result.ResourceChanges[i].Address < result.ResourceChanges[j].Address
+	})
+
+	config := &tfConfigJSON{ProviderConfig: make(map[string]tfProviderConfigJSON)}
+	reader := tfconfigReader{files: e.moduleFiles, schemaVersions: map[string]uint64{}, providers: config.ProviderConfig}
+	if config.RootModule, err = reader.module(""); err != nil {
+		return nil, err
+	}
+	result.Configuration = config
+
+	return json.MarshalIndent(result, "", "\t")
+}
+
+// tfsourceEvaluator evaluates the modules of a source directory.
+type tfsourceEvaluator struct {
+	files       map[string][]byte            // the files of the directory, by path
+	moduleFiles map[string]map[string][]byte // the .tf files of each module evaluated, by module key (see tfconfigReader)
+	resources   map[string][]tfResourceJSON  // the planned resources, by module address
+	changes     []tfResourceChangeJSON
+}
+
+// module evaluates the module of the given key in the given directory, with the given input
+// variables. Returns the values of its variables.
+func (e *tfsourceEvaluator) module(
+	key string,
+	dir string,
+	address string,
+	inputs map[string]cty.Value,
+	depth int,
+) (map[string]cty.Value, error) {
+	if depth > tfsourceMaxModuleDepth {
+		return nil, fmt.Errorf("too many nested modules in %s", dir)
+	}
+
+	// parse the .tf files of the directory, in order
+	e.moduleFiles[key] = make(map[string][]byte)
+	var names []string
+	for name := range e.files {
+		if path.Dir(name) == dir {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	var blocks hclsyntax.Blocks
+	for _, name := range names {
+		base := path.Base(name)
+		switch {
+		case strings.HasSuffix(base, ".tf.json"):
+			return nil, fmt.Errorf("%s: json configuration files not supported", name)
+		case !strings.HasSuffix(base, ".tf"):
+			continue
+		}
+		file, diags := hclsyntax.ParseConfig(e.files[name], name, hcl.Pos{Line: 1, Column: 1})
+		if diags.HasErrors() {
+			return nil, diags
+		}
+		e.moduleFiles[key][base] = e.files[name]
+		blocks = append(blocks, file.Body.(*hclsyntax.Body).Blocks...)
+	}
+
+	// the variables given, or their defaults
+	variables := make(map[string]cty.Value)
+	locals := make(map[string]*hclsyntax.Attribute)
+	for _, block := range blocks {
+		switch {
+		case block.Type == "variable" && len(block.Labels) == 1:
+			value, ok := inputs[block.Labels[0]]
+			if !ok {
+				value = cty.DynamicVal
+				if attr, ok := block.Body.Attributes["default"]; ok {
+					value = tfsourceValue(attr.Expr, nil)
+				}
+			}
+			variables[block.Labels[0]] = value
+		case block.Type == "locals":
+			for name, attr := range block.Body.Attributes {
+				locals[name] = attr
+			}
+		}
+	}
+	ctx := &hcl.EvalContext{
+		Variables: map[string]cty.Value{
+			"var":       cty.ObjectVal(variables),
+			"path":      cty.ObjectVal(map[string]cty.Value{"module": cty.StringVal(dir), "root": cty.StringVal("."), "cwd": cty.StringVal(".")}),
+			"terraform": cty.ObjectVal(map[string]cty.Value{"workspace": cty.StringVal("default")}),
+		},
+		Functions: tfsourceFunctions,
+	}
+
+	// locals may refer to others, so they're evaluated until no more can be
+	localValues := make(map[string]cty.Value)
+	for len(locals) > 0 {
+		ctx.Variables["local"] = cty.ObjectVal(localValues)
+		evaluated := 0
+		for name, attr := range locals {
+			if value, diags := attr.Expr.Value(ctx); !diags.HasErrors() {
+				localValues[name] = value
+				delete(locals, name)
+				evaluated++
+			}
+		}
+		if evaluated == 0 {
+			for name := range locals {
+				localValues[name] = cty.DynamicVal
+			}
+			break
+		}
+	}
+	ctx.Variables["local"] = cty.ObjectVal(localValues)
+
+	for _, block := range blocks {
+		switch {
+		case (block.Type == "resource" || block.Type == "data") && len(block.Labels) == 2:
+			e.resource(block, address, ctx)
+
+		case block.Type == "module" && len(block.Labels) == 1:
+			source, ok := block.Body.Attributes["source"]
+			if !ok {
+				continue
+			}
+			sourceValue := tfsourceValue(source.Expr, nil)
+			if !sourceValue.IsKnown() || sourceValue.Type() != cty.String ||
+				!(strings.HasPrefix(sourceValue.AsString(), "./") || strings.HasPrefix(sourceValue.AsString(), "../")) {
+				continue // not a local module
+			}
+			childDir := path.Join(dir, sourceValue.AsString())
+			if strings.HasPrefix(childDir, "../") {
+				return nil, fmt.Errorf("module %s: source %s out of the directory", block.Labels[0], sourceValue.AsString())
+			}
+			childInputs := make(map[string]cty.Value)
+			for name, attr := range block.Body.Attributes {
+				if !containsString(tfconfigMetaArguments, name) {
+					childInputs[name] = tfsourceValue(attr.Expr, ctx)
+				}
+			}
+			childKey, childAddress := block.Labels[0], "module."+block.Labels[0]
+			if key != "" {
+				childKey, childAddress = key+"."+childKey, address+"."+childAddress
+			}
+			if _, err := e.module(childKey, childDir, childAddress, childInputs, depth+1); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return variables, nil
+}
+
+// resource adds the instances of the given resource block in the module of the given address.
+func (e *tfsourceEvaluator) resource(block *hclsyntax.Block, moduleAddress string, ctx *hcl.EvalContext) {
+	mode, action := "managed", uint64(tfplanActionCreate)
+	if block.Type == "data" {
+		mode, action = "data", tfplanActionRead
+	}
+	resourceType, name := block.Labels[0], block.Labels[1]
+	provider := strings.SplitN(resourceType, "_", 2)[0]
+	if attr, ok := block.Body.Attributes["provider"]; ok {
+		if traversal, diags := hcl.AbsTraversalForExpr(attr.Expr); !diags.HasErrors() {
+			provider = tfconfigTraversalString(traversal)
+		}
+	}
+
+	// the instances by index (nil if there's no count nor for_each), with the count or each values
+	type instance struct {
+		index  interface{}
+		values map[string]cty.Value
+	}
+	instances := []instance{{}}
+	if attr, ok := block.Body.Attributes["count"]; ok {
+		count := tfsourceValue(attr.Expr, ctx)
+		if count.IsKnown() && !count.IsNull() && count.Type() == cty.Number {
+			if n, _ := count.AsBigFloat().Int64(); n <= tfsourceMaxInstances {
+				instances = nil
+				for i := int64(0); i < n; i++ {
+					instances = append(instances, instance{index: i, values: map[string]cty.Value{"count": cty.ObjectVal(map[string]cty.Value{"index": cty.NumberIntVal(i)})}})
+				}
+			}
+		}
+	} else if attr, ok := block.Body.Attributes["for_each"]; ok {
+		forEach := tfsourceValue(attr.Expr, ctx)
+		if forEach.IsWhollyKnown() && !forEach.IsNull() && forEach.CanIterateElements() && forEach.LengthInt() <= tfsourceMaxInstances {
+			instances = nil
+			for it := forEach.ElementIterator(); it.Next(); {
+				key, value := it.Element()
+				if forEach.Type().IsSetType() {
+					key = value
+				}
+				if key.Type() != cty.String {
+					continue
+				}
+				instances = append(instances, instance{index: key.AsString(), values: map[string]cty.Value{"each": cty.ObjectVal(map[string]cty.Value{"key": key, "value": value})}})
+			}
+		}
+	}
+
+	for _, i := range instances {
+		instanceCtx := ctx
+		if i.values != nil {
+			instanceCtx = ctx.NewChild()
+			instanceCtx.Variables = i.values
+		}
+		after := tfsourceBodyValues(block.Body, instanceCtx)
+		resource := tfResourceJSON{
+			Address:      tfResourceAddress(moduleAddress, mode, resourceType, name, i.index),
+			Mode:         mode,
+			Type:         resourceType,
+			Name:         name,
+			Index:        i.index,
+			ProviderName: provider,
+		}
+		if known, ok := knownValues(after); ok {
+			resource.Values, _ = known.(map[string]interface{})
+		}
+		e.resources[moduleAddress] = append(e.resources[moduleAddress], resource)
+		e.changes = append(e.changes, tfResourceChangeJSON{
+			Address:       resource.Address,
+			ModuleAddress: moduleAddress,
+			Mode:          mode,
+			Type:          resourceType,
+			Name:          name,
+			Index:         i.index,
+			ProviderName:  provider,
+			Change:        tfplanChange{action: action}.resourceJSON(nil, after),
+		})
+	}
+}
+
+// tfsourceBodyValues returns the values of the attributes and nested blocks of the given
+// resource body, but the meta-arguments. Nested blocks are lists of objects, as usual.
+func tfsourceBodyValues(body *hclsyntax.Body, ctx *hcl.EvalContext) map[string]interface{} {
+	result := make(map[string]interface{})
+	for name, attr := range body.Attributes {
+		if !containsString(tfconfigMetaArguments, name) {
+			result[name] = ctyToTFValue(tfsourceValue(attr.Expr, ctx))
+		}
+	}
+	for _, block := range body.Blocks {
+		switch {
+		case containsString(tfconfigMetaArguments, block.Type):
+		case block.Type == "dynamic" && len(block.Labels) == 1:
+			result[block.Labels[0]] = unknownValue{} // generated from a collection
+		default:
+			nested, _ := result[block.Type].([]interface{})
+			result[block.Type] = append(nested, tfsourceBodyValues(block.Body, ctx))
+		}
+	}
+	return result
+}
+
+// tfsourceValue returns the value of the given expression, unknown if it can't be evaluated
+// (it refers to resources, for example).
+func tfsourceValue(expr hcl.Expression, ctx *hcl.EvalContext) cty.Value {
+	value, diags := expr.Value(ctx)
+	if diags.HasErrors() {
+		return cty.DynamicVal
+	}
+	return value
+}
+
+// ctyToTFValue converts the given value to json-like values, with unknownValue for the unknown ones.
+func ctyToTFValue(v cty.Value) interface{} {
+	if !v.IsKnown() {
+		return unknownValue{}
+	}
+	if v.IsNull() {
+		return nil
+	}
+	switch t := v.Type(); {
+	case t == cty.String:
+		return v.AsString()
+	case t == cty.Bool:
+		return v.True()
+	case t == cty.Number:
+		return json.Number(v.AsBigFloat().Text('f', -1))
+	case t.IsListType() || t.IsSetType() || t.IsTupleType():
+		result := make([]interface{}, 0, v.LengthInt())
+		for it := v.ElementIterator(); it.Next(); {
+			_, elem := it.Element()
+			result = append(result, ctyToTFValue(elem))
+		}
+		return result
+	case t.IsMapType() || t.IsObjectType():
+		result := make(map[string]interface{})
+		for it := v.ElementIterator(); it.Next(); {
+			key, elem := it.Element()
+			result[key.AsString()] = ctyToTFValue(elem)
+		}
+		return result
+	}
+	return unknownValue{}
+}
@@ -1,9 +1,20 @@
 package main
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
 	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 )
@@ -17,9 +28,333 @@ func TestConvertTerraformBinToJSON(t *testing.T) {
 	planBytes, err := base64.StdEncoding.DecodeString(convertTFPlanDataB64)
 	require.Nil(t, err, "cant decode plan data")
 
-	asJson, err := convertTerraformBinToJSON(planBytes)
-	require.Nil(t, err, "convertTerraformBinToJSON failed")
-	assert.Equal(t, convertTFExpectedJson, asJson, "bad json")
+	asJson, err := showTerraformBin(planBytes)
+	require.Nil(t, err, "showTerraformBin failed")
+	var prettyJSON bytes.Buffer
+	require.Nil(t, json.Indent(&prettyJSON, asJson, "", "\t"))
+	assert.Equal(t, convertTFExpectedJson, prettyJSON.String(), "bad json")
+}
+
+func TestDecodeTerraformPlan(t *testing.T) {
+	planBytes, err := base64.StdEncoding.DecodeString(convertTFPlanDataB64)
+	require.Nil(t, err, "cant decode plan data")
+
+	asJson, err := decodeTerraformPlan(planBytes)
+	require.Nil(t, err, "decodeTerraformPlan failed")
+	var prettyJSON bytes.Buffer
+	require.Nil(t, json.Indent(&prettyJSON, asJson, "", "\t"))
+	assert.Equal(t, convertTFExpectedJson, prettyJSON.String(), "bad json")
+
+	_, err = decodeTerraformPlan([]byte("not a zip"))
+	assert.True(t, errors.Is(err, errUnsupportedPlan), "%v", err)
+}
+
+func TestDecodeTerraform13Plan(t *testing.T) {
+	defer func(previous map[string]uint64) { tfSchemaVersions = previous }(tfSchemaVersions)
+	tfSchemaVersions = map[string]uint64{}
+	planBytes, err := base64.StdEncoding.DecodeString(decodeTF13PlanDataB64)
+	require.Nil(t, err, "cant decode plan data")
+
+	// the schema version of test_resource is in the prior state, but not the one of test_resource_timeout
+	_, err = decodeTerraformPlan(planBytes)
+	assert.True(t, errors.Is(err, errUnsupportedPlan), "%v", err)
+
+	// as "terraform providers schema -json" gives them
+	dir, err := ioutil.TempDir("", "schema-versions")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	schemasPath := filepath.Join(dir, "schemas.json")
+	require.Nil(t, ioutil.WriteFile(schemasPath, []byte(`{"format_version": "0.1", "provider_schemas": {
+		"registry.terraform.io/hashicorp/test": {"resource_schemas": {"test_resource_timeout": {"version": 1, "block": {}}}}}}`), 0644))
+	require.Nil(t, loadTFSchemaVersions(schemasPath))
+
+	asJson, err := decodeTerraformPlan(planBytes)
+	require.Nil(t, err, "decodeTerraformPlan failed")
+	var prettyJSON bytes.Buffer
+	require.Nil(t, json.Indent(&prettyJSON, asJson, "", "\t"))
+	assert.Equal(t, decodeTF13ExpectedJson, prettyJSON.String(), "bad json")
+
+	versionsPath := filepath.Join(dir, "versions.json")
+	require.Nil(t, ioutil.WriteFile(versionsPath, []byte(`{"test_resource_timeout": 2, "data.test_data_source": 1}`), 0644))
+	require.Nil(t, loadTFSchemaVersions(versionsPath))
+	assert.Equal(t, map[string]uint64{"test_resource_timeout": 2, "data.test_data_source": 1}, tfSchemaVersions)
+
+	require.Nil(t, ioutil.WriteFile(versionsPath, []byte(`{"test_resource_timeout": "1"}`), 0644))
+	assert.NotNil(t, loadTFSchemaVersions(versionsPath))
+	assert.NotNil(t, loadTFSchemaVersions(filepath.Join(dir, "missing.json")))
+}
+
+func TestTFProviderName(t *testing.T) {
+	cases := map[string]string{
+		"provider.aws":          "aws",
+		"provider.aws.west":     "aws.west",
+		"module.a.provider.aws": "aws",
+		`provider["registry.terraform.io/hashicorp/aws"]`:               "registry.terraform.io/hashicorp/aws",
+		`provider["registry.terraform.io/hashicorp/aws"].west`:          "registry.terraform.io/hashicorp/aws",
+		`module.a.provider["registry.terraform.io/hashicorp/aws"].west`: "registry.terraform.io/hashicorp/aws",
+	}
+	for address, expected := range cases {
+		assert.Equal(t, expected, tfProviderName(address), "for address: "+address)
+	}
+
+	assert.True(t, supportedTerraformVersion("0.12.6"))
+	assert.True(t, supportedTerraformVersion("0.13.7"))
+	assert.False(t, supportedTerraformVersion("0.11.14"))
+	assert.False(t, supportedTerraformVersion("0.14.0"))
+	assert.False(t, supportedTerraformVersion(""))
+}
+
+func TestTerraformBinFor(t *testing.T) {
+	dir, err := ioutil.TempDir("", "terraform-versions")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	defer func(previous string) { terraformDir = previous }(terraformDir)
+
+	assert.Equal(t, "", terraformFileVersion([]byte("{}")))
+	assert.Equal(t, "0.12.6", terraformFileVersion([]byte(`{"version": 4, "terraform_version": "0.12.6"}`)))
+	planBytes, err := base64.StdEncoding.DecodeString(convertTFPlanDataB64)
+	require.Nil(t, err)
+	assert.Equal(t, "0.12.6", terraformFileVersion(planBytes))
+
+	bin, err := terraformBinFor("0.12.6", true)
+	require.Nil(t, err)
+	assert.Equal(t, tfBin, bin, "no directory given")
+
+	terraformDir = dir
+	_, err = terraformBinFor("0.12.6", false)
+	assert.Equal(t, noTerraformVersionError{version: "0.12.6"}, err)
+
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "terraform_0.12.6"), nil, 0755))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "terraform_0.13.0-beta1"), nil, 0755))
+	require.Nil(t, os.MkdirAll(filepath.Join(dir, "0.12.29"), 0755))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "0.12.29", "terraform"), nil, 0755))
+	require.Nil(t, os.MkdirAll(filepath.Join(dir, "0.11.0"), 0755)) // without binary
+
+	for _, c := range []struct {
+		version string
+		isPlan  bool
+		bin     string
+	}{
+		{"0.12.6", true, "terraform_0.12.6"},
+		{"0.12.29", true, "0.12.29/terraform"},
+		{"0.12.6", false, "terraform_0.12.6"},
+		{"0.12.10", false, "0.12.29/terraform"},
+		{"0.11.14", false, "terraform_0.12.6"},
+		{"0.13.0-alpha1", false, "terraform_0.13.0-beta1"},
+		{"", true, "terraform_0.13.0-beta1"},
+	} {
+		bin, err := terraformBinFor(c.version, c.isPlan)
+		require.Nil(t, err, c.version)
+		assert.Equal(t, filepath.Join(dir, c.bin), bin, c.version)
+	}
+
+	_, err = terraformBinFor("0.12.7", true)
+	assert.Equal(t, noTerraformVersionError{version: "0.12.7", installed: []string{"0.12.6", "0.12.29", "0.13.0-beta1"}}, err)
+	_, err = terraformBinFor("0.13.0", false)
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "no terraform binary compatible with version 0.13.0")
+
+	for _, c := range []struct {
+		a, b     string
+		expected int
+	}{
+		{"0.12.6", "0.12.6", 0},
+		{"0.12.10", "0.12.9", 1},
+		{"0.13.0-beta1", "0.13.0", -1},
+		{"0.13.0-beta1", "0.13.0-alpha2", 1},
+		{"0.13.0-beta10", "0.13.0-beta2", 1},
+		{"0.13.0-beta2", "0.13.0-beta10", -1},
+		{"0.13.0-rc1", "0.13.0-beta10", 1},
+		{"v0.13.0-beta2", "0.13.0-beta2", 0},
+	} {
+		assert.Equal(t, c.expected, compareTerraformVersions(c.a, c.b), "%s vs %s", c.a, c.b)
+	}
+}
+
+func TestDecodeMsgpack(t *testing.T) {
+	value, err := decodeMsgpack([]byte{
+		0x83,                              // map of 3
+		0xa1, 'a', 0x92, 0xff, 0xd0, 0x80, // a: [-1, -128]
+		0xa1, 'b', 0xd4, 0x00, 0x00, // b: unknown
+		0xa1, 'c', 0x92, 0xc4, 0x08, '"', 's', 't', 'r', 'i', 'n', 'g', '"', 0xa1, 'x', // c: "x" of dynamic type
+	})
+	require.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{"a": []interface{}{int64(-1), int64(-128)}, "b": unknownValue{}, "c": "x"}, value)
+	assert.True(t, containsUnknown(value))
+	known, _ := knownValues(value)
+	assert.Equal(t, map[string]interface{}{"a": []interface{}{int64(-1), int64(-128)}, "c": "x"}, known)
+	assert.Equal(t, map[string]interface{}{"a": []interface{}{false, false}, "b": true}, unknownAsBool(value))
+
+	_, err = decodeMsgpack([]byte{0x92, 0x01})
+	assert.NotNil(t, err, "truncated")
+}
+
+func TestTFConfigReference(t *testing.T) {
+	for expr, expected := range map[string]string{
+		"aws_instance.a.id":    "aws_instance.a",
+		"aws_instance.a[0].id": "aws_instance.a[0]",
+		`aws_instance.a["k"]`:  `aws_instance.a["k"]`,
+		"data.aws_ami.a.id":    "data.aws_ami.a",
+		"module.m.out":         "module.m.out",
+		"module.m[1].out":      "module.m[1].out",
+		"var.list[0]":          "var.list",
+		"local.tags.name":      "local.tags",
+		"count.index":          "count.index",
+		"self.private_ip":      "self",
+	} {
+		parsed, diags := hclsyntax.ParseExpression([]byte(expr), "", hcl.Pos{Line: 1, Column: 1})
+		require.False(t, diags.HasErrors(), "%s: %v", expr, diags)
+		assert.Equal(t, []string{expected}, tfconfigExpression(parsed).References, expr)
+	}
+}
+
+// sourceArchive returns a tar.gz with the given files, by path.
+func sourceArchive(t *testing.T, files map[string]string) []byte {
+	var buf bytes.Buffer
+	gzipWriter := gzip.NewWriter(&buf)
+	tarWriter := tar.NewWriter(gzipWriter)
+	for name, content := range files {
+		require.Nil(t, tarWriter.WriteHeader(&tar.Header{Name: name, Mode: 0600, Size: int64(len(content)), Typeflag: tar.TypeReg}))
+		_, err := tarWriter.Write([]byte(content))
+		require.Nil(t, err)
+	}
+	require.Nil(t, tarWriter.Close())
+	require.Nil(t, gzipWriter.Close())
+	return buf.Bytes()
+}
+
+func TestDecodeTerraformSource(t *testing.T) {
+	files, err := readSourceArchive(sourceArchive(t, map[string]string{
+		"src/main.tf": `
+variable "env" {
+  default = "prod"
+}
+variable "ami" {}
+locals {
+  name = "${local.prefix}-web"
+  prefix = upper(var.env)
+}
+resource "aws_instance" "web" {
+  count = 2
+  ami = var.ami
+  instance_type = "t2.micro"
+  tags = {
+    Name = "${local.name}-${count.index}"
+  }
+  ebs_block_device {
+    device_name = "/dev/sdb"
+    volume_size = 10
+  }
+  lifecycle {
+    create_before_destroy = true
+  }
+}
+data "aws_vpc" "default" {
+  default = true
+}
+module "bucket" {
+  source = "./bucket"
+  name = local.name
+}
+module "remote" {
+  source = "terraform-aws-modules/vpc/aws"
+}`,
+		"src/bucket/main.tf": `
+variable "name" {}
+resource "aws_s3_bucket" "b" {
+  for_each = {logs = "log-delivery-write"}
+  bucket = "${var.name}-${each.key}"
+  acl = each.value
+  arn = aws_instance.x.arn
+}`,
+		"src/.terraform/modules/remote/main.tf": `resource "aws_vpc" "ignored" {}`,
+		"src/README.md":                         "not terraform",
+	}))
+	require.Nil(t, err)
+	assert.Len(t, files, 3, "in .terraform")
+
+	planJSON, err := decodeTerraformSource(files)
+	require.Nil(t, err)
+	var plan struct {
+		Variables       map[string]tfVariableJSON `json:"variables"`
+		PlannedValues   tfValuesJSON              `json:"planned_values"`
+		ResourceChanges []tfResourceChangeJSON    `json:"resource_changes"`
+		Configuration   tfConfigJSON              `json:"configuration"`
+	}
+	decoder := json.NewDecoder(bytes.NewReader(planJSON))
+	decoder.UseNumber()
+	require.Nil(t, decoder.Decode(&plan), string(planJSON))
+
+	assert.Equal(t, map[string]tfVariableJSON{"env": {Value: "prod"}}, plan.Variables, "unknown ones omitted")
+	var addresses []string
+	for _, change := range plan.ResourceChanges {
+		addresses = append(addresses, change.Address)
+	}
+	assert.Equal(t, []string{
+		"aws_instance.web[0]",
+		"aws_instance.web[1]",
+		"data.aws_vpc.default",
+		`module.bucket.aws_s3_bucket.b["logs"]`,
+	}, addresses)
+
+	web := plan.ResourceChanges[1]
+	assert.Equal(t, []string{"create"}, web.Change.Actions)
+	assert.Equal(t, map[string]interface{}{
+		"instance_type": "t2.micro",
+		"tags":          map[string]interface{}{"Name": "PROD-web-1"},
+		"ebs_block_device": []interface{}{
+			map[string]interface{}{"device_name": "/dev/sdb", "volume_size": json.Number("10")},
+		},
+	}, web.Change.After)
+	assert.Equal(t, map[string]interface{}{
+		"ami":              true,
+		"tags":             map[string]interface{}{},
+		"ebs_block_device": []interface{}{map[string]interface{}{}},
+	}, web.Change.AfterUnknown)
+	assert.Equal(t, []string{"read"}, plan.ResourceChanges[2].Change.Actions)
+
+	bucket := plan.ResourceChanges[3]
+	assert.Equal(t, "module.bucket", bucket.ModuleAddress)
+	assert.Equal(t, map[string]interface{}{"bucket": "PROD-web-logs", "acl": "log-delivery-write"}, bucket.Change.After)
+	assert.Equal(t, map[string]interface{}{"arn": true}, bucket.Change.AfterUnknown)
+
+	require.Len(t, plan.PlannedValues.RootModule.ChildModules, 1)
+	assert.Equal(t, "module.bucket", plan.PlannedValues.RootModule.ChildModules[0].Address)
+	assert.Len(t, plan.PlannedValues.RootModule.Resources, 3)
+	assert.Contains(t, plan.Configuration.RootModule.ModuleCalls, "remote")
+	assert.Len(t, plan.Configuration.RootModule.ModuleCalls["bucket"].Module.Resources, 1)
+
+	_, err = decodeTerraformSource(map[string][]byte{"main.tf": []byte("resource {")})
+	assert.NotNil(t, err, "invalid hcl")
+	_, err = decodeTerraformSource(map[string][]byte{"README.md": []byte("# no terraform")})
+	assert.NotNil(t, err, "no .tf files")
+	_, err = readSourceArchive([]byte("not a tar.gz"))
+	assert.NotNil(t, err)
+
+	planJSON, err = decodeTerraformSource(map[string][]byte{"main.tf": []byte(`
+resource "aws_instance" "many" {
+  count = 100000000
+}
+resource "aws_s3_bucket" "many" {
+  for_each = {for i in range(2000) : "b${i}" => i}
+}`)})
+	require.Nil(t, err)
+	plan.ResourceChanges = nil
+	require.Nil(t, json.Unmarshal(planJSON, &plan))
+	addresses = nil
+	for _, change := range plan.ResourceChanges {
+		addresses = append(addresses, change.Address)
+	}
+	assert.Equal(t, []string{"aws_instance.many", "aws_s3_bucket.many"}, addresses, "too many instances, as unknown")
+
+	_, err = readSourceArchive(sourceArchive(t, map[string]string{"main.tf": strings.Repeat("#", tfsourceMaxFileSize+1)}))
+	assert.EqualError(t, err, fmt.Sprintf("'main.tf' is bigger than %d bytes", tfsourceMaxFileSize))
+	bigFiles := make(map[string]string)
+	for i := 0; i*tfsourceMaxFileSize <= tfsourceMaxArchiveSize; i++ {
+		bigFiles[fmt.Sprintf("%d.tf", i)] = strings.Repeat("#", tfsourceMaxFileSize)
+	}
+	_, err = readSourceArchive(sourceArchive(t, bigFiles))
+	assert.EqualError(t, err, fmt.Sprintf("the archive is bigger than %d bytes uncompressed", tfsourceMaxArchiveSize))
 }
 
 func TestTrimPreIndentationLevel(t *testing.T) {
@@ -299,6 +634,747 @@ const convertTFExpectedJson = `{
 }
 `
 
+// plan.out binary content as base64, of terraform 0.13 (a module, a data source read during
+// apply, and an alias provider)
+const decodeTF13PlanDataB64 = "UEsDBBQACAAIALiUUF0AAAAAAAAAAAAAAAAGAAkAdGZwbGFuVVQFAAH8btJq7FdPbxtFFB9nE7pagSgrqNqVENJeECh27bhKohwj" +
+	"JNRKXHKNotF45zkePLuzzM7GtaJIlANckSUO3No4SUPqVFBEL/Swh36ElZBAghsIPgWa3Xgd41CccKnU+jB+8+bNvn+/9/atadjX" +
+	"rNmA+GC/Yb3ee2q6kZIs2HT7HWg4D2ed1xRECkuIRCw9cA3B6Wo1lGKLUZDrroRNFinZrSiQkjSF9CtMXG+RqMU8IcPr+ra7ces3" +
+	"w5yzfzasn4xf0bUHJAx5F4OUQiaPPeGHsQKKm1L4WMInMZNAk+OCz1mkeod63SK8NiQWBoWAT8I7e23o1g62CI+h9qg4kUAoFgHv" +
+	"PsxOchUkZE8mJXBTSA9wAJ1/yI70RKB69yPIzDj5X/h+ExQWbQy3WaQi3CQ8gmSX0QPt+E3aZ4FK9rTJyQO9YtHU5iZ9vTz2SYhV" +
+	"iyjMhWhjztqgdSSHIlRMBITfPR5SuCEET74rtkObkh8nWCNHkh8mD30SfvqoYI9EBwVPW/ZtyEkQAC3u3T0cJqYvOB0MN5lwPwL1" +
+	"5dpsEHPuPDEnANOBxgUA88sl07D/NKzfpwWMxusLjpkMM/fIcwOae2SEmg40xlBzp9+G7n4WtQw/9l+G9cfLXJ8z143nJtcpQtMn" +
+	"e+3KtqsjieG2kgRHLea7K9s7O879GetVX9CYQ8VrMU6dt8aaCVbMBxErd4ZepKd8ZJbsm9aHnw88CUQBpsBJNxlQ4FDsdpl25ShL" +
+	"e845PFEaJYM4pKN7a9tnOjHvwkKj2ViqV8vgEVKu1WCxvNxcXi7Xb9QX6w1vybvhVd2VbTe3wl2pVYe/eTe3ZZyXaz3N29lxvi5d" +
+	"LjmXtWOYEkXwyev5ooGZsQ2rlNgfWKtf5BHYZ0EYqxShbzJCwyLHaYpQP2A8RehAxCqXOcopLZQi5Hw1MTXMZYleXTyvZRWhWiBv" +
+	"HRlmyd43rN1pG0SK0Hh/SBEa6wcpQmd0/BShZ1b+2FMi0E89q5enCOVB/H/VnfxncacIPev9nyJ09gSgvS8Opp4BTpf4QZbQ6uQg" +
+	"kPxbbVdf4uKFwUXtPLgoue9Yeki0r5ol+03LPvUNcjIQuYtW3kDsslmy37Pe7T19e91VccjBnV8ffrDMD4mNjV6KUIrQx+9bc1x4" +
+	"hNtXrSuf7YVEtZLjjpDtKCQeYMpk4lyi0CQxV/KVaqVWryz9PQBQSwcIq1DqPH0DAAAQDQAAUEsDBBQACAAIALiUUF0AAAAAAAAA" +
+	"AAAAAAAHAAkAdGZzdGF0ZVVUBQAB/G7SauxVzW7iMBC+8xTWnIGS/rAFqYc97gvspUWWQyZg4dhee0KLVrz7yiG/bUJZqeoetr4Q" +
+	"e2Y+z4y/+fg9Ygz26Lw0Gpbsdhz2hM6J1LiMNxaYTaOb6TcoHDw6KRQs2XWxVVKj2CAsGcyjaBFHi3hyc5vcTeI7vJ9E1/PFZHE7" +
+	"X6xns/Tmfj4/YZicbE4elizkwBjgCzlRb0NaQuUB9LGwh6VzpcadXblZVadAB9uNAcqtQqgcWAuOMfDkpN7AuOesdluVX6ff48kX" +
+	"njHuSxYIPf1I4HVCHdTjqMQBh97kbo2+zrlGzExSBGZCiw32IIabeAXQmLXIijijWjHWmb1M0MGy+X58Aocb6ckdpvWTT6W52gq/" +
+	"lWvj7FW44glWDY7UnoRu59vOOSzwJCgP9QAJqamVeVjg11vMRItZswo8LBBETsY5YcOMaoGwVh04OmdCHV0yhAVrk9mcMOGpMxl3" +
+	"+CuXDpN3fJX01GFMeVs43wsVwXjAct1QpMPB18lkwr6phTHY4SEKXSqYE3WxSpK9LcyhSLjR6lBHnmoVVsK7MTw1bo1c4/NfRHvs" +
+	"7Y7HgeZ4vKA3GyRudhxfpCfPU6E89r+STHpmqkxBauoPKl+0hyDBwk1aPkmPwzkDp60grozZcSV3WHamB8RYkkYXAgkwYOOxMep8" +
+	"OK/ofKFb53kvwa2YeRzI/2LAwa5ZJbTGpF3Jm460xrSjWa/Mw5eUDK1kuiXSJYR1ci8oMAxi/dPH3x8eGnoe+9T9w0Q4/EvUh58p" +
+	"wv9CZTvVljd9yeyXzH6CzAoY0qb/VmfFOaHtmdRKh6tsO9bTINXTcH6MPlSQR4ytRsfRnwEAUEsHCE/gyG51AgAAqQwAAFBLAwQU" +
+	"AAgACAC4lFBdAAAAAAAAAAAAAAAAEwAJAHRmY29uZmlnL20tL21haW4udGZVVAUAAfxu0mqEkdGq2zAMhu/9FMLsahcu7D5PUkpQ" +
+	"YpWYOXbm2GlHybsPyW7XntPDMRRqS/+vX18ypYTnmGa4KYBEf4pLZPslxc1ZSqs8A2RaM3TtArDGkkaCDvSE6+TGmJYDt2ip74p/" +
+	"u1J3F9BSFLnHgTwrZ3RBf9WF3uHKXTFPlPSzrr3sSm2YHA6eQAecqQotnbF4zqovNIh/ohZXUvT3q64dL3tzeuhgw2TY8pnIjAsD" +
+	"gN/0l8039IW0rBqX7GJA38T6u6l0zQnr3AcgPp1QNrKfAhhjCRna6eDX55jV6cdNOo0Llq67fpN5ZwpztIVRjZPztk5vAVtsc6gl" +
+	"gbhQsGsfA3RwfKFmLjSc2M9ixrYb/+0f69mhuruwFP4OdbARc+Msa2PJXPvPX2g2AA9UPOqD4Ande4k0HH+ejLNqV/8GAFBLBwhl" +
+	"rXjmPQEAAN0CAABQSwMEFAAIAAgAuJRQXQAAAAAAAAAAAAAAABgACQB0ZmNvbmZpZy9tLWNoaWxkL21haW4udGZVVAUAAfxu0mps" +
+	"jUGuhEAIRPd9igoH8J/Asxi1+ZFkDA4NbkzffYJxdrNgUfUeKWez+V9tx1UA43eIcZ0O01MqW7trwLk5xicATcNWxgja5rbJqnb8" +
+	"pUI37yWvl2L8iJRw+sbJZWcNJ1BdCFeqGn6Eg6RmAZzzK3Lg5+NQl0Fq6eUzAFBLBwicM9lpegAAAL4AAABQSwMEFAAIAAgAuJRQ" +
+	"XQAAAAAAAAAAAAAAABUACQB0ZmNvbmZpZy9tb2R1bGVzLmpzb25VVAUAAfxu0moAcgCN/1sKICB7CiAgICAiS2V5IjogIiIsCiAg" +
+	"ICAiRGlyIjogIi4iCiAgfSwKICB7CiAgICAiS2V5IjogImNoaWxkIiwKICAgICJTb3VyY2UiOiAiLi9jaGlsZCIsCiAgICAiRGly" +
+	"IjogImNoaWxkIgogIH0KXQMAUEsHCPUQ+eN5AAAAcgAAAFBLAQIUABQACAAIALiUUF2rUOo8fQMAABANAAAGAAkAAAAAAAAAAAAA" +
+	"AAAAAAB0ZnBsYW5VVAUAAfxu0mpQSwECFAAUAAgACAC4lFBdT+DIbnUCAACpDAAABwAJAAAAAAAAAAAAAAC6AwAAdGZzdGF0ZVVU" +
+	"BQAB/G7SalBLAQIUABQACAAIALiUUF1lrXjmPQEAAN0CAAATAAkAAAAAAAAAAAAAAG0GAAB0ZmNvbmZpZy9tLS9tYWluLnRmVVQF" +
+	"AAH8btJqUEsBAhQAFAAIAAgAuJRQXZwz2Wl6AAAAvgAAABgACQAAAAAAAAAAAAAA9AcAAHRmY29uZmlnL20tY2hpbGQvbWFpbi50" +
+	"ZlVUBQAB/G7SalBLAQIUABQACAAIALiUUF31EPnjeQAAAHIAAAAVAAkAAAAAAAAAAAAAAL0IAAB0ZmNvbmZpZy9tb2R1bGVzLmpz" +
+	"b25VVAUAAfxu0mpQSwUGAAAAAAUABQBgAQAAggkAAAAA"
+
+// the 0.13 plan.out output prettified
+const decodeTF13ExpectedJson = `{
+	"format_version": "0.1",
+	"terraform_version": "0.13.7",
+	"variables": {
+		"name": {
+			"value": "web"
+		}
+	},
+	"planned_values": {
+		"outputs": {
+			"extra": {
+				"sensitive": false
+			},
+			"web": {
+				"sensitive": false,
+				"value": "testId"
+			}
+		},
+		"root_module": {
+			"resources": [
+				{
+					"address": "data.test_data_source.db",
+					"mode": "data",
+					"type": "test_data_source",
+					"name": "db",
+					"provider_name": "registry.terraform.io/hashicorp/test",
+					"schema_version": 0,
+					"values": {
+						"input_map": null
+					}
+				},
+				{
+					"address": "test_resource.extra[0]",
+					"mode": "managed",
+					"type": "test_resource",
+					"name": "extra",
+					"index": 0,
+					"provider_name": "registry.terraform.io/hashicorp/test",
+					"schema_version": 0,
+					"values": {
+						"apply_error": null,
+						"int": null,
+						"list": null,
+						"list_of_map": null,
+						"map": null,
+						"map_that_look_like_set": null,
+						"optional": null,
+						"optional_bool": null,
+						"optional_force_new": null,
+						"optional_map": null,
+						"required": "extra0",
+						"required_map": null,
+						"set": null
+					}
+				},
+				{
+					"address": "test_resource.extra[1]",
+					"mode": "managed",
+					"type": "test_resource",
+					"name": "extra",
+					"index": 1,
+					"provider_name": "registry.terraform.io/hashicorp/test",
+					"schema_version": 0,
+					"values": {
+						"apply_error": null,
+						"int": null,
+						"list": null,
+						"list_of_map": null,
+						"map": null,
+						"map_that_look_like_set": null,
+						"optional": null,
+						"optional_bool": null,
+						"optional_force_new": null,
+						"optional_map": null,
+						"required": "extra1",
+						"required_map": null,
+						"set": null
+					}
+				},
+				{
+					"address": "test_resource.web",
+					"mode": "managed",
+					"type": "test_resource",
+					"name": "web",
+					"provider_name": "registry.terraform.io/hashicorp/test",
+					"schema_version": 0,
+					"values": {
+						"apply_error": null,
+						"computed_from_required": "web",
+						"computed_list": [
+							"listval1",
+							"listval2"
+						],
+						"computed_map": {
+							"key1": "value1"
+						},
+						"computed_read_only": "value_from_api",
+						"computed_read_only_force_new": "value_from_api",
+						"computed_set": [
+							"setval1",
+							"setval2"
+						],
+						"get_ok_exists_false": null,
+						"id": "testId",
+						"int": null,
+						"list": null,
+						"list_of_map": null,
+						"map": null,
+						"map_that_look_like_set": null,
+						"optional": "b",
+						"optional_bool": null,
+						"optional_computed": null,
+						"optional_computed_force_new": null,
+						"optional_computed_map": {},
+						"optional_force_new": null,
+						"optional_map": null,
+						"required": "web",
+						"required_map": {
+							"key": "value"
+						},
+						"set": []
+					}
+				}
+			],
+			"child_modules": [
+				{
+					"resources": [
+						{
+							"address": "module.child.test_resource_timeout.db",
+							"mode": "managed",
+							"type": "test_resource_timeout",
+							"name": "db",
+							"provider_name": "registry.terraform.io/hashicorp/test",
+							"schema_version": 1,
+							"values": {
+								"create_delay": null,
+								"delete_delay": null,
+								"read_delay": null,
+								"timeouts": null,
+								"update_delay": null
+							}
+						}
+					],
+					"address": "module.child"
+				}
+			]
+		}
+	},
+	"resource_changes": [
+		{
+			"address": "data.test_data_source.db",
+			"mode": "data",
+			"type": "test_data_source",
+			"name": "db",
+			"provider_name": "registry.terraform.io/hashicorp/test",
+			"change": {
+				"actions": [
+					"read"
+				],
+				"before": null,
+				"after": {
+					"input_map": null
+				},
+				"after_unknown": {
+					"id": true,
+					"input": true,
+					"list": true,
+					"nil": true,
+					"output": true,
+					"output_map": true
+				}
+			}
+		},
+		{
+			"address": "module.child.test_resource_timeout.db",
+			"module_address": "module.child",
+			"mode": "managed",
+			"type": "test_resource_timeout",
+			"name": "db",
+			"provider_name": "registry.terraform.io/hashicorp/test",
+			"change": {
+				"actions": [
+					"create"
+				],
+				"before": null,
+				"after": {
+					"create_delay": null,
+					"delete_delay": null,
+					"read_delay": null,
+					"timeouts": null,
+					"update_delay": null
+				},
+				"after_unknown": {
+					"id": true
+				}
+			}
+		},
+		{
+			"address": "test_resource.extra[0]",
+			"mode": "managed",
+			"type": "test_resource",
+			"name": "extra",
+			"index": 0,
+			"provider_name": "registry.terraform.io/hashicorp/test",
+			"change": {
+				"actions": [
+					"create"
+				],
+				"before": null,
+				"after": {
+					"apply_error": null,
+					"int": null,
+					"list": null,
+					"list_of_map": null,
+					"map": null,
+					"map_that_look_like_set": null,
+					"optional": null,
+					"optional_bool": null,
+					"optional_force_new": null,
+					"optional_map": null,
+					"required": "extra0",
+					"required_map": null,
+					"set": null
+				},
+				"after_unknown": {
+					"computed_from_required": true,
+					"computed_list": true,
+					"computed_map": true,
+					"computed_read_only": true,
+					"computed_read_only_force_new": true,
+					"computed_set": true,
+					"get_ok_exists_false": true,
+					"id": true,
+					"optional_computed": true,
+					"optional_computed_force_new": true,
+					"optional_computed_map": true,
+					"planned_computed": true
+				}
+			}
+		},
+		{
+			"address": "test_resource.extra[1]",
+			"mode": "managed",
+			"type": "test_resource",
+			"name": "extra",
+			"index": 1,
+			"provider_name": "registry.terraform.io/hashicorp/test",
+			"change": {
+				"actions": [
+					"create"
+				],
+				"before": null,
+				"after": {
+					"apply_error": null,
+					"int": null,
+					"list": null,
+					"list_of_map": null,
+					"map": null,
+					"map_that_look_like_set": null,
+					"optional": null,
+					"optional_bool": null,
+					"optional_force_new": null,
+					"optional_map": null,
+					"required": "extra1",
+					"required_map": null,
+					"set": null
+				},
+				"after_unknown": {
+					"computed_from_required": true,
+					"computed_list": true,
+					"computed_map": true,
+					"computed_read_only": true,
+					"computed_read_only_force_new": true,
+					"computed_set": true,
+					"get_ok_exists_false": true,
+					"id": true,
+					"optional_computed": true,
+					"optional_computed_force_new": true,
+					"optional_computed_map": true,
+					"planned_computed": true
+				}
+			}
+		},
+		{
+			"address": "test_resource.old",
+			"mode": "managed",
+			"type": "test_resource",
+			"name": "old",
+			"provider_name": "registry.terraform.io/hashicorp/test",
+			"change": {
+				"actions": [
+					"delete"
+				],
+				"before": {
+					"apply_error": null,
+					"computed_from_required": null,
+					"computed_list": [
+						"listval1",
+						"listval2"
+					],
+					"computed_map": {
+						"key1": "value1"
+					},
+					"computed_read_only": "value_from_api",
+					"computed_read_only_force_new": "value_from_api",
+					"computed_set": [
+						"setval1",
+						"setval2"
+					],
+					"get_ok_exists_false": null,
+					"id": "testId",
+					"int": null,
+					"list": null,
+					"list_of_map": null,
+					"map": null,
+					"map_that_look_like_set": null,
+					"optional": "",
+					"optional_bool": null,
+					"optional_computed": null,
+					"optional_computed_force_new": null,
+					"optional_computed_map": {},
+					"optional_force_new": null,
+					"optional_map": null,
+					"planned_computed": "",
+					"required": "old",
+					"required_map": null,
+					"set": []
+				},
+				"after": null,
+				"after_unknown": {}
+			}
+		},
+		{
+			"address": "test_resource.web",
+			"mode": "managed",
+			"type": "test_resource",
+			"name": "web",
+			"provider_name": "registry.terraform.io/hashicorp/test",
+			"change": {
+				"actions": [
+					"update"
+				],
+				"before": {
+					"apply_error": null,
+					"computed_from_required": "web",
+					"computed_list": [
+						"listval1",
+						"listval2"
+					],
+					"computed_map": {
+						"key1": "value1"
+					},
+					"computed_read_only": "value_from_api",
+					"computed_read_only_force_new": "value_from_api",
+					"computed_set": [
+						"setval1",
+						"setval2"
+					],
+					"get_ok_exists_false": null,
+					"id": "testId",
+					"int": null,
+					"list": null,
+					"list_of_map": null,
+					"map": null,
+					"map_that_look_like_set": null,
+					"optional": "a",
+					"optional_bool": null,
+					"optional_computed": null,
+					"optional_computed_force_new": null,
+					"optional_computed_map": {},
+					"optional_force_new": null,
+					"optional_map": null,
+					"planned_computed": "a",
+					"required": "web",
+					"required_map": {
+						"key": "value"
+					},
+					"set": []
+				},
+				"after": {
+					"apply_error": null,
+					"computed_from_required": "web",
+					"computed_list": [
+						"listval1",
+						"listval2"
+					],
+					"computed_map": {
+						"key1": "value1"
+					},
+					"computed_read_only": "value_from_api",
+					"computed_read_only_force_new": "value_from_api",
+					"computed_set": [
+						"setval1",
+						"setval2"
+					],
+					"get_ok_exists_false": null,
+					"id": "testId",
+					"int": null,
+					"list": null,
+					"list_of_map": null,
+					"map": null,
+					"map_that_look_like_set": null,
+					"optional": "b",
+					"optional_bool": null,
+					"optional_computed": null,
+					"optional_computed_force_new": null,
+					"optional_computed_map": {},
+					"optional_force_new": null,
+					"optional_map": null,
+					"required": "web",
+					"required_map": {
+						"key": "value"
+					},
+					"set": []
+				},
+				"after_unknown": {
+					"computed_list": [
+						false,
+						false
+					],
+					"computed_map": {},
+					"computed_set": [
+						false,
+						false
+					],
+					"optional_computed_map": {},
+					"planned_computed": true,
+					"required_map": {},
+					"set": []
+				}
+			}
+		}
+	],
+	"output_changes": {
+		"extra": {
+			"actions": [
+				"create"
+			],
+			"before": null,
+			"after_unknown": true
+		},
+		"web": {
+			"actions": [
+				"create"
+			],
+			"before": null,
+			"after": "testId",
+			"after_unknown": false
+		}
+	},
+	"prior_state": {
+		"format_version": "0.1",
+		"terraform_version": "0.13.7",
+		"values": {
+			"outputs": {
+				"extra": {
+					"sensitive": false,
+					"value": [
+						null,
+						null
+					]
+				},
+				"web": {
+					"sensitive": false,
+					"value": "testId"
+				}
+			},
+			"root_module": {
+				"resources": [
+					{
+						"address": "test_resource.old",
+						"mode": "managed",
+						"type": "test_resource",
+						"name": "old",
+						"provider_name": "registry.terraform.io/hashicorp/test",
+						"schema_version": 0,
+						"values": {
+							"apply_error": null,
+							"computed_from_required": null,
+							"computed_list": [
+								"listval1",
+								"listval2"
+							],
+							"computed_map": {
+								"key1": "value1"
+							},
+							"computed_read_only": "value_from_api",
+							"computed_read_only_force_new": "value_from_api",
+							"computed_set": [
+								"setval1",
+								"setval2"
+							],
+							"get_ok_exists_false": null,
+							"id": "testId",
+							"int": null,
+							"list": null,
+							"list_of_map": null,
+							"map": null,
+							"map_that_look_like_set": null,
+							"optional": "",
+							"optional_bool": null,
+							"optional_computed": null,
+							"optional_computed_force_new": null,
+							"optional_computed_map": {},
+							"optional_force_new": null,
+							"optional_map": null,
+							"planned_computed": "",
+							"required": "old",
+							"required_map": null,
+							"set": []
+						},
+						"tainted": true
+					},
+					{
+						"address": "test_resource.web",
+						"mode": "managed",
+						"type": "test_resource",
+						"name": "web",
+						"provider_name": "registry.terraform.io/hashicorp/test",
+						"schema_version": 0,
+						"values": {
+							"apply_error": null,
+							"computed_from_required": "web",
+							"computed_list": [
+								"listval1",
+								"listval2"
+							],
+							"computed_map": {
+								"key1": "value1"
+							},
+							"computed_read_only": "value_from_api",
+							"computed_read_only_force_new": "value_from_api",
+							"computed_set": [
+								"setval1",
+								"setval2"
+							],
+							"get_ok_exists_false": null,
+							"id": "testId",
+							"int": null,
+							"list": null,
+							"list_of_map": null,
+							"map": null,
+							"map_that_look_like_set": null,
+							"optional": "a",
+							"optional_bool": null,
+							"optional_computed": null,
+							"optional_computed_force_new": null,
+							"optional_computed_map": {},
+							"optional_force_new": null,
+							"optional_map": null,
+							"planned_computed": "a",
+							"required": "web",
+							"required_map": {
+								"key": "value"
+							},
+							"set": []
+						}
+					}
+				]
+			}
+		}
+	},
+	"configuration": {
+		"provider_config": {
+			"test": {
+				"name": "test",
+				"expressions": {
+					"label": {
+						"constant_value": "main"
+					}
+				}
+			},
+			"test.other": {
+				"name": "test",
+				"alias": "other",
+				"expressions": {
+					"label": {
+						"constant_value": "other"
+					}
+				}
+			}
+		},
+		"root_module": {
+			"outputs": {
+				"extra": {
+					"expression": {
+						"references": [
+							"test_resource.extra"
+						]
+					}
+				},
+				"web": {
+					"expression": {
+						"references": [
+							"test_resource.web"
+						]
+					}
+				}
+			},
+			"resources": [
+				{
+					"address": "test_resource.extra",
+					"mode": "managed",
+					"type": "test_resource",
+					"name": "extra",
+					"provider_config_key": "test.other",
+					"expressions": {
+						"required": {
+							"references": [
+								"count.index"
+							]
+						},
+						"required_map": {
+							"constant_value": {}
+						}
+					},
+					"schema_version": 0,
+					"count_expression": {
+						"constant_value": 2
+					}
+				},
+				{
+					"address": "test_resource.web",
+					"mode": "managed",
+					"type": "test_resource",
+					"name": "web",
+					"provider_config_key": "test",
+					"expressions": {
+						"optional": {
+							"constant_value": "b"
+						},
+						"required": {
+							"references": [
+								"var.name"
+							]
+						},
+						"required_map": {
+							"constant_value": {
+								"key": "value"
+							}
+						}
+					},
+					"schema_version": 0
+				},
+				{
+					"address": "data.test_data_source.db",
+					"mode": "data",
+					"type": "test_data_source",
+					"name": "db",
+					"provider_config_key": "test",
+					"expressions": {
+						"input": {
+							"references": [
+								"module.child.id"
+							]
+						}
+					},
+					"schema_version": 0
+				}
+			],
+			"module_calls": {
+				"child": {
+					"source": "./child",
+					"module": {
+						"outputs": {
+							"id": {
+								"expression": {
+									"references": [
+										"test_resource_timeout.db"
+									]
+								}
+							}
+						},
+						"resources": [
+							{
+								"address": "test_resource_timeout.db",
+								"mode": "managed",
+								"type": "test_resource_timeout",
+								"name": "db",
+								"provider_config_key": "child:test",
+								"schema_version": 1
+							}
+						]
+					},
+					"depends_on": [
+						"test_resource.web"
+					]
+				}
+			},
+			"variables": {
+				"name": {
+					"default": "web"
+				}
+			}
+		}
+	}
+}
+`
+
 const resumeDiffGiven = `{
 	"format_version": "0.1",
 	"terraform_version": "0.12.6",
@@ -443,3 +1519,13 @@ const resumeDiffExpected = `{
 		}
 	}
 }`
+
+func TestParseTFStateVersion(t *testing.T) {
+	serial, lineage, err := parseTFStateVersion([]byte(`{"version": 4, "serial": 12, "lineage": "a-b-c", "resources": []}`))
+	require.Nil(t, err)
+	assert.Equal(t, int64(12), serial)
+	assert.Equal(t, "a-b-c", lineage)
+
+	_, _, err = parseTFStateVersion([]byte("not json"))
+	assert.NotNil(t, err)
+}
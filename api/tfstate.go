@@ -1,16 +1,12 @@
 package main
 
-import (
-	"github.com/aws/aws-sdk-go/service/dynamodb"
-	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
-	"github.com/aws/aws-sdk-go/service/dynamodb/expression"
-)
-
 // TFState defines a remote TF state that must be checked
 // for compliance periodically.
 type TFState struct {
 	Id                 string
 	Timestamp          int64
+	Version            int64            // increased on every save, to detect concurrent updates
+	SchemaVersion      int              // the schema version of this item (see migrations.go)
 	Account            string           // to categorize states
 	Bucket, Path       string           // s3 bucket and item
 	State              string           // the current state (in json)
@@ -19,6 +15,8 @@ type TFState struct {
 	S3LastModification string           // the s3 item last modification (to avoid pulling the state when it doesn't change)
 	ForceValidation    bool             // if this state should be forcibly validated (omit change checks and doesn't wait)
 	Tags               []string         // to specify by which features this state should be checked
+	ForceValidationKey string           `dynamodbav:",omitempty" json:",omitempty"` // "true" when ForceValidation, to index flagged states (bools can't be indexed)
+	StateBlob          string           `dynamodbav:",omitempty" json:",omitempty"` // blob store reference to State, when it's too big to keep it inline
 }
 
 func newTFState(account string, bucket string, path string, tags []string) *TFState {
@@ -43,6 +41,10 @@ func (state *TFState) timestamp() int64 {
 	return state.Timestamp
 }
 
+func (state *TFState) version() int64 {
+	return state.Version
+}
+
 func (state *TFState) writeBasic(dst map[string]interface{}) {
 	dst["account"] = state.Account
 	dst["path"] = state.Path
@@ -62,41 +64,46 @@ func (state *TFState) writeDetailed(dst map[string]interface{}) {
 
 const tfStateTable = "tfstates"
 
+// tfStateForceValidationIndex indexes only the states flagged with ForceValidation.
+var tfStateForceValidationIndex = tableIndex{name: "ForceValidationKey-index", hashKey: "ForceValidationKey"}
+
 func (db *database) findTFStateById(id string) (*TFState, error) {
-	var result *TFState = nil
-	err := db.loadGeneric(
+	var elem TFState
+	found, err := db.getGeneric(
 		db.tableFor(tfStateTable),
+		id,
 		[]string{ // all attributes here
-			"Account", "Bucket", "Path", "State", "ComplianceResult",
+			"Account", "Bucket", "Path", "State", "StateBlob", "ComplianceResult",
 			"LastUpdate", "S3LastModification", "ForceValidation", "Tags",
 		},
-		true,
-		expression.Name("Id").Equal(expression.Value(id)),
-		func(i map[string]*dynamodb.AttributeValue) error {
-			var elem TFState
-			err := dynamodbattribute.UnmarshalMap(i, &elem)
-			if err == nil {
-				result = &elem
-			}
-			return err
-		})
+		&elem)
+	if err != nil || !found {
+		return nil, err
+	}
 
-	return result, err
+	if elem.State, err = db.loadDocument(elem.StateBlob, elem.State); err != nil {
+		return nil, err
+	}
+	return &elem, nil
 }
 
 func (db *database) loadTFStatesWithForceValidation() ([]*TFState, error) {
 	var result []*TFState
-	err := db.loadGeneric(
+	_, err := db.queryGenericPage(
 		db.tableFor(tfStateTable),
-		[]string{ // all attributes except the state, which is kind of big
-			"Account", "Bucket", "Path", "State", "ComplianceResult",
+		indexQuery{index: tfStateForceValidationIndex, hashValue: "true"},
+		[]string{ // all attributes here
+			"Account", "Bucket", "Path", "State", "StateBlob", "ComplianceResult",
 			"LastUpdate", "S3LastModification", "ForceValidation", "Tags",
 		},
-		true,
-		expression.Name("ForceValidation").Equal(expression.Value(true)),
-		func(i map[string]*dynamodb.AttributeValue) error {
+		0,
+		"",
+		func(decode itemDecoder) error {
 			var elem TFState
-			err := dynamodbattribute.UnmarshalMap(i, &elem)
+			err := decode(&elem)
+			if err == nil {
+				elem.State, err = db.loadDocument(elem.StateBlob, elem.State)
+			}
 			if err == nil {
 				result = append(result, &elem)
 			}
@@ -107,40 +114,49 @@ func (db *database) loadTFStatesWithForceValidation() ([]*TFState, error) {
 }
 
 func (db *database) loadAllTFStatesMinimal() ([]*TFState, error) {
+	result, _, err := db.loadTFStatesMinimalPage(0, "")
+	return result, err
+}
+
+// loadTFStatesMinimalPage loads up to limit items (all if 0) starting from the given cursor.
+func (db *database) loadTFStatesMinimalPage(limit int, cursor string) ([]*TFState, string, error) {
 	var result []*TFState
-	err := db.loadGeneric(
+	nextCursor, err := db.loadGenericPage(
 		db.tableFor(tfStateTable),
 		[]string{ // all attributes except the state, which is kind of big
 			"Account", "Bucket", "Path", "ComplianceResult",
 			"LastUpdate", "S3LastModification", "ForceValidation", "Tags",
 		},
-		false,
-		expression.ConditionBuilder{},
-		func(i map[string]*dynamodb.AttributeValue) error {
+		nil,
+		limit,
+		cursor,
+		func(decode itemDecoder) error {
 			var elem TFState
-			err := dynamodbattribute.UnmarshalMap(i, &elem)
+			err := decode(&elem)
 			if err == nil {
 				result = append(result, &elem)
 			}
 			return err
 		})
 
-	return result, err
+	return result, nextCursor, err
 }
 
 func (db *database) loadAllTFStatesFull() ([]*TFState, error) {
 	var result []*TFState
 	err := db.loadGeneric(
 		db.tableFor(tfStateTable),
-		[]string{ // all attributes except the state, which is kind of big
-			"Account", "Bucket", "Path", "State", "ComplianceResult",
+		[]string{ // all attributes here
+			"Account", "Bucket", "Path", "State", "StateBlob", "ComplianceResult",
 			"LastUpdate", "S3LastModification", "ForceValidation", "Tags",
 		},
-		false,
-		expression.ConditionBuilder{},
-		func(i map[string]*dynamodb.AttributeValue) error {
+		nil,
+		func(decode itemDecoder) error {
 			var elem TFState
-			err := dynamodbattribute.UnmarshalMap(i, &elem)
+			err := decode(&elem)
+			if err == nil {
+				elem.State, err = db.loadDocument(elem.StateBlob, elem.State)
+			}
 			if err == nil {
 				result = append(result, &elem)
 			}
@@ -151,9 +167,56 @@ func (db *database) loadAllTFStatesFull() ([]*TFState, error) {
 }
 
 func (db *database) saveTFState(element *TFState) error {
-	return db.insertOrUpdateGeneric(db.tableFor(tfStateTable), element)
+	element.SchemaVersion = latestSchemaVersion(tfStateTable)
+	element.ForceValidationKey = ""
+	if element.ForceValidation {
+		element.ForceValidationKey = "true"
+	}
+
+	// the state may be offloaded, so store a copy to keep element untouched.
+	stored := *element
+	var err error
+	if stored.StateBlob, stored.State, err = db.offloadDocument(element.State); err != nil {
+		return err
+	}
+	if err := db.insertOrUpdateGeneric(db.tableFor(tfStateTable), &stored, &stored.Version); err != nil {
+		return err
+	}
+	element.Version = stored.Version
+	return nil
+}
+
+// tfStateUpdateRetries is how many times updateTFState retries on conflicts.
+const tfStateUpdateRetries = 5
+
+// updateTFState applies update to the given state and saves it. If the state
+// was concurrently updated, reloads it (into state) and tries again. update
+// may return false to skip saving, for example if the reloaded state changed
+// in a way that the update doesn't apply anymore.
+func (db *database) updateTFState(state *TFState, update func(*TFState) bool) error {
+	for retry := 0; ; retry++ {
+		if !update(state) {
+			return nil
+		}
+
+		err := db.saveTFState(state)
+		if err != errConflict || retry >= tfStateUpdateRetries {
+			return err
+		}
+
+		latest, err := db.findTFStateById(state.Id)
+		if err != nil {
+			return err
+		}
+		if latest == nil {
+			return nil // removed meanwhile
+		}
+		*state = *latest
+	}
 }
 
+// removeTFState removes the given state. Its revisions are kept, so it can still be
+// known how the state was at a given time.
 func (db *database) removeTFState(id string) error {
 	return db.removeGeneric(db.tableFor(tfStateTable), id)
 }
@@ -0,0 +1,168 @@
+package main
+
+// TFStateRevision stores a checked version of a TFState, to
+// know how it was (and if it was compliant) at any time.
+type TFStateRevision struct {
+	Id                 string
+	Timestamp          int64            // when this revision was checked
+	Version            int64            // increased on every save, to detect concurrent updates
+	SchemaVersion      int              // the schema version of this item (see migrations.go)
+	TFStateId          string           // the TFState this revision belongs to
+	S3LastModification string           // the s3 item last modification
+	Serial             int64            // the tfstate serial
+	Lineage            string           // the tfstate lineage
+	State              string           // the state (in json)
+	ComplianceResult   ComplianceResult // the result for the compliance tool
+	LogId              string           // the log registered when checked
+	StateBlob          string           `dynamodbav:",omitempty" json:",omitempty"` // blob store reference to State, when it's too big to keep it inline
+}
+
+func newTFStateRevision(
+	tfStateId string,
+	s3LastModification string,
+	serial int64,
+	lineage string,
+	state string,
+	complianceResult ComplianceResult,
+	logId string,
+) *TFStateRevision {
+	return &TFStateRevision{
+		Id:                 generateId(),
+		Timestamp:          generateTimestamp(),
+		TFStateId:          tfStateId,
+		S3LastModification: s3LastModification,
+		Serial:             serial,
+		Lineage:            lineage,
+		State:              state,
+		ComplianceResult:   complianceResult,
+		LogId:              logId,
+	}
+}
+
+// restObject methods
+
+func (r *TFStateRevision) id() string {
+	return r.Id
+}
+
+func (r *TFStateRevision) timestamp() int64 {
+	return r.Timestamp
+}
+
+func (r *TFStateRevision) version() int64 {
+	return r.Version
+}
+
+func (r *TFStateRevision) writeBasic(dst map[string]interface{}) {
+	dst["tfstate_id"] = r.TFStateId
+	dst["s3_last_modification"] = r.S3LastModification
+	dst["serial"] = r.Serial
+	dst["lineage"] = r.Lineage
+	dst["compliance_result"] = r.ComplianceResult
+	dst["log_id"] = r.LogId
+}
+
+func (r *TFStateRevision) writeDetailed(dst map[string]interface{}) {
+	r.writeBasic(dst)
+	dst["state"] = r.State
+}
+
+// database methods
+
+const tfStateRevisionTable = "tfstate_revisions"
+
+var tfStateRevisionIndex = tableIndex{name: "TFStateId-Timestamp-index", hashKey: "TFStateId", rangeKey: "Timestamp"}
+
+// loadTFStateRevisionsMinimalPage loads up to limit revisions (all if 0) of the
+// given tfstate starting from the given cursor, newest first.
+func (db *database) loadTFStateRevisionsMinimalPage(tfStateId string, limit int, cursor string) ([]*TFStateRevision, string, error) {
+	var result []*TFStateRevision
+	nextCursor, err := db.queryGenericPage(
+		db.tableFor(tfStateRevisionTable),
+		indexQuery{index: tfStateRevisionIndex, hashValue: tfStateId},
+		[]string{ // all attributes except the state, which is kind of big
+			"TFStateId", "S3LastModification", "Serial", "Lineage", "ComplianceResult", "LogId",
+		},
+		limit,
+		cursor,
+		func(decode itemDecoder) error {
+			var elem TFStateRevision
+			err := decode(&elem)
+			if err == nil {
+				result = append(result, &elem)
+			}
+			return err
+		})
+
+	return result, nextCursor, err
+}
+
+// findTFStateRevisionAt returns the revision of the given tfstate that was
+// current at the given timestamp, or nil if the state wasn't checked yet.
+func (db *database) findTFStateRevisionAt(tfStateId string, timestamp int64) (*TFStateRevision, error) {
+	var result *TFStateRevision
+	_, err := db.queryGenericPage(
+		db.tableFor(tfStateRevisionTable),
+		indexQuery{index: tfStateRevisionIndex, hashValue: tfStateId, rangeBefore: timestamp + 1},
+		[]string{ // all attributes here
+			"TFStateId", "S3LastModification", "Serial", "Lineage", "State", "StateBlob", "ComplianceResult", "LogId",
+		},
+		1,
+		"",
+		func(decode itemDecoder) error {
+			var elem TFStateRevision
+			err := decode(&elem)
+			if err == nil {
+				elem.State, err = db.loadDocument(elem.StateBlob, elem.State)
+			}
+			if err == nil {
+				result = &elem
+			}
+			return err
+		})
+
+	return result, err
+}
+
+func (db *database) loadAllTFStateRevisionsFull() ([]*TFStateRevision, error) {
+	var result []*TFStateRevision
+	err := db.loadGeneric(
+		db.tableFor(tfStateRevisionTable),
+		[]string{ // all attributes here
+			"TFStateId", "S3LastModification", "Serial", "Lineage", "State", "StateBlob", "ComplianceResult", "LogId",
+		},
+		nil,
+		func(decode itemDecoder) error {
+			var elem TFStateRevision
+			err := decode(&elem)
+			if err == nil {
+				elem.State, err = db.loadDocument(elem.StateBlob, elem.State)
+			}
+			if err == nil {
+				result = append(result, &elem)
+			}
+			return err
+		})
+
+	return result, err
+}
+
+func (db *database) saveTFStateRevision(element *TFStateRevision) error {
+	element.SchemaVersion = latestSchemaVersion(tfStateRevisionTable)
+
+	// the state may be offloaded, so store a copy to keep element untouched.
+	stored := *element
+	var err error
+	if stored.StateBlob, stored.State, err = db.offloadDocument(element.State); err != nil {
+		return err
+	}
+	if err := db.insertOrUpdateGeneric(db.tableFor(tfStateRevisionTable), &stored, &stored.Version); err != nil {
+		return err
+	}
+	element.Version = stored.Version
+	return nil
+}
+
+func (db *database) removeTFStateRevision(id string) error {
+	return db.removeGeneric(db.tableFor(tfStateRevisionTable), id)
+}
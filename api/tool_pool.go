@@ -0,0 +1,59 @@
+// This file contains the pool that bounds the executions of the external tools
+// (terraform and terraform-compliance), which are shared by the API requests
+// and the monitoring, so many concurrent validations can't exhaust the host.
+
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+)
+
+// errToolPoolSaturated is returned when there are too many tool executions queued.
+// The REST endpoints respond it with 503 Service Unavailable.
+var errToolPoolSaturated = errors.New("too many validations in progress, try again later")
+
+// toolPool runs up to a number of executions at a time. The rest wait in a bounded queue.
+type toolPool struct {
+	workers chan struct{} // a token per running execution
+	queue   chan struct{} // a token per running or waiting execution
+}
+
+func newToolPool(workers int, queueSize int) *toolPool {
+	return &toolPool{
+		workers: make(chan struct{}, workers),
+		queue:   make(chan struct{}, workers+queueSize),
+	}
+}
+
+// toolWorkers is the pool of the tool executions. Replaced in main according to the flags.
+var toolWorkers = newToolPool(4, 16)
+
+// run runs fn when there's a free worker. If the queue is full, returns
+// errToolPoolSaturated instead, without waiting.
+func (p *toolPool) run(fn func() error) error {
+	select {
+	case p.queue <- struct{}{}:
+	default:
+		return errToolPoolSaturated
+	}
+	defer func() { <-p.queue }()
+
+	p.workers <- struct{}{}
+	defer func() { <-p.workers }()
+	return fn()
+}
+
+// runInWorkspace runs fn in the pool with a new temporary directory, removed afterwards,
+// so concurrent executions don't overwrite the files of each other.
+func (p *toolPool) runInWorkspace(fn func(dir string) error) error {
+	return p.run(func() error {
+		dir, err := ioutil.TempDir("", "tfvalidator")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		return fn(dir)
+	})
+}
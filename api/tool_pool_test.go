@@ -0,0 +1,66 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestToolPool(t *testing.T) {
+	pool := newToolPool(2, 1)
+
+	// two running and one waiting fill the pool
+	release := make(chan struct{})
+	started := make(chan struct{}, 3)
+	var running, maxRunning int32
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.Nil(t, pool.run(func() error {
+				n := atomic.AddInt32(&running, 1)
+				for {
+					max := atomic.LoadInt32(&maxRunning)
+					if n <= max || atomic.CompareAndSwapInt32(&maxRunning, max, n) {
+						break
+					}
+				}
+				started <- struct{}{}
+				<-release
+				atomic.AddInt32(&running, -1)
+				return nil
+			}))
+		}()
+	}
+	<-started
+	<-started
+	for len(pool.queue) < 3 { // wait for the third one to be queued
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal(t, errToolPoolSaturated, pool.run(func() error { return nil }), "queue full")
+
+	close(release)
+	wg.Wait()
+	assert.Equal(t, int32(2), maxRunning, "no more than the workers at a time")
+	assert.Nil(t, pool.run(func() error { return nil }), "free again")
+
+	// each execution gets its own workspace, removed afterwards
+	var dirs [2]string
+	require.Nil(t, pool.runInWorkspace(func(dir string) error {
+		dirs[0] = dir
+		return pool.runInWorkspace(func(dir string) error {
+			dirs[1] = dir
+			return nil
+		})
+	}))
+	assert.NotEqual(t, dirs[0], dirs[1])
+	for _, dir := range dirs {
+		_, err := os.Stat(dir)
+		assert.True(t, os.IsNotExist(err), "%s not removed", dir)
+	}
+}
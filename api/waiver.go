@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path"
+	"time"
+)
+
+// Waiver is a time-boxed exception to a feature: the failures of the feature
+// for the matching resources are waived instead of failing.
+type Waiver struct {
+	Id              string
+	Timestamp       int64
+	Version         int64  // increased on every save, to detect concurrent updates
+	SchemaVersion   int    // the schema version of this item (see migrations.go)
+	FeatureName     string // the waived feature
+	ResourcePattern string // the waived resource addresses, as a glob (like "aws_s3_bucket.public_*", or "*" for all)
+	TFStateId       string // if not empty, the waiver applies just to this tfstate
+	Account         string // if not empty, the waiver applies just to the tfstates of this account
+	Reason          string // why the failures are ok
+	Approver        string // who approved the waiver
+	ExpiresAt       int64  // when the waiver expires (unix timestamp). 0 = never.
+	ExpiryLogged    bool   // if the waiver expiration was already logged (and the affected states revalidated)
+}
+
+func newWaiver(featureName, resourcePattern, reason, approver string, expiresAt int64) *Waiver {
+	return &Waiver{
+		Id:              generateId(),
+		Timestamp:       generateTimestamp(),
+		FeatureName:     featureName,
+		ResourcePattern: resourcePattern,
+		Reason:          reason,
+		Approver:        approver,
+		ExpiresAt:       expiresAt,
+	}
+}
+
+// active returns true if the waiver didn't expire at the given time.
+func (w *Waiver) active(now time.Time) bool {
+	return w.ExpiresAt == 0 || now.Unix() < w.ExpiresAt
+}
+
+// appliesTo returns true if the waiver applies to the given tfstate (nil for validated plans,
+// to which only the waivers without tfstate or account apply).
+func (w *Waiver) appliesTo(state *TFState) bool {
+	if state == nil {
+		return w.TFStateId == "" && w.Account == ""
+	}
+	return (w.TFStateId == "" || w.TFStateId == state.Id) && (w.Account == "" || w.Account == state.Account)
+}
+
+// waives returns true if the waiver waives the given finding.
+func (w *Waiver) waives(finding ComplianceFinding) bool {
+	if w.FeatureName != finding.Feature {
+		return false
+	}
+	matched, err := path.Match(w.ResourcePattern, finding.ResourceAddress)
+	return err == nil && matched
+}
+
+// restObject methods
+
+func (w *Waiver) id() string {
+	return w.Id
+}
+
+func (w *Waiver) timestamp() int64 {
+	return w.Timestamp
+}
+
+func (w *Waiver) version() int64 {
+	return w.Version
+}
+
+func (w *Waiver) writeBasic(dst map[string]interface{}) {
+	dst["feature_name"] = w.FeatureName
+	dst["resource_pattern"] = w.ResourcePattern
+	dst["tfstate_id"] = w.TFStateId
+	dst["account"] = w.Account
+	dst["reason"] = w.Reason
+	dst["approver"] = w.Approver
+	dst["expires_at"] = w.ExpiresAt
+	dst["expired"] = !w.active(time.Now())
+}
+
+func (w *Waiver) writeDetailed(dst map[string]interface{}) {
+	w.writeBasic(dst)
+}
+
+// database methods
+
+const waiverTable = "waivers"
+
+var waiverAttributes = []string{
+	"FeatureName", "ResourcePattern", "TFStateId", "Account", "Reason", "Approver", "ExpiresAt", "ExpiryLogged",
+}
+
+func (db *database) loadAllWaivers() ([]*Waiver, error) {
+	result, _, err := db.loadWaiversPage(0, "")
+	return result, err
+}
+
+// loadWaiversPage loads up to limit items (all if 0) starting from the given cursor.
+func (db *database) loadWaiversPage(limit int, cursor string) ([]*Waiver, string, error) {
+	var result []*Waiver
+	nextCursor, err := db.loadGenericPage(
+		db.tableFor(waiverTable),
+		waiverAttributes,
+		nil,
+		limit,
+		cursor,
+		func(decode itemDecoder) error {
+			var elem Waiver
+			err := decode(&elem)
+			if err == nil {
+				result = append(result, &elem)
+			}
+			return err
+		})
+
+	return result, nextCursor, err
+}
+
+func (db *database) findWaiverById(id string) (*Waiver, error) {
+	var elem Waiver
+	found, err := db.getGeneric(db.tableFor(waiverTable), id, waiverAttributes, &elem)
+	if err != nil || !found {
+		return nil, err
+	}
+
+	return &elem, nil
+}
+
+func (db *database) saveWaiver(waiver *Waiver) error {
+	waiver.SchemaVersion = latestSchemaVersion(waiverTable)
+	return db.insertOrUpdateGeneric(db.tableFor(waiverTable), waiver, &waiver.Version)
+}
+
+func (db *database) removeWaiver(id string) error {
+	return db.removeGeneric(db.tableFor(waiverTable), id)
+}
+
+// Expiration
+
+// logKindWaiverExpired is the kind of the logs registered when a waiver expires.
+const logKindWaiverExpired = "waiver"
+
+// expireWaivers logs the waivers expired at the given time (the ones not logged yet), and
+// forces the validation of the tfstates they applied to, so their failures fail again.
+// Returns the number of expired waivers.
+func (db *database) expireWaivers(now time.Time) (int, error) {
+	waivers, err := db.loadAllWaivers()
+	if err != nil {
+		return 0, err
+	}
+
+	var states []*TFState
+	count := 0
+	for _, waiver := range waivers {
+		if waiver.active(now) || waiver.ExpiryLogged {
+			continue
+		}
+
+		if states == nil {
+			if states, err = db.loadAllTFStatesFull(); err != nil {
+				return count, err
+			}
+		}
+		for _, state := range states {
+			if !waiver.appliesTo(state) {
+				continue
+			}
+			err := db.updateTFState(state, func(latest *TFState) bool {
+				latest.ForceValidation = true
+				return true
+			})
+			if err != nil {
+				return count, fmt.Errorf("can't force validation of %s: %v", state.Id, err)
+			}
+		}
+
+		logEntry := newWaiverExpiredLog(waiver)
+		if err := db.saveLog(logEntry); err != nil {
+			return count, fmt.Errorf("can't insert log: %v", err)
+		}
+		waiver.ExpiryLogged = true
+		if err := db.saveWaiver(waiver); err != nil {
+			return count, fmt.Errorf("can't save waiver %s: %v", waiver.Id, err)
+		}
+		count++
+	}
+	return count, nil
+}
+
+// initWaiverExpiryMonitoring starts a goroutine that periodically
+// logs the expired waivers, and revalidates the states they applied to.
+func initWaiverExpiryMonitoring(db *database, frequency time.Duration) {
+	ticker := time.NewTicker(frequency)
+	go func() {
+		for range ticker.C {
+			count, err := db.expireWaivers(time.Now())
+			if err != nil {
+				log.Printf("can't expire waivers: %v", err)
+				continue
+			}
+			if count > 0 {
+				log.Printf("%d waivers expired.", count)
+			}
+		}
+	}()
+}
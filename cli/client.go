@@ -10,6 +10,8 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 )
 
@@ -19,10 +21,14 @@ func main() {
 	// features
 	validateFlag := flag.String("validate", "", "Validate the given terraform plan file.")
 	featureListFlag := flag.Bool("feature-list", false, "List all features")
-	featureAddFlag := flag.String("feature-add", "", "Add a new feature from the given file. The name will be the file name.")
+	featureAddFlag := flag.String("feature-add", "", "Add a new feature from the given file (.feature, or .rego for rego policies). The name will be the file name. Its tests are taken from <name>.tests.json, if it exists next to it.")
 	featureRemoveFlag := flag.String("remove-remove", "", "Remove the feature with the given name")
 	featureDetailsFlag := flag.String("feature-details", "", "Get the source code of the given feature.")
 	featureReplaceFlag := flag.Bool("replace", false, "For -add, to replace the feature if it already exists.")
+	featureTestFlag := flag.String("feature-test", "", "Run the tests of the given feature. Exits with 1 if some test fails.")
+	featureSyncFlag := flag.String("feature-sync", "", "Make the server features match the feature files of the given directory (see -prune and -dry-run). Tags and settings are read from the front-matter of each file, or from features.json.")
+	pruneFlag := flag.Bool("prune", false, "For -feature-sync. Remove the server features without file")
+	featureLintFlag := flag.String("feature-lint", "", "Check the given feature file, or the ones in the given directory, as when saved. Exits with 1 if there are problems.")
 	// logs
 	logListFlag := flag.Bool("log-list", false, "List all logs")
 	logGetFlag := flag.String("log-details", "", "Get the info of the given log")
@@ -38,11 +44,26 @@ func main() {
 	frListFlag := flag.Bool("foreignresource-list", false, "List all foreign resources")
 	frGetFlag := flag.String("foreignresource-details", "", "Get the info of the given foreign resource")
 	frRemoveFlag := flag.String("foreignresource-remove", "", "Remove the foreign resource")
+	// export/import
+	exportFlag := flag.String("export", "", "Export the validator tables to the given file (.json, or .tar.gz)")
+	importFlag := flag.String("import", "", "Import the validator tables from the given file, as exported by -export")
+	importModeFlag := flag.String("import-mode", "merge", "For -import. 'merge' to keep the items not in the file, or 'replace' to remove them")
+	dryRunFlag := flag.Bool("dry-run", false, "For -import and -feature-sync. Just print the changes to be made")
+	tablesFlag := flag.String("tables", "", "For -export and -import. Comma-separated tables to use (like features,tfstates). All if empty")
+	// pagination
+	limitFlag := flag.Int("limit", 0, "For -*-list. Max number of items to get (prints the next page cursor too)")
+	cursorFlag := flag.String("cursor", "", "For -*-list. The cursor of the page to get, as printed by a previous -limit call")
 
 	flag.Parse()
 
 	host := *hostFlag
 
+	// query for list requests
+	listQuery := ""
+	if *limitFlag > 0 || *cursorFlag != "" {
+		listQuery = fmt.Sprintf("?limit=%d&cursor=%s", *limitFlag, url.QueryEscape(*cursorFlag))
+	}
+
 	var res string
 	var code int
 	var resErr error
@@ -61,10 +82,37 @@ func main() {
 		asB64 := base64.StdEncoding.EncodeToString(content)
 		res, code, resErr = execRequest(host, "/validate", "POST", asB64)
 
+	// export/import
+
+	case *exportFlag != "":
+		format := "json"
+		if strings.HasSuffix(*exportFlag, ".tar.gz") || strings.HasSuffix(*exportFlag, ".tgz") {
+			format = "tar.gz"
+		}
+		query := fmt.Sprintf("?format=%s&tables=%s", format, url.QueryEscape(*tablesFlag))
+		res, code, resErr = execRequest(host, "/export"+query, "GET", "")
+		if resErr == nil && code == http.StatusOK {
+			if err := ioutil.WriteFile(*exportFlag, []byte(res), 0600); err != nil {
+				fmt.Println("Can't write file:", err)
+				return
+			}
+			res = fmt.Sprintf("Exported to %s.\n", *exportFlag)
+		}
+	case *importFlag != "":
+		content, err := ioutil.ReadFile(*importFlag)
+		if err != nil {
+			fmt.Println("Can't read file:", err)
+			return
+		}
+
+		query := fmt.Sprintf("?mode=%s&dry_run=%t&tables=%s", url.QueryEscape(*importModeFlag), *dryRunFlag, url.QueryEscape(*tablesFlag))
+		asB64 := base64.StdEncoding.EncodeToString(content)
+		res, code, resErr = execRequest(host, "/import"+query, "POST", asB64)
+
 	// -feature-*
 
 	case *featureListFlag:
-		res, code, resErr = execRequest(host, "/features", "GET", "")
+		res, code, resErr = execRequest(host, "/features"+listQuery, "GET", "")
 	case *featureAddFlag != "":
 		content, err := ioutil.ReadFile(*featureAddFlag)
 		if err != nil {
@@ -72,13 +120,15 @@ func main() {
 			return
 		}
 
-		if !strings.HasSuffix(*featureAddFlag, ".feature") {
-			fmt.Println("File must end in .feature.")
+		ext := filepath.Ext(*featureAddFlag)
+		language, ok := featureFileLanguage(*featureAddFlag)
+		if !ok {
+			fmt.Println("File must end in .feature (or .rego).")
 			return
 		}
 
 		featureFileName := extractNameFromPath(*featureAddFlag)
-		featureName := strings.TrimSuffix(featureFileName, ".feature")
+		featureName := strings.TrimSuffix(featureFileName, ext)
 		exists, err := checkIfFeatureExists(host, featureName)
 		resErr = err
 		if resErr == nil {
@@ -86,8 +136,19 @@ func main() {
 				fmt.Printf("Feature '%s' already exists. Pass --replace to overwrite it.\n", featureName)
 				return
 			}
-			body := map[string]string{"name": featureName, "source": string(content)}
-			res, code, resErr = execRequest(host, "/features", "POST", body)
+			body := map[string]interface{}{"name": featureName, "source": string(content), "language": language}
+			testsFile := strings.TrimSuffix(*featureAddFlag, ext) + ".tests.json"
+			if tests, err := ioutil.ReadFile(testsFile); err == nil {
+				body["tests"] = json.RawMessage(tests)
+			} else if !os.IsNotExist(err) {
+				fmt.Println("Can't read tests file:", err)
+				return
+			}
+			if exists {
+				res, code, resErr = replaceFeature(host, featureName, body)
+			} else {
+				res, code, resErr = execRequest(host, "/features", "POST", body)
+			}
 		}
 
 	case *featureRemoveFlag != "":
@@ -97,10 +158,63 @@ func main() {
 	case *featureDetailsFlag != "":
 		res, code, resErr = execRequest(host, "/features/"+url.QueryEscape(*featureDetailsFlag), "GET", "")
 
+	case *featureTestFlag != "":
+		res, code, resErr = execRequest(host, "/features/"+url.QueryEscape(*featureTestFlag)+"/test", "POST", "")
+		if resErr == nil && code == http.StatusOK {
+			var result struct {
+				Passed  bool `json:"passed"`
+				Results []struct {
+					Name     string   `json:"name"`
+					Passed   bool     `json:"passed"`
+					Problems []string `json:"problems"`
+				} `json:"results"`
+			}
+			if err := json.Unmarshal([]byte(res), &result); err != nil {
+				fmt.Println("Can't parse response:", err)
+				os.Exit(2)
+			}
+			for _, r := range result.Results {
+				if r.Passed {
+					fmt.Printf("PASS %s\n", r.Name)
+				} else {
+					fmt.Printf("FAIL %s: %s\n", r.Name, strings.Join(r.Problems, ", "))
+				}
+			}
+			fmt.Printf("%d tests run.\n", len(result.Results))
+			if !result.Passed {
+				os.Exit(1)
+			}
+			return
+		}
+
+	case *featureSyncFlag != "":
+		features, err := readFeatureDir(*featureSyncFlag)
+		if err != nil {
+			fmt.Println("Can't read features:", err)
+			return
+		}
+
+		query := fmt.Sprintf("?prune=%t&dry_run=%t", *pruneFlag, *dryRunFlag)
+		res, code, resErr = execRequest(host, "/features/sync"+query, "POST", map[string]interface{}{"features": features})
+		if resErr == nil && code == http.StatusOK {
+			res, resErr = formatSyncPlan(res)
+		}
+
+	case *featureLintFlag != "":
+		valid, err := lintFeatureFiles(host, *featureLintFlag)
+		if err != nil {
+			fmt.Println("Error during lint:", err)
+			os.Exit(2)
+		}
+		if !valid {
+			os.Exit(1)
+		}
+		return
+
 	// -log-*
 
 	case *logListFlag:
-		res, code, resErr = execRequest(host, "/logs", "GET", "")
+		res, code, resErr = execRequest(host, "/logs"+listQuery, "GET", "")
 	case *logRemoveFlag != "":
 		res, code, resErr = execRequest(host, "/logs/"+url.QueryEscape(*logRemoveFlag), "DELETE", "")
 	case *logGetFlag != "":
@@ -109,7 +223,7 @@ func main() {
 	// -tfstate-*
 
 	case *tfStateListFlag:
-		res, code, resErr = execRequest(host, "/tfstates", "GET", "")
+		res, code, resErr = execRequest(host, "/tfstates"+listQuery, "GET", "")
 	case *tfStateRemoveFlag != "":
 		res, code, resErr = execRequest(host, "/tfstates/"+url.QueryEscape(*tfStateRemoveFlag), "DELETE", "")
 	case *tfStateGetFlag != "":
@@ -125,7 +239,7 @@ func main() {
 	// -foreignresource-*
 
 	case *frListFlag:
-		res, code, resErr = execRequest(host, "/foreignresources", "GET", "")
+		res, code, resErr = execRequest(host, "/foreignresources"+listQuery, "GET", "")
 	case *frRemoveFlag != "":
 		res, code, resErr = execRequest(host, "/foreignresources/"+url.QueryEscape(*frRemoveFlag), "DELETE", "")
 	case *frGetFlag != "":
@@ -151,25 +265,256 @@ func main() {
 	}
 }
 
-func checkIfFeatureExists(host, name string) (bool, error) {
-	content, code, err := execRequest(host, "/features", "GET", "")
+// featureFileLanguage returns the language of the given feature file, given by its extension.
+func featureFileLanguage(path string) (string, bool) {
+	languages := map[string]string{".feature": "gherkin", ".rego": "rego"}
+	language, ok := languages[filepath.Ext(path)]
+	return language, ok
+}
+
+// lintFeatureFiles lints the given feature file, or all the feature files in the given
+// directory, and prints their problems as "file:line:column: message".
+// Returns true if there were no problems (but warnings).
+func lintFeatureFiles(host, path string) (bool, error) {
+	info, err := os.Stat(path)
 	if err != nil {
-		return false, nil
+		return false, err
+	}
+	files := []string{path}
+	if info.IsDir() {
+		files = nil
+		entries, err := ioutil.ReadDir(path)
+		if err != nil {
+			return false, err
+		}
+		for _, entry := range entries {
+			if _, ok := featureFileLanguage(entry.Name()); ok && !entry.IsDir() {
+				files = append(files, filepath.Join(path, entry.Name()))
+			}
+		}
 	}
 
-	if code == 200 {
-		for _, s := range strings.Split(content, "\n") {
-			if s == name {
-				return true, nil
+	valid := true
+	for _, file := range files {
+		language, ok := featureFileLanguage(file)
+		if !ok {
+			return false, fmt.Errorf("%s must end in .feature (or .rego)", file)
+		}
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			return false, err
+		}
+
+		body := map[string]string{"name": strings.TrimSuffix(filepath.Base(file), filepath.Ext(file)), "source": string(content), "language": language}
+		res, code, err := execRequest(host, "/features/lint", "POST", body)
+		if err != nil {
+			return false, err
+		}
+		if code != http.StatusOK {
+			return false, fmt.Errorf("invalid HTTP response %d: %s", code, res)
+		}
+
+		var result struct {
+			Valid  bool `json:"valid"`
+			Errors []struct {
+				Line    int    `json:"line"`
+				Column  int    `json:"column"`
+				Message string `json:"message"`
+				Warning bool   `json:"warning"`
+			} `json:"errors"`
+		}
+		if err := json.Unmarshal([]byte(res), &result); err != nil {
+			return false, fmt.Errorf("can't parse response: %v", err)
+		}
+		for _, e := range result.Errors {
+			if e.Warning {
+				fmt.Printf("%s:%d:%d: warning: %s\n", file, e.Line, e.Column, e.Message)
+			} else {
+				fmt.Printf("%s:%d:%d: %s\n", file, e.Line, e.Column, e.Message)
 			}
 		}
-	} else {
+		valid = valid && result.Valid
+	}
+	fmt.Printf("%d files checked.\n", len(files))
+	return valid, nil
+}
+
+// featureManifestFile is the file of a features directory with the settings of its features, by name.
+const featureManifestFile = "features.json"
+
+// readFeatureDir reads the feature files of the given directory (as in -feature-add), and
+// returns them as given to /features/sync. The settings of each feature are read from the
+// front-matter of the file (its first comment lines, like "# tags: prod, validation"),
+// or else from features.json ({"name": {"tags": ["prod"], "severity": "high"}}).
+func readFeatureDir(dir string) ([]map[string]interface{}, error) {
+	manifest := make(map[string]map[string]interface{})
+	content, err := ioutil.ReadFile(filepath.Join(dir, featureManifestFile))
+	if err == nil {
+		if err := json.Unmarshal(content, &manifest); err != nil {
+			return nil, fmt.Errorf("invalid %s: %v", featureManifestFile, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var result []map[string]interface{}
+	for _, entry := range entries {
+		language, ok := featureFileLanguage(entry.Name())
+		if !ok || entry.IsDir() {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		name := strings.TrimSuffix(entry.Name(), filepath.Ext(entry.Name()))
+		source, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		feature := map[string]interface{}{"name": name, "source": string(source), "language": language}
+		for key, value := range manifest[name] {
+			feature[key] = value
+		}
+		frontMatter, err := parseFrontMatter(string(source))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		for key, value := range frontMatter {
+			feature[key] = value
+		}
+		if _, ok := feature["tags"]; !ok {
+			return nil, fmt.Errorf("%s: no tags given in its front-matter or in %s", path, featureManifestFile)
+		}
+
+		tests, err := ioutil.ReadFile(filepath.Join(dir, name+".tests.json"))
+		if err == nil {
+			feature["tests"] = json.RawMessage(tests)
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+		result = append(result, feature)
+	}
+	return result, nil
+}
+
+// parseFrontMatter returns the settings given in the first comment lines of a feature source,
+// as "# key: value". Tags are comma-separated, and disabled is true or false.
+func parseFrontMatter(source string) (map[string]interface{}, error) {
+	result := make(map[string]interface{})
+	for _, line := range strings.Split(source, "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "#") {
+			break
+		}
+		fields := strings.SplitN(strings.TrimSpace(strings.TrimPrefix(line, "#")), ":", 2)
+		if len(fields) != 2 {
+			continue // just a comment
+		}
+		key, value := strings.TrimSpace(fields[0]), strings.TrimSpace(fields[1])
+		switch key {
+		case "tags":
+			tags := []string{}
+			for _, tag := range strings.Split(value, ",") {
+				if tag = strings.TrimSpace(tag); tag != "" {
+					tags = append(tags, tag)
+				}
+			}
+			result[key] = tags
+		case "disabled":
+			disabled, err := strconv.ParseBool(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid disabled '%s'", value)
+			}
+			result[key] = disabled
+		case "severity", "enforcement", "engine":
+			result[key] = value
+		}
+	}
+	return result, nil
+}
+
+// formatSyncPlan formats the response of /features/sync as a plan.
+func formatSyncPlan(response string) (string, error) {
+	var result struct {
+		DryRun   bool `json:"dry_run"`
+		Features struct {
+			Added     []string `json:"added"`
+			Updated   []string `json:"updated"`
+			Removed   []string `json:"removed"`
+			Unchanged int      `json:"unchanged"`
+		} `json:"features"`
+		Changes map[string][]string `json:"changes"`
+	}
+	if err := json.Unmarshal([]byte(response), &result); err != nil {
+		return "", fmt.Errorf("can't parse response: %v", err)
+	}
+
+	sb := strings.Builder{}
+	for _, name := range result.Features.Added {
+		sb.WriteString(fmt.Sprintf("+ %s\n", name))
+	}
+	for _, name := range result.Features.Updated {
+		sb.WriteString(fmt.Sprintf("~ %s (%s)\n", name, strings.Join(result.Changes[name], ", ")))
+	}
+	for _, name := range result.Features.Removed {
+		sb.WriteString(fmt.Sprintf("- %s\n", name))
+	}
+	format := "%d added, %d updated, %d removed, %d unchanged.\n"
+	if result.DryRun {
+		format = "Plan: %d to add, %d to update, %d to remove, %d unchanged.\n"
+	}
+	sb.WriteString(fmt.Sprintf(format,
+		len(result.Features.Added), len(result.Features.Updated), len(result.Features.Removed), result.Features.Unchanged))
+	return sb.String(), nil
+}
+
+func checkIfFeatureExists(host, name string) (bool, error) {
+	content, code, err := execRequest(host, "/features", "GET", "")
+	if err != nil {
+		return false, err
+	}
+	if code != http.StatusOK {
 		return false, fmt.Errorf("code not 200: %d", code)
 	}
 
+	var features []struct {
+		Name string `json:"name"`
+	}
+	if err := json.Unmarshal([]byte(content), &features); err != nil {
+		return false, fmt.Errorf("can't parse features: %v", err)
+	}
+	for _, f := range features {
+		if f.Name == name {
+			return true, nil
+		}
+	}
 	return false, nil
 }
 
+// replaceFeature updates the existing feature with the given name with the settings of the
+// given body, keeping its tags and whether it's disabled (the update sets them too).
+func replaceFeature(host, name string, body map[string]interface{}) (string, int, error) {
+	endpoint := "/features/" + url.QueryEscape(name)
+	content, code, err := execRequest(host, endpoint, "GET", "")
+	if err != nil || code != http.StatusOK {
+		return content, code, err
+	}
+
+	var current struct {
+		Tags     []string `json:"tags"`
+		Disabled bool     `json:"disabled"`
+	}
+	if err := json.Unmarshal([]byte(content), &current); err != nil {
+		return "", 0, fmt.Errorf("can't parse feature: %v", err)
+	}
+	body["tags"] = current.Tags
+	body["disabled"] = current.Disabled
+	return execRequest(host, endpoint, "PUT", body)
+}
+
 func execRequest(
 	host string,
 	endpoint string,
@@ -189,9 +534,10 @@ func execRequest(
 		resp, err = http.Post(fullUrl, "text/plain", strings.NewReader(bodyJson))
 	case "GET":
 		resp, err = http.Get(fullUrl)
-	case "DELETE":
+	case "DELETE", "PUT":
 		client := &http.Client{}
-		req, err := http.NewRequest("DELETE", fullUrl, strings.NewReader(bodyJson))
+		var req *http.Request
+		req, err = http.NewRequest(reqType, fullUrl, strings.NewReader(bodyJson))
 		if err == nil {
 			resp, err = client.Do(req)
 		}
@@ -13,4 +13,17 @@ func TestExtractNameFromPath(t *testing.T) {
 	for input, expected := range cases {
 		assert.Equal(t, expected, extractNameFromPath(input), "for input: " + input)
 	}
-}
\ No newline at end of file
+}
+
+func TestParseFrontMatter(t *testing.T) {
+	frontMatter, err := parseFrontMatter("# tags: prod, validation\n# A comment\n# severity: high\n# disabled: true\nFeature: f\n# tags: ignored\n")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"tags":     []string{"prod", "validation"},
+		"severity": "high",
+		"disabled": true,
+	}, frontMatter)
+
+	_, err = parseFrontMatter("# disabled: maybe\n")
+	assert.NotNil(t, err)
+}